@@ -30,7 +30,8 @@ type Client struct {
 	Pid      int
 }
 
-var defaultClient = Client{Logger: "", Severity: 6, Hostname: "", Pid: 0}
+var defaultClient = Client{Logger: "", Severity: message.SEVERITY_INFO,
+	Hostname: "", Pid: 0}
 
 func NewHekaClient(sender Sender, encoder Encoder, logger *string,
 	severity *int) *Client {
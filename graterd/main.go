@@ -15,37 +15,21 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"heka/pipeline"
 	"log"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"time"
 )
 
-func main() {
-	udpAddr := flag.String("udpaddr", "127.0.0.1:5565", "UDP address string")
-	udpFdInt := flag.Uint64("udpfd", 0, "UDP socket file descriptor")
-	maxprocs := flag.Int("maxprocs", 1, "Go runtime MAXPROCS value")
-	pprofName := flag.String("pprof", "", "pprof output file path")
-	poolSize := flag.Int("poolsize", 1000, "Pipeline pool size")
-	decoder := flag.String("decoder", "json", "Default decoder")
-	flag.Parse()
-	udpFdIntPtr := uintptr(*udpFdInt)
-
-	runtime.GOMAXPROCS(*maxprocs)
+// Builds the pipeline config used when no config file is given
+func defaultConfig(udpAddr string, udpFd *uintptr,
+	decoder string) *pipeline.GraterConfig {
+	config := &pipeline.GraterConfig{}
 
-	if *pprofName != "" {
-		profFile, err := os.Create(*pprofName)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		pprof.StartCPUProfile(profFile)
-		defer pprof.StopCPUProfile()
-	}
-
-	config := pipeline.GraterConfig{}
-
-	udpInput := pipeline.NewUdpInput(*udpAddr, &udpFdIntPtr)
+	udpInput := pipeline.NewUdpInput(udpAddr, udpFd)
 	var inputs = map[string]pipeline.Input{
 		"udp": udpInput,
 	}
@@ -58,7 +42,7 @@ func main() {
 		"gob":  &gobDecoder,
 	}
 	config.Decoders = decoders
-	config.DefaultDecoder = *decoder
+	config.DefaultDecoder = decoder
 
 	outputNames := []string{"counter"}
 	namedOutputFilter := pipeline.NewNamedOutputFilter(outputNames)
@@ -75,7 +59,91 @@ func main() {
 	}
 	config.Outputs = outputs
 	config.DefaultOutputs = []string{}
-	config.PoolSize = *poolSize
+	return config
+}
+
+func main() {
+	udpAddr := flag.String("udpaddr", "127.0.0.1:5565", "UDP address string")
+	udpFdInt := flag.Uint64("udpfd", 0, "UDP socket file descriptor")
+	maxprocs := flag.Int("maxprocs", 1, "Go runtime MAXPROCS value")
+	pprofName := flag.String("pprof", "", "pprof output file path")
+	poolSize := flag.Int("poolsize", 1000, "Pipeline pool size")
+	decoder := flag.String("decoder", "json", "Default decoder")
+	configPath := flag.String("config", "",
+		"Config file, directory of config files or glob pattern")
+	check := flag.Bool("check", false, "Validate the config and exit")
+	consulAddr := flag.String("consul", "127.0.0.1:8500", "Consul address")
+	consulPrefix := flag.String("consulconfig", "",
+		"Consul KV prefix holding *.json config fragments for -config dir")
+	auditLog := flag.String("auditlog", "", "Delivery audit log file path")
+	auditRate := flag.Float64("auditrate", 0.001,
+		"Fraction of messages recorded in the delivery audit log")
+	tapAddr := flag.String("tap", "",
+		"Address to serve the pipeline tap on, for heka-tail")
+	flag.Parse()
+	udpFdIntPtr := uintptr(*udpFdInt)
+
+	if *check {
+		if err := pipeline.ValidateConfig(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Config OK")
+		os.Exit(0)
+	}
+
+	runtime.GOMAXPROCS(*maxprocs)
+
+	if *pprofName != "" {
+		profFile, err := os.Create(*pprofName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		pprof.StartCPUProfile(profFile)
+		defer pprof.StopCPUProfile()
+	}
+
+	if *consulPrefix != "" {
+		if *configPath == "" {
+			log.Fatalln("-consulconfig requires a -config directory")
+		}
+		watcher := &pipeline.ConfigFragmentWatcher{
+			ConsulAddress: *consulAddr,
+			Prefix:        *consulPrefix,
+			Dir:           *configPath,
+			Interval:      time.Duration(10 * time.Second),
+			Restart:       true,
+		}
+		// Start w/ the current fragments rather than waiting a whole
+		// interval for them
+		if _, err := watcher.Sync(); err != nil {
+			log.Println(err.Error())
+		}
+		go watcher.Watch()
+	}
+
+	var config *pipeline.GraterConfig
+	if *configPath != "" {
+		var err error
+		if config, err = pipeline.LoadConfig(*configPath); err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		config = defaultConfig(*udpAddr, &udpFdIntPtr, *decoder)
+		config.PoolSize = *poolSize
+	}
+
+	if *auditLog != "" {
+		auditor, err := pipeline.NewDeliveryAuditor(*auditLog, *auditRate)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		config.Auditor = auditor
+	}
+
+	if *tapAddr != "" {
+		config.TapAddress = *tapAddr
+	}
 
-	pipeline.Run(&config)
+	pipeline.Run(config)
 }
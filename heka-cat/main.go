@@ -0,0 +1,184 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// heka-cat prints the messages in files of heka's native format, i.e.
+// framed gobs (see pipeline.EncodeFramedGob) as written by a FileOutput w/
+// a GobEncoder, e.g.
+//
+//	heka-cat -match 'Severity <= 3' -since 2013-01-02T15:00:00Z app.log.gz
+//
+// Files ending in .gz are decompressed, and stdin is read if no files (or
+// "-") are given. Corrupt frames are skipped, and the number of bytes
+// skipped is reported on stderr.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"heka/message"
+	"heka/pipeline"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type filter struct {
+	matcher *pipeline.MessageMatcher
+	since   time.Time
+	until   time.Time
+}
+
+func (self *filter) wants(msg *message.Message) bool {
+	if !self.since.IsZero() && msg.Timestamp.Before(self.since) {
+		return false
+	}
+	if !self.until.IsZero() && msg.Timestamp.After(self.until) {
+		return false
+	}
+	return self.matcher == nil || self.matcher.Match(msg)
+}
+
+// Parses a time given as RFC 3339 or Unix seconds
+func parseTime(value string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Writes a message in the given format
+func writeMessage(w io.Writer, msg *message.Message, format string) error {
+	var output []byte
+	var err error
+	switch format {
+	case "text":
+		output = []byte(msg.String() + "\n")
+	case "pretty":
+		output = []byte(msg.PrettyString() + "\n")
+	case "json":
+		if output, err = msg.MarshalJSON(); err == nil {
+			output = append(output, '\n')
+		}
+	case "framed":
+		output, err = pipeline.EncodeFramedGob(msg)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(output)
+	return err
+}
+
+// Prints the wanted messages of a file, returning how many were printed
+func cat(path string, wanted *filter, format string, limit int64) (int64,
+	error) {
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	if strings.HasSuffix(path, ".gz") {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	scanner, splitter := pipeline.NewFrameScanner(reader)
+	var printed int64
+	for scanner.Scan() && (limit <= 0 || printed < limit) {
+		msg := new(message.Message)
+		err := gob.NewDecoder(bytes.NewReader(scanner.Bytes())).Decode(msg)
+		if err != nil {
+			log.Printf("%s: skipping undecodable message: %s\n", path,
+				err.Error())
+			continue
+		}
+		if !wanted.wants(msg) {
+			continue
+		}
+		if err = writeMessage(os.Stdout, msg, format); err != nil {
+			return printed, err
+		}
+		printed++
+	}
+	if skipped := splitter.Skipped(); skipped > 0 {
+		log.Printf("%s: skipped %d corrupt bytes\n", path, skipped)
+	}
+	return printed, scanner.Err()
+}
+
+func main() {
+	match := flag.String("match", "", "Matcher expression messages must match")
+	since := flag.String("since", "",
+		"Only messages from this time on (RFC 3339 or Unix seconds)")
+	until := flag.String("until", "",
+		"Only messages up to this time (RFC 3339 or Unix seconds)")
+	format := flag.String("format", "text",
+		"Output format (text|pretty|json|framed)")
+	limit := flag.Int64("n", 0, "Stop after this many messages (0 for all)")
+	flag.Parse()
+
+	switch *format {
+	case "text", "pretty", "json", "framed":
+	default:
+		log.Fatalf("Unknown format: %s\n", *format)
+	}
+	wanted := new(filter)
+	var err error
+	if *match != "" {
+		if wanted.matcher, err = pipeline.NewMessageMatcher(*match); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *since != "" {
+		if wanted.since, err = parseTime(*since); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *until != "" {
+		if wanted.until, err = parseTime(*until); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	var printed int64
+	for _, path := range paths {
+		var n int64
+		n, err = cat(path, wanted, *format, *limit-printed)
+		printed += n
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			os.Exit(1)
+		}
+		if *limit > 0 && printed >= *limit {
+			break
+		}
+	}
+}
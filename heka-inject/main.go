@@ -0,0 +1,173 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// heka-inject sends a message built from its flags to a graterd input, so
+// routing rules and outputs can be tried out end to end, e.g.
+//
+//	heka-inject -type nginx.access -severity 3 -payload 'GET / 500' \
+//	    -field status=500:int -field path=/ -proto tcp -addr 127.0.0.1:5566
+//
+// Fields are given as name=value, optionally followed by a :type of int,
+// int64, float, float32, float64, bool or string (the default). Messages
+// are encoded as metlog JSON or gob; over TCP they're framed (see
+// pipeline.EncodeFrame), and over HTTP gobs are sent framed and JSON as
+// is.
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"heka/message"
+	"heka/pipeline"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Collects the repeated -field flags
+type fieldFlags []string
+
+func (self *fieldFlags) String() string {
+	return strings.Join(*self, ", ")
+}
+
+func (self *fieldFlags) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
+// Sets the fields given as name=value[:type] on a message
+func setFields(msg *message.Message, specs []string) error {
+	for _, spec := range specs {
+		eq := strings.Index(spec, "=")
+		if eq <= 0 {
+			return fmt.Errorf("Bad field, expected name=value[:type]: %s",
+				spec)
+		}
+		name, value := spec[:eq], spec[eq+1:]
+		conversion := &pipeline.FieldConversion{Name: name, Type: "string"}
+		if colon := strings.LastIndex(value, ":"); colon >= 0 {
+			typeName := value[colon+1:]
+			spec := fmt.Sprintf("Fields[%s] as %s", name, typeName)
+			if parsed, err := pipeline.ParseFieldConversion(spec); err == nil {
+				conversion = parsed
+				value = value[:colon]
+			}
+		}
+		msg.Fields[name] = value
+		if err := conversion.Apply(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encode(msg *message.Message, encoding string) ([]byte, error) {
+	if encoding == "json" {
+		return msg.MarshalJSON()
+	}
+	buffer := new(bytes.Buffer)
+	err := gob.NewEncoder(buffer).Encode(msg)
+	return buffer.Bytes(), err
+}
+
+func send(record []byte, proto, addr, encoding string) error {
+	switch proto {
+	case "udp", "tcp":
+		conn, err := net.DialTimeout(proto, addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if proto == "tcp" {
+			record = pipeline.EncodeFrame(record)
+		}
+		_, err = conn.Write(record)
+		return err
+	case "http":
+		contentType := "application/json"
+		if encoding == "gob" {
+			contentType = "application/x-heka-framed"
+			record = pipeline.EncodeFrame(record)
+		}
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		resp, err := http.Post(addr, contentType, bytes.NewReader(record))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("%s: %s", resp.Status, body)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown protocol: %s", proto)
+}
+
+func main() {
+	proto := flag.String("proto", "udp", "Input protocol (udp|tcp|http)")
+	addr := flag.String("addr", "127.0.0.1:5565",
+		"Input address, or URL for http")
+	encoding := flag.String("encoder", "json", "Message encoding (json|gob)")
+	msgType := flag.String("type", "heka-inject", "Message type")
+	logger := flag.String("logger", "heka-inject", "Message logger")
+	severity := flag.Int("severity", 6, "Message severity")
+	payload := flag.String("payload", "", "Message payload")
+	envVersion := flag.String("env_version", "0.8", "Message env_version")
+	count := flag.Int("count", 1, "Number of copies of the message to send")
+	var fields fieldFlags
+	flag.Var(&fields, "field",
+		"Message field as name=value[:type], may be repeated")
+	flag.Parse()
+
+	if *encoding != "json" && *encoding != "gob" {
+		log.Fatalf("Unknown encoder: %s\n", *encoding)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("Error getting hostname: %s\n", err.Error())
+	}
+	msg := &message.Message{
+		Type:        *msgType,
+		Timestamp:   time.Now(),
+		Logger:      *logger,
+		Severity:    *severity,
+		Payload:     *payload,
+		Env_version: *envVersion,
+		Pid:         os.Getpid(),
+		Hostname:    hostname,
+		Fields:      make(map[string]interface{}),
+	}
+	if err = setFields(msg, fields); err != nil {
+		log.Fatalln(err)
+	}
+	record, err := encode(msg, *encoding)
+	if err != nil {
+		log.Fatalf("Error encoding message: %s\n", err.Error())
+	}
+	for i := 0; i < *count; i++ {
+		if err = send(record, *proto, *addr, *encoding); err != nil {
+			log.Fatalf("Error sending message: %s\n", err.Error())
+		}
+	}
+}
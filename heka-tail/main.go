@@ -0,0 +1,108 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// heka-tail streams the messages flowing through a running graterd, as
+// recorded by its pipeline tap (see pipeline.PipelineTap), e.g.
+//
+//	heka-tail -stage 'filter.default*' -match "Type == 'nginx.access'"
+//
+// graterd needs to be started w/ a tap address, via `tap_address` in its
+// config or the -tap flag.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+type stage struct {
+	Stage string `json:"stage"`
+	Seen  int64  `json:"seen"`
+}
+
+// Fetches a tap URL, returning the response if it's OK
+func get(tapUrl string) (*http.Response, error) {
+	resp, err := http.Get(tapUrl)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	return resp, nil
+}
+
+func listStages(addr string) error {
+	resp, err := get("http://" + addr + "/stages")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var stages []stage
+	if err = json.NewDecoder(resp.Body).Decode(&stages); err != nil {
+		return err
+	}
+	for _, s := range stages {
+		fmt.Printf("%-40s %d\n", s.Stage, s.Seen)
+	}
+	return nil
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:4353", "graterd tap address")
+	stageGlob := flag.String("stage", "",
+		"Stages to tail, as a glob, e.g. 'output.*' (default all)")
+	match := flag.String("match", "", "Matcher expression messages must match")
+	format := flag.String("format", "text", "Output format (text|pretty|json)")
+	recent := flag.Bool("recent", false,
+		"Start w/ the messages the tap has kept for each stage")
+	stages := flag.Bool("stages", false,
+		"List the stages and how many messages each has seen, and exit")
+	flag.Parse()
+
+	if *stages {
+		if err := listStages(*addr); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	query := url.Values{}
+	query.Set("format", *format)
+	query.Set("recent", strconv.FormatBool(*recent))
+	if *stageGlob != "" {
+		query.Set("stage", *stageGlob)
+	}
+	if *match != "" {
+		query.Set("match", *match)
+	}
+	resp, err := get("http://" + *addr + "/tail?" + query.Encode())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+	if _, err = io.Copy(os.Stdout, resp.Body); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,117 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Returns the message on a single line, w/ the fields sorted by name, e.g.
+//
+//	Type="nginx.access" Timestamp=2013-01-02T15:04:05Z Logger="nginx"
+//	Severity=6 Hostname="web1" Pid=123 Env_version="0.8"
+//	Payload="GET / 200" Fields={status=200 path="/"}
+//
+// (all on one line)
+func (self *Message) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Type=%q Timestamp=%s Logger=%q Severity=%d "+
+		"Hostname=%q Pid=%d Env_version=%q Payload=%q Fields={", self.Type,
+		self.Timestamp.Format(time.RFC3339Nano), self.Logger, self.Severity,
+		self.Hostname, self.Pid, self.Env_version, self.Payload)
+	for i, name := range self.FieldNames() {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		value := self.Fields[name]
+		if str, ok := value.(string); ok {
+			fmt.Fprintf(buf, "%s=%q", name, str)
+		} else {
+			fmt.Fprintf(buf, "%s=%v", name, value)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// Returns the message over multiple lines, w/ each field's type and the
+// fields sorted by name, for reading by people
+func (self *Message) PrettyString() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Type:        %s\n", self.Type)
+	fmt.Fprintf(buf, "Timestamp:   %s\n",
+		self.Timestamp.Format(time.RFC3339Nano))
+	fmt.Fprintf(buf, "Logger:      %s\n", self.Logger)
+	fmt.Fprintf(buf, "Severity:    %d\n", self.Severity)
+	fmt.Fprintf(buf, "Hostname:    %s\n", self.Hostname)
+	fmt.Fprintf(buf, "Pid:         %d\n", self.Pid)
+	fmt.Fprintf(buf, "Env_version: %s\n", self.Env_version)
+	fmt.Fprintf(buf, "Payload:     %s\n", self.Payload)
+	fmt.Fprintf(buf, "Fields:\n")
+	for _, name := range self.FieldNames() {
+		value := self.Fields[name]
+		if repr := self.Representations[name]; repr != "" {
+			fmt.Fprintf(buf, "    %s (%T, %s): %v\n", name, value, repr, value)
+		} else {
+			fmt.Fprintf(buf, "    %s (%T): %v\n", name, value, value)
+		}
+	}
+	return buf.String()
+}
+
+type debugField struct {
+	Type           string      `json:"type"`
+	Representation string      `json:"representation,omitempty"`
+	Value          interface{} `json:"value"`
+}
+
+type debugMessage struct {
+	Type        string                `json:"type"`
+	Timestamp   string                `json:"timestamp"`
+	Logger      string                `json:"logger"`
+	Severity    int                   `json:"severity"`
+	Hostname    string                `json:"hostname"`
+	Pid         int                   `json:"pid"`
+	Env_version string                `json:"env_version"`
+	Payload     string                `json:"payload"`
+	Fields      map[string]debugField `json:"fields"`
+}
+
+// Serializes the whole message, unlike the metlog JSON of MarshalJSON.
+// Timestamps keep their nanoseconds and time zone, and each field is an
+// object w/ its Go "type" and any "representation" as well as its
+// "value", so e.g. int64 and float64 fields can be told apart. The output
+// is canonical: equal messages always give the same bytes.
+func (self *Message) MarshalDebugJSON() ([]byte, error) {
+	debug := &debugMessage{
+		Type:        self.Type,
+		Timestamp:   self.Timestamp.Format(time.RFC3339Nano),
+		Logger:      self.Logger,
+		Severity:    self.Severity,
+		Hostname:    self.Hostname,
+		Pid:         self.Pid,
+		Env_version: self.Env_version,
+		Payload:     self.Payload,
+		Fields:      make(map[string]debugField, len(self.Fields)),
+	}
+	// encoding/json sorts map keys, so the fields come out sorted
+	for name, value := range self.Fields {
+		debug.Fields[name] = debugField{fmt.Sprintf("%T", value),
+			self.Representations[name], value}
+	}
+	return json.Marshal(debug)
+}
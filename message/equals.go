@@ -0,0 +1,202 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package message
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Returns whether other is a Message (or *Message) w/ the same contents.
+// Timestamps are compared as instants, so the same time in different
+// locations is equal, and fields are compared deeply, w/ values of
+// different types (e.g. int and int64) never equal. It's written out
+// field by field rather than w/ reflection, so it's cheap enough for
+// dedup and tests alike; only field values of types a decoder wouldn't
+// produce (see NormalizeFieldValue) fall back to reflect.DeepEqual.
+func (self *Message) Equals(other interface{}) bool {
+	var o *Message
+	switch v := other.(type) {
+	case *Message:
+		o = v
+	case Message:
+		o = &v
+	default:
+		return false
+	}
+	if self == o {
+		return true
+	}
+	if self == nil || o == nil {
+		return false
+	}
+	if self.Type != o.Type || self.Logger != o.Logger ||
+		self.Severity != o.Severity || self.Payload != o.Payload ||
+		self.Env_version != o.Env_version || self.Pid != o.Pid ||
+		self.Hostname != o.Hostname || !self.Timestamp.Equal(o.Timestamp) {
+		return false
+	}
+	if len(self.Fields) != len(o.Fields) {
+		return false
+	}
+	for name, value := range self.Fields {
+		otherValue, ok := o.Fields[name]
+		if !ok || !fieldValuesEqual(value, otherValue) {
+			return false
+		}
+	}
+	if len(self.Representations) != len(o.Representations) {
+		return false
+	}
+	for name, repr := range self.Representations {
+		if otherRepr, ok := o.Representations[name]; !ok || repr != otherRepr {
+			return false
+		}
+	}
+	return true
+}
+
+func fieldValuesEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case string, bool, int, int64, float64, nil:
+		return a == b
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !fieldValuesEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			otherValue, ok := y[key]
+			if !ok || !fieldValuesEqual(value, otherValue) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// FNV-1a, inlined so hashing doesn't allocate
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+func fnvString(hash uint64, str string) uint64 {
+	for i := 0; i < len(str); i++ {
+		hash ^= uint64(str[i])
+		hash *= fnvPrime64
+	}
+	return hash
+}
+
+func fnvUint64(hash uint64, value uint64) uint64 {
+	for i := 0; i < 8; i++ {
+		hash ^= value & 0xff
+		hash *= fnvPrime64
+		value >>= 8
+	}
+	return hash
+}
+
+// Type tags, so e.g. the string "1" and the int 1 hash differently
+const (
+	hashNil = iota
+	hashString
+	hashBool
+	hashInt
+	hashInt64
+	hashFloat64
+	hashList
+	hashObject
+	hashOther
+)
+
+func hashFieldValue(hash uint64, value interface{}) uint64 {
+	switch v := value.(type) {
+	case nil:
+		return fnvUint64(hash, hashNil)
+	case string:
+		return fnvString(fnvUint64(hash, hashString), v)
+	case bool:
+		hash = fnvUint64(hash, hashBool)
+		if v {
+			return fnvUint64(hash, 1)
+		}
+		return fnvUint64(hash, 0)
+	case int:
+		return fnvUint64(fnvUint64(hash, hashInt), uint64(v))
+	case int64:
+		return fnvUint64(fnvUint64(hash, hashInt64), uint64(v))
+	case float64:
+		// -0 == 0, so they have to hash the same
+		if v == 0 {
+			v = 0
+		}
+		return fnvUint64(fnvUint64(hash, hashFloat64), math.Float64bits(v))
+	case []interface{}:
+		hash = fnvUint64(fnvUint64(hash, hashList), uint64(len(v)))
+		for _, item := range v {
+			hash = hashFieldValue(hash, item)
+		}
+		return hash
+	case map[string]interface{}:
+		// Summed, since map order is random
+		var sum uint64
+		for key, item := range v {
+			sum += hashFieldValue(fnvString(fnvOffset64, key), item)
+		}
+		return fnvUint64(fnvUint64(hash, hashObject), sum)
+	}
+	return fnvString(fnvUint64(hash, hashOther), fmt.Sprintf("%#v", value))
+}
+
+// Returns a hash of the message's contents, for deduplication. Messages
+// that are Equals have the same key; different messages almost always
+// have different ones, but a match should be confirmed w/ Equals where a
+// collision would matter.
+func (self *Message) HashKey() uint64 {
+	hash := uint64(fnvOffset64)
+	hash = fnvString(hash, self.Type)
+	hash = fnvUint64(hash, uint64(self.Timestamp.UnixNano()))
+	hash = fnvString(hash, self.Logger)
+	hash = fnvUint64(hash, uint64(self.Severity))
+	hash = fnvString(hash, self.Payload)
+	hash = fnvString(hash, self.Env_version)
+	hash = fnvUint64(hash, uint64(self.Pid))
+	hash = fnvString(hash, self.Hostname)
+	// Fields and representations are summed, since map order is random
+	var sum uint64
+	for name, value := range self.Fields {
+		sum += hashFieldValue(fnvString(fnvOffset64, name), value)
+	}
+	hash = fnvUint64(hash, sum)
+	sum = 0
+	for name, repr := range self.Representations {
+		sum += fnvString(fnvString(fnvOffset64, name), repr)
+	}
+	return fnvUint64(hash, sum)
+}
@@ -0,0 +1,197 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package message
+
+import (
+	"encoding/gob"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	// Nested field values are stored as these types, which gob needs to
+	// know about to carry them inside the Fields interface values
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// Returns a value in one of the types fields hold, so filters, encoders and
+// gob (which only knows the types registered above) don't each need to
+// cope w/ every Go type a decoder might produce:
+//
+//	int8, int16, int32, uints    int64 (uint64s too big for that: float64)
+//	float32                      float64
+//	time.Time                    int64 nanoseconds since the epoch
+//	time.Duration                int64 nanoseconds
+//	[]string, []int, []int64,    []interface{} of the normalized values,
+//	[]float64, []bool            for multi-value fields
+//
+// Anything else, including the usual string, bool, int, int64, float64,
+// map[string]interface{} and []interface{}, is returned as is. This is a
+// type switch rather than reflection, since it's on the decode path.
+func NormalizeFieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, bool, int, int64, float64:
+		return value
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return normalizeUint(uint64(v))
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return normalizeUint(v)
+	case float32:
+		return float64(v)
+	case time.Time:
+		return v.UnixNano()
+	case time.Duration:
+		return int64(v)
+	case []string:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = item
+		}
+		return values
+	case []int:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = item
+		}
+		return values
+	case []int64:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = item
+		}
+		return values
+	case []float64:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = item
+		}
+		return values
+	case []bool:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = item
+		}
+		return values
+	}
+	return value
+}
+
+func normalizeUint(value uint64) interface{} {
+	if value > math.MaxInt64 {
+		return float64(value)
+	}
+	return int64(value)
+}
+
+// Returns the fields w/ nested objects and arrays flattened into dotted
+// names, e.g. {"a": {"b": [1, 2]}} becomes {"a.b.0": 1, "a.b.1": 2}. Empty
+// objects and arrays are kept as is, so nothing is lost. UnflattenFields
+// reverses this.
+func FlattenFields(fields map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	for name, value := range fields {
+		flattenValue(flat, name, value)
+	}
+	return flat
+}
+
+func flattenValue(flat map[string]interface{}, name string,
+	value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) > 0 {
+			for key, item := range v {
+				flattenValue(flat, name+"."+key, item)
+			}
+			return
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			for i, item := range v {
+				flattenValue(flat, name+"."+strconv.Itoa(i), item)
+			}
+			return
+		}
+	}
+	flat[name] = value
+}
+
+// Rebuilds nested objects from dotted field names. An object whose keys
+// are exactly 0 through n-1 becomes an array.
+func UnflattenFields(fields map[string]interface{}) map[string]interface{} {
+	nested := make(map[string]interface{})
+	for name, value := range fields {
+		parts := strings.Split(name, ".")
+		current := nested
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := current[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				current[part] = next
+			}
+			current = next
+		}
+		current[parts[len(parts)-1]] = value
+	}
+	for name, value := range nested {
+		nested[name] = restoreArrays(value)
+	}
+	return nested
+}
+
+func restoreArrays(value interface{}) interface{} {
+	obj, ok := value.(map[string]interface{})
+	if !ok || len(obj) == 0 {
+		return value
+	}
+	for key, item := range obj {
+		obj[key] = restoreArrays(item)
+	}
+	indexes := make([]int, 0, len(obj))
+	for key := range obj {
+		i, err := strconv.Atoi(key)
+		if err != nil || strconv.Itoa(i) != key {
+			return obj
+		}
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for pos, i := range indexes {
+		if pos != i {
+			return obj
+		}
+	}
+	array := make([]interface{}, len(obj))
+	for key, item := range obj {
+		i, _ := strconv.Atoi(key)
+		array[i] = item
+	}
+	return array
+}
@@ -14,6 +14,9 @@
 package message
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -27,14 +30,157 @@ type Message struct {
 	Env_version string
 	Pid         int
 	Hostname    string
+	// Field name to Representation name, for fields that have one
+	Representations map[string]string
 }
 
 // Copies a message to a newly initialized Message, including a deep
-// copy of the Fields
+// copy of the Fields and their Representations
 func (self *Message) Copy(dst *Message) {
 	*dst = *self
 	dst.Fields = make(map[string]interface{})
 	for k, v := range self.Fields {
 		dst.Fields[k] = v
 	}
+	if self.Representations != nil {
+		dst.Representations = make(map[string]string)
+		for k, v := range self.Representations {
+			dst.Representations[k] = v
+		}
+	}
+}
+
+// Returns the message's timestamp
+func (self *Message) Time() time.Time {
+	return self.Timestamp
+}
+
+// Sets the message's timestamp, w/o any monotonic clock reading, so
+// timestamps set from time.Now() compare equal to their encoded and
+// decoded copies
+func (self *Message) SetTime(t time.Time) {
+	self.Timestamp = t.Round(0)
+}
+
+// Fields have no order of their own. FieldNames, String, PrettyString and
+// MarshalDebugJSON all list them sorted by name, so output is stable.
+// Fields should be changed w/ ReplaceField and the Delete methods rather
+// than by hand, since they take care of a nil Fields map.
+
+// Returns the names of the fields, sorted
+func (self *Message) FieldNames() []string {
+	names := make([]string, 0, len(self.Fields))
+	for name := range self.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Sets a field, creating the Fields map if need be, and returns whether
+// it replaced an existing value. The value is normalized to one of the
+// field types (see NormalizeFieldValue), so e.g. a uint16, a time.Time or
+// a []string can be passed as is.
+func (self *Message) ReplaceField(name string, value interface{}) bool {
+	if self.Fields == nil {
+		self.Fields = make(map[string]interface{})
+	}
+	_, existed := self.Fields[name]
+	self.Fields[name] = NormalizeFieldValue(value)
+	return existed
+}
+
+// Removes a field and its representation, returning whether it was there
+func (self *Message) DeleteField(name string) bool {
+	_, existed := self.Fields[name]
+	delete(self.Fields, name)
+	delete(self.Representations, name)
+	return existed
+}
+
+// Removes a field along w/ any fields flattened from it, e.g. "a", "a.b"
+// and "a.0.c" for "a" (see FlattenFields), returning how many were removed
+func (self *Message) DeleteAllFields(name string) int {
+	removed := 0
+	for fieldName := range self.Fields {
+		if fieldName == name || strings.HasPrefix(fieldName, name+".") {
+			delete(self.Fields, fieldName)
+			delete(self.Representations, fieldName)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Returns the name of a field's representation (see Representation), or
+// "" if it has none
+func (self *Message) FieldRepresentation(name string) string {
+	return self.Representations[name]
+}
+
+// Sets a field's representation, which must be registered and fit the
+// field's value. An empty representation removes it.
+func (self *Message) SetFieldRepresentation(name, repr string) error {
+	if repr == "" {
+		delete(self.Representations, name)
+		return nil
+	}
+	representation, ok := GetRepresentation(repr)
+	if !ok {
+		return fmt.Errorf("unknown representation %s", repr)
+	}
+	value, ok := self.Fields[name]
+	if !ok {
+		return fmt.Errorf("no field %s", name)
+	}
+	if err := representation.Check(value); err != nil {
+		return fmt.Errorf("Fields[%s]: %s", name, err.Error())
+	}
+	if self.Representations == nil {
+		self.Representations = make(map[string]string)
+	}
+	self.Representations[name] = repr
+	return nil
+}
+
+// Sets a field along w/ its representation, e.g. a latency in "ms". The
+// value is checked against the representation first, and the message
+// left alone if it doesn't fit.
+func (self *Message) ReplaceFieldWithRepresentation(name string,
+	value interface{}, repr string) error {
+	representation, ok := GetRepresentation(repr)
+	if !ok {
+		return fmt.Errorf("unknown representation %s", repr)
+	}
+	value = NormalizeFieldValue(value)
+	if err := representation.Check(value); err != nil {
+		return fmt.Errorf("Fields[%s]: %s", name, err.Error())
+	}
+	self.ReplaceField(name, value)
+	if self.Representations == nil {
+		self.Representations = make(map[string]string)
+	}
+	self.Representations[name] = repr
+	return nil
+}
+
+// Returns a numeric field's value converted to the given representation,
+// e.g. FieldValueIn("latency", "s") for a latency field in "ms", so
+// outputs can write values in the units their destination expects. A
+// field w/o a representation is returned as is, i.e. it's assumed to
+// already be in those units.
+func (self *Message) FieldValueIn(name, repr string) (float64, error) {
+	value, ok := self.Fields[name]
+	if !ok {
+		return 0, fmt.Errorf("no field %s", name)
+	}
+	from := self.Representations[name]
+	if from == "" || from == repr {
+		num, ok := numericValue(value)
+		if !ok {
+			return 0, fmt.Errorf("Fields[%s] isn't a number", name)
+		}
+		return num, nil
+	}
+	return ConvertRepresentation(value, from, repr)
 }
@@ -0,0 +1,154 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package message
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// A Representation says what a field's value means, e.g. that 1500 is a
+// number of milliseconds, so outputs can convert units consistently
+// rather than guessing from field names. Representations of the same
+// Dimension (e.g. "time") can be converted between w/ their Scale, which
+// is relative to the dimension's base unit (e.g. seconds).
+type Representation struct {
+	Name      string
+	Dimension string
+	Scale     float64
+	// Optional check of a value, in addition to the dimension's
+	Validate func(value interface{}) error
+}
+
+var (
+	representations     = make(map[string]*Representation)
+	representationsLock sync.RWMutex
+)
+
+func init() {
+	for _, repr := range []*Representation{
+		{Name: "ns", Dimension: "time", Scale: 1e-9},
+		{Name: "us", Dimension: "time", Scale: 1e-6},
+		{Name: "ms", Dimension: "time", Scale: 1e-3},
+		{Name: "s", Dimension: "time", Scale: 1},
+		{Name: "min", Dimension: "time", Scale: 60},
+		{Name: "h", Dimension: "time", Scale: 3600},
+		{Name: "B", Dimension: "data", Scale: 1},
+		{Name: "KiB", Dimension: "data", Scale: 1 << 10},
+		{Name: "MiB", Dimension: "data", Scale: 1 << 20},
+		{Name: "GiB", Dimension: "data", Scale: 1 << 30},
+		{Name: "bit", Dimension: "data", Scale: 1.0 / 8},
+		{Name: "count", Dimension: "count", Scale: 1,
+			Validate: validateWholeNumber},
+		{Name: "%", Dimension: "ratio", Scale: 0.01},
+		{Name: "ratio", Dimension: "ratio", Scale: 1},
+		{Name: "ip4", Dimension: "address", Validate: validateIp(4)},
+		{Name: "ip6", Dimension: "address", Validate: validateIp(6)},
+	} {
+		RegisterRepresentation(repr)
+	}
+}
+
+// Adds a representation to the registry, replacing any w/ the same name
+func RegisterRepresentation(repr *Representation) {
+	representationsLock.Lock()
+	defer representationsLock.Unlock()
+	representations[repr.Name] = repr
+}
+
+// Looks up a registered representation by name
+func GetRepresentation(name string) (*Representation, bool) {
+	representationsLock.RLock()
+	defer representationsLock.RUnlock()
+	repr, ok := representations[name]
+	return repr, ok
+}
+
+// Returns whether the representation is numeric, i.e. has a Scale
+func (self *Representation) Numeric() bool {
+	return self.Scale != 0
+}
+
+// Checks that a value is valid for the representation
+func (self *Representation) Check(value interface{}) error {
+	if self.Numeric() {
+		if _, ok := numericValue(value); !ok {
+			return fmt.Errorf("%s needs a number, not %T", self.Name, value)
+		}
+	}
+	if self.Validate != nil {
+		return self.Validate(value)
+	}
+	return nil
+}
+
+// Converts a numeric value between two representations of the same
+// dimension, e.g. ConvertRepresentation(1500, "ms", "s") gives 1.5
+func ConvertRepresentation(value interface{}, from, to string) (float64,
+	error) {
+	fromRepr, ok := GetRepresentation(from)
+	if !ok {
+		return 0, fmt.Errorf("unknown representation %s", from)
+	}
+	toRepr, ok := GetRepresentation(to)
+	if !ok {
+		return 0, fmt.Errorf("unknown representation %s", to)
+	}
+	if !fromRepr.Numeric() || !toRepr.Numeric() ||
+		fromRepr.Dimension != toRepr.Dimension {
+		return 0, fmt.Errorf("can't convert %s to %s", from, to)
+	}
+	num, ok := numericValue(value)
+	if !ok {
+		return 0, fmt.Errorf("%s needs a number, not %T", from, value)
+	}
+	return num * fromRepr.Scale / toRepr.Scale, nil
+}
+
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func validateWholeNumber(value interface{}) error {
+	if num, _ := numericValue(value); num != float64(int64(num)) {
+		return fmt.Errorf("count needs a whole number, not %v", value)
+	}
+	return nil
+}
+
+func validateIp(version int) func(interface{}) error {
+	return func(value interface{}) error {
+		str, _ := value.(string)
+		ip := net.ParseIP(str)
+		if ip == nil || (ip.To4() != nil) != (version == 4) {
+			return fmt.Errorf("%v isn't an IPv%d address", value, version)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package message
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Message severities are syslog's levels (RFC 5424), from the most severe
+// down
+const (
+	SEVERITY_EMERGENCY = 0
+	SEVERITY_ALERT     = 1
+	SEVERITY_CRITICAL  = 2
+	SEVERITY_ERROR     = 3
+	SEVERITY_WARNING   = 4
+	SEVERITY_NOTICE    = 5
+	SEVERITY_INFO      = 6
+	SEVERITY_DEBUG     = 7
+)
+
+// Indexed by severity
+var severityNames = []string{"emergency", "alert", "critical", "error",
+	"warning", "notice", "info", "debug"}
+
+// The other names syslog implementations and logging libraries use for
+// the levels
+var severityAliases = map[string]int{
+	"emerg":         SEVERITY_EMERGENCY,
+	"panic":         SEVERITY_EMERGENCY,
+	"crit":          SEVERITY_CRITICAL,
+	"fatal":         SEVERITY_CRITICAL,
+	"err":           SEVERITY_ERROR,
+	"warn":          SEVERITY_WARNING,
+	"informational": SEVERITY_INFO,
+	"information":   SEVERITY_INFO,
+	"trace":         SEVERITY_DEBUG,
+}
+
+// Returns the severity for a level name, e.g. "warning" or "WARN", or a
+// number in range
+func SeverityFromString(name string) (int, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for severity, severityName := range severityNames {
+		if name == severityName {
+			return severity, nil
+		}
+	}
+	if severity, ok := severityAliases[name]; ok {
+		return severity, nil
+	}
+	if severity, err := strconv.Atoi(name); err == nil &&
+		SeverityName(severity) != "" {
+		return severity, nil
+	}
+	return 0, fmt.Errorf("unknown severity %q", name)
+}
+
+// Returns the syslog name of a severity, or "" if it's out of range
+func SeverityName(severity int) string {
+	if severity < 0 || severity >= len(severityNames) {
+		return ""
+	}
+	return severityNames[severity]
+}
+
+// Returns the syslog name of the message's severity, e.g. "warning", or
+// "" if it's out of range
+func (self *Message) SeverityName() string {
+	return SeverityName(self.Severity)
+}
@@ -0,0 +1,193 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Inputs that can hold off confirming a record to its source (advancing
+// a checkpoint, FINishing a queue message) until the record's been
+// delivered implement AckAwareInput, for at-least-once delivery. They
+// put a token on each pack they read (PipelinePack.AckToken), and Ack is
+// called w/ it once every output the pack was routed to has accepted it,
+// w/ the first error if any of them failed. Packs that are filtered out
+// or fail to decode are acked too, since they've been dealt with.
+type AckAwareInput interface {
+	Input
+	Ack(token interface{}, err error)
+}
+
+// Outputs that only know a message is safe some time after Deliver
+// returns, e.g. once it's been written and synced, implement
+// AckAwareOutput. For packs from an AckAwareInput DeliverAck is called in
+// place of Deliver, and the output calls the PackAck's Done once it's
+// done w/ the message. Other outputs are taken to have delivered a
+// message when Deliver returns.
+type AckAwareOutput interface {
+	Output
+	DeliverAck(pipelinePack *PipelinePack, ack *PackAck)
+}
+
+// Errors packs are acked w/ when they're lost on the way
+var (
+	errAckDropped = errors.New("dropped under backpressure")
+	errAckEvicted = errors.New("evicted, max pack age exceeded")
+)
+
+// PackAck counts the outputs a pack is still waiting on. The pipeline
+// holds one reference while it routes the pack, and one more for each
+// AckAwareOutput it's delivered to; when the last is released the input
+// is acked. A nil PackAck, i.e. for packs from other inputs, ignores
+// everything.
+type PackAck struct {
+	pending int32
+	input   AckAwareInput
+	token   interface{}
+	lock    sync.Mutex
+	err     error
+}
+
+func newPackAck(input AckAwareInput, token interface{}) *PackAck {
+	return &PackAck{pending: 1, input: input, token: token}
+}
+
+// Takes another reference, for an output that acks asynchronously
+func (self *PackAck) hold() {
+	if self != nil {
+		atomic.AddInt32(&self.pending, 1)
+	}
+}
+
+// Records a failure w/o releasing a reference
+func (self *PackAck) fail(err error) {
+	if self == nil || err == nil {
+		return
+	}
+	self.lock.Lock()
+	if self.err == nil {
+		self.err = err
+	}
+	self.lock.Unlock()
+}
+
+// Releases a reference, w/ the error if the output failed to deliver the
+// message. The input is acked once all references are released.
+func (self *PackAck) Done(err error) {
+	if self == nil {
+		return
+	}
+	self.fail(err)
+	if atomic.AddInt32(&self.pending, -1) != 0 {
+		return
+	}
+	self.lock.Lock()
+	err = self.err
+	self.lock.Unlock()
+	self.input.Ack(self.token, err)
+}
+
+// Checkpoints tracks the positions of the records an input has handed to
+// the pipeline in the order they were read, so that as acks come back, in
+// whatever order the packs finished in, the input can tell how far
+// everything's been acked, i.e. where it's safe to resume from.
+type Checkpoints struct {
+	lock     sync.Mutex
+	pending  []*checkpoint
+	position int64
+}
+
+type checkpoint struct {
+	position int64
+	acked    bool
+}
+
+// Creates Checkpoints starting from position
+func NewCheckpoints(position int64) *Checkpoints {
+	return &Checkpoints{position: position}
+}
+
+// Records that the record ending at position has been read, returning
+// the ack token for its pack
+func (self *Checkpoints) Add(position int64) interface{} {
+	entry := &checkpoint{position: position}
+	self.lock.Lock()
+	self.pending = append(self.pending, entry)
+	self.lock.Unlock()
+	return entry
+}
+
+// Marks the token's record as acked, returning the new position and
+// whether it moved
+func (self *Checkpoints) Ack(token interface{}) (int64, bool) {
+	entry, ok := token.(*checkpoint)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !ok {
+		return self.position, false
+	}
+	entry.acked = true
+	moved := false
+	for len(self.pending) > 0 && self.pending[0].acked {
+		self.position = self.pending[0].position
+		self.pending[0] = nil
+		self.pending = self.pending[1:]
+		moved = true
+	}
+	return self.position, moved
+}
+
+// Number of records read but not yet acked
+func (self *Checkpoints) Pending() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.pending)
+}
+
+// Returns the ack for a pack from an AckAwareInput, nil for other packs
+func packAckFor(config *GraterConfig, pipelinePack *PipelinePack) *PackAck {
+	if pipelinePack.AckToken == nil {
+		return nil
+	}
+	input, ok := config.Inputs[pipelinePack.InputName].(AckAwareInput)
+	if !ok {
+		return nil
+	}
+	return newPackAck(input, pipelinePack.AckToken)
+}
+
+// Delivers a pack to an output, taking a reference on the ack for
+// outputs that ack asynchronously
+func deliverAcked(output Output, pipelinePack *PipelinePack,
+	ack *PackAck) error {
+	ackOutput, ok := output.(AckAwareOutput)
+	if !ok || ack == nil {
+		return runRecovered(func() error {
+			output.Deliver(pipelinePack)
+			return nil
+		})
+	}
+	ack.hold()
+	err := runRecovered(func() error {
+		ackOutput.DeliverAck(pipelinePack, ack)
+		return nil
+	})
+	if err != nil {
+		// A panicking output can't be relied on to release its reference
+		ack.Done(err)
+	}
+	return err
+}
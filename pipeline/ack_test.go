@@ -0,0 +1,59 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+)
+
+// An input that records its acks
+type ackRecordingInput struct {
+	Input
+	acks []error
+}
+
+func (self *ackRecordingInput) Ack(token interface{}, err error) {
+	self.acks = append(self.acks, err)
+}
+
+func AckSpec(c gospec.Context) {
+	c.Specify("The input is acked once all references are released", func() {
+		input := new(ackRecordingInput)
+		ack := newPackAck(input, "token")
+		ack.hold()
+		ack.Done(nil)
+		c.Expect(len(input.acks), gs.Equals, 0)
+		ack.Done(errors.New("write failed"))
+		c.Expect(len(input.acks), gs.Equals, 1)
+		c.Expect(input.acks[0].Error(), gs.Equals, "write failed")
+	})
+
+	c.Specify("Checkpoints only move past contiguous acks", func() {
+		checkpoints := NewCheckpoints(10)
+		first := checkpoints.Add(20)
+		second := checkpoints.Add(30)
+		third := checkpoints.Add(40)
+		position, moved := checkpoints.Ack(second)
+		c.Expect(moved, gs.IsFalse)
+		c.Expect(position, gs.Equals, int64(10))
+		position, moved = checkpoints.Ack(first)
+		c.Expect(moved, gs.IsTrue)
+		c.Expect(position, gs.Equals, int64(30))
+		c.Expect(checkpoints.Pending(), gs.Equals, 1)
+		position, _ = checkpoints.Ack(third)
+		c.Expect(position, gs.Equals, int64(40))
+	})
+}
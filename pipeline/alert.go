@@ -0,0 +1,238 @@
+//go:build !noalert
+// +build !noalert
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("AlertFilter", func() interface{} {
+		return new(AlertFilter)
+	})
+}
+
+// AlertFilter fires an alert when too many messages match its `Matcher`,
+// e.g. more than 100 5xx responses in a minute:
+//
+//	{"Matcher": "Type == 'nginx.access' && Fields[status] >= 500",
+//	 "Threshold": 100, "Window": 60}
+//
+// The alert is a message of type `Type` ("heka.alert" by default) w/
+// `Severity` 1 (alert) by default, given as a number or a name such as
+// "critical", meant to be routed to email, chat or paging outputs. Its
+// fields are "name" (`Name`, defaulting to the matcher), "state"
+// ("firing"), "count", "threshold" and "window".
+//
+// The limit is more than `Threshold` matching messages in the last
+// `Window`, a duration such as "5m" or a number of seconds (60 by
+// default), or w/ `Rate` set instead, more than Rate per second averaged
+// over the window. Once fired, the alert stays firing until the count
+// drops to `ResetThreshold` (half the threshold by default), when a
+// "resolved" message is sent at severity 6 (info). A new
+// alert isn't fired until `QuietPeriod` seconds (300 by default) after the
+// last, so flapping doesn't page anyone repeatedly.
+//
+// Messages w/ a "backfill" field set to true (see LogfileInput) are
+// historical, so they're ignored unless `IncludeBackfill` is set.
+type AlertFilter struct {
+	helper      PluginHelper
+	matcher     *MessageMatcher
+	name        string
+	msgType     string
+	severity    int
+	threshold   int64
+	reset       int64
+	window      int64
+	quietPeriod time.Duration
+	backfill    bool
+	// Per second counts, indexed by the second modulo the window
+	counts    []int64
+	seconds   []int64
+	firing    bool
+	lastAlert time.Time
+	lock      sync.Mutex
+}
+
+func (self *AlertFilter) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Matcher"]
+	if !ok {
+		return errors.New("AlertFilter config: Missing Matcher")
+	}
+	if self.matcher, err = NewMessageMatcher(value.(string)); err != nil {
+		return fmt.Errorf("AlertFilter config: %s", err.Error())
+	}
+	self.name = self.matcher.String()
+	if value, ok = (*config)["Name"]; ok {
+		self.name = value.(string)
+	}
+	window, err := ConfigDuration(config, "Window", time.Second,
+		60*time.Second)
+	if err != nil {
+		return fmt.Errorf("AlertFilter config: %s", err.Error())
+	}
+	// Matches are counted per second
+	self.window = int64(window / time.Second)
+	if self.window <= 0 || window%time.Second != 0 {
+		return errors.New("AlertFilter config: Window must be a positive " +
+			"whole number of seconds")
+	}
+	if value, ok = (*config)["Threshold"]; ok {
+		self.threshold, ok = value.(int64)
+		if !ok {
+			return errors.New("AlertFilter config: Threshold must be a " +
+				"whole number")
+		}
+	} else if value, ok = (*config)["Rate"]; ok {
+		rate, err := toFloat64(value)
+		if err != nil {
+			return errors.New("AlertFilter config: Rate must be a number")
+		}
+		self.threshold = int64(rate * float64(self.window))
+	} else {
+		return errors.New("AlertFilter config: Missing Threshold or Rate")
+	}
+	self.reset = self.threshold / 2
+	if value, ok = (*config)["ResetThreshold"]; ok {
+		self.reset, ok = value.(int64)
+		if !ok || self.reset > self.threshold {
+			return errors.New("AlertFilter config: ResetThreshold must be " +
+				"a whole number no greater than Threshold")
+		}
+	}
+	self.quietPeriod, err = ConfigDuration(config, "QuietPeriod", time.Second,
+		300*time.Second)
+	if err != nil {
+		return fmt.Errorf("AlertFilter config: %s", err.Error())
+	}
+	self.msgType = "heka.alert"
+	if value, ok = (*config)["Type"]; ok {
+		self.msgType = value.(string)
+	}
+	self.severity, err = ConfigSeverity(config, "Severity", SEVERITY_ALERT)
+	if err != nil {
+		return fmt.Errorf("AlertFilter config: %s", err.Error())
+	}
+	if value, ok = (*config)["IncludeBackfill"]; ok {
+		self.backfill = value.(bool)
+	}
+	self.counts = make([]int64, self.window)
+	self.seconds = make([]int64, self.window)
+	return nil
+}
+
+func (self *AlertFilter) SetPluginHelper(helper PluginHelper) {
+	self.helper = helper
+}
+
+// Starts checking for resolution once a second, since that can happen
+// w/o any messages arriving
+func (self *AlertFilter) Prepare() error {
+	if self.helper == nil {
+		return errors.New("AlertFilter needs a PluginHelper")
+	}
+	go func() {
+		for _ = range time.Tick(time.Second) {
+			self.lock.Lock()
+			alert := self.check(self.helper.Now())
+			self.lock.Unlock()
+			if alert != nil {
+				self.helper.InjectMessage(alert)
+			}
+		}
+	}()
+	return nil
+}
+
+// Returns the number of matches in the window ending at now
+func (self *AlertFilter) count(now int64) (total int64) {
+	for i, second := range self.seconds {
+		if second > now-self.window && second <= now {
+			total += self.counts[i]
+		}
+	}
+	return
+}
+
+// Updates the alert state, returning the message to send if it changed.
+// Must be called w/ the lock held.
+func (self *AlertFilter) check(now time.Time) *Message {
+	count := self.count(now.Unix())
+	var state string
+	if !self.firing && count > self.threshold &&
+		now.Sub(self.lastAlert) >= self.quietPeriod {
+		self.firing = true
+		self.lastAlert = now
+		state = "firing"
+	} else if self.firing && count <= self.reset {
+		self.firing = false
+		state = "resolved"
+	} else {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	msg := &Message{
+		Type:      self.msgType,
+		Timestamp: now,
+		Logger:    "hekad",
+		Severity:  self.severity,
+		Payload: fmt.Sprintf("%s %s: %d messages in %ds (threshold %d)",
+			self.name, state, count, self.window, self.threshold),
+		Pid:      os.Getpid(),
+		Hostname: hostname,
+		Fields: map[string]interface{}{
+			"name":      self.name,
+			"state":     state,
+			"count":     count,
+			"threshold": self.threshold,
+			"window":    self.window,
+		},
+	}
+	if state == "resolved" {
+		msg.Severity = SEVERITY_INFO
+	}
+	return msg
+}
+
+func (self *AlertFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	if msg.Type == self.msgType || !self.matcher.Match(msg) {
+		return
+	}
+	if backfill, _ := msg.Fields["backfill"].(bool); backfill && !self.backfill {
+		return
+	}
+	now := self.helper.Now()
+	second := now.Unix()
+	slot := second % self.window
+	self.lock.Lock()
+	if self.seconds[slot] != second {
+		self.seconds[slot] = second
+		self.counts[slot] = 0
+	}
+	self.counts[slot]++
+	alert := self.check(now)
+	self.lock.Unlock()
+	if alert != nil {
+		self.helper.InjectMessage(alert)
+	}
+}
@@ -17,41 +17,48 @@ import (
 	//"fmt"
 	"github.com/orfjackal/gospec/src/gospec"
 	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"math"
 	"os"
-	"reflect"
 	"testing"
 	"time"
 )
 
+// Specs for plugins that can be left out of the build, added by their
+// spec files so they're only run when the plugin's built in
+var pluginSpecs []func(gospec.Context)
+
 func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.AddSpec(DecodersSpec)
 	r.AddSpec(MessageEqualsSpec)
-	gospec.MainGoTest(r, t)
-}
-
-func (self *Message) Equals(other interface{}) bool {
-	vSelf := reflect.ValueOf(self).Elem()
-	vOther := reflect.ValueOf(other).Elem()
-
-	var sField, oField reflect.Value
-	var sMap, oMap map[string]interface{}
-	for i := 0; i < vSelf.NumField(); i++ {
-		sField = vSelf.Field(i)
-		oField = vOther.Field(i)
-		if sField.Kind() == reflect.Map {
-			sMap = sField.Interface().(map[string]interface{})
-			oMap = oField.Interface().(map[string]interface{})
-			if !reflect.DeepEqual(sMap, oMap) {
-				return false
-			}
-		} else {
-			if sField.Interface() != oField.Interface() {
-				return false
-			}
-		}
+	r.AddSpec(ConversionsSpec)
+	r.AddSpec(SplittersSpec)
+	r.AddSpec(FieldsSpec)
+	r.AddSpec(MatcherSpec)
+	r.AddSpec(ExprSpec)
+	r.AddSpec(ConfigStructSpec)
+	r.AddSpec(StatMetricSpec)
+	r.AddSpec(InputRunnerSpec)
+	r.AddSpec(MessageGeneratorInputSpec)
+	r.AddSpec(TapSpec)
+	r.AddSpec(PackPoolSpec)
+	r.AddSpec(BackpressureSpec)
+	r.AddSpec(QueueSpec)
+	r.AddSpec(FdNameSpec)
+	r.AddSpec(CircuitBreakerSpec)
+	r.AddSpec(AckSpec)
+	r.AddSpec(RegistrySpec)
+	r.AddSpec(OversizeGuardSpec)
+	r.AddSpec(ClockSkewGuardSpec)
+	r.AddSpec(OutputRunnerSpec)
+	r.AddSpec(MessageTracerSpec)
+	r.AddSpec(LatencyHistogramSpec)
+	r.AddSpec(ConfigFragmentWatcherSpec)
+	for _, spec := range pluginSpecs {
+		r.AddSpec(spec)
 	}
-	return true
+	gospec.MainGoTest(r, t)
 }
 
 func getTestMessage() *Message {
@@ -92,4 +99,37 @@ func MessageEqualsSpec(c gospec.Context) {
 		msg1.Fields = map[string]interface{}{"sna": "foo"}
 		c.Expect(msg0, gs.Not(gs.Equals), msg1)
 	})
+	c.Specify("Messages w/ diff nested field values are not equal", func() {
+		msg0.Fields["list"] = []interface{}{"a", map[string]interface{}{
+			"b": int64(1)}}
+		msg1.Fields = map[string]interface{}{"foo": "bar",
+			"list": []interface{}{"a", map[string]interface{}{"b": int64(1)}}}
+		c.Expect(msg0, gs.Equals, msg1)
+		msg1.Fields["list"].([]interface{})[1].(map[string]interface{})["b"] = 1
+		c.Expect(msg0, gs.Not(gs.Equals), msg1)
+	})
+
+	c.Specify("Messages at the same time in diff locations are equal",
+		func() {
+			msg1.Timestamp = msg0.Timestamp.In(time.FixedZone("X", 3600))
+			c.Expect(msg0, gs.Equals, msg1)
+			c.Expect(msg0.HashKey(), gs.Equals, msg1.HashKey())
+		})
+
+	c.Specify("Messages w/ diff representations are not equal", func() {
+		msg1.Representations = map[string]string{"foo": "ms"}
+		c.Expect(msg0, gs.Not(gs.Equals), msg1)
+	})
+
+	c.Specify("Equal messages have the same HashKey", func() {
+		copied := new(Message)
+		msg0.Copy(copied)
+		c.Expect(copied.HashKey(), gs.Equals, msg0.HashKey())
+		copied.Fields["foo"] = "baz"
+		c.Expect(copied.HashKey(), gs.Not(gs.Equals), msg0.HashKey())
+		copied.Fields["foo"] = 0.0
+		msg0.Fields["foo"] = math.Copysign(0, -1)
+		c.Expect(copied, gs.Equals, msg0)
+		c.Expect(copied.HashKey(), gs.Equals, msg0.HashKey())
+	})
 }
@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	. "heka/message"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Returns a 64 bit fingerprint identifying a message, computed from its
+// header values and payload
+func MessageFingerprint(msg *Message) uint64 {
+	hash := fnv.New64a()
+	fmt.Fprint(hash, msg.Type, "\x00", msg.Logger, "\x00", msg.Hostname,
+		"\x00", msg.Pid, "\x00", msg.Timestamp.UnixNano(), "\x00")
+	hash.Write([]byte(msg.Payload))
+	return hash.Sum64()
+}
+
+type auditRecord struct {
+	Id        string `json:"id"`
+	Type      string `json:"type"`
+	Logger    string `json:"logger"`
+	Output    string `json:"output"`
+	Status    string `json:"status"`
+	LatencyNs int64  `json:"latency_ns"`
+	Time      string `json:"time"`
+}
+
+// DeliveryAuditor writes a sample of output deliveries to an audit log as
+// newline delimited JSON, so operators can spot check that specific
+// messages reached their destinations. Sampling is keyed on the message
+// fingerprint, so a sampled message is audited for every output it's
+// delivered to.
+type DeliveryAuditor struct {
+	threshold  uint64
+	recordChan chan *auditRecord
+	file       *os.File
+}
+
+// Creates an auditor appending to the file at path, auditing roughly
+// sampleRate (0.0 - 1.0) of the messages
+func NewDeliveryAuditor(path string, sampleRate float64) (*DeliveryAuditor,
+	error) {
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("Audit sample rate out of range: %f", sampleRate)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	self := &DeliveryAuditor{
+		threshold:  uint64(sampleRate * 10000),
+		recordChan: make(chan *auditRecord, 1000),
+		file:       file,
+	}
+	go self.writer()
+	return self, nil
+}
+
+// Returns whether deliveries of the message should be audited
+func (self *DeliveryAuditor) Sampled(msg *Message) bool {
+	return MessageFingerprint(msg)%10000 < self.threshold
+}
+
+// Records a delivery of the pack's message to the named output. Records
+// are dropped rather than blocking the pipeline if the writer falls
+// behind.
+func (self *DeliveryAuditor) Record(pipelinePack *PipelinePack,
+	outputName, status string, latency time.Duration) {
+	msg := pipelinePack.Message
+	record := &auditRecord{
+		Id:        strconv.FormatUint(MessageFingerprint(msg), 16),
+		Type:      msg.Type,
+		Logger:    msg.Logger,
+		Output:    outputName,
+		Status:    status,
+		LatencyNs: latency.Nanoseconds(),
+		Time:      time.Now().Format(time.RFC3339Nano),
+	}
+	select {
+	case self.recordChan <- record:
+	default:
+	}
+}
+
+func (self *DeliveryAuditor) writer() {
+	for record := range self.recordChan {
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		if _, err = self.file.Write(append(recordBytes, '\n')); err != nil {
+			log.Printf("Error writing audit record: %s\n", err.Error())
+		}
+	}
+}
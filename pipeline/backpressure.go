@@ -0,0 +1,106 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// What happens when a bounded queue is full: the sender waits for room,
+// the new item is dropped, or the oldest queued items are discarded to
+// make room for it
+const (
+	BackpressureBlock      = "block"
+	BackpressureDrop       = "drop"
+	BackpressureShedOldest = "shed_oldest"
+)
+
+// Backpressure applies a policy to sends on a bounded queue and counts
+// how often the queue was full, so the policy's cost shows up in the
+// plugin's report rather than as a silent stall or silent loss.
+type Backpressure struct {
+	Policy  string
+	blocked int64
+	dropped int64
+	shed    int64
+}
+
+// Returns a Backpressure for the named policy, or for defaultPolicy if
+// policy is empty
+func NewBackpressure(policy, defaultPolicy string) (*Backpressure, error) {
+	if policy == "" {
+		policy = defaultPolicy
+	}
+	switch policy {
+	case BackpressureBlock, BackpressureDrop, BackpressureShedOldest:
+	default:
+		return nil, fmt.Errorf("unknown backpressure policy '%s', must be "+
+			"one of %s, %s or %s", policy, BackpressureBlock,
+			BackpressureDrop, BackpressureShedOldest)
+	}
+	return &Backpressure{Policy: policy}, nil
+}
+
+// Reads the `Backpressure` setting from a plugin config
+func ConfigBackpressure(config *PluginConfig,
+	defaultPolicy string) (*Backpressure, error) {
+	policy := ""
+	if value, ok := (*config)["Backpressure"]; ok {
+		if policy, ok = value.(string); !ok {
+			return nil, fmt.Errorf("Backpressure must be a string")
+		}
+	}
+	return NewBackpressure(policy, defaultPolicy)
+}
+
+// Queues an item according to the policy, returning whether it was
+// queued. trySend makes a non-blocking send and reports whether it
+// succeeded, send blocks until it succeeds, and shedOldest discards the
+// oldest queued item, reporting whether there was one.
+func (self *Backpressure) Send(trySend func() bool, send func(),
+	shedOldest func() bool) bool {
+	if trySend() {
+		return true
+	}
+	switch self.Policy {
+	case BackpressureDrop:
+		atomic.AddInt64(&self.dropped, 1)
+		return false
+	case BackpressureShedOldest:
+		for {
+			if shedOldest() {
+				atomic.AddInt64(&self.shed, 1)
+			}
+			if trySend() {
+				return true
+			}
+		}
+	}
+	atomic.AddInt64(&self.blocked, 1)
+	send()
+	return true
+}
+
+// Number of items dropped, either new ones or shed queued ones
+func (self *Backpressure) Lost() int64 {
+	return atomic.LoadInt64(&self.dropped) + atomic.LoadInt64(&self.shed)
+}
+
+// Adds the counters to a plugin's report
+func (self *Backpressure) report(report map[string]interface{}) {
+	report["backpressure_blocked"] = atomic.LoadInt64(&self.blocked)
+	report["backpressure_dropped"] = atomic.LoadInt64(&self.dropped)
+	report["backpressure_shed"] = atomic.LoadInt64(&self.shed)
+}
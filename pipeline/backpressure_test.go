@@ -0,0 +1,74 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+)
+
+func BackpressureSpec(c gospec.Context) {
+	// A full queue w/ the given policy
+	newQueue := func(backpressure *Backpressure) *Queue {
+		queue := NewQueue(2, backpressure)
+		queue.Push([]byte("one"), 0)
+		queue.Push([]byte("two"), 0)
+		return queue
+	}
+	pop := func(queue *Queue) string {
+		item, _ := queue.TryPop()
+		data, _ := item.([]byte)
+		return string(data)
+	}
+
+	c.Specify("Drop discards the new item", func() {
+		backpressure, err := NewBackpressure("", BackpressureDrop)
+		c.Assume(err, gs.IsNil)
+		queue := newQueue(backpressure)
+		c.Expect(queue.Send([]byte("three"), nil), gs.IsFalse)
+		c.Expect(pop(queue), gs.Equals, "one")
+		c.Expect(backpressure.Lost(), gs.Equals, int64(1))
+	})
+
+	c.Specify("Shed oldest makes room for the new item", func() {
+		backpressure, err := NewBackpressure(BackpressureShedOldest, "")
+		c.Assume(err, gs.IsNil)
+		queue := newQueue(backpressure)
+		var shed []string
+		c.Expect(queue.Send([]byte("three"), func(item interface{}) {
+			shed = append(shed, string(item.([]byte)))
+		}), gs.IsTrue)
+		c.Expect(pop(queue), gs.Equals, "two")
+		c.Expect(pop(queue), gs.Equals, "three")
+		c.Expect(len(shed), gs.Equals, 1)
+		c.Expect(shed[0], gs.Equals, "one")
+		report := make(map[string]interface{})
+		backpressure.report(report)
+		c.Expect(report["backpressure_shed"], gs.Equals, int64(1))
+	})
+
+	c.Specify("Block waits for room", func() {
+		backpressure, err := NewBackpressure(BackpressureBlock, "")
+		c.Assume(err, gs.IsNil)
+		queue := newQueue(backpressure)
+		go func() { queue.Pop(0) }()
+		c.Expect(queue.Send([]byte("three"), nil), gs.IsTrue)
+		c.Expect(backpressure.Lost(), gs.Equals, int64(0))
+	})
+
+	c.Specify("Unknown policies are rejected", func() {
+		_, err := NewBackpressure("panic", BackpressureBlock)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,148 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// Returned by outputs for sends skipped because the breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreaker stops an output from spending its whole retry budget on
+// a destination that's down. After `BreakerThreshold` consecutive failed
+// attempts the breaker opens, and sends are refused (the output drops
+// and counts them) for `BreakerCooldown` seconds (30 by default). Then a
+// single probe is let through, i.e. the breaker is half-open: if it
+// succeeds the breaker closes, otherwise it opens for another cooldown.
+// A nil CircuitBreaker, what you get w/o a threshold, allows everything.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	lock      sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	opened    int64
+	rejected  int64
+	// For testing
+	now func() time.Time
+}
+
+func NewCircuitBreaker(name string, threshold int,
+	cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{name: name, threshold: threshold,
+		cooldown: cooldown, state: breakerClosed, now: time.Now}
+}
+
+// Reads the `BreakerThreshold` and `BreakerCooldown` settings, returning
+// nil if there's no threshold
+func ConfigCircuitBreaker(config *PluginConfig,
+	name string) (*CircuitBreaker, error) {
+	value, ok := (*config)["BreakerThreshold"]
+	if !ok {
+		return nil, nil
+	}
+	threshold, ok := value.(int64)
+	if !ok || threshold < 1 {
+		return nil, fmt.Errorf("BreakerThreshold must be a positive integer")
+	}
+	cooldown, err := ConfigDuration(config, "BreakerCooldown", time.Second,
+		30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return NewCircuitBreaker(name, int(threshold), cooldown), nil
+}
+
+// Returns whether an attempt may be made, moving an open breaker to
+// half-open once the cooldown has passed
+func (self *CircuitBreaker) Allow() bool {
+	if self == nil {
+		return true
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	switch self.state {
+	case breakerOpen:
+		if self.now().Sub(self.openedAt) >= self.cooldown {
+			self.state = breakerHalfOpen
+			return true
+		}
+	case breakerHalfOpen:
+		// The probe is still out
+	default:
+		return true
+	}
+	self.rejected++
+	return false
+}
+
+// Records a successful attempt, closing the breaker
+func (self *CircuitBreaker) Success() {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	if self.state != breakerClosed {
+		log.Printf("%s circuit breaker closed\n", self.name)
+	}
+	self.state = breakerClosed
+	self.failures = 0
+	self.lock.Unlock()
+}
+
+// Records a failed attempt, opening the breaker if it was a failed probe
+// or the threshold has been reached
+func (self *CircuitBreaker) Failure() {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.failures++
+	if self.state == breakerHalfOpen || (self.state == breakerClosed &&
+		self.failures >= self.threshold) {
+		if self.state == breakerClosed {
+			log.Printf("%s circuit breaker opened after %d failures\n",
+				self.name, self.failures)
+		}
+		self.state = breakerOpen
+		self.openedAt = self.now()
+		self.opened++
+	}
+}
+
+// Adds the breaker's state and counters to a plugin's report
+func (self *CircuitBreaker) report(report map[string]interface{}) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	report["breaker_state"] = self.state
+	report["breaker_opened"] = self.opened
+	report["breaker_rejected"] = self.rejected
+	self.lock.Unlock()
+}
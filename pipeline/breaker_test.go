@@ -0,0 +1,64 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	"time"
+)
+
+func CircuitBreakerSpec(c gospec.Context) {
+	now := time.Now()
+	breaker := NewCircuitBreaker("TestOutput", 2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	c.Specify("The breaker opens after consecutive failures", func() {
+		breaker.Failure()
+		breaker.Success()
+		breaker.Failure()
+		c.Expect(breaker.Allow(), gs.IsTrue)
+		breaker.Failure()
+		c.Expect(breaker.Allow(), gs.IsFalse)
+		report := make(map[string]interface{})
+		breaker.report(report)
+		c.Expect(report["breaker_state"], gs.Equals, breakerOpen)
+		c.Expect(report["breaker_rejected"], gs.Equals, int64(1))
+	})
+
+	c.Specify("A single probe is let through after the cooldown", func() {
+		breaker.Failure()
+		breaker.Failure()
+		now = now.Add(2 * time.Minute)
+		c.Expect(breaker.Allow(), gs.IsTrue)
+		c.Expect(breaker.Allow(), gs.IsFalse)
+
+		c.Specify("and a failed probe reopens the breaker", func() {
+			breaker.Failure()
+			c.Expect(breaker.state, gs.Equals, breakerOpen)
+			c.Expect(breaker.Allow(), gs.IsFalse)
+		})
+
+		c.Specify("and a successful probe closes it", func() {
+			breaker.Success()
+			c.Expect(breaker.Allow(), gs.IsTrue)
+		})
+	})
+
+	c.Specify("A nil breaker allows everything", func() {
+		var none *CircuitBreaker
+		none.Failure()
+		c.Expect(none.Allow(), gs.IsTrue)
+	})
+}
@@ -0,0 +1,325 @@
+//go:build !nocef
+// +build !nocef
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("CefEncoder", func() interface{} {
+		return new(CefEncoder)
+	})
+	RegisterPlugin("CefOutput", func() interface{} {
+		return new(CefOutput)
+	})
+}
+
+// CEF extension keys are alphanumeric
+var cefKeyRegex = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// Syslog facility names, for the `Facility` setting
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20,
+	"local5": 21, "local6": 22, "local7": 23,
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`,
+		"\r\n", " ", "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`,
+		"\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+)
+
+// Heka severities are syslog's, from 0 (emergency) to 7 (debug); CEF's
+// run the other way, from 0 to 10 (most severe)
+var cefSeverities = []int{10, 9, 8, 7, 5, 4, 3, 1}
+
+// CefEncoder formats messages as Common Event Format records for SIEMs
+// such as ArcSight:
+//
+//	CEF:0|Vendor|Product|Version|SignatureId|Name|Severity|Extensions
+//
+// `DeviceVendor`, `DeviceProduct` and `DeviceVersion` default to
+// "Mozilla", "heka" and "1.0". The signature ID and name are taken from
+// the message variables (see MessageVariable) in `SignatureId` and `Name`,
+// the type and payload by default, and the severity is the message's,
+// mapped onto CEF's 0-10 scale.
+//
+// `Extensions` maps CEF extension keys to message variables, e.g.
+//
+//	"Extensions": {"src": "Fields[remote_addr]", "request": "Fields[url]"}
+//
+// on top of "rt" (the timestamp, in milliseconds) and "dvchost" (the
+// hostname), which can be overridden or, w/ an empty variable, left out.
+// Extensions are written in key order, and those whose variable is missing
+// from a message are skipped.
+type CefEncoder struct {
+	header      string
+	signatureId string
+	name        string
+	extensions  []string
+	variables   map[string]string
+}
+
+func (self *CefEncoder) Init(config *PluginConfig) error {
+	setting := func(name, def string) string {
+		if value, ok := (*config)[name].(string); ok {
+			return value
+		}
+		return def
+	}
+	self.header = fmt.Sprintf("CEF:0|%s|%s|%s|",
+		cefHeaderEscaper.Replace(setting("DeviceVendor", "Mozilla")),
+		cefHeaderEscaper.Replace(setting("DeviceProduct", "heka")),
+		cefHeaderEscaper.Replace(setting("DeviceVersion", "1.0")))
+	self.signatureId = setting("SignatureId", "Type")
+	self.name = setting("Name", "Payload")
+	for _, variable := range []string{self.signatureId, self.name} {
+		if !isMessageVariable(variable) {
+			return fmt.Errorf("CefEncoder config: Invalid message variable: "+
+				"%s", variable)
+		}
+	}
+	self.variables = map[string]string{"rt": "Timestamp",
+		"dvchost": "Hostname"}
+	if value, ok := (*config)["Extensions"]; ok {
+		extensions, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.New("CefEncoder config: Extensions must be an " +
+				"object")
+		}
+		for key, value := range extensions {
+			variable, _ := value.(string)
+			if !cefKeyRegex.MatchString(key) {
+				return fmt.Errorf("CefEncoder config: Invalid extension "+
+					"key: %s", key)
+			}
+			if variable != "" && !isMessageVariable(variable) {
+				return fmt.Errorf("CefEncoder config: Invalid message "+
+					"variable for %s: %s", key, variable)
+			}
+			self.variables[key] = variable
+		}
+	}
+	for key, variable := range self.variables {
+		if variable == "" {
+			delete(self.variables, key)
+		} else {
+			self.extensions = append(self.extensions, key)
+		}
+	}
+	sort.Strings(self.extensions)
+	return nil
+}
+
+func cefSeverity(severity int) int {
+	if severity < 0 {
+		severity = 0
+	} else if severity >= len(cefSeverities) {
+		severity = len(cefSeverities) - 1
+	}
+	return cefSeverities[severity]
+}
+
+// Returns the CEF record for a message, w/o a trailing newline
+func (self *CefEncoder) Record(pipelinePack *PipelinePack) []byte {
+	msg := pipelinePack.Message
+	variable := func(name string) string {
+		if name == "Timestamp" {
+			millis := msg.Timestamp.UnixNano() / int64(time.Millisecond)
+			return strconv.FormatInt(millis, 10)
+		}
+		if value, ok := MessageVariable(msg, name); ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+	buffer := bytes.NewBufferString(self.header)
+	fmt.Fprintf(buffer, "%s|%s|%d|",
+		cefHeaderEscaper.Replace(variable(self.signatureId)),
+		cefHeaderEscaper.Replace(strings.TrimSpace(variable(self.name))),
+		cefSeverity(msg.Severity))
+	first := true
+	for _, key := range self.extensions {
+		value := variable(self.variables[key])
+		if value == "" {
+			continue
+		}
+		if !first {
+			buffer.WriteByte(' ')
+		}
+		first = false
+		fmt.Fprintf(buffer, "%s=%s", key, cefExtensionEscaper.Replace(value))
+	}
+	return buffer.Bytes()
+}
+
+func (self *CefEncoder) Encode(pipelinePack *PipelinePack) ([]byte, error) {
+	return append(self.Record(pipelinePack), '\n'), nil
+}
+
+// CefOutput sends CEF records, formatted by a CefEncoder configured by
+// the same settings, to the syslog server at `Address`. Each record gets
+// an RFC 3164 syslog header w/ the message's severity, the `Facility`
+// ("local0" by default) and the message's hostname. W/ `Protocol` "udp"
+// (the default) each record is a datagram; w/ "tcp" records are newline
+// delimited and the connection is re-established as needed. Up to
+// `QueueSize` records (1000 by default) wait to be sent; records that
+// don't fit are dropped and counted, unless `Backpressure` says otherwise
+// (see Backpressure).
+type CefOutput struct {
+	dryRunnable
+	address  string
+	protocol string
+	facility int
+	hostname string
+	encoder  CefEncoder
+	conn     net.Conn
+	queue    *Queue
+	// What to do when the queue is full
+	backpressure *Backpressure
+}
+
+func (self *CefOutput) Init(config *PluginConfig) error {
+	if err := self.encoder.Init(config); err != nil {
+		return err
+	}
+	value, ok := (*config)["Address"]
+	if !ok {
+		return errors.New("CefOutput config: Missing Address")
+	}
+	self.address = value.(string)
+	self.protocol = "udp"
+	if value, ok = (*config)["Protocol"]; ok {
+		self.protocol = value.(string)
+	}
+	if self.protocol != "udp" && self.protocol != "tcp" {
+		return fmt.Errorf("CefOutput config: Unknown Protocol: %s",
+			self.protocol)
+	}
+	facility := "local0"
+	if value, ok = (*config)["Facility"]; ok {
+		facility = value.(string)
+	}
+	if self.facility, ok = syslogFacilities[facility]; !ok {
+		return fmt.Errorf("CefOutput config: Unknown Facility: %s", facility)
+	}
+	queueSize := 1000
+	if value, ok = (*config)["QueueSize"]; ok {
+		queueSize = int(value.(int64))
+	}
+	var err error
+	self.backpressure, err = ConfigBackpressure(config, BackpressureDrop)
+	if err != nil {
+		return fmt.Errorf("CefOutput config: %s", err.Error())
+	}
+	self.hostname, _ = os.Hostname()
+	self.queue = NewQueue(queueSize, self.backpressure)
+	go self.sender()
+	return nil
+}
+
+func (self *CefOutput) Deliver(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	severity := msg.Severity
+	if severity < 0 || severity > 7 {
+		severity = 7
+	}
+	hostname := msg.Hostname
+	if hostname == "" {
+		hostname = self.hostname
+	}
+	buffer := new(bytes.Buffer)
+	fmt.Fprintf(buffer, "<%d>%s %s ", self.facility*8+severity,
+		msg.Timestamp.Format(time.Stamp), hostname)
+	buffer.Write(self.encoder.Record(pipelinePack))
+	if self.protocol == "tcp" {
+		buffer.WriteByte('\n')
+	}
+	self.queue.Send(buffer.Bytes(), nil)
+}
+
+// Sends a record, connecting first if necessary
+func (self *CefOutput) send(data []byte) (err error) {
+	if self.dryRun.Skip(data) {
+		return nil
+	}
+	if self.conn == nil {
+		self.conn, err = net.DialTimeout(self.protocol, self.address,
+			10*time.Second)
+		if err != nil {
+			return
+		}
+	}
+	if _, err = self.conn.Write(data); err != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+	return
+}
+
+func (self *CefOutput) sender() {
+	interval := 100 * time.Millisecond
+	for item := range self.queue.Chan() {
+		data := item.([]byte)
+		for {
+			err := self.send(data)
+			if err == nil {
+				interval = 100 * time.Millisecond
+				break
+			}
+			log.Printf("CefOutput error sending to %s: %s\n", self.address,
+				err.Error())
+			if self.protocol == "udp" {
+				break
+			}
+			time.Sleep(interval)
+			if interval *= 2; interval > 30*time.Second {
+				interval = 30 * time.Second
+			}
+		}
+	}
+}
+
+// Waits for the send queue to empty out
+func (self *CefOutput) Drain() error {
+	for self.queue.Len() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (self *CefOutput) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"dropped": self.backpressure.Lost(),
+	}
+	self.queue.report(report)
+	return report
+}
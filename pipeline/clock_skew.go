@@ -0,0 +1,116 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// What's done w/ a message whose timestamp is too far from its arrival
+const (
+	ClockSkewTag     = "tag"
+	ClockSkewCorrect = "correct"
+)
+
+// The field skewed messages are tagged w/
+const clockSkewField = "clock_skew_ns"
+
+// ClockSkewGuard catches messages stamped by producers w/ bad clocks,
+// i.e. w/ timestamps more than max_future_skew ahead of the time they
+// were read or more than max_past_skew behind it. W/ the "tag" policy
+// (the default) such messages get a "clock_skew_ns" field, their
+// timestamp less their arrival time. W/ "correct" they're also
+// restamped w/ their arrival time, so time based filters and outputs see
+// something sensible; the field keeps the original offset. Either limit
+// can be left off, e.g. inputs replaying old logs make past skew normal.
+// Messages w/o a timestamp always count as skewed. The counts are
+// reported as the "pipeline clock_skew" plugin.
+type ClockSkewGuard struct {
+	maxFuture time.Duration
+	maxPast   time.Duration
+	policy    string
+	future    int64
+	past      int64
+	missing   int64
+}
+
+// Returns the guard for the config's skew limits, or nil if there are
+// none
+func NewClockSkewGuard(config *GraterConfig) *ClockSkewGuard {
+	if config.MaxFutureSkew <= 0 && config.MaxPastSkew <= 0 {
+		return nil
+	}
+	policy := config.ClockSkewPolicy
+	if policy == "" {
+		policy = ClockSkewTag
+	}
+	return &ClockSkewGuard{maxFuture: config.MaxFutureSkew,
+		maxPast: config.MaxPastSkew, policy: policy}
+}
+
+// Checks a clock_skew_policy setting
+func checkClockSkewPolicy(policy string) error {
+	switch policy {
+	case "", ClockSkewTag, ClockSkewCorrect:
+		return nil
+	}
+	return fmt.Errorf("clock_skew_policy must be %s or %s", ClockSkewTag,
+		ClockSkewCorrect)
+}
+
+// Checks the message's timestamp against its arrival time, tagging or
+// correcting it if it's skewed. Returns whether it was. Works on a nil
+// guard.
+func (self *ClockSkewGuard) Check(msg *Message, arrival time.Time) bool {
+	if self == nil {
+		return false
+	}
+	if msg.Timestamp.IsZero() {
+		atomic.AddInt64(&self.missing, 1)
+		if self.policy == ClockSkewCorrect {
+			msg.SetTime(arrival)
+		}
+		return true
+	}
+	skew := msg.Timestamp.Sub(arrival)
+	switch {
+	case self.maxFuture > 0 && skew > self.maxFuture:
+		if future := atomic.AddInt64(&self.future, 1); future%1000 == 1 {
+			log.Printf("%s message from %s is %s in the future (%d so "+
+				"far)\n", msg.Type, msg.Hostname, skew, future)
+		}
+	case self.maxPast > 0 && -skew > self.maxPast:
+		atomic.AddInt64(&self.past, 1)
+	default:
+		return false
+	}
+	msg.ReplaceField(clockSkewField, int64(skew))
+	if self.policy == ClockSkewCorrect {
+		msg.SetTime(arrival)
+	}
+	return true
+}
+
+func (self *ClockSkewGuard) Report() map[string]interface{} {
+	return map[string]interface{}{
+		"policy":  self.policy,
+		"future":  atomic.LoadInt64(&self.future),
+		"past":    atomic.LoadInt64(&self.past),
+		"missing": atomic.LoadInt64(&self.missing),
+	}
+}
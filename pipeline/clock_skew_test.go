@@ -0,0 +1,55 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"time"
+)
+
+func ClockSkewGuardSpec(c gospec.Context) {
+	arrival := time.Now()
+	config := &GraterConfig{MaxFutureSkew: time.Minute}
+
+	c.Specify("Future timestamps are tagged by default", func() {
+		guard := NewClockSkewGuard(config)
+		msg := &Message{Timestamp: arrival.Add(time.Hour)}
+		c.Expect(guard.Check(msg, arrival), gs.IsTrue)
+		c.Expect(msg.Fields[clockSkewField], gs.Equals,
+			int64(time.Hour))
+		c.Expect(msg.Time().Equal(arrival.Add(time.Hour)), gs.IsTrue)
+		c.Expect(guard.Check(&Message{Timestamp: arrival}, arrival),
+			gs.IsFalse)
+	})
+
+	c.Specify("Past skew is only checked w/ a limit", func() {
+		msg := &Message{Timestamp: arrival.Add(-24 * time.Hour)}
+		c.Expect(NewClockSkewGuard(config).Check(msg, arrival), gs.IsFalse)
+		config.MaxPastSkew = time.Hour
+		c.Expect(NewClockSkewGuard(config).Check(msg, arrival), gs.IsTrue)
+	})
+
+	c.Specify("Skewed timestamps can be corrected", func() {
+		config.ClockSkewPolicy = ClockSkewCorrect
+		guard := NewClockSkewGuard(config)
+		msg := &Message{Timestamp: arrival.Add(time.Hour)}
+		guard.Check(msg, arrival)
+		c.Expect(msg.Time().Equal(arrival), gs.IsTrue)
+		missing := new(Message)
+		c.Expect(guard.Check(missing, arrival), gs.IsTrue)
+		c.Expect(missing.Time().Equal(arrival), gs.IsTrue)
+	})
+}
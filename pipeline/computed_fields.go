@@ -0,0 +1,93 @@
+//go:build !nocomputedfields
+// +build !nocomputedfields
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterPlugin("ComputedFieldsFilter", func() interface{} {
+		return new(ComputedFieldsFilter)
+	})
+}
+
+type computedField struct {
+	name string
+	expr *FieldExpression
+}
+
+// ComputedFieldsFilter adds fields computed from each message, so simple
+// derived values don't need custom Go code. `Fields` is a list of
+// definitions like
+//
+//	latency_ms = (end_ts - start_ts) / 1e6
+//	bucket = floor(size / 1024)
+//
+// where the right hand side is a FieldExpression. Definitions are
+// evaluated in order, so later ones can use earlier results. If a
+// definition can't be evaluated, e.g. because a field it uses is missing,
+// its field is left unset; these failures are counted in the plugin
+// report (see Reporter).
+type ComputedFieldsFilter struct {
+	fields []computedField
+	errors int64
+}
+
+func (self *ComputedFieldsFilter) Init(config *PluginConfig) error {
+	value, ok := (*config)["Fields"]
+	if !ok {
+		return errors.New("ComputedFieldsFilter config: Missing Fields")
+	}
+	for _, definition := range value.([]string) {
+		eq := strings.Index(definition, "=")
+		if eq < 0 {
+			return fmt.Errorf("ComputedFieldsFilter config: Expected "+
+				"name = expression, got %q", definition)
+		}
+		name := strings.TrimSpace(definition[:eq])
+		if name == "" || strings.ContainsAny(name, " []") {
+			return fmt.Errorf("ComputedFieldsFilter config: Invalid field "+
+				"name %q", name)
+		}
+		expr, err := NewFieldExpression(strings.TrimSpace(definition[eq+1:]))
+		if err != nil {
+			return fmt.Errorf("ComputedFieldsFilter config: %s", err.Error())
+		}
+		self.fields = append(self.fields, computedField{name, expr})
+	}
+	return nil
+}
+
+func (self *ComputedFieldsFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	for _, field := range self.fields {
+		value, err := field.expr.Eval(msg)
+		if err != nil {
+			atomic.AddInt64(&self.errors, 1)
+			continue
+		}
+		msg.ReplaceField(field.name, value)
+	}
+}
+
+func (self *ComputedFieldsFilter) Report() map[string]interface{} {
+	return map[string]interface{}{"errors": atomic.LoadInt64(&self.errors)}
+}
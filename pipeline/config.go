@@ -0,0 +1,696 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The core plugins. The optional ones register themselves from their own
+// files, each of which can be left out of the build w/ a build tag (e.g.
+// `go install -tags "notcpinput notcpoutput" heka/graterd`).
+func init() {
+	RegisterPlugin("UdpInput", func() interface{} { return new(UdpInput) })
+	RegisterPlugin("JsonDecoder", func() interface{} {
+		return new(JsonDecoder)
+	})
+	RegisterPlugin("GobDecoder", func() interface{} { return new(GobDecoder) })
+	RegisterPlugin("StatMetricDecoder", func() interface{} {
+		return new(StatMetricDecoder)
+	})
+	RegisterPlugin("TimestampDecoder", func() interface{} {
+		return new(TimestampDecoder)
+	})
+	RegisterPlugin("LogFilter", func() interface{} { return new(LogFilter) })
+	RegisterPlugin("NamedOutputFilter", func() interface{} {
+		return new(NamedOutputFilter)
+	})
+	RegisterPlugin("StatRollupFilter", func() interface{} {
+		return new(StatRollupFilter)
+	})
+	RegisterPlugin("PayloadEncoder", func() interface{} {
+		return new(PayloadEncoder)
+	})
+	RegisterPlugin("JsonEncoder", func() interface{} {
+		return new(JsonEncoder)
+	})
+	RegisterPlugin("GobEncoder", func() interface{} { return new(GobEncoder) })
+	RegisterPlugin("StatMetricEncoder", func() interface{} {
+		return new(StatMetricEncoder)
+	})
+	RegisterPlugin("LogOutput", func() interface{} { return new(LogOutput) })
+	RegisterPlugin("CounterOutput", func() interface{} {
+		return NewCounterOutput()
+	})
+	RegisterPlugin("MessageGeneratorInput", func() interface{} {
+		return new(MessageGeneratorInput)
+	})
+}
+
+// The JSON config file layout. Each plugin section is an object w/ a
+// `type` key naming the plugin; the remaining keys are passed to the
+// plugin's Init as its PluginConfig. Output sections can also set
+// `dry_run` (see DryRun), `transform` (see transformPack),
+// `delivery_workers`, `delivery_queue_size`, `priority_severity` and
+// `priority_matcher` (see OutputRunner), and filter sections `sandbox`
+// and `sandbox_sample` (see FilterSandbox).
+// Filter and output sections can set `message_matcher` (see Router).
+// Plugin types from shared objects in `plugins_dir` can be used like any
+// other (see PluginRegistrar).
+type configFile struct {
+	Inputs             map[string]PluginConfig
+	Decoders           map[string]PluginConfig
+	FilterChains       map[string][]PluginConfig `json:"filter_chains"`
+	Encoders           map[string]PluginConfig
+	Outputs            map[string]PluginConfig
+	DefaultDecoder     string   `json:"default_decoder"`
+	DefaultFilterChain string   `json:"default_filter_chain"`
+	DefaultOutputs     []string `json:"default_outputs"`
+	PoolSize           int      `json:"pool_size"`
+	ReportInterval     int      `json:"report_interval"`
+	AllowControl       bool     `json:"allow_control"`
+	StagedStart        string   `json:"staged_start"`
+	DecodeErrors       bool     `json:"decode_error_messages"`
+	TapAddress         string   `json:"tap_address"`
+	TapSize            int      `json:"tap_size"`
+	TraceMessages      bool     `json:"trace_messages"`
+	TraceSize          int      `json:"trace_size"`
+	PackLeakTimeout    int      `json:"pack_leak_timeout"`
+	ReplaceLeakedPacks bool     `json:"replace_leaked_packs"`
+	PoolBackpressure   string   `json:"pool_backpressure"`
+	PluginsDir         string   `json:"plugins_dir"`
+	// A number of bytes or a size string, e.g. "1MB"
+	MaxMessageSize interface{} `json:"max_message_size"`
+	OversizePolicy string      `json:"oversize_policy"`
+	// Durations, in seconds if given as numbers
+	MaxFutureSkew   interface{} `json:"max_future_skew"`
+	MaxPastSkew     interface{} `json:"max_past_skew"`
+	ClockSkewPolicy string      `json:"clock_skew_policy"`
+	// How long a pack can be in flight before it's evicted (see
+	// evictPack), and the output it's then sent to, if any
+	MaxPackAge       interface{} `json:"max_pack_age"`
+	DeadLetterOutput string      `json:"dead_letter_output"`
+	// Where queues are snapshotted on a handoff and exported on SIGUSR1
+	// (see Snapshotter)
+	SnapshotDir string `json:"snapshot_dir"`
+	// Where plugin state and disabled plugins are kept across restarts
+	StateDir string `json:"state_dir"`
+	// How long plugins' Prepare and Drain hooks get (see Preparer and
+	// Drainer), in seconds if given as numbers
+	PrepareTimeout interface{} `json:"prepare_timeout"`
+	DrainTimeout   interface{} `json:"drain_timeout"`
+	// Field type conversions by message_matcher (see MatchedConversions)
+	FieldConversions []PluginConfig `json:"field_conversions"`
+}
+
+// Converts values decoded from JSON to the types plugins expect, i.e.
+// whole numbers become int64 and lists of strings become []string
+func normalizeConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == float64(int64(v)) {
+			return int64(v)
+		}
+	case []interface{}:
+		strs := make([]string, len(v))
+		for i, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return v
+			}
+			strs[i] = str
+		}
+		return strs
+	}
+	return value
+}
+
+// Returns the config files a path refers to. A directory means every
+// *.json file in it, anything else is treated as a glob pattern. Files are
+// returned sorted, so the load order is predictable.
+func configPaths(path string) ([]string, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "*.json")
+	}
+	paths, err := filepath.Glob(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No config files found: %s", path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Collects all of the problems found in a config
+type ConfigErrors []string
+
+func (self ConfigErrors) Error() string {
+	return fmt.Sprintf("Config errors:\n  %s", strings.Join(self, "\n  "))
+}
+
+// Reads the `MaxRetries`, `RetryDelay` and `MaxRetryDelay` (both
+// durations, in milliseconds if given as numbers) settings from a plugin
+// section, returning false if none are set
+func restartPolicyFromSection(section PluginConfig) (RestartPolicy, bool) {
+	policy := DefaultRestartPolicy
+	found := false
+	// Plugin configs have whole numbers normalized to int64
+	switch value := section["MaxRetries"].(type) {
+	case float64:
+		policy.MaxRetries = int(value)
+		found = true
+	case int64:
+		policy.MaxRetries = int(value)
+		found = true
+	}
+	if _, ok := section["RetryDelay"]; ok {
+		delay, err := ConfigDuration(&section, "RetryDelay", time.Millisecond,
+			policy.Delay)
+		if err == nil {
+			policy.Delay = delay
+			found = true
+		}
+	}
+	if _, ok := section["MaxRetryDelay"]; ok {
+		delay, err := ConfigDuration(&section, "MaxRetryDelay",
+			time.Millisecond, policy.MaxDelay)
+		if err == nil {
+			policy.MaxDelay = delay
+			found = true
+		}
+	}
+	return policy, found
+}
+
+// Instantiates and initializes the plugin described by a config section.
+// Plugins that panic on bad config values (e.g. failed type assertions)
+// are reported as errors rather than taking the process down.
+func loadPlugin(section PluginConfig) (plugin Plugin, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			plugin = nil
+			err = fmt.Errorf("invalid config: %v", r)
+		}
+	}()
+	typeName, ok := section["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing type")
+	}
+	factory, ok := PluginFactory(typeName)
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin type: %s", typeName)
+	}
+	plugin, ok = factory().(Plugin)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a plugin", typeName)
+	}
+	config := make(PluginConfig)
+	for key, value := range section {
+		if key != "type" && key != "dry_run" && key != "transform" &&
+			key != "sandbox" && key != "sandbox_sample" &&
+			key != "message_matcher" && key != "delivery_workers" &&
+			key != "delivery_queue_size" && key != "priority_severity" &&
+			key != "priority_matcher" {
+			config[key] = normalizeConfigValue(value)
+		}
+	}
+	if err := plugin.Init(&config); err != nil {
+		return nil, err
+	}
+	return plugin, nil
+}
+
+// Sets up the sandbox for a filter w/ the `sandbox` setting
+func sandboxFilter(config *GraterConfig, plugin Plugin, kind, name string,
+	path, sample interface{}) error {
+	filter, ok := plugin.(Filter)
+	if !ok || kind != "filter" {
+		return errors.New("sandbox is only supported for filters")
+	}
+	sandboxPath, ok := path.(string)
+	if !ok || sandboxPath == "" {
+		return errors.New("sandbox must be the path of the capture file")
+	}
+	fraction := 1.0
+	if sample != nil {
+		var err error
+		fraction, err = toFloat64(sample)
+		if err != nil || fraction <= 0 || fraction > 1 {
+			return errors.New("sandbox_sample must be a fraction between 0 " +
+				"and 1")
+		}
+	}
+	config.Sandboxes[filter] = NewFilterSandbox(fmt.Sprintf("%s filter",
+		name), sandboxPath, fraction)
+	return nil
+}
+
+func isPluginKind(plugin Plugin, kind string) (ok bool) {
+	switch kind {
+	case "input":
+		_, ok = plugin.(Input)
+	case "decoder":
+		_, ok = plugin.(Decoder)
+	case "filter":
+		_, ok = plugin.(Filter)
+	case "encoder":
+		_, ok = plugin.(Encoder)
+	case "output":
+		_, ok = plugin.(Output)
+	}
+	return
+}
+
+// Loads a pipeline config from a JSON config file, a directory of them or
+// a glob pattern. Files are merged in sorted order; later files can
+// override the default settings but plugin names must be unique across
+// all of the files.
+func LoadConfig(path string) (*GraterConfig, error) {
+	paths, err := configPaths(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &GraterConfig{
+		Inputs:                make(map[string]Input),
+		Decoders:              make(map[string]Decoder),
+		FilterChains:          make(map[string][]Filter),
+		Encoders:              make(map[string]Encoder),
+		Outputs:               make(map[string]Output),
+		PoolSize:              1000,
+		RestartPolicies:       make(map[string]RestartPolicy),
+		OutputRestartPolicies: make(map[string]RestartPolicy),
+		InputWeights:          make(map[string]float64),
+		Sandboxes:             make(map[Filter]*FilterSandbox),
+		Transforms:            make(map[string][]Filter),
+		FilterMatchers:        make(map[Filter]*MessageMatcher),
+		OutputMatchers:        make(map[string]*MessageMatcher),
+		DeliveryWorkers:       make(map[string]int),
+		DeliveryQueueSizes:    make(map[string]int),
+		DeliveryPriorities:    make(map[string]*DeliveryPriority),
+	}
+	// Tracks the file each plugin was defined in, keyed by "kind name"
+	definedIn := make(map[string]string)
+	errs := make([]string, 0)
+	define := func(kind, name, filePath string) bool {
+		key := kind + " " + name
+		if prev, ok := definedIn[key]; ok {
+			errs = append(errs, fmt.Sprintf("%s: duplicate %s '%s', also "+
+				"defined in %s", filePath, kind, name, prev))
+			return false
+		}
+		definedIn[key] = filePath
+		return true
+	}
+	// Returns nil and records an error if the plugin can't be loaded or
+	// isn't of the expected kind
+	load := func(kind, name, filePath string, section PluginConfig) Plugin {
+		plugin, err := loadPlugin(section)
+		if err == nil && !isPluginKind(plugin, kind) {
+			err = fmt.Errorf("%s is not a valid %s plugin", section["type"], kind)
+		}
+		if dryRun, _ := section["dry_run"].(bool); dryRun && err == nil {
+			if runner, ok := plugin.(DryRunner); ok && kind == "output" {
+				runner.SetDryRun(NewDryRun(fmt.Sprintf("%s output", name)))
+			} else {
+				err = fmt.Errorf("%s doesn't support dry_run", section["type"])
+			}
+		}
+		if expr, ok := section["message_matcher"]; ok && err == nil {
+			err = routeByMatcher(config, plugin, kind, name, expr)
+		}
+		if path, ok := section["sandbox"]; ok && err == nil {
+			err = sandboxFilter(config, plugin, kind, name, path,
+				section["sandbox_sample"])
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s '%s': %s", filePath, kind,
+				name, err.Error()))
+			return nil
+		}
+		return plugin
+	}
+
+	files := make([]*configFile, len(paths))
+	for i, filePath := range paths {
+		contents, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = new(configFile)
+		if err = json.Unmarshal(contents, files[i]); err != nil {
+			return nil, fmt.Errorf("%s: %s", filePath, err.Error())
+		}
+		if files[i].PluginsDir != "" {
+			config.PluginsDir = files[i].PluginsDir
+		}
+	}
+	// Plugin types from shared objects have to be registered before any
+	// of the sections are loaded
+	if config.PluginsDir != "" {
+		for _, err := range loadPluginsDir(config.PluginsDir) {
+			errs = append(errs, fmt.Sprintf("plugins_dir: %s", err.Error()))
+		}
+	}
+
+	for i, filePath := range paths {
+		file := files[i]
+		for name, section := range file.Inputs {
+			if define("input", name, filePath) {
+				plugin := load("input", name, filePath, section)
+				if p, ok := plugin.(Input); ok {
+					config.Inputs[name] = p
+				}
+				if policy, ok := restartPolicyFromSection(section); ok {
+					config.RestartPolicies[name] = policy
+				}
+				if weight, ok := section["Weight"].(float64); ok {
+					config.InputWeights[name] = weight
+				}
+			}
+		}
+		for name, section := range file.Decoders {
+			if define("decoder", name, filePath) {
+				plugin := load("decoder", name, filePath, section)
+				if p, ok := plugin.(Decoder); ok {
+					config.Decoders[name] = p
+				}
+			}
+		}
+		for name, sections := range file.FilterChains {
+			if !define("filter chain", name, filePath) {
+				continue
+			}
+			chain := make([]Filter, 0, len(sections))
+			for i, section := range sections {
+				filterName := fmt.Sprintf("%s[%d]", name, i)
+				plugin := load("filter", filterName, filePath, section)
+				if filter, ok := plugin.(Filter); ok {
+					chain = append(chain, filter)
+				}
+			}
+			config.FilterChains[name] = chain
+		}
+		for name, section := range file.Encoders {
+			if define("encoder", name, filePath) {
+				plugin := load("encoder", name, filePath, section)
+				if p, ok := plugin.(Encoder); ok {
+					config.Encoders[name] = p
+				}
+			}
+		}
+		for name, section := range file.Outputs {
+			if define("output", name, filePath) {
+				plugin := load("output", name, filePath, section)
+				if p, ok := plugin.(Output); ok {
+					config.Outputs[name] = p
+				}
+				if policy, ok := restartPolicyFromSection(section); ok {
+					config.OutputRestartPolicies[name] = policy
+				}
+				if err := outputDelivery(config, name, section); err != nil {
+					errs = append(errs, fmt.Sprintf("%s: output '%s': %s",
+						filePath, name, err.Error()))
+				}
+				value, ok := section["transform"]
+				if !ok {
+					continue
+				}
+				filters, err := loadTransform(name, value,
+					func(filterName string, section PluginConfig) Plugin {
+						return load("filter", filterName, filePath, section)
+					})
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s: output '%s': %s",
+						filePath, name, err.Error()))
+					continue
+				}
+				config.Transforms[name] = filters
+			}
+		}
+		if file.DefaultDecoder != "" {
+			config.DefaultDecoder = file.DefaultDecoder
+		}
+		if file.DefaultFilterChain != "" {
+			config.DefaultFilterChain = file.DefaultFilterChain
+		}
+		if file.DefaultOutputs != nil {
+			config.DefaultOutputs = file.DefaultOutputs
+		}
+		if file.PoolSize != 0 {
+			config.PoolSize = file.PoolSize
+		}
+		if file.AllowControl {
+			config.AllowControl = true
+		}
+		if file.DecodeErrors {
+			config.DecodeErrorMessages = true
+		}
+		if file.StagedStart != "" {
+			config.StagedStart = file.StagedStart
+		}
+		if file.ReportInterval != 0 {
+			config.ReportInterval = time.Duration(file.ReportInterval) *
+				time.Second
+		}
+		if file.TapAddress != "" {
+			config.TapAddress = file.TapAddress
+		}
+		if file.TapSize != 0 {
+			config.TapSize = file.TapSize
+		}
+		if file.TraceMessages {
+			config.TraceMessages = true
+		}
+		if file.TraceSize != 0 {
+			config.TraceSize = file.TraceSize
+		}
+		if file.PackLeakTimeout != 0 {
+			config.PackLeakTimeout = time.Duration(file.PackLeakTimeout) *
+				time.Second
+		}
+		if file.ReplaceLeakedPacks {
+			config.ReplaceLeakedPacks = true
+		}
+		if file.MaxMessageSize != nil {
+			size, err := configByteSize(file.MaxMessageSize)
+			if err != nil || size < 0 {
+				errs = append(errs, fmt.Sprintf("%s: max_message_size must "+
+					"be a size, e.g. \"1MB\"", filePath))
+			} else {
+				config.MaxMessageSize = int(size)
+			}
+		}
+		if file.OversizePolicy != "" {
+			if err := checkOversizePolicy(file.OversizePolicy); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", filePath,
+					err.Error()))
+			} else {
+				config.OversizePolicy = file.OversizePolicy
+			}
+		}
+		if file.MaxPackAge != nil {
+			age, err := configDuration(file.MaxPackAge, time.Second)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: max_pack_age %s",
+					filePath, err.Error()))
+			} else {
+				config.MaxPackAge = age
+			}
+		}
+		if file.DeadLetterOutput != "" {
+			config.DeadLetterOutput = file.DeadLetterOutput
+		}
+		if file.SnapshotDir != "" {
+			config.SnapshotDir = file.SnapshotDir
+		}
+		if file.StateDir != "" {
+			config.StateDir = file.StateDir
+		}
+		for i, entry := range file.FieldConversions {
+			matched, err := NewMatchedConversions(entry)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: field_conversions[%d]: "+
+					"%s", filePath, i, err.Error()))
+				continue
+			}
+			config.FieldConversions = append(config.FieldConversions,
+				matched)
+		}
+		for key, value := range map[string]interface{}{
+			"max_future_skew": file.MaxFutureSkew,
+			"max_past_skew":   file.MaxPastSkew,
+		} {
+			if value == nil {
+				continue
+			}
+			skew, err := configDuration(value, time.Second)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s %s", filePath, key,
+					err.Error()))
+			} else if key == "max_future_skew" {
+				config.MaxFutureSkew = skew
+			} else {
+				config.MaxPastSkew = skew
+			}
+		}
+		for key, value := range map[string]interface{}{
+			"prepare_timeout": file.PrepareTimeout,
+			"drain_timeout":   file.DrainTimeout,
+		} {
+			if value == nil {
+				continue
+			}
+			timeout, err := configDuration(value, time.Second)
+			if err == nil && timeout <= 0 {
+				err = errors.New("must be positive")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s %s", filePath, key,
+					err.Error()))
+			} else if key == "prepare_timeout" {
+				config.PrepareTimeout = timeout
+			} else {
+				config.DrainTimeout = timeout
+			}
+		}
+		if file.ClockSkewPolicy != "" {
+			if err := checkClockSkewPolicy(file.ClockSkewPolicy); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", filePath,
+					err.Error()))
+			} else {
+				config.ClockSkewPolicy = file.ClockSkewPolicy
+			}
+		}
+		switch file.PoolBackpressure {
+		case "":
+		case BackpressureBlock, BackpressureDrop:
+			config.PoolBackpressure = file.PoolBackpressure
+		default:
+			errs = append(errs, fmt.Sprintf("%s: pool_backpressure must be "+
+				"%s or %s", filePath, BackpressureBlock, BackpressureDrop))
+		}
+	}
+	if name := config.DeadLetterOutput; name != "" {
+		if _, ok := config.Outputs[name]; !ok {
+			errs = append(errs, fmt.Sprintf("dead_letter_output '%s' isn't "+
+				"a configured output", name))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, ConfigErrors(errs)
+	}
+	return config, nil
+}
+
+// Records the `message_matcher` of a filter or output section
+func routeByMatcher(config *GraterConfig, plugin Plugin, kind, name string,
+	value interface{}) error {
+	expr, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("message_matcher must be a string")
+	}
+	matcher, err := NewMessageMatcher(expr)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "filter":
+		config.FilterMatchers[plugin.(Filter)] = matcher
+	case "output":
+		config.OutputMatchers[name] = matcher
+	default:
+		return fmt.Errorf("message_matcher isn't supported for %ss",
+			kind)
+	}
+	return nil
+}
+
+// Loads the config at path and checks that it's usable, w/o opening any
+// sockets or starting the pipeline. Returns ConfigErrors listing every
+// problem found, or nil if the config is valid.
+func ValidateConfig(path string) error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		if errs, ok := err.(ConfigErrors); ok {
+			return errs
+		}
+		return ConfigErrors{err.Error()}
+	}
+	errs := make(ConfigErrors, 0)
+	if _, ok := config.Decoders[config.DefaultDecoder]; !ok {
+		errs = append(errs, fmt.Sprintf("default decoder '%s' doesn't exist",
+			config.DefaultDecoder))
+	}
+	if _, ok := config.FilterChains[config.DefaultFilterChain]; !ok {
+		errs = append(errs, fmt.Sprintf("default filter chain '%s' doesn't "+
+			"exist", config.DefaultFilterChain))
+	}
+	for _, name := range config.DefaultOutputs {
+		if _, ok := config.Outputs[name]; !ok {
+			errs = append(errs, fmt.Sprintf("default output '%s' doesn't "+
+				"exist", name))
+		}
+	}
+	switch config.StagedStart {
+	case "", StagedStartAuto:
+	case StagedStartManual:
+		if !config.AllowControl {
+			errs = append(errs, "staged_start 'manual' requires "+
+				"allow_control, to release the inputs")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown staged_start mode '%s'",
+			config.StagedStart))
+	}
+	for name, output := range config.Outputs {
+		encoding, ok := output.(interface {
+			encoderRef() string
+		})
+		if !ok || encoding.encoderRef() == "" {
+			continue
+		}
+		if _, ok = config.Encoders[encoding.encoderRef()]; !ok {
+			errs = append(errs, fmt.Sprintf("output '%s': encoder '%s' doesn't "+
+				"exist", name, encoding.encoderRef()))
+		}
+	}
+	for name, decoder := range config.Decoders {
+		chaining, ok := decoder.(interface {
+			decoderRefs() []string
+		})
+		if !ok {
+			continue
+		}
+		for _, ref := range chaining.decoderRefs() {
+			if _, ok = config.Decoders[ref]; !ok {
+				errs = append(errs, fmt.Sprintf("decoder '%s': decoder '%s' "+
+					"doesn't exist", name, ref))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
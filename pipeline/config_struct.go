@@ -0,0 +1,463 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ByteSize is a number of bytes. In configs it can be a plain number or
+// a string w/ a unit, e.g. "64MB"; K, M, G and T (w/ or w/o a trailing B
+// or iB) are powers of 1024.
+type ByteSize int64
+
+var byteSizeUnits = map[string]int64{
+	"": 1, "B": 1,
+	"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+	"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+	"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+	"T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+}
+
+// Parses a size like "512", "64MB" or "1.5GiB"
+func ParseByteSize(str string) (ByteSize, error) {
+	str = strings.TrimSpace(str)
+	split := strings.IndexFunc(str, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if split == -1 {
+		split = len(str)
+	}
+	multiplier, ok := byteSizeUnits[strings.ToUpper(strings.TrimSpace(
+		str[split:]))]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit: %s", str[split:])
+	}
+	number, err := strconv.ParseFloat(str[:split], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", str)
+	}
+	size := number * float64(multiplier)
+	if size > math.MaxInt64 {
+		return 0, fmt.Errorf("size too large: %s", str)
+	}
+	return ByteSize(size), nil
+}
+
+// Percent is a percentage, e.g. 12.5 for 12.5%. In configs it can be a
+// plain number or a string w/ a trailing %, e.g. "12.5%".
+type Percent float64
+
+// Returns the percentage as a fraction, e.g. 0.125 for 12.5%
+func (self Percent) Fraction() float64 {
+	return float64(self) / 100
+}
+
+// Parses a percentage like "12.5%" or "12.5"
+func ParsePercent(str string) (Percent, error) {
+	str = strings.TrimSuffix(strings.TrimSpace(str), "%")
+	number, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage: %s", str)
+	}
+	return Percent(number), nil
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	byteSizeType = reflect.TypeOf(ByteSize(0))
+	percentType  = reflect.TypeOf(Percent(0))
+)
+
+// Units a plain number can be given in for a time.Duration field
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// LoadConfigStruct fills in the exported fields of the struct target
+// points to from a plugin config, so plugins can declare their settings
+// rather than picking them out of the PluginConfig by hand. Each field is
+// read from the setting of the same name (or the name in its `config`
+// tag; "-" skips the field). Other tags:
+//
+//	default:"..."  value used when the setting is missing, parsed as if
+//	               it had been given as a string
+//	required:"true"  the setting must be present
+//	min:"...", max:"..."  inclusive bounds for numbers, durations and
+//	                      sizes
+//	choices:"a,b,c"  the values a string setting may have
+//	unit:"ms"  unit of plain numbers given for a time.Duration, which
+//	           otherwise are seconds; strings are parsed w/
+//	           time.ParseDuration, e.g. "1m30s"
+//
+// Supported field types are strings, bools, ints, uints, floats,
+// []string, time.Duration, ByteSize and Percent. The error for a bad
+// setting names it, e.g. `FlushInterval: must be at least 1s`, so callers
+// only need to add the plugin name.
+func LoadConfigStruct(config *PluginConfig, target interface{}) error {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Struct {
+		return errors.New("LoadConfigStruct needs a pointer to a struct")
+	}
+	value := ptr.Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		key := field.Name
+		if tag := field.Tag.Get("config"); tag == "-" {
+			continue
+		} else if tag != "" {
+			key = tag
+		}
+		raw, ok := (*config)[key]
+		if !ok {
+			if field.Tag.Get("required") == "true" {
+				return fmt.Errorf("Missing %s", key)
+			}
+			if raw, ok = field.Tag.Lookup("default"); !ok {
+				continue
+			}
+		}
+		if err := setConfigField(value.Field(i), field, raw); err != nil {
+			return fmt.Errorf("%s: %s", key, err.Error())
+		}
+		if err := checkConfigField(value.Field(i), field); err != nil {
+			return fmt.Errorf("%s: %s", key, err.Error())
+		}
+	}
+	return nil
+}
+
+// Converts a duration setting. Plain numbers are multiples of unit.
+func configDuration(raw interface{}, unit time.Duration) (time.Duration,
+	error) {
+	if str, ok := raw.(string); ok {
+		if duration, err := time.ParseDuration(str); err == nil {
+			return duration, nil
+		}
+		if _, err := strconv.ParseFloat(str, 64); err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", str)
+		}
+	}
+	number, err := toFloat64(raw)
+	if err != nil {
+		return 0, errors.New("must be a duration, e.g. \"10s\"")
+	}
+	return time.Duration(number * float64(unit)), nil
+}
+
+func configByteSize(raw interface{}) (ByteSize, error) {
+	switch v := raw.(type) {
+	case string:
+		return ParseByteSize(v)
+	case int64:
+		return ByteSize(v), nil
+	case float64:
+		return ByteSize(v), nil
+	}
+	return 0, errors.New("must be a size, e.g. \"64MB\"")
+}
+
+func configPercent(raw interface{}) (Percent, error) {
+	if str, ok := raw.(string); ok {
+		return ParsePercent(str)
+	}
+	number, err := toFloat64(raw)
+	if err != nil {
+		return 0, errors.New("must be a percentage, e.g. \"50%\"")
+	}
+	return Percent(number), nil
+}
+
+func configInt(raw interface{}) (int64, error) {
+	switch v := raw.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v), nil
+		}
+	case string:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i, nil
+		}
+	}
+	return 0, errors.New("must be a whole number")
+}
+
+// Converts a raw setting to the field's type and stores it
+func setConfigField(value reflect.Value, field reflect.StructField,
+	raw interface{}) error {
+	switch value.Type() {
+	case durationType:
+		unit := time.Second
+		if tag := field.Tag.Get("unit"); tag != "" {
+			var ok bool
+			if unit, ok = durationUnits[tag]; !ok {
+				return fmt.Errorf("unknown duration unit: %s", tag)
+			}
+		}
+		duration, err := configDuration(raw, unit)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(duration))
+		return nil
+	case byteSizeType:
+		size, err := configByteSize(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(size))
+		return nil
+	case percentType:
+		percent, err := configPercent(raw)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(float64(percent))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		str, ok := raw.(string)
+		if !ok {
+			return errors.New("must be a string")
+		}
+		value.SetString(str)
+	case reflect.Bool:
+		switch v := raw.(type) {
+		case bool:
+			value.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return errors.New("must be true or false")
+			}
+			value.SetBool(b)
+		default:
+			return errors.New("must be true or false")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		i, err := configInt(raw)
+		if err != nil {
+			return err
+		}
+		if value.OverflowInt(i) {
+			return fmt.Errorf("%d is out of range", i)
+		}
+		value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		i, err := configInt(raw)
+		if err != nil {
+			return err
+		}
+		if i < 0 || value.OverflowUint(uint64(i)) {
+			return fmt.Errorf("%d is out of range", i)
+		}
+		value.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat64(raw)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type: %s", value.Type())
+		}
+		var strs []string
+		switch v := raw.(type) {
+		case []string:
+			strs = v
+		case string:
+			// Defaults are comma separated
+			strs = strings.Split(v, ",")
+		default:
+			return errors.New("must be a list of strings")
+		}
+		value.Set(reflect.ValueOf(strs).Convert(value.Type()))
+	default:
+		return fmt.Errorf("unsupported setting type: %s", value.Type())
+	}
+	return nil
+}
+
+// Compares a field w/ a bound parsed from a tag, returning -1, 0 or 1
+func compareConfigBound(value reflect.Value, field reflect.StructField,
+	bound string) (int, error) {
+	parsed := reflect.New(value.Type()).Elem()
+	if err := setConfigField(parsed, field, bound); err != nil {
+		return 0, fmt.Errorf("invalid bound %s: %s", bound, err.Error())
+	}
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		switch {
+		case value.Int() < parsed.Int():
+			return -1, nil
+		case value.Int() > parsed.Int():
+			return 1, nil
+		}
+		return 0, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		switch {
+		case value.Uint() < parsed.Uint():
+			return -1, nil
+		case value.Uint() > parsed.Uint():
+			return 1, nil
+		}
+		return 0, nil
+	case reflect.Float32, reflect.Float64:
+		return compareFloats(value.Float(), parsed.Float()), nil
+	}
+	return 0, fmt.Errorf("bounds don't apply to %s", value.Type())
+}
+
+// Checks a field against its min, max and choices tags
+func checkConfigField(value reflect.Value, field reflect.StructField) error {
+	if bound, ok := field.Tag.Lookup("min"); ok {
+		cmp, err := compareConfigBound(value, field, bound)
+		if err != nil {
+			return err
+		}
+		if cmp < 0 {
+			return fmt.Errorf("must be at least %s", bound)
+		}
+	}
+	if bound, ok := field.Tag.Lookup("max"); ok {
+		cmp, err := compareConfigBound(value, field, bound)
+		if err != nil {
+			return err
+		}
+		if cmp > 0 {
+			return fmt.Errorf("must be at most %s", bound)
+		}
+	}
+	if choices, ok := field.Tag.Lookup("choices"); ok {
+		for _, choice := range strings.Split(choices, ",") {
+			if value.String() == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s, not %s",
+			strings.Replace(choices, ",", ", ", -1), value.String())
+	}
+	return nil
+}
+
+// ConfigDuration reads a duration setting for plugins that don't use
+// LoadConfigStruct. Strings are parsed w/ time.ParseDuration, e.g. "10s",
+// and plain numbers are multiples of unit, so settings that used to be
+// bare numbers keep their meaning. Returns def if the setting is missing.
+func ConfigDuration(config *PluginConfig, key string, unit,
+	def time.Duration) (time.Duration, error) {
+	raw, ok := (*config)[key]
+	if !ok {
+		return def, nil
+	}
+	duration, err := configDuration(raw, unit)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", key, err.Error())
+	}
+	return duration, nil
+}
+
+// ConfigByteSize reads a size setting, e.g. "64MB" (see ByteSize), for
+// plugins that don't use LoadConfigStruct. Returns def if the setting is
+// missing.
+func ConfigByteSize(config *PluginConfig, key string,
+	def ByteSize) (ByteSize, error) {
+	raw, ok := (*config)[key]
+	if !ok {
+		return def, nil
+	}
+	size, err := configByteSize(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", key, err.Error())
+	}
+	return size, nil
+}
+
+// ConfigSeverity reads a severity setting, either a number or a syslog
+// level name such as "warning" (see SeverityFromString). Returns def if
+// the setting is missing.
+func ConfigSeverity(config *PluginConfig, key string, def int) (int, error) {
+	switch value := (*config)[key].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		if SeverityName(int(value)) != "" {
+			return int(value), nil
+		}
+	case string:
+		severity, err := SeverityFromString(value)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", key, err.Error())
+		}
+		return severity, nil
+	}
+	return 0, fmt.Errorf("%s must be a severity from %d to %d or its name",
+		key, SEVERITY_EMERGENCY, SEVERITY_DEBUG)
+}
+
+// ConfigPercent reads a percentage setting, e.g. "12.5%" (see Percent),
+// for plugins that don't use LoadConfigStruct. Returns def if the setting
+// is missing.
+func ConfigPercent(config *PluginConfig, key string,
+	def Percent) (Percent, error) {
+	raw, ok := (*config)[key]
+	if !ok {
+		return def, nil
+	}
+	percent, err := configPercent(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", key, err.Error())
+	}
+	return percent, nil
+}
+
+// ConfigInt reads a whole number setting for plugins that don't use
+// LoadConfigStruct, so a mistyped value is a config error rather than a
+// panic. Returns def if the setting is missing.
+func ConfigInt(config *PluginConfig, key string, def int64) (int64, error) {
+	raw, ok := (*config)[key]
+	if !ok {
+		return def, nil
+	}
+	i, err := configInt(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", key, err.Error())
+	}
+	return i, nil
+}
@@ -0,0 +1,155 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	"time"
+)
+
+type testConfigStruct struct {
+	Name     string        `required:"true"`
+	Mode     string        `default:"fast" choices:"fast,slow"`
+	Count    int           `default:"10" min:"1" max:"100"`
+	Interval time.Duration `default:"5s" unit:"ms"`
+	Limit    ByteSize      `default:"1MB"`
+	Tags     []string      `default:"a,b"`
+	Verbose  bool
+	internal string
+}
+
+func ConfigStructSpec(c gospec.Context) {
+	c.Specify("LoadConfigStruct", func() {
+		conf := new(testConfigStruct)
+
+		c.Specify("fills in defaults", func() {
+			config := PluginConfig{"Name": "x"}
+			err := LoadConfigStruct(&config, conf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(conf.Mode, gs.Equals, "fast")
+			c.Expect(conf.Count, gs.Equals, 10)
+			c.Expect(conf.Interval, gs.Equals, 5*time.Second)
+			c.Expect(conf.Limit, gs.Equals, ByteSize(1<<20))
+			c.Expect(len(conf.Tags), gs.Equals, 2)
+			c.Expect(conf.Verbose, gs.Equals, false)
+		})
+
+		c.Specify("reads settings", func() {
+			config := PluginConfig{"Name": "x", "Count": int64(20),
+				"Interval": int64(250), "Limit": "64KiB", "Verbose": true,
+				"Tags": []string{"c"}}
+			err := LoadConfigStruct(&config, conf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(conf.Count, gs.Equals, 20)
+			c.Expect(conf.Interval, gs.Equals, 250*time.Millisecond)
+			c.Expect(conf.Limit, gs.Equals, ByteSize(64<<10))
+			c.Expect(conf.Verbose, gs.Equals, true)
+			c.Expect(conf.Tags[0], gs.Equals, "c")
+		})
+
+		c.Specify("parses duration strings", func() {
+			config := PluginConfig{"Name": "x", "Interval": "1m30s"}
+			err := LoadConfigStruct(&config, conf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(conf.Interval, gs.Equals, 90*time.Second)
+		})
+
+		c.Specify("names the setting in errors", func() {
+			config := PluginConfig{}
+			err := LoadConfigStruct(&config, conf)
+			c.Expect(err.Error(), gs.Equals, "Missing Name")
+
+			config = PluginConfig{"Name": "x", "Count": int64(0)}
+			err = LoadConfigStruct(&config, conf)
+			c.Expect(err.Error(), gs.Equals, "Count: must be at least 1")
+
+			config = PluginConfig{"Name": "x", "Mode": "medium"}
+			err = LoadConfigStruct(&config, conf)
+			c.Expect(err.Error(), gs.Equals,
+				"Mode: must be one of fast, slow, not medium")
+
+			config = PluginConfig{"Name": "x", "Limit": "12XB"}
+			err = LoadConfigStruct(&config, conf)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			config = PluginConfig{"Name": 5}
+			err = LoadConfigStruct(&config, conf)
+			c.Expect(err.Error(), gs.Equals, "Name: must be a string")
+		})
+
+		c.Specify("rejects non-struct targets", func() {
+			config := PluginConfig{}
+			err := LoadConfigStruct(&config, conf.Name)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("Config value helpers", func() {
+		config := PluginConfig{"Interval": int64(30), "Timeout": "1.5s",
+			"Bad": "soon", "Size": int64(512), "Buffer": "2 MiB",
+			"Share": "12.5%", "Ratio": 40.0}
+
+		c.Specify("keep the legacy unit for plain numbers", func() {
+			interval, err := ConfigDuration(&config, "Interval", time.Second, 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(interval, gs.Equals, 30*time.Second)
+		})
+
+		c.Specify("parse duration strings", func() {
+			timeout, err := ConfigDuration(&config, "Timeout", time.Second, 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(timeout, gs.Equals, 1500*time.Millisecond)
+			_, err = ConfigDuration(&config, "Bad", time.Second, 0)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fall back to the default", func() {
+			missing, err := ConfigDuration(&config, "Missing", time.Second,
+				time.Minute)
+			c.Expect(err, gs.IsNil)
+			c.Expect(missing, gs.Equals, time.Minute)
+		})
+
+		c.Specify("parse sizes", func() {
+			size, err := ConfigByteSize(&config, "Size", 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(size, gs.Equals, ByteSize(512))
+			size, err = ConfigByteSize(&config, "Buffer", 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(size, gs.Equals, ByteSize(2<<20))
+		})
+
+		c.Specify("parse percentages", func() {
+			percent, err := ConfigPercent(&config, "Share", 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(percent, gs.Equals, Percent(12.5))
+			c.Expect(percent.Fraction(), gs.Equals, 0.125)
+			percent, err = ConfigPercent(&config, "Ratio", 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(percent, gs.Equals, Percent(40))
+		})
+
+		c.Specify("reject non-integers", func() {
+			interval, err := ConfigInt(&config, "Interval", 0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(interval, gs.Equals, int64(30))
+			_, err = ConfigInt(&config, "Timeout", 0)
+			c.Expect(err, gs.Not(gs.IsNil))
+			missing, err := ConfigInt(&config, "Missing", 3)
+			c.Expect(err, gs.IsNil)
+			c.Expect(missing, gs.Equals, int64(3))
+		})
+	})
+}
@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the fields network inputs stamp w/ where a message came from,
+// so filters can route or rate limit on it. Each is configurable w/ the
+// setting of the same name, and an empty name leaves that field out:
+//
+//	RemoteAddrField    "remote_addr"    the peer's IP address
+//	LocalPortField     "local_port"     the port the message arrived on
+//	TlsCipherField     "tls_cipher"     the TLS cipher suite, if any
+//	TlsPeerCnField     "tls_peer_cn"    the CN of the client certificate
+//	ConnectionIdField  "connection_id"  unique to each connection
+//
+// Fields that don't apply to an input, e.g. a connection ID for UDP, or
+// to a connection, e.g. TLS fields on a plain connection, aren't set.
+type ConnFieldNames struct {
+	RemoteAddr   string
+	LocalPort    string
+	TlsCipher    string
+	TlsPeerCn    string
+	ConnectionId string
+}
+
+// Reads the field names from a plugin config, falling back to the
+// defaults
+func NewConnFieldNames(config *PluginConfig) *ConnFieldNames {
+	self := &ConnFieldNames{"remote_addr", "local_port", "tls_cipher",
+		"tls_peer_cn", "connection_id"}
+	for setting, name := range map[string]*string{
+		"RemoteAddrField":   &self.RemoteAddr,
+		"LocalPortField":    &self.LocalPort,
+		"TlsCipherField":    &self.TlsCipher,
+		"TlsPeerCnField":    &self.TlsPeerCn,
+		"ConnectionIdField": &self.ConnectionId,
+	} {
+		if value, ok := (*config)[setting]; ok {
+			*name = value.(string)
+		}
+	}
+	return self
+}
+
+// A record and the fields of the connection it came from
+type connRecord struct {
+	data   []byte
+	fields map[string]interface{}
+}
+
+// Process start time and counter, making connection IDs unique across
+// restarts
+var (
+	connectionIdPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+	lastConnectionId   uint64
+)
+
+// Returns a new connection ID
+func NewConnectionId() string {
+	id := atomic.AddUint64(&lastConnectionId, 1)
+	return connectionIdPrefix + "-" + strconv.FormatUint(id, 10)
+}
+
+// Returns the fields for a connection, given its remote and local
+// addresses ("host:port"). Any of the arguments can be empty or nil if
+// unknown.
+func (self *ConnFieldNames) Fields(remote, local string,
+	tlsState *tls.ConnectionState, connectionId string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if self.RemoteAddr != "" && remote != "" {
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+		fields[self.RemoteAddr] = remote
+	}
+	if self.LocalPort != "" && local != "" {
+		if _, port, err := net.SplitHostPort(local); err == nil {
+			if portNum, err := strconv.ParseInt(port, 10, 64); err == nil {
+				fields[self.LocalPort] = portNum
+			}
+		}
+	}
+	if tlsState != nil {
+		if self.TlsCipher != "" {
+			fields[self.TlsCipher] = tls.CipherSuiteName(tlsState.CipherSuite)
+		}
+		if self.TlsPeerCn != "" && len(tlsState.PeerCertificates) > 0 {
+			fields[self.TlsPeerCn] =
+				tlsState.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	if self.ConnectionId != "" && connectionId != "" {
+		fields[self.ConnectionId] = connectionId
+	}
+	return fields
+}
@@ -0,0 +1,342 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages of this type are handled by the pipeline itself rather than
+// being filtered and delivered, if the config allows it (see
+// GraterConfig.AllowControl). Their "command" field is "disable" or
+// "enable", and "plugin_kind" ("input" or "output") and "plugin_name" say
+// which plugin it applies to, "drain" (see pluginSwitches.Drain), or
+// "release" to release the inputs held by a staged start (see
+// StagedStartManual).
+const controlMessageType = "heka.control"
+
+// How long a drain waits for open connections to be closed by their
+// clients, unless the control message's "timeout" field (in seconds) says
+// otherwise
+const defaultDrainWait = 5 * time.Minute
+
+// Inputs that accept connections implement ConnectionAcceptor, so a drain
+// can turn new connections away while the open ones finish
+type ConnectionAcceptor interface {
+	StopAccepting()
+	OpenConnections() int
+}
+
+// Inputs embed acceptTracker to keep track of their open connections and
+// stop their listener for a drain
+type acceptTracker struct {
+	open    int64
+	stopped int32
+	peers   map[string]int
+	lock    sync.Mutex
+}
+
+func (self *acceptTracker) OpenConnections() int {
+	return int(atomic.LoadInt64(&self.open))
+}
+
+// Records a new connection from a peer, e.g. an edge hekad's address or
+// certificate CN
+func (self *acceptTracker) opened(peer string) {
+	atomic.AddInt64(&self.open, 1)
+	self.lock.Lock()
+	if self.peers == nil {
+		self.peers = make(map[string]int)
+	}
+	self.peers[peer]++
+	self.lock.Unlock()
+}
+
+func (self *acceptTracker) closed(peer string) {
+	atomic.AddInt64(&self.open, -1)
+	self.lock.Lock()
+	if self.peers[peer]--; self.peers[peer] <= 0 {
+		delete(self.peers, peer)
+	}
+	self.lock.Unlock()
+}
+
+// Returns the number of open connections from each peer
+func (self *acceptTracker) Peers() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	peers := make(map[string]interface{}, len(self.peers))
+	for peer, count := range self.peers {
+		peers[peer] = int64(count)
+	}
+	return peers
+}
+
+// Returns the host part of a connection's remote address
+func peerHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// Closes the listener. Accept errors after this mean the input is done
+// accepting rather than something going wrong.
+func (self *acceptTracker) stopListener(listener net.Listener) {
+	atomic.StoreInt32(&self.stopped, 1)
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+func (self *acceptTracker) accepting() bool {
+	return atomic.LoadInt32(&self.stopped) == 0
+}
+
+// pluginSwitches tracks which inputs and outputs have been disabled by
+// control messages. A disabled input isn't read from and a disabled
+// output isn't delivered to (and is drained when it's disabled) until
+// it's enabled again. The disabled set is saved to the state dir (see
+// GraterConfig.StateDir) as soon as it changes, so a restart doesn't
+// re-enable a plugin that was taken out of service. While the inputs are
+// held for a staged start they're all disabled.
+type pluginSwitches struct {
+	config   *GraterConfig
+	state    *StateStore
+	disabled map[string]bool
+	draining bool
+	held     bool
+	lock     sync.RWMutex
+}
+
+func switchesPath(dir string) string {
+	return filepath.Join(dir, "pipeline.state")
+}
+
+func drainedPath(dir string) string {
+	return filepath.Join(dir, "drained")
+}
+
+// Returns the switches for a pipeline, w/ any disabled set saved by a
+// previous run
+func newPluginSwitches(config *GraterConfig) *pluginSwitches {
+	self := &pluginSwitches{config: config, state: NewStateStore(),
+		disabled: make(map[string]bool)}
+	dir := config.stateDir()
+	if dir == "" {
+		return self
+	}
+	// A drain only lasts until the process stops
+	os.Remove(drainedPath(dir))
+	err := self.state.load(switchesPath(dir))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error loading disabled plugins: %s\n", err.Error())
+	}
+	if value, ok := self.state.Get("disabled"); ok {
+		var keys []string
+		if err = json.Unmarshal(value, &keys); err != nil {
+			log.Printf("Error loading disabled plugins: %s\n", err.Error())
+		}
+		for _, key := range keys {
+			self.disabled[key] = true
+			log.Printf("Plugin disabled by an earlier run: %s\n", key)
+		}
+	}
+	return self
+}
+
+// Returns whether the plugin of the given kind and name is disabled
+func (self *pluginSwitches) Disabled(kind, name string) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.held && kind == "input" {
+		return true
+	}
+	return self.disabled[kind+" "+name]
+}
+
+// Saves the disabled set. Must be called w/ the lock held.
+func (self *pluginSwitches) save() error {
+	dir := self.config.stateDir()
+	if dir == "" {
+		return nil
+	}
+	keys := make([]string, 0, len(self.disabled))
+	for key := range self.disabled {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	value, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	self.state.Set("disabled", value)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return self.state.save(switchesPath(dir))
+}
+
+// Disables or enables a plugin
+func (self *pluginSwitches) Set(kind, name string, disabled bool) error {
+	var plugin interface{}
+	var ok bool
+	switch kind {
+	case "input":
+		plugin, ok = self.config.Inputs[name]
+	case "output":
+		plugin, ok = self.config.Outputs[name]
+	default:
+		return fmt.Errorf("Can't disable %s plugins", kind)
+	}
+	if !ok {
+		return fmt.Errorf("No such %s: %s", kind, name)
+	}
+	key := kind + " " + name
+	self.lock.Lock()
+	if disabled {
+		self.disabled[key] = true
+	} else {
+		delete(self.disabled, key)
+	}
+	err := self.save()
+	self.lock.Unlock()
+	if disabled {
+		log.Printf("Disabled %s\n", key)
+		// Flush whatever the output has buffered, rather than holding it
+		// until it's enabled again
+		if drainer, ok := plugin.(Drainer); ok && kind == "output" {
+			go func() {
+				if drainErr := drainer.Drain(); drainErr != nil {
+					log.Printf("Error draining %s: %s\n", key,
+						drainErr.Error())
+				}
+			}()
+		}
+	} else {
+		log.Printf("Enabled %s\n", key)
+	}
+	if err != nil {
+		return fmt.Errorf("Error saving disabled plugins: %s", err.Error())
+	}
+	return nil
+}
+
+// Carries out the command in a control message
+func (self *pluginSwitches) Handle(msg *Message) error {
+	command, _ := msg.Fields["command"].(string)
+	kind, _ := msg.Fields["plugin_kind"].(string)
+	name, _ := msg.Fields["plugin_name"].(string)
+	switch command {
+	case "disable":
+		return self.Set(kind, name, true)
+	case "enable":
+		return self.Set(kind, name, false)
+	case "drain":
+		wait := defaultDrainWait
+		if seconds, err := toFloat64(msg.Fields["timeout"]); err == nil {
+			wait = time.Duration(seconds * float64(time.Second))
+		}
+		return self.Drain(wait)
+	case "release":
+		return self.Release()
+	}
+	return fmt.Errorf("Unknown control command: %s", command)
+}
+
+// Prepares the process to be stopped w/o losing data, e.g. for a rolling
+// restart of aggregators behind a load balancer. Inputs that accept
+// connections stop doing so, and once their open connections have been
+// closed by the clients (or the wait is up) and the messages in flight
+// are through the pipeline, every plugin is drained as on shutdown. The
+// process then logs that it's safe to stop and, if there's a state dir,
+// creates a "drained" file in it for scripts to watch for. Everything
+// else carries on as normal, so connectionless inputs like UDP still
+// deliver.
+func (self *pluginSwitches) Drain(wait time.Duration) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.draining {
+		return errors.New("Already draining")
+	}
+	self.draining = true
+	go self.drain(wait)
+	return nil
+}
+
+func (self *pluginSwitches) drain(wait time.Duration) {
+	log.Println("Draining for shutdown")
+	acceptors := make(map[string]ConnectionAcceptor)
+	for name, input := range self.config.Inputs {
+		if acceptor, ok := input.(ConnectionAcceptor); ok {
+			acceptor.StopAccepting()
+			acceptors[name] = acceptor
+			log.Printf("Stopped accepting connections on %s\n", name)
+		}
+	}
+	deadline := time.Now().Add(wait)
+	lastLog := time.Now()
+	for {
+		open := 0
+		for _, acceptor := range acceptors {
+			open += acceptor.OpenConnections()
+		}
+		inFlight := atomic.LoadInt64(&inFlightPacks)
+		if open == 0 && inFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Gave up waiting for %d connections to close\n", open)
+			break
+		}
+		if time.Since(lastLog) >= 10*time.Second {
+			log.Printf("Draining: %d connections open, %d messages in "+
+				"flight\n", open, inFlight)
+			lastLog = time.Now()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	timeout := self.config.DrainTimeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	// Connections that wouldn't close may have left messages in flight;
+	// give them a chance to reach the outputs before the plugins are
+	// drained
+	if inFlight := waitIdle(timeout); inFlight > 0 {
+		log.Printf("Gave up waiting for %d messages in flight\n", inFlight)
+	}
+	drainPlugins(pipelinePlugins(self.config), timeout)
+	if dir := self.config.stateDir(); dir != "" {
+		err := ioutil.WriteFile(drainedPath(dir),
+			[]byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+		if err != nil {
+			log.Printf("Error marking drain complete: %s\n", err.Error())
+		}
+	}
+	log.Println("Drain complete, safe to stop")
+}
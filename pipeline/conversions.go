@@ -0,0 +1,184 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"log"
+	"regexp"
+	"strconv"
+)
+
+var conversionRegex = regexp.MustCompile(`^\s*Fields\[([^\]]+)\]\s+as\s+(\w+)\s*$`)
+
+// A FieldConversion coerces a message field to a specific type, so that
+// filters don't each have to cope with producers that send numbers as
+// strings (or vice versa).
+type FieldConversion struct {
+	Name string
+	Type string
+}
+
+// Parses a conversion spec of the form "Fields[name] as type", where type
+// is one of int, int64, float, float32, float64, bool or string.
+func ParseFieldConversion(spec string) (*FieldConversion, error) {
+	matches := conversionRegex.FindStringSubmatch(spec)
+	if matches == nil {
+		return nil, fmt.Errorf("Invalid field conversion: %s", spec)
+	}
+	conversion := &FieldConversion{Name: matches[1], Type: matches[2]}
+	switch conversion.Type {
+	case "int", "int64", "float", "float32", "float64", "bool", "string":
+	default:
+		return nil, fmt.Errorf("Unsupported field conversion type: %s",
+			conversion.Type)
+	}
+	return conversion, nil
+}
+
+// MatchedConversions are the conversions of a `field_conversions` entry,
+// applied to the messages its `message_matcher` picks out before they go
+// through their filter chain, e.g.
+//
+//	"field_conversions": [
+//		{"message_matcher": "Type == 'nginx.access'",
+//		 "conversions": ["Fields[status] as int", "Fields[rate] as float"]}
+//	]
+type MatchedConversions struct {
+	Matcher     *MessageMatcher
+	Conversions []*FieldConversion
+}
+
+// Parses a `field_conversions` entry
+func NewMatchedConversions(entry PluginConfig) (*MatchedConversions, error) {
+	expr, ok := entry["message_matcher"].(string)
+	if !ok {
+		return nil, fmt.Errorf("message_matcher must be a string")
+	}
+	matcher, err := NewMessageMatcher(expr)
+	if err != nil {
+		return nil, err
+	}
+	specs, ok := entry["conversions"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("conversions must be a list of " +
+			"\"Fields[name] as type\" strings")
+	}
+	matched := &MatchedConversions{Matcher: matcher}
+	for _, spec := range specs {
+		str, ok := spec.(string)
+		if !ok {
+			return nil, fmt.Errorf("conversions must be a list of " +
+				"\"Fields[name] as type\" strings")
+		}
+		conversion, err := ParseFieldConversion(str)
+		if err != nil {
+			return nil, err
+		}
+		matched.Conversions = append(matched.Conversions, conversion)
+	}
+	return matched, nil
+}
+
+// Converts the fields of a message that matches, logging any that can't
+// be converted
+func (self *MatchedConversions) Apply(router *Router, msg *Message) {
+	if !router.Match(self.Matcher, msg) {
+		return
+	}
+	for _, conversion := range self.Conversions {
+		if err := conversion.Apply(msg); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("can't convert %T to a number", value)
+}
+
+// Converts the named field in place. Messages without the field are left
+// untouched.
+func (self *FieldConversion) Apply(msg *Message) error {
+	value, ok := msg.Fields[self.Name]
+	if !ok {
+		return nil
+	}
+	var converted interface{}
+	var err error
+	switch self.Type {
+	case "string":
+		converted = fmt.Sprint(value)
+	case "bool":
+		if s, isString := value.(string); isString {
+			converted, err = strconv.ParseBool(s)
+		} else {
+			var f float64
+			f, err = toFloat64(value)
+			converted = f != 0
+		}
+	default:
+		s, isString := value.(string)
+		if isString && (self.Type == "int" || self.Type == "int64") {
+			// Parse integers directly to avoid float precision loss
+			var i int64
+			if i, err = strconv.ParseInt(s, 0, 64); err == nil {
+				if self.Type == "int" {
+					converted = int(i)
+				} else {
+					converted = i
+				}
+				break
+			}
+		}
+		var f float64
+		if f, err = toFloat64(value); err != nil {
+			break
+		}
+		switch self.Type {
+		case "int":
+			converted = int(f)
+		case "int64":
+			converted = int64(f)
+		case "float32":
+			converted = float32(f)
+		default:
+			converted = f
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error converting Fields[%s] to %s: %s", self.Name,
+			self.Type, err.Error())
+	}
+	msg.Fields[self.Name] = converted
+	return nil
+}
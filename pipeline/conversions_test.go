@@ -0,0 +1,93 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+)
+
+func ConversionsSpec(c gospec.Context) {
+	msg := getTestMessage()
+
+	c.Specify("A FieldConversion", func() {
+		c.Specify("parses a valid spec", func() {
+			conversion, err := ParseFieldConversion("Fields[rate] as float32")
+			c.Expect(err, gs.IsNil)
+			c.Expect(conversion.Name, gs.Equals, "rate")
+			c.Expect(conversion.Type, gs.Equals, "float32")
+		})
+
+		c.Specify("rejects unknown types", func() {
+			_, err := ParseFieldConversion("Fields[rate] as decimal")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("converts numeric strings", func() {
+			msg.Fields["status"] = "503"
+			conversion, _ := ParseFieldConversion("Fields[status] as int")
+			err := conversion.Apply(msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.Fields["status"], gs.Equals, 503)
+		})
+
+		c.Specify("converts between numeric types", func() {
+			msg.Fields["rate"] = 0.5
+			conversion, _ := ParseFieldConversion("Fields[rate] as float32")
+			conversion.Apply(msg)
+			c.Expect(msg.Fields["rate"], gs.Equals, float32(0.5))
+		})
+
+		c.Specify("returns an error for unparseable values", func() {
+			conversion, _ := ParseFieldConversion("Fields[foo] as int")
+			err := conversion.Apply(msg)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(msg.Fields["foo"], gs.Equals, "bar")
+		})
+
+		c.Specify("ignores missing fields", func() {
+			conversion, _ := ParseFieldConversion("Fields[missing] as int")
+			c.Expect(conversion.Apply(msg), gs.IsNil)
+			_, ok := msg.Fields["missing"]
+			c.Expect(ok, gs.IsFalse)
+		})
+	})
+
+	c.Specify("Matched conversions", func() {
+		entry := PluginConfig{"message_matcher": "Type == 'TEST'",
+			"conversions": []interface{}{"Fields[status] as int"}}
+
+		c.Specify("only convert matching messages", func() {
+			matched, err := NewMatchedConversions(entry)
+			c.Assume(err, gs.IsNil)
+			msg.Fields["status"] = "503"
+			matched.Apply(nil, msg)
+			c.Expect(msg.Fields["status"], gs.Equals, 503)
+
+			msg.Type = "OTHER"
+			msg.Fields["status"] = "503"
+			matched.Apply(nil, msg)
+			c.Expect(msg.Fields["status"], gs.Equals, "503")
+		})
+
+		c.Specify("reject bad entries", func() {
+			entry["conversions"] = []interface{}{"status as int"}
+			_, err := NewMatchedConversions(entry)
+			c.Expect(err, gs.Not(gs.IsNil))
+			delete(entry, "message_matcher")
+			_, err = NewMatchedConversions(entry)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,236 @@
+//go:build !nocsvdecoder
+// +build !nocsvdecoder
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("CsvDecoder", func() interface{} {
+		return new(CsvDecoder)
+	})
+}
+
+// Where a CSV column's values go: a message variable, and for fields the
+// type to convert them to
+type csvColumn struct {
+	variable   string
+	conversion *FieldConversion
+}
+
+// Parses a column mapping like "Hostname" or "Fields[bytes] as int". An
+// empty mapping skips the column.
+func newCsvColumn(mapping string) (*csvColumn, error) {
+	mapping = strings.TrimSpace(mapping)
+	if mapping == "" {
+		return nil, nil
+	}
+	if strings.Contains(mapping, " as ") {
+		conversion, err := ParseFieldConversion(mapping)
+		if err != nil {
+			return nil, err
+		}
+		return &csvColumn{"Fields[" + conversion.Name + "]", conversion}, nil
+	}
+	if !isMessageVariable(mapping) {
+		return nil, fmt.Errorf("Invalid message variable: %s", mapping)
+	}
+	return &csvColumn{variable: mapping}, nil
+}
+
+// CsvDecoder turns rows of CSV or TSV, e.g. from exported spreadsheets or
+// legacy logs, into messages. `Delimiter` is "," by default, or "\t" for
+// TSV. `Columns` maps each column, in order, to a message variable (see
+// MessageVariable), optionally w/ a type for fields as in a field
+// conversion, or to "" to skip it:
+//
+//	["Timestamp", "Hostname", "Fields[path]", "Fields[bytes] as int"]
+//
+// W/ `Header` set instead, the columns are named by a header row: the
+// first record of each file LogfileInput opens (see
+// PipelinePack.FirstRecord), or otherwise the first record the decoder
+// sees from each input. Each column goes to the field of the same name,
+// unless `Mapping` maps the name to something else, e.g. {"ts":
+// "Timestamp", "bytes": "Fields[bytes] as int"}. Header rows are skipped.
+//
+// Timestamps are parsed w/ a TimestampParser for `TimestampLayouts` (RFC
+// 3339 by default) and `Timezone`. Messages get the `Type` "csv" unless a
+// column says otherwise, and the record as their payload.
+type CsvDecoder struct {
+	delimiter rune
+	columns   []*csvColumn
+	header    bool
+	mapping   map[string]*csvColumn
+	parser    *TimestampParser
+	msgType   string
+	// Columns from the header rows, by input name
+	headers map[string][]*csvColumn
+	lock    sync.Mutex
+}
+
+func (self *CsvDecoder) Init(config *PluginConfig) (err error) {
+	self.delimiter = ','
+	if value, ok := (*config)["Delimiter"]; ok {
+		delimiter := []rune(value.(string))
+		if len(delimiter) != 1 || strings.ContainsRune("\"\r\n",
+			delimiter[0]) {
+			return errors.New("CsvDecoder config: Delimiter must be a " +
+				"single character other than a quote or line break")
+		}
+		self.delimiter = delimiter[0]
+	}
+	if value, ok := (*config)["Header"]; ok {
+		self.header = value.(bool)
+	}
+	if value, ok := (*config)["Columns"]; ok && !self.header {
+		for _, mapping := range value.([]string) {
+			column, err := newCsvColumn(mapping)
+			if err != nil {
+				return fmt.Errorf("CsvDecoder config: %s", err.Error())
+			}
+			self.columns = append(self.columns, column)
+		}
+	} else if !self.header {
+		return errors.New("CsvDecoder config: Missing Columns or Header")
+	}
+	self.mapping = make(map[string]*csvColumn)
+	if value, ok := (*config)["Mapping"]; ok {
+		mapping, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.New("CsvDecoder config: Mapping must be an object")
+		}
+		for name, target := range mapping {
+			str, _ := target.(string)
+			if self.mapping[name], err = newCsvColumn(str); err != nil {
+				return fmt.Errorf("CsvDecoder config: %s", err.Error())
+			}
+		}
+	}
+	self.headers = make(map[string][]*csvColumn)
+	var layouts []string
+	switch value := (*config)["TimestampLayouts"].(type) {
+	case string:
+		layouts = []string{value}
+	case []string:
+		layouts = value
+	default:
+		layouts = []string{time.RFC3339Nano}
+	}
+	timezone, _ := (*config)["Timezone"].(string)
+	if self.parser, err = NewTimestampParser(layouts, timezone); err != nil {
+		return fmt.Errorf("CsvDecoder config: %s", err.Error())
+	}
+	self.msgType = "csv"
+	if value, ok := (*config)["Type"]; ok {
+		self.msgType = value.(string)
+	}
+	return nil
+}
+
+// Returns the columns a header row names
+func (self *CsvDecoder) headerColumns(names []string) []*csvColumn {
+	columns := make([]*csvColumn, len(names))
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if column, ok := self.mapping[name]; ok {
+			columns[i] = column
+		} else if name != "" {
+			columns[i] = &csvColumn{variable: "Fields[" + name + "]"}
+		}
+	}
+	return columns
+}
+
+// Sets the column's message variable from a value
+func (self *CsvDecoder) set(msg *Message, column *csvColumn,
+	value string) (err error) {
+	switch column.variable {
+	case "Type":
+		msg.Type = value
+	case "Logger":
+		msg.Logger = value
+	case "Hostname":
+		msg.Hostname = value
+	case "Payload":
+		msg.Payload = value
+	case "Env_version":
+		msg.Env_version = value
+	case "Severity":
+		msg.Severity, err = strconv.Atoi(value)
+	case "Pid":
+		msg.Pid, err = strconv.Atoi(value)
+	case "Timestamp":
+		msg.Timestamp, err = self.parser.Parse(value)
+	default:
+		msg.ReplaceField(column.variable[7:len(column.variable)-1], value)
+		if column.conversion != nil {
+			err = column.conversion.Apply(msg)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", column.variable, err.Error())
+	}
+	return nil
+}
+
+func (self *CsvDecoder) Decode(pipelinePack *PipelinePack) error {
+	reader := csv.NewReader(bytes.NewReader(pipelinePack.MsgBytes))
+	reader.Comma = self.delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	values, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	columns := self.columns
+	if self.header {
+		self.lock.Lock()
+		var ok bool
+		columns, ok = self.headers[pipelinePack.InputName]
+		if !ok || pipelinePack.FirstRecord {
+			self.headers[pipelinePack.InputName] = self.headerColumns(values)
+		}
+		self.lock.Unlock()
+		if !ok || pipelinePack.FirstRecord {
+			// Not a message, so it's dropped
+			pipelinePack.Message = nil
+			return nil
+		}
+	}
+	msg := pipelinePack.Message
+	*msg = Message{Type: self.msgType, Timestamp: time.Now(),
+		Payload: strings.TrimRight(string(pipelinePack.MsgBytes), "\r\n")}
+	for i, value := range values {
+		if i >= len(columns) || columns[i] == nil {
+			continue
+		}
+		if err = self.set(msg, columns[i], value); err != nil {
+			return err
+		}
+	}
+	pipelinePack.Decoded = true
+	return nil
+}
@@ -0,0 +1,70 @@
+//go:build !nocsvdecoder
+// +build !nocsvdecoder
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+)
+
+func init() {
+	pluginSpecs = append(pluginSpecs, CsvDecoderSpec)
+}
+
+func CsvDecoderSpec(c gospec.Context) {
+	decoder := new(CsvDecoder)
+	pipelinePack := &PipelinePack{InputName: "csv", Message: new(Message)}
+	decode := func(record string) error {
+		pipelinePack.MsgBytes = []byte(record)
+		pipelinePack.Message = new(Message)
+		return decoder.Decode(pipelinePack)
+	}
+
+	c.Specify("Maps columns to typed fields", func() {
+		settings := PluginConfig{"Delimiter": "\t", "Columns": []string{
+			"Timestamp", "Hostname", "", "Fields[bytes] as int"}}
+		c.Assume(decoder.Init(&settings), gs.IsNil)
+		err := decode("2013-01-02T03:04:05Z\tweb1\tskipped\t512\n")
+		c.Expect(err, gs.IsNil)
+		msg := pipelinePack.Message
+		c.Expect(msg.Timestamp.Year(), gs.Equals, 2013)
+		c.Expect(msg.Hostname, gs.Equals, "web1")
+		c.Expect(msg.Fields["bytes"], gs.Equals, 512)
+		c.Expect(len(msg.Fields), gs.Equals, 1)
+		c.Expect(decode("nope\tweb1"), gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Reads column names from a header row", func() {
+		mapping := map[string]interface{}{"host": "Hostname",
+			"size": "Fields[size] as float"}
+		settings := PluginConfig{"Header": true, "Mapping": mapping}
+		c.Assume(decoder.Init(&settings), gs.IsNil)
+		c.Expect(decode("host,size,path"), gs.IsNil)
+		c.Expect(pipelinePack.Message, gs.IsNil)
+		c.Expect(decode(`web1,1.5,"/a,b"`), gs.IsNil)
+		msg := pipelinePack.Message
+		c.Expect(msg.Hostname, gs.Equals, "web1")
+		c.Expect(msg.Fields["size"], gs.Equals, 1.5)
+		c.Expect(msg.Fields["path"], gs.Equals, "/a,b")
+		pipelinePack.FirstRecord = true
+		c.Expect(decode("path,host"), gs.IsNil)
+		pipelinePack.FirstRecord = false
+		c.Expect(decode("/c,web2"), gs.IsNil)
+		c.Expect(pipelinePack.Message.Hostname, gs.Equals, "web2")
+	})
+}
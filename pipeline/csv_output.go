@@ -0,0 +1,196 @@
+//go:build !nocsvoutput && !nofileoutput
+// +build !nocsvoutput,!nofileoutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("CsvEncoder", func() interface{} {
+		return new(CsvEncoder)
+	})
+	RegisterPlugin("CsvOutput", func() interface{} {
+		return new(CsvOutput)
+	})
+}
+
+// CsvEncoder emits a row of delimited values per message. `Columns` lists
+// the message variables (see MessageVariable) to write, in order, e.g.
+// ["Timestamp", "Hostname", "Fields[status]"]; missing values are left
+// empty. `Delimiter` is "," by default, or "\t" for TSV.
+//
+// `Quote` is "minimal" (the default) to quote only values containing the
+// delimiter, quotes or line breaks, "all" to quote every value, or "none"
+// to never quote, replacing delimiters and line breaks in values w/
+// spaces. Timestamps are formatted w/ the Go time layout in
+// `TimestampFormat` (RFC 3339 by default), or as seconds or milliseconds
+// since the epoch w/ "epoch" or "epoch_ms".
+type CsvEncoder struct {
+	columns         []string
+	delimiter       string
+	quote           string
+	timestampFormat string
+}
+
+func (self *CsvEncoder) Init(config *PluginConfig) error {
+	value, ok := (*config)["Columns"]
+	if !ok {
+		return errors.New("CsvEncoder config: Missing Columns")
+	}
+	self.columns = value.([]string)
+	for _, column := range self.columns {
+		if !isMessageVariable(column) {
+			return fmt.Errorf("CsvEncoder config: Invalid column: %s", column)
+		}
+	}
+	self.delimiter = ","
+	if value, ok = (*config)["Delimiter"]; ok {
+		self.delimiter = value.(string)
+		if len(self.delimiter) != 1 || strings.ContainsAny(self.delimiter,
+			"\"\r\n") {
+			return errors.New("CsvEncoder config: Delimiter must be a single " +
+				"character other than a quote or line break")
+		}
+	}
+	self.quote = "minimal"
+	if value, ok = (*config)["Quote"]; ok {
+		self.quote = value.(string)
+	}
+	switch self.quote {
+	case "minimal", "all", "none":
+	default:
+		return fmt.Errorf("CsvEncoder config: Unknown Quote: %s", self.quote)
+	}
+	self.timestampFormat = time.RFC3339Nano
+	if value, ok = (*config)["TimestampFormat"]; ok {
+		self.timestampFormat = value.(string)
+	}
+	return nil
+}
+
+func (self *CsvEncoder) formatTime(t time.Time) string {
+	switch self.timestampFormat {
+	case "epoch":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "epoch_ms":
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return t.Format(self.timestampFormat)
+}
+
+func (self *CsvEncoder) formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return self.formatTime(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// Writes value to buffer, quoted as configured
+func (self *CsvEncoder) writeValue(buffer *bytes.Buffer, value string) {
+	switch self.quote {
+	case "none":
+		buffer.WriteString(strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || string(r) == self.delimiter {
+				return ' '
+			}
+			return r
+		}, value))
+		return
+	case "minimal":
+		if !strings.ContainsAny(value, self.delimiter+"\"\r\n") &&
+			!strings.HasPrefix(value, " ") {
+			buffer.WriteString(value)
+			return
+		}
+	}
+	buffer.WriteByte('"')
+	buffer.WriteString(strings.Replace(value, `"`, `""`, -1))
+	buffer.WriteByte('"')
+}
+
+func (self *CsvEncoder) writeRow(buffer *bytes.Buffer, values []string) {
+	for i, value := range values {
+		if i > 0 {
+			buffer.WriteString(self.delimiter)
+		}
+		self.writeValue(buffer, value)
+	}
+	buffer.WriteByte('\n')
+}
+
+// Returns the header row, naming each column after its message variable
+// (or just the field name, for fields)
+func (self *CsvEncoder) Header() []byte {
+	names := make([]string, len(self.columns))
+	for i, column := range self.columns {
+		if strings.HasPrefix(column, "Fields[") {
+			column = column[7 : len(column)-1]
+		}
+		names[i] = column
+	}
+	buffer := new(bytes.Buffer)
+	self.writeRow(buffer, names)
+	return buffer.Bytes()
+}
+
+func (self *CsvEncoder) Encode(pipelinePack *PipelinePack) ([]byte, error) {
+	msg := pipelinePack.Message
+	values := make([]string, len(self.columns))
+	for i, column := range self.columns {
+		if column == "Timestamp" {
+			values[i] = self.formatTime(msg.Timestamp)
+		} else if value, ok := MessageVariable(msg, column); ok {
+			values[i] = self.formatValue(value)
+		}
+	}
+	buffer := new(bytes.Buffer)
+	self.writeRow(buffer, values)
+	return buffer.Bytes(), nil
+}
+
+// CsvOutput is a FileOutput (see its settings for paths, rotation and
+// syncing) that writes messages as rows of a CSV or TSV file w/ a
+// CsvEncoder, configured by the same settings. Unless `Header` is set to
+// false, each new file, including each one started by a rotation, begins
+// w/ a header row naming the columns.
+type CsvOutput struct {
+	FileOutput
+	encoder CsvEncoder
+}
+
+func (self *CsvOutput) Init(config *PluginConfig) error {
+	if err := self.encoder.Init(config); err != nil {
+		return err
+	}
+	if value, ok := (*config)["Header"]; !ok || value.(bool) {
+		self.header = self.encoder.Header()
+	}
+	return self.initFile(config, "CsvOutput", &self.encoder)
+}
@@ -0,0 +1,434 @@
+//go:build !nodashboard
+// +build !nodashboard
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	. "heka/message"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("DashboardOutput", func() interface{} {
+		return new(DashboardOutput)
+	})
+}
+
+// DashboardOutput serves a web page on `Address` giving operators a live
+// view of a running graterd w/o shelling into the box. It's built up from
+// the internal messages routed to the output, so it needs a
+// ReportInterval set and a matcher along the lines of
+//
+//	Type == 'heka.plugin-report' || Type == 'heka.flow-stats' ||
+//	Type == 'heka.alert' || Type == 'heka.stats'
+//
+// and shows:
+//
+//   - the plugins that report (see Reporter), laid out by kind from
+//     inputs to outputs, w/ their counters and the rate each counter went
+//     up by between the last two reports; counters w/ "error", "fail" or
+//     "drop" in their names are highlighted
+//   - the messages and bytes per second flowing to each output, from
+//     FlowStatsFilter rollups
+//   - the latest message of each Type and Logger in `OutputTypes`
+//     (["heka.stats"] by default), i.e. the output of summarizing filters
+//   - the last `MaxAlerts` (50) messages of the types in `AlertTypes`
+//     (["heka.alert", "heka.quarantine"] by default), newest first
+//
+// The page polls /data.json every `RefreshInterval` (5s) for the data.
+type DashboardOutput struct {
+	conf     *DashboardOutputConfig
+	listener net.Listener
+	plugins  map[string]*dashboardPlugin
+	flows    map[string]*dashboardFlow
+	outputs  map[string]*dashboardFilterOutput
+	alerts   []json.RawMessage
+	lock     sync.RWMutex
+}
+
+type DashboardOutputConfig struct {
+	Address         string        `required:"true"`
+	RefreshInterval time.Duration `default:"5s" min:"1s"`
+	MaxAlerts       int           `default:"50" min:"0"`
+	AlertTypes      []string      `default:"heka.alert,heka.quarantine"`
+	OutputTypes     []string      `default:"heka.stats"`
+}
+
+// A plugin as of its latest report
+type dashboardPlugin struct {
+	Kind     string                 `json:"kind"`
+	Name     string                 `json:"name"`
+	Counters map[string]interface{} `json:"counters"`
+	// Per second increase of the numeric counters since the previous
+	// report
+	Rates   map[string]float64 `json:"rates"`
+	Updated time.Time          `json:"updated"`
+}
+
+// The traffic to an output over the latest flow stats interval
+type dashboardFlow struct {
+	Output         string    `json:"output"`
+	Messages       int64     `json:"messages"`
+	Bytes          int64     `json:"bytes"`
+	MessagesPerSec float64   `json:"messages_per_sec"`
+	BytesPerSec    float64   `json:"bytes_per_sec"`
+	Updated        time.Time `json:"updated"`
+}
+
+type dashboardFilterOutput struct {
+	Type    string                 `json:"type"`
+	Logger  string                 `json:"logger"`
+	Payload string                 `json:"payload"`
+	Fields  map[string]interface{} `json:"fields"`
+	Updated time.Time              `json:"updated"`
+}
+
+// Everything served as /data.json
+type dashboardData struct {
+	Plugins []*dashboardPlugin       `json:"plugins"`
+	Flows   []*dashboardFlow         `json:"flows"`
+	Outputs []*dashboardFilterOutput `json:"outputs"`
+	Alerts  []json.RawMessage        `json:"alerts"`
+}
+
+func (self *DashboardOutput) Init(config *PluginConfig) error {
+	self.conf = new(DashboardOutputConfig)
+	if err := LoadConfigStruct(config, self.conf); err != nil {
+		return fmt.Errorf("DashboardOutput config: %s", err.Error())
+	}
+	self.plugins = make(map[string]*dashboardPlugin)
+	self.flows = make(map[string]*dashboardFlow)
+	self.outputs = make(map[string]*dashboardFilterOutput)
+	self.alerts = make([]json.RawMessage, 0, self.conf.MaxAlerts)
+	return nil
+}
+
+// Starts serving the dashboard, reusing an inherited socket if there is
+// one
+func (self *DashboardOutput) Prepare() (err error) {
+	address := self.conf.Address
+	if file := InheritedFile(address); file != nil {
+		self.listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		self.listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", self.servePage)
+	mux.HandleFunc("/data.json", self.serveData)
+	go func() {
+		err := http.Serve(self.listener, mux)
+		log.Printf("DashboardOutput %s stopped: %s\n", address, err.Error())
+	}()
+	return nil
+}
+
+func (self *DashboardOutput) Deliver(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	switch {
+	case msg.Type == pluginReportType:
+		self.updatePlugin(msg)
+	case msg.Type == flowStatsType:
+		if err := self.updateFlows(msg); err != nil {
+			log.Println(NewDeliveryError(pipelinePack, "DashboardOutput", err))
+		}
+	case stringIn(msg.Type, self.conf.AlertTypes):
+		self.addAlert(msg)
+	case stringIn(msg.Type, self.conf.OutputTypes):
+		self.outputs[msg.Type+" "+msg.Logger] = &dashboardFilterOutput{
+			Type:    msg.Type,
+			Logger:  msg.Logger,
+			Payload: msg.Payload,
+			Fields:  msg.Fields,
+			Updated: msg.Timestamp,
+		}
+	}
+}
+
+func stringIn(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called w/ the lock held
+func (self *DashboardOutput) updatePlugin(msg *Message) {
+	kind, _ := msg.Fields["plugin_kind"].(string)
+	name, _ := msg.Fields["plugin_name"].(string)
+	plugin := &dashboardPlugin{
+		Kind:     kind,
+		Name:     name,
+		Counters: make(map[string]interface{}),
+		Rates:    make(map[string]float64),
+		Updated:  msg.Timestamp,
+	}
+	for field, value := range msg.Fields {
+		if field != "plugin_kind" && field != "plugin_name" {
+			plugin.Counters[field] = value
+		}
+	}
+	previous, ok := self.plugins[kind+" "+name]
+	if ok && plugin.Updated.After(previous.Updated) {
+		secs := plugin.Updated.Sub(previous.Updated).Seconds()
+		for field, value := range plugin.Counters {
+			switch value.(type) {
+			case string, bool:
+				// Not a counter
+				continue
+			}
+			current, err := toFloat64(value)
+			if err != nil {
+				continue
+			}
+			if last, err := toFloat64(previous.Counters[field]); err == nil {
+				plugin.Rates[field] = (current - last) / secs
+			}
+		}
+	}
+	self.plugins[kind+" "+name] = plugin
+}
+
+// Must be called w/ the lock held
+func (self *DashboardOutput) updateFlows(msg *Message) error {
+	var stats []*FlowStat
+	if err := json.Unmarshal([]byte(msg.Payload), &stats); err != nil {
+		return fmt.Errorf("Bad flow stats: %s", err.Error())
+	}
+	interval, _ := toFloat64(msg.Fields["interval"])
+	flows := make(map[string]*dashboardFlow)
+	for _, stat := range stats {
+		flow, ok := flows[stat.Output]
+		if !ok {
+			flow = &dashboardFlow{Output: stat.Output, Updated: msg.Timestamp}
+			flows[stat.Output] = flow
+		}
+		flow.Messages += stat.Messages
+		flow.Bytes += stat.Bytes
+	}
+	for output, flow := range flows {
+		if interval > 0 {
+			flow.MessagesPerSec = float64(flow.Messages) / interval
+			flow.BytesPerSec = float64(flow.Bytes) / interval
+		}
+		self.flows[output] = flow
+	}
+	return nil
+}
+
+// Must be called w/ the lock held
+func (self *DashboardOutput) addAlert(msg *Message) {
+	if self.conf.MaxAlerts == 0 {
+		return
+	}
+	msgJson, err := msg.MarshalJSON()
+	if err != nil {
+		return
+	}
+	if len(self.alerts) == self.conf.MaxAlerts {
+		copy(self.alerts, self.alerts[1:])
+		self.alerts = self.alerts[:len(self.alerts)-1]
+	}
+	self.alerts = append(self.alerts, msgJson)
+}
+
+func (self *DashboardOutput) data() *dashboardData {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	data := &dashboardData{
+		Plugins: make([]*dashboardPlugin, 0, len(self.plugins)),
+		Flows:   make([]*dashboardFlow, 0, len(self.flows)),
+		Outputs: make([]*dashboardFilterOutput, 0, len(self.outputs)),
+		Alerts:  make([]json.RawMessage, 0, len(self.alerts)),
+	}
+	for _, plugin := range self.plugins {
+		data.Plugins = append(data.Plugins, plugin)
+	}
+	for _, flow := range self.flows {
+		data.Flows = append(data.Flows, flow)
+	}
+	for _, output := range self.outputs {
+		data.Outputs = append(data.Outputs, output)
+	}
+	for i := len(self.alerts) - 1; i >= 0; i-- {
+		data.Alerts = append(data.Alerts, self.alerts[i])
+	}
+	return data
+}
+
+func (self *DashboardOutput) serveData(w http.ResponseWriter,
+	req *http.Request) {
+	dataJson, err := json.Marshal(self.data())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(dataJson)
+}
+
+func (self *DashboardOutput) servePage(w http.ResponseWriter,
+	req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	refresh := int64(self.conf.RefreshInterval / time.Millisecond)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(strings.Replace(dashboardPage, "{{refresh}}",
+		fmt.Sprint(refresh), 1)))
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>graterd dashboard</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 1em 2em; }
+h2 { font-size: 15px; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 3px 8px; text-align: left;
+  vertical-align: top; }
+#graph { display: flex; align-items: flex-start; }
+.kind { margin-right: 1.5em; }
+.kind h3 { font-size: 13px; text-transform: capitalize; }
+.plugin { border: 1px solid #888; border-radius: 4px; padding: 4px 8px;
+  margin-bottom: 8px; min-width: 12em; }
+.plugin b { display: block; margin-bottom: 3px; }
+.error { color: #c00; font-weight: bold; }
+pre { margin: 0; white-space: pre-wrap; max-width: 60em; }
+</style>
+</head>
+<body>
+<h1>graterd</h1>
+<div id="updated"></div>
+<h2>Plugins</h2>
+<div id="graph"></div>
+<h2>Output throughput</h2>
+<table id="flows"></table>
+<h2>Filter outputs</h2>
+<table id="outputs"></table>
+<h2>Recent alerts</h2>
+<table id="alerts"></table>
+<script>
+var kinds = ["input", "decoder", "filter", "encoder", "output"];
+
+function esc(value) {
+  return String(value).replace(/&/g, "&amp;").replace(/</g, "&lt;")
+    .replace(/>/g, "&gt;").replace(/"/g, "&quot;");
+}
+
+function byName(a, b) {
+  var x = a.name || a.output || a.type, y = b.name || b.output || b.type;
+  return x < y ? -1 : x > y ? 1 : 0;
+}
+
+function isError(counter) {
+  return /error|fail|drop/i.test(counter);
+}
+
+function renderPlugin(plugin) {
+  var html = '<div class="plugin"><b>' + esc(plugin.name) + '</b>';
+  Object.keys(plugin.counters).sort().forEach(function(counter) {
+    var value = plugin.counters[counter], rate = plugin.rates[counter];
+    var cls = isError(counter) && value > 0 ? ' class="error"' : '';
+    html += '<div' + cls + '>' + esc(counter) + ': ' + esc(value);
+    if (rate !== undefined) {
+      html += ' (' + rate.toFixed(2) + '/s)';
+    }
+    html += '</div>';
+  });
+  return html + '</div>';
+}
+
+function renderGraph(plugins) {
+  var html = '';
+  kinds.forEach(function(kind) {
+    var ofKind = plugins.filter(function(p) { return p.kind == kind; });
+    if (ofKind.length == 0) {
+      return;
+    }
+    html += '<div class="kind"><h3>' + kind + 's</h3>';
+    ofKind.sort(byName).forEach(function(p) { html += renderPlugin(p); });
+    html += '</div>';
+  });
+  return html || 'No plugin reports yet, is ReportInterval set?';
+}
+
+function row(cells, header) {
+  var tag = header ? 'th' : 'td';
+  return '<tr>' + cells.map(function(cell) {
+    return '<' + tag + '>' + cell + '</' + tag + '>';
+  }).join('') + '</tr>';
+}
+
+function render(data) {
+  document.getElementById("graph").innerHTML = renderGraph(data.plugins);
+  var html = row(["Output", "Messages/s", "Bytes/s", "As of"], true);
+  data.flows.sort(byName).forEach(function(f) {
+    html += row([esc(f.output), f.messages_per_sec.toFixed(2),
+      f.bytes_per_sec.toFixed(0), esc(f.updated)]);
+  });
+  document.getElementById("flows").innerHTML = html;
+  html = row(["Type", "Logger", "Payload", "Fields", "As of"], true);
+  data.outputs.sort(byName).forEach(function(o) {
+    html += row([esc(o.type), esc(o.logger), '<pre>' + esc(o.payload) +
+      '</pre>', '<pre>' + esc(JSON.stringify(o.fields || {}, null, 1)) +
+      '</pre>', esc(o.updated)]);
+  });
+  document.getElementById("outputs").innerHTML = html;
+  html = row(["Time", "Type", "Severity", "Payload"], true);
+  data.alerts.forEach(function(a) {
+    html += row([esc(a.timestamp), esc(a.type), esc(a.severity),
+      '<pre>' + esc(a.payload) + '</pre>']);
+  });
+  document.getElementById("alerts").innerHTML = html;
+  document.getElementById("updated").innerHTML = "Updated " +
+    esc(new Date().toString());
+}
+
+function refresh() {
+  var req = new XMLHttpRequest();
+  req.onreadystatechange = function() {
+    if (req.readyState == 4 && req.status == 200) {
+      render(JSON.parse(req.responseText));
+    }
+  };
+  req.open("GET", "data.json", true);
+  req.send();
+}
+
+refresh();
+setInterval(refresh, {{refresh}});
+</script>
+</body>
+</html>
+`
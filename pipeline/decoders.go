@@ -16,8 +16,14 @@ package pipeline
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"fmt"
 	"github.com/bitly/go-simplejson"
+	. "heka/message"
 	"log"
+	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -26,43 +32,234 @@ type Decoder interface {
 	Decode(pipelinePack *PipelinePack) error
 }
 
+// W/ GraterConfig.DecodeErrorMessages set, a message that fails to decode
+// is replaced by one of this type, which carries on through the pipeline
+// so decode failures can be filtered, counted and stored like any other
+// message (see QuarantineFilter). Its payload is the error, and its fields
+// "input", "decoder", "error" and "sample" (the start of the undecoded
+// record), plus the fields the input supplied, e.g. "remote_addr".
+const decodeErrorType = "heka.decode-error"
+
+// How much of an undecodable record a decode error message includes
+const decodeErrorSampleSize = 256
+
+// Replaces the pack's message w/ a decode error message
+func setDecodeError(pipelinePack *PipelinePack, decoder string, err error) {
+	sample := pipelinePack.MsgBytes
+	if len(sample) > decodeErrorSampleSize {
+		sample = sample[:decodeErrorSampleSize]
+	}
+	hostname, _ := os.Hostname()
+	*pipelinePack.Message = Message{
+		Type:      decodeErrorType,
+		Timestamp: time.Now(),
+		Logger:    "hekad",
+		Severity:  SEVERITY_WARNING,
+		Payload:   err.Error(),
+		Pid:       os.Getpid(),
+		Hostname:  hostname,
+		Fields: map[string]interface{}{
+			"input":   pipelinePack.InputName,
+			"decoder": decoder,
+			"error":   err.Error(),
+			"sample":  string(sample),
+		},
+	}
+	pipelinePack.Decoded = true
+}
+
 const (
 	timeFormat           = "2006-01-02T15:04:05.000000-07:00"
 	timeFormatFullSecond = "2006-01-02T15:04:05-07:00"
 )
 
+// The keys of the metlog JSON format, and whether they're required in
+// strict mode
+var jsonMessageKeys = map[string]bool{
+	"type":            true,
+	"timestamp":       true,
+	"logger":          false,
+	"severity":        false,
+	"payload":         false,
+	"fields":          false,
+	"env_version":     false,
+	"metlog_pid":      false,
+	"metlog_hostname": false,
+}
+
+// JsonDecoder keeps nested objects and arrays in the message fields as is,
+// unless `FlattenFields` is set, in which case they're flattened into
+// dotted field names (see FlattenFields) so filters can get at them
+// directly.
+//
+// By default values of the wrong type are silently ignored, and a bad
+// timestamp is only logged. W/ a `Mode` of "strict" any problem w/ a
+// message, i.e. an unknown key, a value of the wrong type, a bad timestamp
+// or a missing type or timestamp, fails the decode w/ an error listing
+// them all. W/ a `Mode` of "lenient" as much of the message as possible is
+// decoded, and any problems are summarized in a "decode_errors" field.
 type JsonDecoder struct {
+	flattenFields bool
+	mode          string
 }
 
 func (self *JsonDecoder) Init(config *PluginConfig) error {
+	if value, ok := (*config)["FlattenFields"]; ok {
+		self.flattenFields = value.(bool)
+	}
+	if value, ok := (*config)["Mode"]; ok {
+		self.mode = value.(string)
+		switch self.mode {
+		case "default", "strict", "lenient":
+		default:
+			return fmt.Errorf("JsonDecoder config: Unknown Mode: %s",
+				self.mode)
+		}
+	}
 	return nil
 }
 
+// Reads the metlog JSON keys out of a decoded object, noting any problems
+// w/ them
+type jsonMessageReader struct {
+	values   map[string]interface{}
+	problems []string
+}
+
+func (self *jsonMessageReader) problem(format string, args ...interface{}) {
+	self.problems = append(self.problems, fmt.Sprintf(format, args...))
+}
+
+// Names a decoded JSON value's type, for problem reports
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case float64, json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "an array"
+	}
+	return "an object"
+}
+
+func (self *jsonMessageReader) get(key string) (interface{}, bool) {
+	value, ok := self.values[key]
+	if !ok && jsonMessageKeys[key] {
+		self.problem("missing %s", key)
+	}
+	return value, ok
+}
+
+func (self *jsonMessageReader) str(key string) string {
+	value, ok := self.get(key)
+	if !ok {
+		return ""
+	}
+	str, ok := value.(string)
+	if !ok {
+		self.problem("%s should be a string, not %s", key,
+			jsonTypeName(value))
+	}
+	return str
+}
+
+func (self *jsonMessageReader) int(key string) int {
+	value, ok := self.get(key)
+	if !ok {
+		return 0
+	}
+	switch v := value.(type) {
+	case float64:
+		return int(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+	}
+	if _, isNumber := value.(json.Number); isNumber {
+		self.problem("%s should be a whole number, not %s", key, value)
+	} else {
+		self.problem("%s should be a whole number, not %s", key,
+			jsonTypeName(value))
+	}
+	return 0
+}
+
+func (self *jsonMessageReader) timestamp(key string) time.Time {
+	timeStr := self.str(key)
+	if timeStr == "" {
+		return time.Time{}
+	}
+	for _, format := range []string{timeFormat, timeFormatFullSecond,
+		time.RFC3339Nano} {
+		if t, err := time.Parse(format, timeStr); err == nil {
+			return t
+		}
+	}
+	self.problem("can't parse %s %q", key, timeStr)
+	return time.Time{}
+}
+
 func (self *JsonDecoder) Decode(pipelinePack *PipelinePack) error {
 	msgBytes := pipelinePack.MsgBytes
 	msgJson, err := simplejson.NewJson(msgBytes)
 	if err != nil {
 		return err
 	}
+	values, err := msgJson.Map()
+	if err != nil {
+		return err
+	}
 
+	reader := &jsonMessageReader{values: values}
 	msg := pipelinePack.Message
-	msg.Type = msgJson.Get("type").MustString()
-	timeStr := msgJson.Get("timestamp").MustString()
-	msg.Timestamp, err = time.Parse(timeFormat, timeStr)
-	if err != nil {
-		msg.Timestamp, err = time.Parse(timeFormatFullSecond, timeStr)
-		if err != nil {
-			log.Printf("Timestamp parsing error: %s\n", err.Error())
+	msg.Type = reader.str("type")
+	msg.Timestamp = reader.timestamp("timestamp")
+	msg.Logger = reader.str("logger")
+	msg.Severity = reader.int("severity")
+	msg.Payload = reader.str("payload")
+	msg.Fields = nil
+	if value, ok := reader.get("fields"); ok {
+		if msg.Fields, ok = value.(map[string]interface{}); !ok {
+			reader.problem("fields should be an object, not %s",
+				jsonTypeName(value))
 		}
 	}
-	msg.Logger = msgJson.Get("logger").MustString()
-	msg.Severity = msgJson.Get("severity").MustInt()
-	msg.Payload, _ = msgJson.Get("payload").String()
-	msg.Fields, _ = msgJson.Get("fields").Map()
-	msg.Env_version = msgJson.Get("env_version").MustString()
-	msg.Pid, _ = msgJson.Get("metlog_pid").Int()
-	msg.Hostname, _ = msgJson.Get("metlog_hostname").String()
+	if self.flattenFields {
+		msg.Fields = FlattenFields(msg.Fields)
+	}
+	msg.Env_version = reader.str("env_version")
+	msg.Pid = reader.int("metlog_pid")
+	msg.Hostname = reader.str("metlog_hostname")
+	unknown := make([]string, 0)
+	for key := range values {
+		if _, ok := jsonMessageKeys[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		reader.problem("unknown keys %s", strings.Join(unknown, ", "))
+	}
 
+	if len(reader.problems) > 0 {
+		summary := strings.Join(reader.problems, "; ")
+		switch self.mode {
+		case "strict":
+			return fmt.Errorf("Invalid JSON message: %s", summary)
+		case "lenient":
+			msg.ReplaceField("decode_errors", summary)
+		default:
+			if msg.Timestamp.IsZero() {
+				log.Printf("Error decoding JSON message: %s\n", summary)
+			}
+		}
+	}
 	pipelinePack.Decoded = true
 	return nil
 }
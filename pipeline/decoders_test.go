@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"github.com/orfjackal/gospec/src/gospec"
 	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"time"
 )
 
 func DecodersSpec(c gospec.Context) {
@@ -35,26 +37,60 @@ func DecodersSpec(c gospec.Context) {
 			timestampJson, msg.Logger, msg.Severity, msg.Payload,
 			fieldsJson, msg.Env_version, msg.Pid, msg.Hostname)
 
-		msgBytes := []byte(jsonString)
-		pipelinePack := &PipelinePack{msgBytes}
+		newPack := func(jsonString string) *PipelinePack {
+			return &PipelinePack{MsgBytes: []byte(jsonString),
+				Message: new(Message)}
+		}
+		pipelinePack := newPack(jsonString)
 		jsonDecoder := &JsonDecoder{}
 
 		c.Specify("can decode a JSON message", func() {
-			decodedMsg := jsonDecoder.Decode(pipelinePack)
+			err := jsonDecoder.Decode(pipelinePack)
+			c.Expect(err, gs.IsNil)
+			decodedMsg := pipelinePack.Message
+			c.Expect(decodedMsg.Timestamp.Equal(msg.Timestamp), gs.IsTrue)
+			decodedMsg.Timestamp = msg.Timestamp
 			c.Expect(decodedMsg, gs.Equals, msg)
 		})
 
 		c.Specify("returns `fields` as a map", func() {
-			decodedMsg := jsonDecoder.Decode(pipelinePack)
-			c.Expect(decodedMsg.Fields["foo"], gs.Equals, "bar")
+			jsonDecoder.Decode(pipelinePack)
+			c.Expect(pipelinePack.Message.Fields["foo"], gs.Equals, "bar")
 		})
 
-		c.Specify("returns nil for bogus JSON", func() {
-			badJson := fmt.Sprint("{{", jsonString)
-			msgBytes = []byte(badJson)
-			pipelinePack = &PipelinePack{msgBytes}
-			decodedMsg := jsonDecoder.Decode(pipelinePack)
-			c.Expect(decodedMsg, gs.IsNil)
+		c.Specify("returns an error for bogus JSON", func() {
+			pipelinePack = newPack(fmt.Sprint("{{", jsonString))
+			err := jsonDecoder.Decode(pipelinePack)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		badJson := `{"type":5,"timestamp":"nope","bogus":1}`
+
+		c.Specify("in strict mode", func() {
+			config := PluginConfig{"Mode": "strict"}
+			c.Assume(jsonDecoder.Init(&config), gs.IsNil)
+
+			c.Specify("decodes valid messages", func() {
+				c.Expect(jsonDecoder.Decode(pipelinePack), gs.IsNil)
+			})
+
+			c.Specify("lists every problem w/ a message", func() {
+				err := jsonDecoder.Decode(newPack(badJson))
+				c.Assume(err, gs.Not(gs.IsNil))
+				c.Expect(err.Error(), gs.Equals, "Invalid JSON message: "+
+					"type should be a string, not a number; "+
+					`can't parse timestamp "nope"; unknown keys bogus`)
+			})
+		})
+
+		c.Specify("in lenient mode summarizes problems in a field", func() {
+			config := PluginConfig{"Mode": "lenient"}
+			c.Assume(jsonDecoder.Init(&config), gs.IsNil)
+			pipelinePack = newPack(badJson)
+			c.Expect(jsonDecoder.Decode(pipelinePack), gs.IsNil)
+			c.Expect(pipelinePack.Message.Fields["decode_errors"], gs.Equals,
+				"type should be a string, not a number; "+
+					`can't parse timestamp "nope"; unknown keys bogus`)
 		})
 	})
 
@@ -65,21 +101,97 @@ func DecodersSpec(c gospec.Context) {
 		c.Assume(err, gs.IsNil)
 		decoder := &GobDecoder{}
 		msgBytes := buffer.Bytes()
-		c.Assume(err, gs.IsNil)
-		pipelinePack := &PipelinePack{msgBytes}
+		pipelinePack := &PipelinePack{MsgBytes: msgBytes, Message: new(Message)}
 
 		c.Specify("can decode a gob message", func() {
-			decodedMsg := decoder.Decode(pipelinePack)
+			err := decoder.Decode(pipelinePack)
+			c.Expect(err, gs.IsNil)
+			decodedMsg := pipelinePack.Message
+			c.Expect(decodedMsg.Timestamp.Equal(msg.Timestamp), gs.IsTrue)
+			decodedMsg.Timestamp = msg.Timestamp
 			c.Expect(decodedMsg, gs.Equals, msg)
 		})
 
-		c.Specify("returns nil for bogus gob data", func() {
-			longerBytes := make([]byte, len(msgBytes)+1)
-			copy([]byte{'x'}, longerBytes[0:1])
-			copy(msgBytes[:], longerBytes[1:])
-			pipelinePack := &PipelinePack{longerBytes}
-			decodedMsg := decoder.Decode(pipelinePack)
-			c.Expect(decodedMsg, gs.IsNil)
+		c.Specify("returns an error for bogus gob data", func() {
+			bogusBytes := append([]byte{'x'}, msgBytes...)
+			pipelinePack.MsgBytes = bogusBytes
+			err := decoder.Decode(pipelinePack)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A TimestampDecoder", func() {
+		config := &GraterConfig{Decoders: map[string]Decoder{
+			"json": new(JsonDecoder)}}
+		msgJson := `{"type": "access", "timestamp": ` +
+			`"2013-01-02T03:04:05-08:00", "payload": "[02/Jan/2013:10:00:00] ` +
+			`GET /", "fields": {"time": "1357120800.5"}}`
+		pipelinePack := &PipelinePack{MsgBytes: []byte(msgJson),
+			Message: new(Message), Config: config}
+		decoder := new(TimestampDecoder)
+
+		c.Specify("parses a field", func() {
+			settings := PluginConfig{"Decoder": "json",
+				"Source": "Fields[time]", "Layouts": []string{"unix"}}
+			c.Assume(decoder.Init(&settings), gs.IsNil)
+			c.Expect(decoder.Decode(pipelinePack), gs.IsNil)
+			expected := time.Unix(1357120800, 500000000)
+			c.Expect(pipelinePack.Message.Timestamp.Equal(expected), gs.IsTrue)
+		})
+
+		c.Specify("parses a pattern match in a timezone", func() {
+			settings := PluginConfig{"Decoder": "json",
+				"Pattern": `^\[([^\]]+)\]`, "Timezone": "America/New_York",
+				"Layouts": []string{time.RFC3339, "02/Jan/2006:15:04:05"}}
+			c.Assume(decoder.Init(&settings), gs.IsNil)
+			c.Expect(decoder.Decode(pipelinePack), gs.IsNil)
+			expected := time.Date(2013, 1, 2, 15, 0, 0, 0, time.UTC)
+			c.Expect(pipelinePack.Message.Timestamp.Equal(expected), gs.IsTrue)
+		})
+
+		c.Specify("keeps the decoded timestamp unless Required", func() {
+			settings := PluginConfig{"Decoder": "json", "Source": "Type",
+				"Layouts": "unix"}
+			c.Assume(decoder.Init(&settings), gs.IsNil)
+			c.Expect(decoder.Decode(pipelinePack), gs.IsNil)
+			c.Expect(pipelinePack.Message.Timestamp.Year(), gs.Equals, 2013)
+			decoder.required = true
+			c.Expect(decoder.Decode(pipelinePack), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fills in a missing year", func() {
+			parser, _ := NewTimestampParser([]string{time.Stamp}, "")
+			parser.now = func() time.Time {
+				return time.Date(2013, 1, 2, 0, 0, 0, 0, time.UTC)
+			}
+			t, err := parser.Parse("Dec 31 23:00:00")
+			c.Expect(err, gs.IsNil)
+			c.Expect(t.Year(), gs.Equals, 2012)
+			t, _ = parser.Parse("Jan  2 10:00:00")
+			c.Expect(t.Year(), gs.Equals, 2013)
+		})
+
+		c.Specify("parses localized names", func() {
+			parser, _ := NewTimestampParser([]string{
+				"Monday 2. January 2006 15:04"}, "")
+			c.Assume(parser.SetLocale("de"), gs.IsNil)
+			t, err := parser.Parse("Mittwoch 2. JANUAR 2013 10:00")
+			c.Expect(err, gs.IsNil)
+			c.Expect(t.Month(), gs.Equals, time.January)
+			c.Expect(parser.SetLocale("xx"), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("resolves ambiguous dates by DateOrder", func() {
+			parser, _ := NewTimestampParser([]string{"01/02/2006",
+				"02/01/2006"}, "")
+			c.Assume(parser.SetDateOrder("dmy"), gs.IsNil)
+			t, _ := parser.Parse("05/06/2013")
+			c.Expect(t.Month(), gs.Equals, time.June)
+			t, _ = parser.Parse("06/13/2013")
+			c.Expect(t.Month(), gs.Equals, time.June)
+			c.Assume(parser.SetDateOrder("mdy"), gs.IsNil)
+			t, _ = parser.Parse("05/06/2013")
+			c.Expect(t.Month(), gs.Equals, time.May)
 		})
 	})
 }
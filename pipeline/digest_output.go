@@ -0,0 +1,325 @@
+//go:build !nodigestoutput
+// +build !nodigestoutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("DigestOutput", func() interface{} {
+		return new(DigestOutput)
+	})
+}
+
+// Longest payload used to group errors in a digest
+const digestMaxErrorLength = 200
+
+var defaultDigestTemplate = `Digest for {{.Start.Format "2006-01-02 15:04"}} to {{.End.Format "2006-01-02 15:04"}}
+{{.Total}} messages
+
+Messages by type and logger:
+{{range .Groups}}  {{printf "%8d" .Count}}  {{.Type}} / {{.Logger}}
+{{end}}{{if .TopErrors}}
+Top errors:
+{{range .TopErrors}}  {{printf "%8d" .Count}}  [{{.Type}}] {{.Payload}}
+{{end}}{{end}}`
+
+// A row of a digest's per Type/Logger breakdown
+type DigestGroup struct {
+	Type   string
+	Logger string
+	Count  int64
+}
+
+// An error message that occurred Count times during a digest window
+type DigestError struct {
+	Type    string
+	Payload string
+	Count   int64
+}
+
+// The data a digest template is rendered with
+type Digest struct {
+	Start     time.Time
+	End       time.Time
+	Total     int64
+	Groups    []*DigestGroup
+	TopErrors []*DigestError
+}
+
+// DigestOutput accumulates messages over a long window and then sends a
+// summary of them, counts by Type and Logger plus the most frequent error
+// payloads, by email and/or webhook. Digests are sent every `Interval`
+// seconds (a day by default), or daily at `SendAt` ("HH:MM", local time).
+//
+// Messages w/ a severity of `ErrorSeverity` (3, or "error", by default) or
+// lower are counted as errors; `TopErrors` (10 by default) of them are
+// listed. The summary is rendered w/ the text/template in the `Template`
+// setting, if given. It's emailed to `To` from `From` via `SmtpServer` (w/
+// `SmtpUser` and `SmtpPassword` if set), and POSTed to `WebhookUrl`.
+type DigestOutput struct {
+	dryRunnable
+	interval      time.Duration
+	sendAt        string
+	errorSeverity int
+	topErrors     int
+	template      *template.Template
+	subject       string
+	smtpServer    string
+	smtpUser      string
+	smtpPassword  string
+	from          string
+	to            []string
+	webhookUrl    string
+	msgChan       chan *Message
+	drainChan     chan chan error
+	start         time.Time
+	groups        map[[2]string]*DigestGroup
+	errorCounts   map[[2]string]*DigestError
+	total         int64
+}
+
+func (self *DigestOutput) Init(config *PluginConfig) (err error) {
+	var ok bool
+	var value interface{}
+	self.interval, err = ConfigDuration(config, "Interval", time.Second,
+		24*time.Hour)
+	if err != nil {
+		return fmt.Errorf("DigestOutput config: %s", err.Error())
+	}
+	if value, ok = (*config)["SendAt"]; ok {
+		self.sendAt = value.(string)
+		if _, err = time.Parse("15:04", self.sendAt); err != nil {
+			return fmt.Errorf("DigestOutput config: Invalid SendAt: %s",
+				self.sendAt)
+		}
+	}
+	self.errorSeverity, err = ConfigSeverity(config, "ErrorSeverity",
+		SEVERITY_ERROR)
+	if err != nil {
+		return fmt.Errorf("DigestOutput config: %s", err.Error())
+	}
+	self.topErrors = 10
+	if value, ok = (*config)["TopErrors"]; ok {
+		self.topErrors = int(value.(int64))
+	}
+	templateText := defaultDigestTemplate
+	if value, ok = (*config)["Template"]; ok {
+		templateText = value.(string)
+	}
+	if self.template, err = template.New("digest").Parse(templateText); err != nil {
+		return fmt.Errorf("DigestOutput config: %s", err.Error())
+	}
+	self.subject = "heka digest"
+	if value, ok = (*config)["Subject"]; ok {
+		self.subject = value.(string)
+	}
+	if value, ok = (*config)["SmtpServer"]; ok {
+		self.smtpServer = value.(string)
+		if value, ok = (*config)["From"]; !ok {
+			return errors.New("DigestOutput config: SmtpServer needs From")
+		}
+		self.from = value.(string)
+		if value, ok = (*config)["To"]; !ok {
+			return errors.New("DigestOutput config: SmtpServer needs To")
+		}
+		self.to = value.([]string)
+		if value, ok = (*config)["SmtpUser"]; ok {
+			self.smtpUser = value.(string)
+			self.smtpPassword, _ = (*config)["SmtpPassword"].(string)
+		}
+	}
+	if value, ok = (*config)["WebhookUrl"]; ok {
+		self.webhookUrl = value.(string)
+	}
+	if self.smtpServer == "" && self.webhookUrl == "" {
+		return errors.New("DigestOutput config: Missing SmtpServer or " +
+			"WebhookUrl")
+	}
+	self.msgChan = make(chan *Message, 1000)
+	self.drainChan = make(chan chan error)
+	self.reset()
+	go self.collector()
+	return nil
+}
+
+func (self *DigestOutput) reset() {
+	self.start = time.Now()
+	self.groups = make(map[[2]string]*DigestGroup)
+	self.errorCounts = make(map[[2]string]*DigestError)
+	self.total = 0
+}
+
+func (self *DigestOutput) Deliver(pipelinePack *PipelinePack) {
+	// Copied, since the pack will be recycled as soon as Deliver returns
+	msg := new(Message)
+	pipelinePack.Message.Copy(msg)
+	self.msgChan <- msg
+}
+
+func (self *DigestOutput) add(msg *Message) {
+	self.total++
+	key := [2]string{msg.Type, msg.Logger}
+	group, ok := self.groups[key]
+	if !ok {
+		group = &DigestGroup{Type: msg.Type, Logger: msg.Logger}
+		self.groups[key] = group
+	}
+	group.Count++
+	if msg.Severity > self.errorSeverity {
+		return
+	}
+	payload := strings.TrimSpace(msg.Payload)
+	if len(payload) > digestMaxErrorLength {
+		payload = payload[:digestMaxErrorLength] + "..."
+	}
+	key = [2]string{msg.Type, payload}
+	digestError, ok := self.errorCounts[key]
+	if !ok {
+		digestError = &DigestError{Type: msg.Type, Payload: payload}
+		self.errorCounts[key] = digestError
+	}
+	digestError.Count++
+}
+
+// Returns the summary of the current window
+func (self *DigestOutput) digest() *Digest {
+	digest := &Digest{Start: self.start, End: time.Now(), Total: self.total}
+	for _, group := range self.groups {
+		digest.Groups = append(digest.Groups, group)
+	}
+	sort.Slice(digest.Groups, func(i, j int) bool {
+		return digest.Groups[i].Count > digest.Groups[j].Count
+	})
+	for _, digestError := range self.errorCounts {
+		digest.TopErrors = append(digest.TopErrors, digestError)
+	}
+	sort.Slice(digest.TopErrors, func(i, j int) bool {
+		return digest.TopErrors[i].Count > digest.TopErrors[j].Count
+	})
+	if len(digest.TopErrors) > self.topErrors {
+		digest.TopErrors = digest.TopErrors[:self.topErrors]
+	}
+	return digest
+}
+
+// Renders and sends the current window's digest, if anything happened
+func (self *DigestOutput) send() error {
+	if self.total == 0 {
+		self.reset()
+		return nil
+	}
+	buffer := new(bytes.Buffer)
+	err := self.template.Execute(buffer, self.digest())
+	self.reset()
+	if err != nil {
+		return err
+	}
+	if self.dryRun.Skip(buffer.Bytes()) {
+		return nil
+	}
+	if self.smtpServer != "" {
+		if err = self.sendMail(buffer.Bytes()); err != nil {
+			log.Printf("DigestOutput error sending mail: %s\n", err.Error())
+		}
+	}
+	if self.webhookUrl != "" {
+		resp, postErr := http.Post(self.webhookUrl, "text/plain",
+			bytes.NewReader(buffer.Bytes()))
+		if postErr == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				postErr = fmt.Errorf("POST %s: %s", self.webhookUrl, resp.Status)
+			}
+		}
+		if postErr != nil {
+			log.Printf("DigestOutput error posting digest: %s\n",
+				postErr.Error())
+			err = postErr
+		}
+	}
+	return err
+}
+
+func (self *DigestOutput) sendMail(body []byte) error {
+	var auth smtp.Auth
+	if self.smtpUser != "" {
+		host, _, _ := net.SplitHostPort(self.smtpServer)
+		auth = smtp.PlainAuth("", self.smtpUser, self.smtpPassword, host)
+	}
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", self.from,
+		strings.Join(self.to, ", "), self.subject)
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(body)
+	return smtp.SendMail(self.smtpServer, auth, self.from, self.to,
+		msg.Bytes())
+}
+
+// Returns how long until the next digest is due
+func (self *DigestOutput) untilNext(now time.Time) time.Duration {
+	if self.sendAt == "" {
+		return self.interval
+	}
+	at, _ := time.Parse("15:04", self.sendAt)
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(),
+		at.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Sub(now)
+}
+
+// Sends whatever has been collected so far, so it isn't lost on shutdown
+func (self *DigestOutput) Drain() error {
+	done := make(chan error)
+	self.drainChan <- done
+	return <-done
+}
+
+func (self *DigestOutput) collector() {
+	timer := time.NewTimer(self.untilNext(time.Now()))
+	for {
+		select {
+		case msg := <-self.msgChan:
+			self.add(msg)
+		case <-timer.C:
+			if err := self.send(); err != nil {
+				log.Printf("DigestOutput error: %s\n", err.Error())
+			}
+			timer.Reset(self.untilNext(time.Now()))
+		case done := <-self.drainChan:
+			for queued := len(self.msgChan); queued > 0; queued-- {
+				self.add(<-self.msgChan)
+			}
+			done <- self.send()
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+func getJson(rawUrl string, result interface{}) error {
+	resp, err := discoveryClient.Get(rawUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawUrl, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// ConsulResolver returns the addresses of the healthy instances of a
+// Consul service
+type ConsulResolver struct {
+	ConsulAddress string // e.g. "127.0.0.1:8500"
+	Service       string
+}
+
+func (self *ConsulResolver) Resolve() ([]string, error) {
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	rawUrl := fmt.Sprintf("http://%s/v1/health/service/%s?passing",
+		self.ConsulAddress, url.QueryEscape(self.Service))
+	if err := getJson(rawUrl, &entries); err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		addrs = append(addrs, fmt.Sprintf("%s:%d", host, entry.Service.Port))
+	}
+	return addrs, nil
+}
+
+type etcdNode struct {
+	Key   string
+	Value string
+	Dir   bool
+	Nodes []etcdNode
+}
+
+// EtcdResolver returns the addresses stored as the values of the keys in
+// an etcd directory, e.g. /heka/aggregators/agg1 = "10.0.0.1:5565"
+type EtcdResolver struct {
+	EtcdAddress string // e.g. "127.0.0.1:2379"
+	Dir         string
+}
+
+func (self *EtcdResolver) Resolve() ([]string, error) {
+	var result struct {
+		Node etcdNode
+	}
+	rawUrl := fmt.Sprintf("http://%s/v2/keys/%s", self.EtcdAddress,
+		strings.TrimPrefix(self.Dir, "/"))
+	if err := getJson(rawUrl, &result); err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(result.Node.Nodes))
+	for _, node := range result.Node.Nodes {
+		if !node.Dir && node.Value != "" {
+			addrs = append(addrs, node.Value)
+		}
+	}
+	// Keep the order stable so unchanged lists don't look like changes
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// Prefixes the names of the files a ConfigFragmentWatcher writes, so it
+// only ever removes its own files and never ones written by hand
+const fragmentFilePrefix = "consul-"
+
+// ConfigFragmentWatcher mirrors the keys under a Consul KV prefix into
+// *.json files in a local config directory (see LoadConfig), named
+// "consul-" plus the key below the prefix w/ "/"s replaced by "_"s, e.g.
+// "outputs/es.json" becomes "consul-outputs_es.json". Other files in the
+// directory are left alone. When the fragments change, and Restart is
+// set, a graceful restart is triggered (as w/ SIGUSR2) so the new config
+// takes effect. An empty prefix is taken to be a mistake, e.g. a KV
+// store that's been wiped, so the files are left as they are.
+type ConfigFragmentWatcher struct {
+	ConsulAddress string
+	Prefix        string
+	Dir           string
+	Interval      time.Duration
+	Restart       bool
+}
+
+// Returns the file name for a fragment's key
+func (self *ConfigFragmentWatcher) fileName(key string) string {
+	prefix := strings.Trim(self.Prefix, "/")
+	name := strings.Trim(strings.TrimPrefix(strings.Trim(key, "/"), prefix),
+		"/")
+	return fragmentFilePrefix + strings.Replace(name, "/", "_", -1)
+}
+
+// Fetches the current fragments, keyed by file name
+func (self *ConfigFragmentWatcher) fetch() (map[string][]byte, error) {
+	var entries []struct {
+		Key   string
+		Value string
+	}
+	rawUrl := fmt.Sprintf("http://%s/v1/kv/%s?recurse", self.ConsulAddress,
+		strings.TrimPrefix(self.Prefix, "/"))
+	if err := getJson(rawUrl, &entries); err != nil {
+		return nil, err
+	}
+	fragments := make(map[string][]byte)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Key, ".json") {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(entry.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding %s: %s", entry.Key,
+				err.Error())
+		}
+		name := self.fileName(entry.Key)
+		if _, ok := fragments[name]; ok {
+			return nil, fmt.Errorf("More than one key maps to %s", name)
+		}
+		fragments[name] = value
+	}
+	return fragments, nil
+}
+
+// Writes the fragments to the config directory, removing the ones it
+// wrote that have gone away. Returns whether anything changed.
+func (self *ConfigFragmentWatcher) sync(fragments map[string][]byte) (bool,
+	error) {
+	if len(fragments) == 0 {
+		return false, fmt.Errorf("No config fragments under %s, leaving "+
+			"the config as it is", self.Prefix)
+	}
+	changed := false
+	existing, _ := filepath.Glob(filepath.Join(self.Dir,
+		fragmentFilePrefix+"*.json"))
+	for _, path := range existing {
+		if _, ok := fragments[filepath.Base(path)]; !ok {
+			if err := os.Remove(path); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+	for name, contents := range fragments {
+		path := filepath.Join(self.Dir, name)
+		if current, err := ioutil.ReadFile(path); err == nil &&
+			string(current) == string(contents) {
+			continue
+		}
+		if err := ioutil.WriteFile(path+".tmp", contents, 0644); err != nil {
+			return changed, err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// Fetches and writes the fragments once, returning whether anything
+// changed. Run before the config is loaded, so it starts out current.
+func (self *ConfigFragmentWatcher) Sync() (bool, error) {
+	fragments, err := self.fetch()
+	if err != nil {
+		return false, fmt.Errorf("Error fetching config fragments: %s",
+			err.Error())
+	}
+	changed, err := self.sync(fragments)
+	if err != nil {
+		return changed, fmt.Errorf("Error writing config fragments: %s",
+			err.Error())
+	}
+	return changed, nil
+}
+
+// Polls for config fragment changes until the process exits
+func (self *ConfigFragmentWatcher) Watch() {
+	ticker := time.NewTicker(self.Interval)
+	for _ = range ticker.C {
+		changed, err := self.Sync()
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		if changed {
+			log.Printf("Config fragments under %s changed\n", self.Prefix)
+			if self.Restart {
+				syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+				return
+			}
+		}
+	}
+}
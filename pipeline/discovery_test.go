@@ -0,0 +1,69 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func ConfigFragmentWatcherSpec(c gospec.Context) {
+	dir, err := ioutil.TempDir("", "fragments")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(dir)
+	watcher := &ConfigFragmentWatcher{Prefix: "/heka/config/", Dir: dir}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	c.Specify("Fragment files are named for their whole key", func() {
+		c.Expect(watcher.fileName("heka/config/outputs/es.json"), gs.Equals,
+			"consul-outputs_es.json")
+		c.Expect(watcher.fileName("/heka/config/main.json"), gs.Equals,
+			"consul-main.json")
+	})
+
+	c.Specify("Only the watcher's own files are removed", func() {
+		ioutil.WriteFile(filepath.Join(dir, "local.json"), []byte("{}"), 0644)
+		changed, err := watcher.sync(map[string][]byte{
+			"consul-a.json": []byte("{}"), "consul-b.json": []byte("{}")})
+		c.Expect(err, gs.IsNil)
+		c.Expect(changed, gs.IsTrue)
+
+		changed, err = watcher.sync(map[string][]byte{
+			"consul-a.json": []byte("{}")})
+		c.Expect(err, gs.IsNil)
+		c.Expect(changed, gs.IsTrue)
+		c.Expect(exists("consul-a.json"), gs.IsTrue)
+		c.Expect(exists("consul-b.json"), gs.IsFalse)
+		c.Expect(exists("local.json"), gs.IsTrue)
+
+		changed, err = watcher.sync(map[string][]byte{
+			"consul-a.json": []byte("{}")})
+		c.Expect(err, gs.IsNil)
+		c.Expect(changed, gs.IsFalse)
+	})
+
+	c.Specify("An empty set of fragments isn't synced", func() {
+		watcher.sync(map[string][]byte{"consul-a.json": []byte("{}")})
+		changed, err := watcher.sync(map[string][]byte{})
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(changed, gs.IsFalse)
+		c.Expect(exists("consul-a.json"), gs.IsTrue)
+	})
+}
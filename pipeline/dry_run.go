@@ -0,0 +1,95 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// The first few records skipped by a dry run are logged in full (up to
+	// dryRunSampleSize bytes each), after which just the totals are
+	// logged every dryRunLogInterval
+	dryRunSamples     = 5
+	dryRunSampleSize  = 512
+	dryRunLogInterval = time.Minute
+)
+
+// Outputs supporting the `dry_run` output section setting implement
+// DryRunner. The config loader hands them a DryRun when it's set; outputs
+// w/o support for it fail to load rather than silently writing.
+type DryRunner interface {
+	SetDryRun(dryRun *DryRun)
+}
+
+// DryRun stands in for an output's final write when its `dry_run` setting
+// is true, so a new output config can be tried against production traffic
+// safely: messages are still encoded, batched and queued as usual, but
+// instead of reaching the network or disk the records are counted and
+// sampled to the log.
+type DryRun struct {
+	name    string
+	records int64
+	bytes   int64
+	logged  int64
+	lastLog time.Time
+	lock    sync.Mutex
+}
+
+func NewDryRun(name string) *DryRun {
+	return &DryRun{name: name, lastLog: time.Now()}
+}
+
+// Returns whether the records should be skipped, recording them if so.
+// Always false for a nil DryRun, i.e. when the output isn't in a dry run,
+// so outputs can call it unconditionally right before writing.
+func (self *DryRun) Skip(records ...[]byte) bool {
+	if self == nil {
+		return false
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, record := range records {
+		self.records++
+		self.bytes += int64(len(record))
+		if self.records <= dryRunSamples {
+			sample := record
+			if len(sample) > dryRunSampleSize {
+				sample = sample[:dryRunSampleSize]
+			}
+			log.Printf("%s (dry run) would have written %d bytes: %q\n",
+				self.name, len(record), sample)
+		}
+	}
+	if time.Since(self.lastLog) >= dryRunLogInterval &&
+		self.records > self.logged {
+		log.Printf("%s (dry run) would have written %d records (%d bytes) "+
+			"so far\n", self.name, self.records, self.bytes)
+		self.logged = self.records
+		self.lastLog = time.Now()
+	}
+	return true
+}
+
+// Outputs embed dryRunnable to implement DryRunner, and check
+// self.dryRun.Skip before each write
+type dryRunnable struct {
+	dryRun *DryRun
+}
+
+func (self *dryRunnable) SetDryRun(dryRun *DryRun) {
+	self.dryRun = dryRun
+}
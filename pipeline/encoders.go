@@ -0,0 +1,192 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"path"
+	"sync"
+)
+
+// Encoders serialize messages for outputs, so that any output can be
+// paired w/ any serialization format via config.
+type Encoder interface {
+	Plugin
+	Encode(pipelinePack *PipelinePack) ([]byte, error)
+}
+
+// PayloadEncoder emits the message payload followed by a newline
+type PayloadEncoder struct {
+}
+
+func (self *PayloadEncoder) Init(config *PluginConfig) error {
+	return nil
+}
+
+func (self *PayloadEncoder) Encode(pipelinePack *PipelinePack) ([]byte, error) {
+	payload := pipelinePack.Message.Payload
+	msgBytes := make([]byte, len(payload)+1)
+	copy(msgBytes, payload)
+	msgBytes[len(payload)] = '\n'
+	return msgBytes, nil
+}
+
+// JsonEncoder emits newline delimited metlog JSON. If `UnflattenFields`
+// is set, dotted field names are turned back into nested objects, which
+// restores the original document for messages decoded by a JsonDecoder
+// w/ FlattenFields set.
+type JsonEncoder struct {
+	unflattenFields bool
+}
+
+func (self *JsonEncoder) Init(config *PluginConfig) error {
+	if value, ok := (*config)["UnflattenFields"]; ok {
+		self.unflattenFields = value.(bool)
+	}
+	return nil
+}
+
+func (self *JsonEncoder) Encode(pipelinePack *PipelinePack) ([]byte, error) {
+	msg := pipelinePack.Message
+	if self.unflattenFields {
+		unflattened := *msg
+		unflattened.Fields = UnflattenFields(msg.Fields)
+		msg = &unflattened
+	}
+	msgBytes, err := msg.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return append(msgBytes, '\n'), nil
+}
+
+// GobEncoder emits length framed gobs (see EncodeFramedGob). W/
+// `Compression` set to "gzip" gobs of at least `CompressionMinSize` bytes
+// (1024 by default) are compressed (see CompressFrame), which readers
+// using heka framing undo transparently.
+type GobEncoder struct {
+	compression string
+	minSize     int
+}
+
+func (self *GobEncoder) Init(config *PluginConfig) error {
+	var err error
+	self.compression, self.minSize, err = configFrameCompression(config)
+	if err != nil {
+		return fmt.Errorf("GobEncoder config: %s", err.Error())
+	}
+	return nil
+}
+
+func (self *GobEncoder) Encode(pipelinePack *PipelinePack) ([]byte, error) {
+	frame, err := EncodeFramedGob(pipelinePack.Message)
+	if err != nil || self.compression == "" {
+		return frame, err
+	}
+	return CompressFrame(frame, self.compression, self.minSize), nil
+}
+
+// Outputs embed EncodingOutput to get their serialization format from the
+// `Encoder` config setting, which names one of the configured encoders.
+// Since plugins are initialized before the pipeline config is complete,
+// the named encoder is looked up on first use.
+//
+// Outputs that only need a few fields can project them w/ the
+// `IncludeFields` and `ExcludeFields` settings, lists of glob patterns
+// (e.g. "http.*") matched against field names. A field is encoded if it
+// matches any include pattern (or there are none) and no exclude pattern;
+// the rest are left out of what the encoder sees.
+type EncodingOutput struct {
+	encoderName   string
+	encoder       Encoder
+	once          sync.Once
+	includeFields []string
+	excludeFields []string
+}
+
+// Reads the `Encoder` config setting, falling back to defaultEncoder if
+// it's not specified, and the field projection settings
+func (self *EncodingOutput) InitEncoder(config *PluginConfig,
+	defaultEncoder Encoder) error {
+	if value, ok := (*config)["Encoder"]; ok {
+		self.encoderName = value.(string)
+	} else {
+		self.encoder = defaultEncoder
+	}
+	if value, ok := (*config)["IncludeFields"]; ok {
+		self.includeFields = value.([]string)
+	}
+	if value, ok := (*config)["ExcludeFields"]; ok {
+		self.excludeFields = value.([]string)
+	}
+	for _, pattern := range append(self.includeFields,
+		self.excludeFields...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid field pattern: %s", pattern)
+		}
+	}
+	return nil
+}
+
+func matchesAnyField(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the fields the output is configured to encode
+func (self *EncodingOutput) projectFields(
+	fields map[string]interface{}) map[string]interface{} {
+	projected := make(map[string]interface{})
+	for name, value := range fields {
+		if len(self.includeFields) > 0 &&
+			!matchesAnyField(self.includeFields, name) {
+			continue
+		}
+		if !matchesAnyField(self.excludeFields, name) {
+			projected[name] = value
+		}
+	}
+	return projected
+}
+
+// Returns the name of the configured encoder, or "" for the default
+func (self *EncodingOutput) encoderRef() string {
+	return self.encoderName
+}
+
+func (self *EncodingOutput) Encode(pipelinePack *PipelinePack) ([]byte, error) {
+	self.once.Do(func() {
+		if self.encoder == nil {
+			self.encoder = pipelinePack.Config.Encoders[self.encoderName]
+		}
+	})
+	if self.encoder == nil {
+		return nil, fmt.Errorf("Encoder doesn't exist: %s", self.encoderName)
+	}
+	if self.includeFields == nil && self.excludeFields == nil {
+		return self.encoder.Encode(pipelinePack)
+	}
+	// The pack and message are shared w/ the other outputs, so the
+	// projection is encoded from shallow copies of them
+	projectedMsg := *pipelinePack.Message
+	projectedMsg.Fields = self.projectFields(projectedMsg.Fields)
+	projectedPack := *pipelinePack
+	projectedPack.Message = &projectedMsg
+	return self.encoder.Encode(&projectedPack)
+}
@@ -0,0 +1,491 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A FieldExpression computes a value from a message, e.g.
+//
+//	(end_ts - start_ts) / 1e6
+//	floor(Fields[size] / 1024)
+//	lower(Hostname) + ':' + Pid
+//
+// Operands are numbers, quoted strings, message variables (see
+// MessageVariable) and bare field names, which are short for Fields[name].
+// The operators are +, -, *, / and %, w/ the usual precedence and
+// parentheses; + concatenates if either side is a string. Arithmetic on
+// two integers gives an integer, except for /, which always gives a
+// float. The functions are floor, ceil and round (giving integers), abs,
+// min, max, int, float, string, lower, upper and len.
+type FieldExpression struct {
+	expr string
+	root exprNode
+}
+
+type exprNode interface {
+	eval(msg *Message) (interface{}, error)
+}
+
+type exprConst struct{ value interface{} }
+type exprVariable struct{ name string }
+type exprNegate struct{ operand exprNode }
+
+type exprBinary struct {
+	op          byte
+	left, right exprNode
+}
+
+type exprCall struct {
+	name string
+	fn   exprFunc
+	args []exprNode
+}
+
+func (self *exprConst) eval(msg *Message) (interface{}, error) {
+	return self.value, nil
+}
+
+func (self *exprVariable) eval(msg *Message) (interface{}, error) {
+	value, ok := MessageVariable(msg, self.name)
+	if !ok {
+		return nil, fmt.Errorf("%s is missing", self.name)
+	}
+	// Settle on int64, float64, string and bool
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	case int64, float64, string, bool:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%s is a %T", self.name, value)
+}
+
+func (self *exprNegate) eval(msg *Message) (interface{}, error) {
+	value, err := self.operand.eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := value.(int64); ok {
+		return -i, nil
+	}
+	f, err := toFloat64(value)
+	return -f, err
+}
+
+func (self *exprBinary) eval(msg *Message) (interface{}, error) {
+	left, err := self.left.eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	right, err := self.right.eval(msg)
+	if err != nil {
+		return nil, err
+	}
+	if self.op == '+' {
+		_, leftIsString := left.(string)
+		_, rightIsString := right.(string)
+		if leftIsString || rightIsString {
+			return exprString(left) + exprString(right), nil
+		}
+	}
+	leftInt, leftIsInt := left.(int64)
+	rightInt, rightIsInt := right.(int64)
+	if leftIsInt && rightIsInt && self.op != '/' {
+		switch self.op {
+		case '+':
+			return leftInt + rightInt, nil
+		case '-':
+			return leftInt - rightInt, nil
+		case '*':
+			return leftInt * rightInt, nil
+		case '%':
+			if rightInt == 0 {
+				return nil, errors.New("modulo by zero")
+			}
+			return leftInt % rightInt, nil
+		}
+	}
+	a, err := toFloat64(left)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toFloat64(right)
+	if err != nil {
+		return nil, err
+	}
+	switch self.op {
+	case '+':
+		return a + b, nil
+	case '-':
+		return a - b, nil
+	case '*':
+		return a * b, nil
+	case '/':
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return a / b, nil
+	}
+	if b == 0 {
+		return nil, errors.New("modulo by zero")
+	}
+	return math.Mod(a, b), nil
+}
+
+func (self *exprCall) eval(msg *Message) (interface{}, error) {
+	args := make([]interface{}, len(self.args))
+	for i, arg := range self.args {
+		value, err := arg.eval(msg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	value, err := self.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", self.name, err.Error())
+	}
+	return value, nil
+}
+
+// Formats a value the way the string function does
+func exprString(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// Returns the floats of numeric arguments
+func exprFloats(args []interface{}) ([]float64, error) {
+	floats := make([]float64, len(args))
+	for i, arg := range args {
+		f, err := toFloat64(arg)
+		if err != nil {
+			return nil, err
+		}
+		floats[i] = f
+	}
+	return floats, nil
+}
+
+type exprFunc struct {
+	minArgs, maxArgs int // maxArgs < 0 means no maximum
+	call             func(args []interface{}) (interface{}, error)
+}
+
+// Wraps a function of one float as an exprFunc giving an integer
+func exprRounding(round func(float64) float64) exprFunc {
+	return exprFunc{1, 1, func(args []interface{}) (interface{}, error) {
+		if i, ok := args[0].(int64); ok {
+			return i, nil
+		}
+		f, err := toFloat64(args[0])
+		return int64(round(f)), err
+	}}
+}
+
+// Wraps min or max as an exprFunc; integers stay integers
+func exprExtreme(pick func(a, b float64) bool) exprFunc {
+	return exprFunc{1, -1, func(args []interface{}) (interface{}, error) {
+		floats, err := exprFloats(args)
+		if err != nil {
+			return nil, err
+		}
+		best := 0
+		for i := range floats {
+			if pick(floats[i], floats[best]) {
+				best = i
+			}
+		}
+		if i, ok := args[best].(int64); ok {
+			return i, nil
+		}
+		return floats[best], nil
+	}}
+}
+
+var exprFuncs = map[string]exprFunc{
+	"floor": exprRounding(math.Floor),
+	"ceil":  exprRounding(math.Ceil),
+	"round": exprRounding(func(f float64) float64 {
+		return math.Floor(f + 0.5)
+	}),
+	"abs": {1, 1, func(args []interface{}) (interface{}, error) {
+		if i, ok := args[0].(int64); ok {
+			if i < 0 {
+				return -i, nil
+			}
+			return i, nil
+		}
+		f, err := toFloat64(args[0])
+		return math.Abs(f), err
+	}},
+	"min": exprExtreme(func(a, b float64) bool { return a < b }),
+	"max": exprExtreme(func(a, b float64) bool { return a > b }),
+	"int": {1, 1, func(args []interface{}) (interface{}, error) {
+		if s, ok := args[0].(string); ok {
+			// Parse integers directly to avoid float precision loss
+			if i, err := strconv.ParseInt(strings.TrimSpace(s), 0, 64); err == nil {
+				return i, nil
+			}
+		}
+		if i, ok := args[0].(int64); ok {
+			return i, nil
+		}
+		f, err := toFloat64(args[0])
+		return int64(f), err
+	}},
+	"float": {1, 1, func(args []interface{}) (interface{}, error) {
+		return toFloat64(args[0])
+	}},
+	"string": {1, 1, func(args []interface{}) (interface{}, error) {
+		return exprString(args[0]), nil
+	}},
+	"lower": {1, 1, func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(exprString(args[0])), nil
+	}},
+	"upper": {1, 1, func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(exprString(args[0])), nil
+	}},
+	"len": {1, 1, func(args []interface{}) (interface{}, error) {
+		return int64(len(exprString(args[0]))), nil
+	}},
+}
+
+// Parses a field expression
+func NewFieldExpression(expr string) (*FieldExpression, error) {
+	parser := &exprParser{}
+	if err := parser.tokenize(expr); err != nil {
+		return nil, fmt.Errorf("Invalid expression %q: %s", expr, err.Error())
+	}
+	root, err := parser.parseSum()
+	if err == nil && parser.pos < len(parser.tokens) {
+		err = fmt.Errorf("unexpected %q", parser.tokens[parser.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression %q: %s", expr, err.Error())
+	}
+	return &FieldExpression{expr, root}, nil
+}
+
+// Returns the expression's value for a message, which is an int64,
+// float64, string or bool. Missing variables are an error.
+func (self *FieldExpression) Eval(msg *Message) (interface{}, error) {
+	return self.root.eval(msg)
+}
+
+func (self *FieldExpression) String() string {
+	return self.expr
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func isExprIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func (self *exprParser) tokenize(input string) error {
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexByte("+-*/%(),", c) >= 0:
+			self.tokens = append(self.tokens, input[i:i+1])
+			i++
+		case c == '\'' || c == '"':
+			// Quoted strings, w/ backslash escaped quotes
+			j := i + 1
+			for ; j < len(input) && input[j] != c; j++ {
+				if input[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(input) {
+				return fmt.Errorf("unterminated %c", c)
+			}
+			self.tokens = append(self.tokens, input[i:j+1])
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.':
+			j := i + 1
+			for ; j < len(input); j++ {
+				d := input[j]
+				isExponentSign := (d == '-' || d == '+') &&
+					(input[j-1] == 'e' || input[j-1] == 'E')
+				if !(d >= '0' && d <= '9' || d == '.' || d == 'e' || d == 'E' ||
+					isExponentSign) {
+					break
+				}
+			}
+			self.tokens = append(self.tokens, input[i:j])
+			i = j
+		case isExprIdentRune(rune(c)):
+			j := i + 1
+			for ; j < len(input) && isExprIdentRune(rune(input[j])); j++ {
+			}
+			if j < len(input) && input[j] == '[' {
+				// Fields[name]
+				end := strings.IndexByte(input[j:], ']')
+				if end < 0 {
+					return errors.New("missing ]")
+				}
+				j += end + 1
+			}
+			self.tokens = append(self.tokens, input[i:j])
+			i = j
+		default:
+			return fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return nil
+}
+
+func (self *exprParser) next() string {
+	if self.pos >= len(self.tokens) {
+		return ""
+	}
+	token := self.tokens[self.pos]
+	self.pos++
+	return token
+}
+
+func (self *exprParser) peek() string {
+	if self.pos >= len(self.tokens) {
+		return ""
+	}
+	return self.tokens[self.pos]
+}
+
+func (self *exprParser) parseSum() (exprNode, error) {
+	left, err := self.parseProduct()
+	for err == nil && (self.peek() == "+" || self.peek() == "-") {
+		op := self.next()[0]
+		var right exprNode
+		if right, err = self.parseProduct(); err == nil {
+			left = &exprBinary{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (self *exprParser) parseProduct() (exprNode, error) {
+	left, err := self.parseUnary()
+	for err == nil && (self.peek() == "*" || self.peek() == "/" ||
+		self.peek() == "%") {
+		op := self.next()[0]
+		var right exprNode
+		if right, err = self.parseUnary(); err == nil {
+			left = &exprBinary{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (self *exprParser) parseUnary() (exprNode, error) {
+	if self.peek() == "-" {
+		self.next()
+		operand, err := self.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNegate{operand}, nil
+	}
+	return self.parseOperand()
+}
+
+func (self *exprParser) parseOperand() (exprNode, error) {
+	token := self.next()
+	switch {
+	case token == "":
+		return nil, errors.New("unexpected end of expression")
+	case token == "(":
+		node, err := self.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if self.next() != ")" {
+			return nil, errors.New("missing )")
+		}
+		return node, nil
+	case token[0] == '\'' || token[0] == '"':
+		unquoted := token[1 : len(token)-1]
+		return &exprConst{strings.Replace(unquoted, `\`+token[:1], token[:1],
+			-1)}, nil
+	case token[0] >= '0' && token[0] <= '9' || token[0] == '.':
+		if i, err := strconv.ParseInt(token, 10, 64); err == nil {
+			return &exprConst{i}, nil
+		}
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token)
+		}
+		return &exprConst{f}, nil
+	case token == "TRUE" || token == "FALSE":
+		return &exprConst{token == "TRUE"}, nil
+	case self.peek() == "(":
+		return self.parseCall(token)
+	case isMessageVariable(token):
+		return &exprVariable{token}, nil
+	case strings.IndexByte(token, '[') < 0 && isExprIdentRune(rune(token[0])):
+		return &exprVariable{"Fields[" + token + "]"}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+func (self *exprParser) parseCall(name string) (exprNode, error) {
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	self.next() // (
+	call := &exprCall{name: name, fn: fn}
+	if self.peek() == ")" {
+		self.next()
+	} else {
+		for {
+			arg, err := self.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if token := self.next(); token == ")" {
+				break
+			} else if token != "," {
+				return nil, fmt.Errorf("expected , or ) in %s(), got %q", name,
+					token)
+			}
+		}
+	}
+	if len(call.args) < fn.minArgs || fn.maxArgs >= 0 &&
+		len(call.args) > fn.maxArgs {
+		return nil, fmt.Errorf("wrong number of arguments to %s", name)
+	}
+	return call, nil
+}
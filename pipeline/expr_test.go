@@ -0,0 +1,71 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+)
+
+func ExprSpec(c gospec.Context) {
+	msg := getTestMessage()
+	msg.Fields["start_ts"] = int64(1000000)
+	msg.Fields["end_ts"] = int64(3500000)
+	msg.Fields["size"] = 5000.0
+	msg.Fields["count"] = "7"
+
+	eval := func(expr string) interface{} {
+		fieldExpr, err := NewFieldExpression(expr)
+		c.Assume(err, gs.IsNil)
+		value, err := fieldExpr.Eval(msg)
+		c.Assume(err, gs.IsNil)
+		return value
+	}
+
+	c.Specify("A FieldExpression", func() {
+		c.Specify("does arithmetic w/ precedence", func() {
+			c.Expect(eval("(end_ts - start_ts) / 1e6"), gs.Equals, 2.5)
+			c.Expect(eval("1 + 2 * 3 - -1"), gs.Equals, int64(8))
+			c.Expect(eval("end_ts % 7"), gs.Equals, int64(3500000%7))
+		})
+
+		c.Specify("calls functions", func() {
+			c.Expect(eval("floor(size / 1024)"), gs.Equals, int64(4))
+			c.Expect(eval("max(1, Fields[size], 3)"), gs.Equals, 5000.0)
+			c.Expect(eval("int(count) * 2"), gs.Equals, int64(14))
+			c.Expect(eval("upper(foo)"), gs.Equals, "BAR")
+		})
+
+		c.Specify("concatenates strings", func() {
+			c.Expect(eval("Type + '-' + Severity"), gs.Equals, "TEST-6")
+		})
+
+		c.Specify("fails on missing fields and division by zero", func() {
+			for _, expr := range []string{"missing + 1", "size / 0"} {
+				fieldExpr, err := NewFieldExpression(expr)
+				c.Assume(err, gs.IsNil)
+				_, err = fieldExpr.Eval(msg)
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+
+		c.Specify("rejects invalid expressions", func() {
+			for _, expr := range []string{"1 +", "(1", "bogus(1)",
+				"floor(1, 2)", "1 2", "'x"} {
+				_, err := NewFieldExpression(expr)
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+	})
+}
@@ -0,0 +1,469 @@
+//go:build !noexternal
+// +build !noexternal
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("ExternalInput", func() interface{} {
+		return new(ExternalInput)
+	})
+	RegisterPlugin("ExternalDecoder", func() interface{} {
+		return new(ExternalDecoder)
+	})
+	RegisterPlugin("ExternalFilter", func() interface{} {
+		return new(ExternalFilter)
+	})
+	RegisterPlugin("ExternalOutput", func() interface{} {
+		return new(ExternalOutput)
+	})
+}
+
+// Message encodings understood by external plugins
+const (
+	externalFormatGob  = "gob"
+	externalFormatJson = "json"
+)
+
+// Returned once a plugin has failed more times in a row than its restart
+// policy allows
+var errExternalGaveUp = errors.New("restart limit reached, giving up")
+
+// The stdin and stdout of a plugin process, closed by killing it
+type processConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (self *processConn) Close() error {
+	self.WriteCloser.Close()
+	self.cmd.Process.Kill()
+	return self.cmd.Wait()
+}
+
+// externalProcess is the connection to an out-of-process plugin, which
+// is either a command started by hekad (talking over its stdin and
+// stdout) or a server listening on a unix socket. Messages are exchanged
+// in heka's framing (see EncodeFrame); an empty frame stands for "no
+// message". The frames hold gobs by default, or w/ a `Format` of "json"
+// the metlog JSON understood by JsonDecoder, so plugins can be written in
+// anything that can read and write JSON.
+//
+// Any protocol error drops the connection, killing the process if hekad
+// started it, and it's re-established on next use, so a plugin crashing
+// never takes hekad down w/ it. Reconnects follow the restart policy, set
+// w/ `MaxRetries`, `RetryDelay` and `MaxRetryDelay` as for inputs: the
+// delay doubles w/ each failure in a row, and once MaxRetries is exceeded
+// the plugin is given up on (a negative MaxRetries retries forever). A
+// `Timeout` (in milliseconds) bounds how long to wait for a reply, so a
+// hung plugin gets restarted rather than stalling the pipeline.
+type externalProcess struct {
+	command    string
+	args       []string
+	socketPath string
+	format     string
+	timeout    time.Duration
+	policy     RestartPolicy
+	conn       io.ReadWriteCloser
+	reader     *bufio.Reader
+	failedAt   time.Time
+	delay      time.Duration
+	// Consecutive failures, reset by a successful exchange
+	failures int
+	// Counters for the report
+	restarts   int64
+	errorCount int64
+	gaveUp     int32
+}
+
+// Reads the `Command` (w/ `Args`) or `Socket` settings, along w/
+// `Format`, `Timeout` and the restart policy
+func newExternalProcess(config *PluginConfig) (*externalProcess, error) {
+	self := &externalProcess{format: externalFormatGob}
+	if value, ok := (*config)["Socket"]; ok {
+		self.socketPath = value.(string)
+	} else if value, ok = (*config)["Command"]; ok {
+		self.command = value.(string)
+		if value, ok = (*config)["Args"]; ok {
+			self.args = value.([]string)
+		}
+	} else {
+		return nil, errors.New("Missing Command or Socket")
+	}
+	if value, ok := (*config)["Format"]; ok {
+		self.format, _ = value.(string)
+		if self.format != externalFormatGob &&
+			self.format != externalFormatJson {
+			return nil, fmt.Errorf("Format must be %s or %s",
+				externalFormatGob, externalFormatJson)
+		}
+	}
+	var err error
+	if self.timeout, err = ConfigDuration(config, "Timeout",
+		time.Millisecond, 0); err != nil {
+		return nil, err
+	}
+	self.policy, _ = restartPolicyFromSection(*config)
+	self.delay = self.policy.Delay
+	return self, nil
+}
+
+func (self *externalProcess) String() string {
+	if self.socketPath != "" {
+		return self.socketPath
+	}
+	return self.command
+}
+
+func (self *externalProcess) connect() (err error) {
+	if self.conn != nil {
+		return nil
+	}
+	if atomic.LoadInt32(&self.gaveUp) != 0 {
+		return errExternalGaveUp
+	}
+	if !self.failedAt.IsZero() {
+		if wait := self.delay - time.Since(self.failedAt); wait > 0 {
+			time.Sleep(wait)
+		}
+		atomic.AddInt64(&self.restarts, 1)
+	}
+	if self.socketPath != "" {
+		self.conn, err = net.Dial("unix", self.socketPath)
+	} else {
+		self.conn, err = self.startProcess()
+	}
+	if err != nil {
+		return self.fail(err)
+	}
+	self.reader = bufio.NewReader(self.conn)
+	return nil
+}
+
+func (self *externalProcess) startProcess() (io.ReadWriteCloser, error) {
+	cmd := exec.Command(self.command, self.args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &processConn{stdout, stdin, cmd}, nil
+}
+
+// Drops the connection after a failure, killing the process if we
+// started it, and backs off or gives up according to the restart policy
+func (self *externalProcess) fail(err error) error {
+	atomic.AddInt64(&self.errorCount, 1)
+	self.close()
+	if !self.failedAt.IsZero() {
+		if self.delay *= 2; self.delay > self.policy.MaxDelay {
+			self.delay = self.policy.MaxDelay
+		}
+	}
+	self.failedAt = time.Now()
+	self.failures++
+	if self.policy.MaxRetries >= 0 && self.failures > self.policy.MaxRetries {
+		log.Printf("External plugin %s failed, giving up after %d "+
+			"restarts: %s\n", self, self.policy.MaxRetries, err.Error())
+		atomic.StoreInt32(&self.gaveUp, 1)
+		return err
+	}
+	log.Printf("External plugin %s failed, restarting in %s (attempt %d): "+
+		"%s\n", self, self.delay, self.failures, err.Error())
+	return err
+}
+
+// Resets the backoff after a successful exchange
+func (self *externalProcess) healthy() {
+	self.failures = 0
+	self.failedAt = time.Time{}
+	self.delay = self.policy.Delay
+}
+
+func (self *externalProcess) close() {
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+}
+
+// Sends a record as is, in a frame of its own
+func (self *externalProcess) sendBytes(record []byte) (err error) {
+	if err = self.connect(); err != nil {
+		return
+	}
+	if _, err = self.conn.Write(EncodeFrame(record)); err != nil {
+		return self.fail(err)
+	}
+	return nil
+}
+
+// Sends a message, or an empty frame if msg is nil
+func (self *externalProcess) send(msg *Message) (err error) {
+	var record []byte
+	if msg != nil {
+		if record, err = self.encode(msg); err != nil {
+			return
+		}
+	}
+	return self.sendBytes(record)
+}
+
+func (self *externalProcess) encode(msg *Message) ([]byte, error) {
+	if self.format == externalFormatJson {
+		return msg.MarshalJSON()
+	}
+	buffer := new(bytes.Buffer)
+	err := gob.NewEncoder(buffer).Encode(msg)
+	return buffer.Bytes(), err
+}
+
+// Receives a message, returning nil for an empty frame. W/ wait set the
+// plugin's Timeout applies, i.e. this is a reply to a request.
+func (self *externalProcess) receive(wait bool) (*Message, error) {
+	if err := self.connect(); err != nil {
+		return nil, err
+	}
+	var timer *time.Timer
+	if wait && self.timeout > 0 {
+		// Closing the connection unblocks the read
+		conn := self.conn
+		timer = time.AfterFunc(self.timeout, func() { conn.Close() })
+	}
+	body, err := ReadFrame(self.reader)
+	if timer != nil && !timer.Stop() {
+		err = fmt.Errorf("no reply within %s", self.timeout)
+	}
+	if err != nil {
+		return nil, self.fail(err)
+	}
+	if len(body) == 0 {
+		self.healthy()
+		return nil, nil
+	}
+	msg, err := self.decode(body)
+	if err != nil {
+		return nil, self.fail(err)
+	}
+	self.healthy()
+	return msg, nil
+}
+
+func (self *externalProcess) decode(body []byte) (*Message, error) {
+	msg := new(Message)
+	if self.format == externalFormatJson {
+		decoder := &JsonDecoder{mode: "lenient"}
+		err := decoder.Decode(&PipelinePack{MsgBytes: body, Message: msg})
+		return msg, err
+	}
+	return msg, gob.NewDecoder(bytes.NewReader(body)).Decode(msg)
+}
+
+// Sends a request and waits for the reply
+func (self *externalProcess) exchange(send func() error) (*Message, error) {
+	if err := send(); err != nil {
+		return nil, err
+	}
+	return self.receive(true)
+}
+
+// Adds the plugin's restart counters to its report
+func (self *externalProcess) Report() map[string]interface{} {
+	return map[string]interface{}{
+		"restarts": atomic.LoadInt64(&self.restarts),
+		"errors":   atomic.LoadInt64(&self.errorCount),
+		"gave_up":  atomic.LoadInt32(&self.gaveUp) != 0,
+	}
+}
+
+// ExternalInput reads messages from an external plugin. The plugin just
+// writes framed messages; empty frames are ignored.
+type ExternalInput struct {
+	process  *externalProcess
+	messages chan *Message
+}
+
+func (self *ExternalInput) Init(config *PluginConfig) (err error) {
+	if self.process, err = newExternalProcess(config); err != nil {
+		return fmt.Errorf("ExternalInput config: %s", err.Error())
+	}
+	self.messages = make(chan *Message, 100)
+	return nil
+}
+
+// Starts the plugin. This happens here rather than in Init so configs can
+// be validated w/o running anything.
+func (self *ExternalInput) Prepare() error {
+	if err := self.process.connect(); err != nil {
+		return err
+	}
+	go self.receiveLoop()
+	return nil
+}
+
+func (self *ExternalInput) receiveLoop() {
+	for {
+		msg, err := self.process.receive(false)
+		if err == errExternalGaveUp {
+			return
+		}
+		if err == nil && msg != nil {
+			self.messages <- msg
+		}
+	}
+}
+
+func (self *ExternalInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case msg := <-self.messages:
+		pipelinePack.Message = msg
+		pipelinePack.Decoded = true
+		return nil
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No messages to read")
+	return &err
+}
+
+func (self *ExternalInput) Report() map[string]interface{} {
+	return self.process.Report()
+}
+
+// ExternalDecoder sends each raw record to an external plugin, as is, and
+// waits for the decoded message. An empty reply means the plugin couldn't
+// decode the record.
+type ExternalDecoder struct {
+	process *externalProcess
+	lock    sync.Mutex
+}
+
+func (self *ExternalDecoder) Init(config *PluginConfig) (err error) {
+	if self.process, err = newExternalProcess(config); err != nil {
+		return fmt.Errorf("ExternalDecoder config: %s", err.Error())
+	}
+	return nil
+}
+
+func (self *ExternalDecoder) Decode(pipelinePack *PipelinePack) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	msg, err := self.process.exchange(func() error {
+		return self.process.sendBytes(pipelinePack.MsgBytes)
+	})
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return fmt.Errorf("External plugin %s couldn't decode record",
+			self.process)
+	}
+	*pipelinePack.Message = *msg
+	pipelinePack.Decoded = true
+	return nil
+}
+
+func (self *ExternalDecoder) Report() map[string]interface{} {
+	return self.process.Report()
+}
+
+// ExternalFilter sends each message to an external plugin and waits for
+// its reply: either the (possibly modified) message, or an empty frame to
+// drop it. If the plugin fails the message passes through unchanged.
+type ExternalFilter struct {
+	process *externalProcess
+	lock    sync.Mutex
+}
+
+func (self *ExternalFilter) Init(config *PluginConfig) (err error) {
+	if self.process, err = newExternalProcess(config); err != nil {
+		return fmt.Errorf("ExternalFilter config: %s", err.Error())
+	}
+	return nil
+}
+
+func (self *ExternalFilter) FilterMsg(pipelinePack *PipelinePack) {
+	// One request at a time, so replies can't get out of order
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	msg, err := self.process.exchange(func() error {
+		return self.process.send(pipelinePack.Message)
+	})
+	if err != nil {
+		return
+	}
+	pipelinePack.Message = msg
+}
+
+func (self *ExternalFilter) Report() map[string]interface{} {
+	return self.process.Report()
+}
+
+// ExternalOutput writes each message to an external plugin. No reply is
+// expected.
+type ExternalOutput struct {
+	process *externalProcess
+	lock    sync.Mutex
+}
+
+func (self *ExternalOutput) Init(config *PluginConfig) (err error) {
+	if self.process, err = newExternalProcess(config); err != nil {
+		return fmt.Errorf("ExternalOutput config: %s", err.Error())
+	}
+	return nil
+}
+
+func (self *ExternalOutput) Deliver(pipelinePack *PipelinePack) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.process.send(pipelinePack.Message); err != nil {
+		log.Printf("ExternalOutput dropping message: %s\n", err.Error())
+	}
+}
+
+// Closes the connection, stopping the plugin if hekad started it
+func (self *ExternalOutput) Drain() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.process.close()
+	return nil
+}
+
+func (self *ExternalOutput) Report() map[string]interface{} {
+	return self.process.Report()
+}
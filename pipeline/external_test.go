@@ -0,0 +1,343 @@
+//go:build !noexternal
+// +build !noexternal
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	pluginSpecs = append(pluginSpecs, ExternalPluginSpec,
+		ExternalProcessSpec)
+}
+
+// A unix socket server standing in for an external plugin, running serve
+// for each connection
+type externalStub struct {
+	listener net.Listener
+	accepted int32
+}
+
+func newExternalStub(path string, serve func(conn net.Conn)) (
+	*externalStub, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	self := &externalStub{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&self.accepted, 1)
+			go serve(conn)
+		}
+	}()
+	return self, nil
+}
+
+func (self *externalStub) Accepted() int {
+	return int(atomic.LoadInt32(&self.accepted))
+}
+
+func (self *externalStub) Close() {
+	self.listener.Close()
+}
+
+// Serves each request frame w/ the reply returned by reply, sending no
+// reply at all if it returns false
+func replyingStub(reply func(body []byte) ([]byte, bool)) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			body, err := ReadFrame(reader)
+			if err != nil {
+				return
+			}
+			if data, ok := reply(body); ok {
+				conn.Write(EncodeFrame(data))
+			}
+		}
+	}
+}
+
+func ExternalPluginSpec(c gospec.Context) {
+	dir, err := ioutil.TempDir("", "external")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "plugin.sock")
+	timeout := 100 * time.Millisecond
+	newPack := func(payload string) *PipelinePack {
+		return &PipelinePack{MsgBytes: []byte(payload),
+			Message: &Message{Type: "test", Payload: payload}}
+	}
+
+	for _, format := range []string{externalFormatGob, externalFormatJson} {
+		format := format
+		// Encodes and decodes messages as the plugin would
+		codec := &externalProcess{format: format}
+		config := func() *PluginConfig {
+			return &PluginConfig{"Socket": socket, "Format": format,
+				"Timeout": int64(50), "MaxRetries": int64(1),
+				"RetryDelay": int64(1)}
+		}
+
+		c.Specify("An ExternalFilter w/ "+format+" messages", func() {
+			filter := new(ExternalFilter)
+			c.Assume(filter.Init(config()), gs.IsNil)
+
+			c.Specify("passes on the plugin's reply", func() {
+				stub, err := newExternalStub(socket, replyingStub(
+					func(body []byte) ([]byte, bool) {
+						msg, err := codec.decode(body)
+						c.Assume(err, gs.IsNil)
+						msg.Payload = "filtered " + msg.Payload
+						reply, _ := codec.encode(msg)
+						return reply, true
+					}))
+				c.Assume(err, gs.IsNil)
+				defer stub.Close()
+				pipelinePack := newPack("hello")
+				filter.FilterMsg(pipelinePack)
+				c.Expect(pipelinePack.Message.Payload, gs.Equals,
+					"filtered hello")
+				c.Expect(pipelinePack.Message.Type, gs.Equals, "test")
+			})
+
+			c.Specify("drops the message on an empty reply", func() {
+				stub, err := newExternalStub(socket, replyingStub(
+					func(body []byte) ([]byte, bool) {
+						return nil, true
+					}))
+				c.Assume(err, gs.IsNil)
+				defer stub.Close()
+				pipelinePack := newPack("hello")
+				filter.FilterMsg(pipelinePack)
+				c.Expect(pipelinePack.Message == nil, gs.IsTrue)
+				c.Expect(filter.Report()["errors"], gs.Equals, int64(0))
+			})
+
+			c.Specify("passes the message through if there's no reply",
+				func() {
+					replies := int32(0)
+					stub, err := newExternalStub(socket, replyingStub(
+						func(body []byte) ([]byte, bool) {
+							// Only the restarted plugin answers
+							if atomic.AddInt32(&replies, 1) == 1 {
+								return nil, false
+							}
+							return body, true
+						}))
+					c.Assume(err, gs.IsNil)
+					defer stub.Close()
+					pipelinePack := newPack("hello")
+					msg := pipelinePack.Message
+					filter.FilterMsg(pipelinePack)
+					c.Expect(pipelinePack.Message == msg, gs.IsTrue)
+					c.Expect(filter.Report()["errors"], gs.Equals, int64(1))
+
+					filter.FilterMsg(pipelinePack)
+					c.Expect(pipelinePack.Message.Payload, gs.Equals, "hello")
+					c.Expect(stub.Accepted(), gs.Equals, 2)
+					report := filter.Report()
+					c.Expect(report["restarts"], gs.Equals, int64(1))
+					c.Expect(report["gave_up"], gs.IsFalse)
+				})
+		})
+
+		c.Specify("An ExternalDecoder w/ "+format+" messages", func() {
+			decoder := new(ExternalDecoder)
+			c.Assume(decoder.Init(config()), gs.IsNil)
+			stub, err := newExternalStub(socket, replyingStub(
+				func(body []byte) ([]byte, bool) {
+					if string(body) == "garbage" {
+						return nil, true
+					}
+					reply, _ := codec.encode(&Message{Type: "decoded",
+						Payload: string(body)})
+					return reply, true
+				}))
+			c.Assume(err, gs.IsNil)
+			defer stub.Close()
+
+			pipelinePack := newPack("hello")
+			c.Expect(decoder.Decode(pipelinePack), gs.IsNil)
+			c.Expect(pipelinePack.Decoded, gs.IsTrue)
+			c.Expect(pipelinePack.Message.Type, gs.Equals, "decoded")
+			c.Expect(pipelinePack.Message.Payload, gs.Equals, "hello")
+
+			pipelinePack = newPack("garbage")
+			c.Expect(decoder.Decode(pipelinePack), gs.Not(gs.IsNil))
+			c.Expect(pipelinePack.Decoded, gs.IsFalse)
+		})
+
+		c.Specify("An ExternalInput w/ "+format+" messages", func() {
+			stub, err := newExternalStub(socket, func(conn net.Conn) {
+				defer conn.Close()
+				reply, _ := codec.encode(&Message{Type: "input",
+					Payload: "hello"})
+				conn.Write(EncodeFrame(nil))
+				conn.Write(EncodeFrame(reply))
+				time.Sleep(time.Second)
+			})
+			c.Assume(err, gs.IsNil)
+			defer stub.Close()
+			input := new(ExternalInput)
+			c.Assume(input.Init(config()), gs.IsNil)
+			c.Assume(input.Prepare(), gs.IsNil)
+
+			pipelinePack := newPack("")
+			c.Expect(input.Read(pipelinePack, &timeout), gs.IsNil)
+			c.Expect(pipelinePack.Decoded, gs.IsTrue)
+			c.Expect(pipelinePack.Message.Payload, gs.Equals, "hello")
+			// The empty frame is ignored
+			err = input.Read(pipelinePack, &timeout)
+			_, timedOut := err.(*TimeoutError)
+			c.Expect(timedOut, gs.IsTrue)
+		})
+
+		c.Specify("An ExternalOutput w/ "+format+" messages", func() {
+			received := make(chan *Message, 2)
+			stub, err := newExternalStub(socket, replyingStub(
+				func(body []byte) ([]byte, bool) {
+					msg, _ := codec.decode(body)
+					received <- msg
+					return nil, false
+				}))
+			c.Assume(err, gs.IsNil)
+			defer stub.Close()
+			output := new(ExternalOutput)
+			c.Assume(output.Init(config()), gs.IsNil)
+
+			output.Deliver(newPack("one"))
+			output.Deliver(newPack("two"))
+			for _, payload := range []string{"one", "two"} {
+				select {
+				case msg := <-received:
+					c.Expect(msg.Payload, gs.Equals, payload)
+				case <-time.After(time.Second):
+					c.Expect("delivered", gs.Equals, "not delivered")
+				}
+			}
+			c.Expect(output.Drain(), gs.IsNil)
+			c.Expect(output.Report()["errors"], gs.Equals, int64(0))
+		})
+	}
+
+	c.Specify("An external plugin run as a command", func() {
+		c.Specify("exchanges messages over its stdin and stdout", func() {
+			// cat hands each message straight back
+			filter := new(ExternalFilter)
+			c.Assume(filter.Init(&PluginConfig{"Command": "cat",
+				"Format": externalFormatJson, "Timeout": int64(1000)}),
+				gs.IsNil)
+			defer filter.process.close()
+			pipelinePack := newPack("hello")
+			filter.FilterMsg(pipelinePack)
+			c.Expect(pipelinePack.Message.Payload, gs.Equals, "hello")
+			c.Expect(filter.Report()["errors"], gs.Equals, int64(0))
+		})
+
+		c.Specify("is restarted when it exits", func() {
+			filter := new(ExternalFilter)
+			c.Assume(filter.Init(&PluginConfig{"Command": "true",
+				"Timeout": int64(1000), "MaxRetries": int64(1),
+				"RetryDelay": int64(1)}), gs.IsNil)
+			pipelinePack := newPack("hello")
+			for i := 0; i < 3; i++ {
+				filter.FilterMsg(pipelinePack)
+				c.Expect(pipelinePack.Message.Payload, gs.Equals, "hello")
+			}
+			report := filter.Report()
+			c.Expect(report["errors"], gs.Equals, int64(2))
+			c.Expect(report["restarts"], gs.Equals, int64(1))
+			c.Expect(report["gave_up"], gs.IsTrue)
+		})
+	})
+}
+
+func ExternalProcessSpec(c gospec.Context) {
+	dir, err := ioutil.TempDir("", "external")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "plugin.sock")
+	newProcess := func(maxRetries int64) *externalProcess {
+		process, err := newExternalProcess(&PluginConfig{"Socket": socket,
+			"MaxRetries": maxRetries, "RetryDelay": int64(1),
+			"MaxRetryDelay": int64(3)})
+		c.Assume(err, gs.IsNil)
+		return process
+	}
+
+	c.Specify("Failures back off up to the maximum delay", func() {
+		process := newProcess(-1)
+		delays := make([]time.Duration, 4)
+		for i := range delays {
+			c.Expect(process.connect(), gs.Not(gs.IsNil))
+			delays[i] = process.delay
+		}
+		c.Expect(delays[0], gs.Equals, time.Millisecond)
+		c.Expect(delays[1], gs.Equals, 2*time.Millisecond)
+		c.Expect(delays[2], gs.Equals, 3*time.Millisecond)
+		c.Expect(delays[3], gs.Equals, 3*time.Millisecond)
+		c.Expect(process.Report()["gave_up"], gs.IsFalse)
+	})
+
+	c.Specify("A plugin is given up on after MaxRetries", func() {
+		process := newProcess(2)
+		for i := 0; i < 3; i++ {
+			c.Expect(process.connect(), gs.Not(gs.IsNil))
+		}
+		c.Expect(process.connect(), gs.Equals, errExternalGaveUp)
+		report := process.Report()
+		c.Expect(report["errors"], gs.Equals, int64(3))
+		c.Expect(report["restarts"], gs.Equals, int64(2))
+		c.Expect(report["gave_up"], gs.IsTrue)
+	})
+
+	c.Specify("A successful exchange resets the backoff", func() {
+		process := newProcess(1)
+		c.Expect(process.connect(), gs.Not(gs.IsNil))
+		stub, err := newExternalStub(socket, replyingStub(
+			func(body []byte) ([]byte, bool) {
+				return nil, true
+			}))
+		c.Assume(err, gs.IsNil)
+		defer stub.Close()
+		msg, err := process.exchange(func() error {
+			return process.send(&Message{Payload: "hello"})
+		})
+		c.Expect(err, gs.IsNil)
+		c.Expect(msg == nil, gs.IsTrue)
+		c.Expect(process.failures, gs.Equals, 0)
+		c.Expect(process.failedAt.IsZero(), gs.IsTrue)
+		c.Expect(process.delay, gs.Equals, time.Millisecond)
+		process.close()
+	})
+}
@@ -0,0 +1,161 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"reflect"
+	"time"
+)
+
+func FieldsSpec(c gospec.Context) {
+	nested := map[string]interface{}{
+		"status": 200.0,
+		"request": map[string]interface{}{
+			"path":    "/",
+			"headers": []interface{}{"a", map[string]interface{}{"b": true}},
+		},
+		"empty": []interface{}{},
+	}
+
+	c.Specify("FlattenFields", func() {
+		flat := FlattenFields(nested)
+
+		c.Specify("uses dotted names for nested values", func() {
+			c.Expect(flat["status"], gs.Equals, 200.0)
+			c.Expect(flat["request.path"], gs.Equals, "/")
+			c.Expect(flat["request.headers.0"], gs.Equals, "a")
+			c.Expect(flat["request.headers.1.b"], gs.Equals, true)
+			c.Expect(len(flat), gs.Equals, 5)
+		})
+
+		c.Specify("round trips through UnflattenFields", func() {
+			c.Expect(reflect.DeepEqual(UnflattenFields(flat), nested), gs.IsTrue)
+		})
+	})
+
+	c.Specify("UnflattenFields only makes arrays of contiguous indexes", func() {
+		fields := UnflattenFields(map[string]interface{}{"a.0": 1, "a.2": 2})
+		_, isMap := fields["a"].(map[string]interface{})
+		c.Expect(isMap, gs.IsTrue)
+	})
+
+	c.Specify("Message field mutation", func() {
+		msg := &Message{Fields: FlattenFields(nested)}
+
+		c.Specify("replaces and adds fields", func() {
+			c.Expect(msg.ReplaceField("status", 404.0), gs.IsTrue)
+			c.Expect(msg.ReplaceField("new", "x"), gs.IsFalse)
+			c.Expect(msg.Fields["status"], gs.Equals, 404.0)
+			empty := new(Message)
+			c.Expect(empty.ReplaceField("a", 1), gs.IsFalse)
+		})
+
+		c.Specify("deletes fields", func() {
+			c.Expect(msg.DeleteField("status"), gs.IsTrue)
+			c.Expect(msg.DeleteField("status"), gs.IsFalse)
+		})
+
+		c.Specify("deletes fields along w/ their flattened children", func() {
+			c.Expect(msg.DeleteAllFields("request"), gs.Equals, 3)
+			c.Expect(msg.FieldNames(), gs.ContainsExactly,
+				[]string{"empty", "status"})
+		})
+	})
+
+	c.Specify("Field values are normalized", func() {
+		when := time.Unix(1, 500)
+		c.Expect(NormalizeFieldValue(uint16(7)), gs.Equals, int64(7))
+		c.Expect(NormalizeFieldValue(int32(-7)), gs.Equals, int64(-7))
+		c.Expect(NormalizeFieldValue(uint64(1<<63)), gs.Equals,
+			float64(1<<63))
+		c.Expect(NormalizeFieldValue(float32(1.5)), gs.Equals, 1.5)
+		c.Expect(NormalizeFieldValue(when), gs.Equals, int64(1000000500))
+		c.Expect(NormalizeFieldValue(time.Second), gs.Equals,
+			int64(time.Second))
+		c.Expect(NormalizeFieldValue(int(3)), gs.Equals, int(3))
+		values := NormalizeFieldValue([]string{"a", "b"})
+		c.Expect(reflect.DeepEqual(values, []interface{}{"a", "b"}),
+			gs.IsTrue)
+
+		msg := new(Message)
+		msg.ReplaceField("codes", []int64{200, 404})
+		c.Expect(reflect.DeepEqual(msg.Fields["codes"],
+			[]interface{}{int64(200), int64(404)}), gs.IsTrue)
+	})
+
+	c.Specify("Field representations", func() {
+		msg := &Message{Fields: map[string]interface{}{
+			"latency": 1500, "client": "10.0.0.1", "hits": 2.5}}
+
+		c.Specify("are validated when set", func() {
+			c.Expect(msg.SetFieldRepresentation("latency", "ms"), gs.IsNil)
+			c.Expect(msg.FieldRepresentation("latency"), gs.Equals, "ms")
+			c.Expect(msg.SetFieldRepresentation("client", "ip4"), gs.IsNil)
+			c.Expect(msg.SetFieldRepresentation("client", "ip6"),
+				gs.Not(gs.IsNil))
+			c.Expect(msg.SetFieldRepresentation("client", "ms"),
+				gs.Not(gs.IsNil))
+			c.Expect(msg.SetFieldRepresentation("hits", "count"),
+				gs.Not(gs.IsNil))
+			c.Expect(msg.SetFieldRepresentation("latency", "bogus"),
+				gs.Not(gs.IsNil))
+		})
+
+		c.Specify("go w/ their fields", func() {
+			msg.SetFieldRepresentation("latency", "ms")
+			copied := new(Message)
+			msg.Copy(copied)
+			c.Expect(copied.FieldRepresentation("latency"), gs.Equals, "ms")
+			msg.DeleteField("latency")
+			c.Expect(msg.FieldRepresentation("latency"), gs.Equals, "")
+		})
+
+		c.Specify("convert w/in a dimension", func() {
+			seconds, err := ConvertRepresentation(1500, "ms", "s")
+			c.Expect(err, gs.IsNil)
+			c.Expect(seconds, gs.Equals, 1.5)
+			_, err = ConvertRepresentation(1500, "ms", "B")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("can be set along w/ their fields", func() {
+			err := msg.ReplaceFieldWithRepresentation("size", int64(2048),
+				"KiB")
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.Fields["size"], gs.Equals, int64(2048))
+			c.Expect(msg.FieldRepresentation("size"), gs.Equals, "KiB")
+			err = msg.ReplaceFieldWithRepresentation("peer", 2, "ip4")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, ok := msg.Fields["peer"]
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("let outputs read values in their own units", func() {
+			msg.ReplaceFieldWithRepresentation("latency", 1500, "ms")
+			seconds, err := msg.FieldValueIn("latency", "s")
+			c.Expect(err, gs.IsNil)
+			c.Expect(seconds, gs.Equals, 1.5)
+			hits, err := msg.FieldValueIn("hits", "count")
+			c.Expect(err, gs.IsNil)
+			c.Expect(hits, gs.Equals, 2.5)
+			_, err = msg.FieldValueIn("latency", "B")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = msg.FieldValueIn("client", "s")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,365 @@
+//go:build !nofileoutput
+// +build !nofileoutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("FileOutput", func() interface{} { return new(FileOutput) })
+}
+
+var pathVarRegex = regexp.MustCompile(`%{([^}]+)}`)
+
+// Keeps message values from choosing the directory a file lands in, e.g.
+// w/ a Logger of "../../etc": separators and ".." become "_"
+var pathValueReplacer = strings.NewReplacer("/", "_", "\\", "_", "..", "_",
+	"\x00", "_")
+
+// Replaces `%{Type}`, `%{Logger}`, `%{Hostname}`, `%{Severity}`,
+// `%{Pid}` and `%{Fields[name]}` references in a path with the
+// corresponding values from the message. The values can't contain path
+// separators or "..", so the file is always in the directory the path
+// names.
+func InterpolatePath(path string, msg *Message) string {
+	return pathVarRegex.ReplaceAllStringFunc(path, func(match string) string {
+		name := match[2 : len(match)-1]
+		switch name {
+		case "Type":
+			return pathValueReplacer.Replace(msg.Type)
+		case "Logger":
+			return pathValueReplacer.Replace(msg.Logger)
+		case "Hostname":
+			return pathValueReplacer.Replace(msg.Hostname)
+		case "Severity":
+			return strconv.Itoa(msg.Severity)
+		case "Pid":
+			return strconv.Itoa(msg.Pid)
+		}
+		if len(name) > 8 && name[:7] == "Fields[" && name[len(name)-1] == ']' {
+			if value, ok := msg.Fields[name[7:len(name)-1]]; ok {
+				return pathValueReplacer.Replace(fmt.Sprint(value))
+			}
+		}
+		return ""
+	})
+}
+
+type fileRecord struct {
+	path     string
+	msgBytes []byte
+	ack      *PackAck
+}
+
+type outFile struct {
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// FileOutput writes encoded messages to files on disk. The file path may refer
+// to message values (see InterpolatePath), so a single output can fan
+// out to many files. Files can be rotated by size or age, are fsynced on
+// an interval, and are reopened on SIGHUP for logrotate compatibility.
+// Up to 1000 records wait to be written; once that queue is full the
+// pipeline waits for the writer, unless `Backpressure` says otherwise (see
+// Backpressure). Records from an AckAwareInput are acked once they've been
+// synced.
+type FileOutput struct {
+	EncodingOutput
+	dryRunnable
+	path           string
+	perm           os.FileMode
+	rotateSize     int64
+	rotateInterval time.Duration
+	flushInterval  time.Duration
+	queue          *Queue
+	backpressure   *Backpressure
+	drainChan      chan chan error
+	files          map[string]*outFile
+	// Acks for records written since the last sync
+	unsynced []*PackAck
+	// Written at the start of each new (or empty) file, e.g. a CSV header
+	header []byte
+	helper PluginHelper
+}
+
+func (self *FileOutput) Init(config *PluginConfig) error {
+	return self.initFile(config, "FileOutput", &PayloadEncoder{})
+}
+
+// Reads the file settings. Outputs built on FileOutput use this to supply
+// their own default encoder and name for config errors.
+func (self *FileOutput) initFile(config *PluginConfig, name string,
+	defaultEncoder Encoder) error {
+	var ok bool
+	var value interface{}
+	value, ok = (*config)["Path"]
+	if !ok {
+		return fmt.Errorf("%s config: Missing Path", name)
+	}
+	if self.path, ok = value.(string); !ok {
+		return fmt.Errorf("%s config: Path must be a string", name)
+	}
+	if err := self.InitEncoder(config, defaultEncoder); err != nil {
+		return fmt.Errorf("%s config: %s", name, err.Error())
+	}
+	self.perm = 0644
+	if value, ok = (*config)["Perm"]; ok {
+		switch perm := value.(type) {
+		case int64:
+			self.perm = os.FileMode(perm)
+		case string:
+			// Octal strings, e.g. "0644", since JSON has no octal literals
+			parsed, err := strconv.ParseUint(perm, 8, 32)
+			if err != nil {
+				return fmt.Errorf("%s config: Invalid Perm: %s", name, perm)
+			}
+			self.perm = os.FileMode(parsed)
+		}
+	}
+	rotateSize, err := ConfigByteSize(config, "RotateSize", 0)
+	if err != nil {
+		return fmt.Errorf("%s config: %s", name, err.Error())
+	}
+	self.rotateSize = int64(rotateSize)
+	self.rotateInterval, err = ConfigDuration(config, "RotateInterval",
+		time.Second, 0)
+	if err != nil {
+		return fmt.Errorf("%s config: %s", name, err.Error())
+	}
+	self.flushInterval, err = ConfigDuration(config, "FlushInterval",
+		time.Millisecond, time.Second)
+	if err != nil {
+		return fmt.Errorf("%s config: %s", name, err.Error())
+	}
+	self.backpressure, err = ConfigBackpressure(config, BackpressureBlock)
+	if err != nil {
+		return fmt.Errorf("%s config: %s", name, err.Error())
+	}
+	self.queue = NewQueue(1000, self.backpressure)
+	self.drainChan = make(chan chan error)
+	self.files = make(map[string]*outFile)
+	return nil
+}
+
+// Starts writing queued records
+func (self *FileOutput) Prepare() error {
+	superviseTask(self.helper, "writer", self.writer)
+	return nil
+}
+
+func (self *FileOutput) SetPluginHelper(helper PluginHelper) {
+	self.helper = helper
+}
+
+func (self *FileOutput) Deliver(pipelinePack *PipelinePack) {
+	self.DeliverAck(pipelinePack, nil)
+}
+
+func (self *FileOutput) DeliverAck(pipelinePack *PipelinePack, ack *PackAck) {
+	// Encoding happens on the pipeline goroutine, since the pack will be
+	// recycled as soon as Deliver returns
+	msgBytes, err := self.Encode(pipelinePack)
+	if err != nil {
+		log.Println(NewDeliveryError(pipelinePack, "FileOutput", err))
+		ack.Done(err)
+		return
+	}
+	record := &fileRecord{InterpolatePath(self.path, pipelinePack.Message),
+		msgBytes, ack}
+	queued := self.queue.Send(record, func(shed interface{}) {
+		shed.(*fileRecord).ack.Done(errAckDropped)
+	})
+	if !queued {
+		ack.Done(errAckDropped)
+	}
+}
+
+func (self *FileOutput) Report() map[string]interface{} {
+	report := make(map[string]interface{})
+	self.queue.report(report)
+	return report
+}
+
+func (self *FileOutput) openFile(path string) (*outFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		self.perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	out := &outFile{file, info.Size(), time.Now()}
+	if out.size == 0 && len(self.header) > 0 {
+		n, err := file.Write(self.header)
+		out.size += int64(n)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Closes the current file and moves it aside w/ a timestamp suffix. The
+// next write to the path will create a fresh file.
+func (self *FileOutput) rotate(path string, out *outFile) {
+	self.syncAll()
+	out.file.Close()
+	delete(self.files, path)
+	if err := os.Rename(path, rotatedPath(path, time.Now())); err != nil {
+		log.Printf("FileOutput error rotating %s: %s\n", path, err.Error())
+	}
+}
+
+// Returns the name to move a file aside to, w/ a timestamp suffix down to
+// the microsecond and, should that be taken already, a counter after it,
+// so rotating never overwrites an earlier rotated file
+func rotatedPath(path string, now time.Time) string {
+	rotated := fmt.Sprintf("%s.%s", path, now.Format("20060102150405.000000"))
+	candidate := rotated
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s.%d", rotated, i)
+	}
+}
+
+func (self *FileOutput) needsRotation(out *outFile) bool {
+	if self.rotateSize > 0 && out.size >= self.rotateSize {
+		return true
+	}
+	if self.rotateInterval > 0 && time.Since(out.opened) >= self.rotateInterval {
+		return true
+	}
+	return false
+}
+
+func (self *FileOutput) write(record *fileRecord) {
+	if self.dryRun.Skip(record.msgBytes) {
+		record.ack.Done(nil)
+		return
+	}
+	out, ok := self.files[record.path]
+	if ok && self.needsRotation(out) {
+		self.rotate(record.path, out)
+		ok = false
+	}
+	if !ok {
+		var err error
+		if out, err = self.openFile(record.path); err != nil {
+			log.Printf("FileOutput error opening %s: %s\n", record.path,
+				err.Error())
+			record.ack.Done(err)
+			return
+		}
+		self.files[record.path] = out
+	}
+	n, err := out.file.Write(record.msgBytes)
+	out.size += int64(n)
+	if err != nil {
+		log.Printf("FileOutput error writing to %s: %s\n", record.path,
+			err.Error())
+		record.ack.Done(err)
+		return
+	}
+	if record.ack != nil {
+		self.unsynced = append(self.unsynced, record.ack)
+	}
+}
+
+// Writes out any queued records and syncs all open files
+func (self *FileOutput) Drain() error {
+	done := make(chan error)
+	self.drainChan <- done
+	return <-done
+}
+
+// Syncs all open files, then acks the records written since the last
+// sync
+func (self *FileOutput) syncAll() (err error) {
+	for path, out := range self.files {
+		if syncErr := out.file.Sync(); syncErr != nil {
+			log.Printf("FileOutput error syncing %s: %s\n", path,
+				syncErr.Error())
+			err = syncErr
+		}
+	}
+	for _, ack := range self.unsynced {
+		ack.Done(err)
+	}
+	self.unsynced = self.unsynced[:0]
+	return
+}
+
+func (self *FileOutput) closeAll() {
+	self.syncAll()
+	for path, out := range self.files {
+		out.file.Close()
+		delete(self.files, path)
+	}
+}
+
+// All file access happens on this goroutine, so the open file map needs
+// no locking
+func (self *FileOutput) writer() error {
+	ticker := time.NewTicker(self.flushInterval)
+	defer ticker.Stop()
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+	for {
+		select {
+		case item := <-self.queue.Chan():
+			self.write(item.(*fileRecord))
+		case <-ticker.C:
+			self.syncAll()
+		case done := <-self.drainChan:
+			for queued := self.queue.Len(); queued > 0; queued-- {
+				item, ok := self.queue.TryPop()
+				if !ok {
+					break
+				}
+				self.write(item.(*fileRecord))
+			}
+			done <- self.syncAll()
+		case <-hupChan:
+			// Files get reopened lazily on the next write
+			self.closeAll()
+			log.Println("FileOutput reopening files")
+		}
+	}
+}
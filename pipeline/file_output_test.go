@@ -0,0 +1,118 @@
+//go:build !nofileoutput
+// +build !nofileoutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+func init() {
+	pluginSpecs = append(pluginSpecs, InterpolatePathSpec, FileOutputSpec)
+}
+
+func InterpolatePathSpec(c gospec.Context) {
+	msg := &Message{Type: "access", Logger: "nginx", Severity: 6,
+		Fields: map[string]interface{}{"host": "web1"}}
+
+	c.Specify("Message values are filled in", func() {
+		path := InterpolatePath("/var/log/%{Logger}/%{Fields[host]}-"+
+			"%{Severity}.log", msg)
+		c.Expect(path, gs.Equals, "/var/log/nginx/web1-6.log")
+	})
+
+	c.Specify("Values can't leave the path's directory", func() {
+		msg.Logger = "../../etc"
+		msg.Fields["host"] = "a/b\\c"
+		path := InterpolatePath("/var/log/%{Logger}/%{Fields[host]}.log",
+			msg)
+		c.Expect(path, gs.Equals, "/var/log/____etc/a_b_c.log")
+	})
+}
+
+func FileOutputSpec(c gospec.Context) {
+	dir, err := ioutil.TempDir("", "fileoutput")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(dir)
+	newOutput := func(config PluginConfig) *FileOutput {
+		output := new(FileOutput)
+		c.Assume(output.Init(&config), gs.IsNil)
+		c.Assume(output.Prepare(), gs.IsNil)
+		return output
+	}
+	deliver := func(output *FileOutput, logger, payload string) {
+		output.Deliver(&PipelinePack{Message: &Message{Logger: logger,
+			Payload: payload}})
+	}
+	// Returns the files under dir, w/ their contents
+	contents := func() map[string]string {
+		files := make(map[string]string)
+		paths, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for _, path := range paths {
+			data, _ := ioutil.ReadFile(path)
+			files[filepath.Base(path)] = string(data)
+		}
+		return files
+	}
+
+	c.Specify("Writes payloads to the interpolated path", func() {
+		output := newOutput(PluginConfig{
+			"Path": filepath.Join(dir, "%{Logger}.log")})
+		deliver(output, "web", "GET /")
+		deliver(output, "db", "SELECT 1")
+		deliver(output, "web", "GET /about")
+		c.Expect(output.Drain(), gs.IsNil)
+		files := contents()
+		c.Expect(files["web.log"], gs.Equals, "GET /\nGET /about\n")
+		c.Expect(files["db.log"], gs.Equals, "SELECT 1\n")
+	})
+
+	c.Specify("Rotating never overwrites a rotated file", func() {
+		output := newOutput(PluginConfig{
+			"Path": filepath.Join(dir, "out.log"), "RotateSize": int64(4)})
+		for _, payload := range []string{"one", "two", "six", "ten"} {
+			deliver(output, "", payload)
+		}
+		c.Expect(output.Drain(), gs.IsNil)
+		files := contents()
+		c.Expect(len(files), gs.Equals, 4)
+		c.Expect(files["out.log"], gs.Equals, "ten\n")
+		rotated := make([]string, 0, 3)
+		for name, data := range files {
+			if name != "out.log" {
+				rotated = append(rotated, data)
+			}
+		}
+		sort.Strings(rotated)
+		c.Expect(rotated[0]+rotated[1]+rotated[2], gs.Equals,
+			"one\nsix\ntwo\n")
+	})
+
+	c.Specify("Rotated names get a counter if they're taken", func() {
+		path := filepath.Join(dir, "out.log")
+		now := time.Now()
+		first := rotatedPath(path, now)
+		ioutil.WriteFile(first, nil, 0644)
+		c.Expect(rotatedPath(path, now), gs.Equals, first+".1")
+	})
+}
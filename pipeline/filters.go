@@ -14,10 +14,8 @@
 package pipeline
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	. "heka/message"
 	"log"
 	"sort"
 	"strconv"
@@ -51,7 +49,16 @@ func NewNamedOutputFilter(outputNames []string) *NamedOutputFilter {
 	return &self
 }
 
+// The output names can also be given by the `OutputNames` config setting
 func (self *NamedOutputFilter) Init(config *PluginConfig) error {
+	if value, ok := (*config)["OutputNames"]; ok {
+		outputNames, ok := value.([]string)
+		if !ok {
+			return errors.New("NamedOutputFilter config: OutputNames must " +
+				"be a list of strings")
+		}
+		self.outputNames = outputNames
+	}
 	return nil
 }
 
@@ -70,8 +77,9 @@ type Packet struct {
 }
 
 // A local statsd like structure that rolls-up counter/timer/gauge type
-// messages and later creates a StatMetric type message which is
-// inserted via the MessageGeneratorInput
+// messages, statsd's or statmetric ones (see Metric), and later creates a
+// statmetric message per rolled up metric which is inserted via the
+// MessageGeneratorInput
 type StatRollupFilter struct {
 	messageGenerator *MessageGeneratorInput
 	flushInterval    int64
@@ -94,7 +102,7 @@ func (self *StatRollupFilter) Init(config *PluginConfig) (err error) {
 	if !ok {
 		return errors.New("StatRollupFilter config: Missing PercentThreshold")
 	}
-	self.percentThreshold = value.(int)
+	self.percentThreshold = int(value.(int64))
 	self.StatsIn = make(chan *Packet, 10000)
 	self.counters = make(map[string]int)
 	self.timers = make(map[string][]int)
@@ -134,20 +142,27 @@ func (self *StatRollupFilter) Monitor() {
 	}
 }
 
+// Rolled up metrics are delivered w/ this logger, so the filter can tell
+// them from the statmetric messages it rolls up
+const statRollupLogger = "hekad.statrollup"
+
 func (self *StatRollupFilter) Flush() {
 	numStats := 0
 	now := time.Now()
-	buffer := bytes.NewBufferString("")
+	var metrics []*Metric
+	add := func(name string, value float64, metricType string) {
+		metrics = append(metrics, &Metric{Name: name, Value: value,
+			Type: metricType, Timestamp: now})
+	}
 	for s, c := range self.counters {
 		value := int64(c) / ((self.flushInterval * int64(time.Second)) / 1e3)
-		fmt.Fprintf(buffer, "stats.%s %d %d\n", s, value, now)
-		fmt.Fprintf(buffer, "stats_counts.%s %d %d\n", s, c, now)
+		add("stats."+s, float64(value), MetricCounter)
+		add("stats_counts."+s, float64(c), MetricCounter)
 		self.counters[s] = 0
 		numStats++
 	}
 	for i, g := range self.gauges {
-		value := int64(g)
-		fmt.Fprintf(buffer, "stats.%s %d %d\n", i, value, now)
+		add("stats."+i, float64(g), MetricGauge)
 		numStats++
 	}
 	for u, t := range self.timers {
@@ -173,22 +188,27 @@ func (self *StatRollupFilter) Flush() {
 			var z []int
 			self.timers[u] = z
 
-			fmt.Fprintf(buffer, "stats.timers.%s.mean %d %d\n", u, mean, now)
-			fmt.Fprintf(buffer, "stats.timers.%s.upper %d %d\n", u, max, now)
-			fmt.Fprintf(buffer, "stats.timers.%s.upper_%d %d %d\n", u,
-				self.percentThreshold, maxAtThreshold, now)
-			fmt.Fprintf(buffer, "stats.timers.%s.lower %d %d\n", u, min, now)
-			fmt.Fprintf(buffer, "stats.timers.%s.count %d %d\n", u, count, now)
+			prefix := "stats.timers." + u
+			add(prefix+".mean", float64(mean), MetricTimer)
+			add(prefix+".upper", float64(max), MetricTimer)
+			add(fmt.Sprintf("%s.upper_%d", prefix, self.percentThreshold),
+				float64(maxAtThreshold), MetricTimer)
+			add(prefix+".lower", float64(min), MetricTimer)
+			add(prefix+".count", float64(count), MetricTimer)
 		}
 		numStats++
 	}
-	fmt.Fprintf(buffer, "statsd.numStats %d %d\n", numStats, now)
-
-	fmt.Println(buffer) // Prints to std out just for fun
+	add("statsd.numStats", float64(numStats), MetricGauge)
 
-	msg := Message{Type: "statmetric", Timestamp: time.Now()}
-	msg.Fields = make(map[string]interface{})
-	self.messageGenerator.Deliver(&msg)
+	for _, metric := range metrics {
+		if err := metric.Validate(); err != nil {
+			log.Printf("StatRollupFilter error: %s\n", err.Error())
+			continue
+		}
+		msg := metric.Message()
+		msg.Logger = statRollupLogger
+		self.messageGenerator.Deliver(msg)
+	}
 }
 
 // Scans the config to locate the MessageGeneratorInput and saves a
@@ -224,6 +244,12 @@ func (self *StatRollupFilter) FilterMsg(pipeline *PipelinePack) {
 		packet.Modifier = "g"
 	case "statsd_counter":
 		packet.Modifier = ""
+	case StatMetricType:
+		if msg.Logger == statRollupLogger {
+			return
+		}
+		self.filterMetric(pipeline)
+		return
 	default:
 		return
 	}
@@ -242,3 +268,25 @@ func (self *StatRollupFilter) FilterMsg(pipeline *PipelinePack) {
 	packet.Sampling = msg.Fields["rate"].(float32)
 	self.StatsIn <- &packet
 }
+
+// Rolls up a statmetric message (see Metric) like the equivalent statsd
+// message
+func (self *StatRollupFilter) filterMetric(pipeline *PipelinePack) {
+	defer func() {
+		pipeline.Message = nil
+	}()
+	metric, err := MetricFromMessage(pipeline.Message)
+	if err != nil {
+		log.Printf("StatRollupFilter error: %s\n", err.Error())
+		return
+	}
+	packet := Packet{Bucket: metric.Name, Value: int(metric.Value),
+		Sampling: 1}
+	switch metric.Type {
+	case MetricTimer:
+		packet.Modifier = "ms"
+	case MetricGauge:
+		packet.Modifier = "g"
+	}
+	self.StatsIn <- &packet
+}
@@ -0,0 +1,29 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+// The flow stats message format, kept out of flow_stats.go so outputs
+// that read the rollups, e.g. DashboardOutput, build w/o FlowStatsFilter
+
+// The message type of the rollups emitted by FlowStatsFilter
+const flowStatsType = "heka.flow-stats"
+
+// One row of a flow stats rollup
+type FlowStat struct {
+	Type     string `json:"type"`
+	Logger   string `json:"logger"`
+	Output   string `json:"output"`
+	Messages int64  `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+}
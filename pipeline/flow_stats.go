@@ -0,0 +1,170 @@
+//go:build !noflowstats
+// +build !noflowstats
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("FlowStatsFilter", func() interface{} {
+		return new(FlowStatsFilter)
+	})
+}
+
+type flowKey struct {
+	Type   string
+	Logger string
+	Output string
+}
+
+// A message's outputs and payload size, as seen by the filter
+type flowSample struct {
+	keys []flowKey
+	size int64
+}
+
+// Counts the messages and payload bytes flowing to each output, broken
+// down by message Type and Logger, and periodically emits the counts as a
+// heka.flow-stats message via its PluginHelper. The payload is a
+// JSON list of FlowStat rows, sorted by Type, Logger and Output.
+//
+// It should be the last filter in a chain, so it sees the final set of
+// outputs for each message.
+type FlowStatsFilter struct {
+	helper        PluginHelper
+	flushInterval int64
+	flowsIn       chan *flowSample
+	counts        map[flowKey]*FlowStat
+}
+
+// `FlushInterval` is a duration, e.g. "5m", or a number of seconds, and
+// defaults to 60s. It's rounded down to whole seconds.
+func (self *FlowStatsFilter) Init(config *PluginConfig) error {
+	interval, err := ConfigDuration(config, "FlushInterval", time.Second,
+		60*time.Second)
+	if err != nil {
+		return fmt.Errorf("FlowStatsFilter config: %s", err.Error())
+	}
+	self.flushInterval = int64(interval / time.Second)
+	if self.flushInterval <= 0 {
+		return errors.New("FlowStatsFilter config: FlushInterval must be " +
+			"at least a second")
+	}
+	self.flowsIn = make(chan *flowSample, 10000)
+	self.counts = make(map[flowKey]*FlowStat)
+	go self.Monitor()
+	return nil
+}
+
+func (self *FlowStatsFilter) SetPluginHelper(helper PluginHelper) {
+	self.helper = helper
+}
+
+func (self *FlowStatsFilter) Monitor() {
+	t := time.NewTicker(time.Duration(self.flushInterval) * time.Second)
+	for {
+		select {
+		case <-t.C:
+			self.Flush()
+		case sample := <-self.flowsIn:
+			for _, key := range sample.keys {
+				stat, ok := self.counts[key]
+				if !ok {
+					stat = &FlowStat{Type: key.Type, Logger: key.Logger,
+						Output: key.Output}
+					self.counts[key] = stat
+				}
+				stat.Messages++
+				stat.Bytes += sample.size
+			}
+		}
+	}
+}
+
+// Emits the current rollup and resets the counts
+func (self *FlowStatsFilter) Flush() {
+	if len(self.counts) == 0 || self.helper == nil {
+		return
+	}
+	stats := make([]*FlowStat, 0, len(self.counts))
+	var messages, size int64
+	for _, stat := range self.counts {
+		stats = append(stats, stat)
+		messages += stat.Messages
+		size += stat.Bytes
+	}
+	sort.Sort(flowStatsByKey(stats))
+	self.counts = make(map[flowKey]*FlowStat)
+	payload, err := json.Marshal(stats)
+	if err != nil {
+		log.Printf("FlowStatsFilter error encoding stats: %s\n", err.Error())
+		return
+	}
+	hostname, _ := os.Hostname()
+	msg := &Message{
+		Type:      flowStatsType,
+		Timestamp: self.helper.Now(),
+		Logger:    "hekad",
+		Severity:  SEVERITY_INFO,
+		Payload:   string(payload),
+		Pid:       os.Getpid(),
+		Hostname:  hostname,
+		Fields: map[string]interface{}{
+			"interval": self.flushInterval,
+			"messages": messages,
+			"bytes":    size,
+		},
+	}
+	self.helper.InjectMessage(msg)
+}
+
+type flowStatsByKey []*FlowStat
+
+func (self flowStatsByKey) Len() int      { return len(self) }
+func (self flowStatsByKey) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self flowStatsByKey) Less(i, j int) bool {
+	a, b := self[i], self[j]
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	if a.Logger != b.Logger {
+		return a.Logger < b.Logger
+	}
+	return a.Output < b.Output
+}
+
+func (self *FlowStatsFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	keys := make([]flowKey, 0, len(pipelinePack.Outputs))
+	for outputName, use := range pipelinePack.Outputs {
+		if use {
+			keys = append(keys, flowKey{msg.Type, msg.Logger, outputName})
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	self.flowsIn <- &flowSample{keys, int64(len(msg.Payload))}
+}
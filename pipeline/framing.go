@@ -0,0 +1,222 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	. "heka/message"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Frames start w/ this byte, so a reader that hits a corrupt frame can
+// scan forward to the next one
+const frameSeparator = 0x1e
+
+// Size of the header preceding each framed record: the separator, then
+// big-endian 4 byte length and CRC-32 (IEEE) of the record
+const frameHeaderSize = 9
+
+// Frames claiming to be bigger than a pack's message buffer are taken to
+// be corrupt
+const maxFrameSize = 65536
+
+// Record encodings, kept in the top byte of the frame header's length,
+// which a valid length never reaches. Compressed frames' lengths and CRCs
+// are those of the compressed record.
+const (
+	frameEncodingNone = 0
+	frameEncodingGzip = 1
+	frameSizeMask     = 0x00ffffff
+)
+
+// Names of the record encodings, for `Compression` settings
+const (
+	FrameCompressionNone = "none"
+	FrameCompressionGzip = "gzip"
+)
+
+// Frames a record, so stream readers can find record boundaries and spot
+// corruption. An empty record makes an empty frame.
+func EncodeFrame(record []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(record))
+	writeFrameHeader(frame, record)
+	copy(frame[frameHeaderSize:], record)
+	return frame
+}
+
+func writeFrameHeader(header []byte, record []byte) {
+	header[0] = frameSeparator
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(record)))
+	binary.BigEndian.PutUint32(header[5:9], crc32.ChecksumIEEE(record))
+}
+
+// Checks a frame header, returning the size of the record that follows
+func parseFrameHeader(header []byte) (int, error) {
+	if header[0] != frameSeparator {
+		return 0, errors.New("Missing frame separator")
+	}
+	// The top byte of the length holds the record's encoding
+	size := binary.BigEndian.Uint32(header[1:5]) & frameSizeMask
+	if size > maxFrameSize {
+		return 0, fmt.Errorf("%d byte frame exceeds max size", size)
+	}
+	if encoding := header[1]; encoding > frameEncodingGzip {
+		return 0, fmt.Errorf("Unknown frame encoding %d", encoding)
+	}
+	return int(size), nil
+}
+
+// Checks a record against the CRC in its frame header
+func checkFrame(header []byte, record []byte) error {
+	if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[5:9]) {
+		return errors.New("Frame checksum mismatch")
+	}
+	return nil
+}
+
+// Reads a single frame, returning the record, decompressed if need be.
+// Unlike FramingSplitter this doesn't resynchronize, it's meant for
+// streams where corruption means the connection should be dropped.
+func ReadFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	size, err := parseFrameHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, size)
+	if _, err = io.ReadFull(reader, record); err != nil {
+		return nil, err
+	}
+	if err = checkFrame(header, record); err != nil {
+		return nil, err
+	}
+	return frameRecord(header, record)
+}
+
+// Returns a frame's record, decompressing it if the header says it's
+// compressed
+func frameRecord(header []byte, record []byte) ([]byte, error) {
+	if header[1] != frameEncodingGzip {
+		return record, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(record))
+	if err != nil {
+		return nil, err
+	}
+	// Read one byte past the max, so oversized records can be told apart
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader,
+		maxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxFrameSize {
+		return nil, errors.New("Decompressed frame exceeds max size")
+	}
+	return decompressed, nil
+}
+
+// Records of fewer bytes aren't worth compressing by default
+const defaultCompressionMinSize = 1024
+
+// Reads the `Compression` ("none" or "gzip") and `CompressionMinSize`
+// settings, returning "" for no compression
+func configFrameCompression(config *PluginConfig) (string, int, error) {
+	compression, _ := (*config)["Compression"].(string)
+	switch compression {
+	case "", FrameCompressionNone:
+		return "", 0, nil
+	case FrameCompressionGzip:
+	default:
+		return "", 0, fmt.Errorf("Unknown Compression '%s', must be %s or %s",
+			compression, FrameCompressionNone, FrameCompressionGzip)
+	}
+	minSize, err := ConfigByteSize(config, "CompressionMinSize",
+		defaultCompressionMinSize)
+	if err != nil {
+		return "", 0, err
+	}
+	return compression, int(minSize), nil
+}
+
+// Compressors are reused, they're expensive to set up
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+// Compresses a frame's record w/ the given compression, for records of at
+// least minSize bytes. Frames that are already compressed, that aren't
+// frames at all (e.g. from a non-framing encoder) or that compression
+// doesn't shrink are returned as is, so the receiving end can always read
+// the result w/ a FramingSplitter or ReadFrame.
+func CompressFrame(frame []byte, compression string, minSize int) []byte {
+	if compression != FrameCompressionGzip ||
+		len(frame) < frameHeaderSize+minSize || frame[0] != frameSeparator ||
+		frame[1] != frameEncodingNone {
+		return frame
+	}
+	size, err := parseFrameHeader(frame)
+	if err != nil || frameHeaderSize+size != len(frame) {
+		return frame
+	}
+	buffer := bytes.NewBuffer(make([]byte, frameHeaderSize, len(frame)))
+	writer := gzipWriters.Get().(*gzip.Writer)
+	writer.Reset(buffer)
+	_, err = writer.Write(frame[frameHeaderSize:])
+	if err == nil {
+		err = writer.Close()
+	}
+	gzipWriters.Put(writer)
+	compressed := buffer.Bytes()
+	if err != nil || len(compressed) >= len(frame) {
+		return frame
+	}
+	writeFrameHeader(compressed, compressed[frameHeaderSize:])
+	compressed[1] = frameEncodingGzip
+	return compressed
+}
+
+// Returns a scanner for a stream of framed records, skipping over corrupt
+// data (see FramingSplitter). The splitter is returned too, so callers can
+// tell how much was skipped.
+func NewFrameScanner(reader io.Reader) (*bufio.Scanner, *FramingSplitter) {
+	splitter := new(FramingSplitter)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 4096), frameHeaderSize+maxFrameSize)
+	scanner.Split(splitter.Split)
+	return scanner, splitter
+}
+
+// Encodes a message as a self-contained gob in a frame (see EncodeFrame).
+// This is the native format for heka-to-heka streams and on-disk files.
+func EncodeFramedGob(msg *Message) ([]byte, error) {
+	buffer := bytes.NewBuffer(make([]byte, frameHeaderSize, 512))
+	if err := gob.NewEncoder(buffer).Encode(msg); err != nil {
+		return nil, err
+	}
+	frame := buffer.Bytes()
+	writeFrameHeader(frame, frame[frameHeaderSize:])
+	return frame, nil
+}
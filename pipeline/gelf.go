@@ -0,0 +1,688 @@
+//go:build !nogelf
+// +build !nogelf
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("GelfDecoder", func() interface{} {
+		return new(GelfDecoder)
+	})
+	RegisterPlugin("GelfEncoder", func() interface{} {
+		return new(GelfEncoder)
+	})
+	RegisterPlugin("GelfInput", func() interface{} {
+		return new(GelfInput)
+	})
+	RegisterPlugin("GelfOutput", func() interface{} {
+		return new(GelfOutput)
+	})
+}
+
+const (
+	// Chunked GELF datagrams start w/ these two bytes, followed by an 8
+	// byte message ID, the chunk's sequence number and the chunk count
+	gelfChunkMagic      = "\x1e\x0f"
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+	// Incomplete chunked messages are given up on after this long
+	gelfChunkTimeout = 5 * time.Second
+	// Bounds of the backoff between attempts to send over TCP
+	gelfMinRetryInterval = 100 * time.Millisecond
+	gelfMaxRetryInterval = 30 * time.Second
+)
+
+// Additional field names allowed by the GELF spec
+var gelfFieldNameRegex = regexp.MustCompile(`[^\w.\-]`)
+
+// Returns GELF data w/ any gzip or zlib compression removed
+func gelfDecompress(data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch {
+	case len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) > 1 && data[0] == 0x78:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// GelfDecoder decodes GELF JSON, compressed or not, into messages of type
+// "gelf" (or the "_type" additional field, if set). `host` is the
+// hostname, `short_message` the payload, `level` the severity and
+// `facility` (or "_logger") the logger. Additional fields become message
+// fields w/o the leading underscore, and `full_message` is kept in a field
+// of the same name.
+type GelfDecoder struct {
+}
+
+func (self *GelfDecoder) Init(config *PluginConfig) error {
+	return nil
+}
+
+func (self *GelfDecoder) Decode(pipelinePack *PipelinePack) error {
+	data, err := gelfDecompress(pipelinePack.MsgBytes)
+	if err != nil {
+		return fmt.Errorf("Error decompressing GELF: %s", err.Error())
+	}
+	var gelf map[string]interface{}
+	if err = json.Unmarshal(data, &gelf); err != nil {
+		return err
+	}
+	msg := pipelinePack.Message
+	*msg = Message{Type: "gelf", Severity: SEVERITY_ALERT,
+		Timestamp: time.Now(), Fields: make(map[string]interface{})}
+	for key, value := range gelf {
+		str, _ := value.(string)
+		num, isNum := value.(float64)
+		switch key {
+		case "version":
+		case "host":
+			msg.Hostname = str
+		case "short_message":
+			msg.Payload = str
+		case "full_message":
+			msg.Fields["full_message"] = str
+		case "timestamp":
+			if isNum {
+				seconds, fraction := math.Modf(num)
+				msg.Timestamp = time.Unix(int64(seconds),
+					int64(fraction*1e9))
+			}
+		case "level":
+			if isNum {
+				msg.Severity = int(num)
+			}
+		case "facility":
+			msg.Logger = str
+		case "_type":
+			msg.Type = str
+		case "_logger":
+			if msg.Logger == "" {
+				msg.Logger = str
+			}
+		case "_pid":
+			if isNum {
+				msg.Pid = int(num)
+			}
+		default:
+			if strings.HasPrefix(key, "_") {
+				msg.Fields[key[1:]] = value
+			}
+		}
+	}
+	if msg.Payload == "" {
+		return errors.New("GELF message w/o short_message")
+	}
+	pipelinePack.Decoded = true
+	return nil
+}
+
+// GelfEncoder emits messages as GELF 1.1 JSON, the inverse of GelfDecoder.
+// The first line of the payload is the `short_message`, and the whole
+// payload the `full_message` if it has several lines. The type, logger
+// and pid are sent as the "_type", "_logger" and "_pid" additional fields,
+// and fields as additional fields, w/ characters GELF doesn't allow in
+// names replaced by underscores. Field values other than strings and
+// numbers are sent as JSON strings.
+type GelfEncoder struct {
+	hostname string
+}
+
+func (self *GelfEncoder) Init(config *PluginConfig) error {
+	self.hostname, _ = os.Hostname()
+	return nil
+}
+
+func (self *GelfEncoder) Encode(pipelinePack *PipelinePack) ([]byte, error) {
+	msg := pipelinePack.Message
+	gelf := map[string]interface{}{
+		"version":   "1.1",
+		"host":      msg.Hostname,
+		"timestamp": float64(msg.Timestamp.UnixNano()) / 1e9,
+		"level":     msg.Severity,
+		"_type":     msg.Type,
+	}
+	if msg.Hostname == "" {
+		gelf["host"] = self.hostname
+	}
+	shortMessage := msg.Payload
+	if i := strings.IndexAny(shortMessage, "\r\n"); i >= 0 {
+		shortMessage = shortMessage[:i]
+		gelf["full_message"] = msg.Payload
+	}
+	if shortMessage == "" {
+		// GELF requires a short_message
+		shortMessage = "-"
+	}
+	gelf["short_message"] = shortMessage
+	if msg.Logger != "" {
+		gelf["_logger"] = msg.Logger
+	}
+	if msg.Pid != 0 {
+		gelf["_pid"] = msg.Pid
+	}
+	for name, value := range msg.Fields {
+		if name == "full_message" {
+			if str, ok := value.(string); ok {
+				gelf["full_message"] = str
+			}
+			continue
+		}
+		name = "_" + gelfFieldNameRegex.ReplaceAllString(name, "_")
+		if name == "_id" {
+			// Reserved by the spec
+			name = "_id_"
+		}
+		if _, ok := gelf[name]; ok {
+			continue
+		}
+		switch v := value.(type) {
+		case string, float64, int, int64:
+		case bool:
+			value = fmt.Sprint(v)
+		default:
+			data, err := json.Marshal(value)
+			if err != nil {
+				continue
+			}
+			value = string(data)
+		}
+		gelf[name] = value
+	}
+	return json.Marshal(gelf)
+}
+
+// A chunked GELF message being reassembled
+type gelfChunks struct {
+	chunks   [][]byte
+	received int
+	started  time.Time
+}
+
+// GelfInput accepts GELF messages, as sent by Graylog clients, on
+// `Address`. W/ `Protocol` "udp" (the default) datagrams can be gzip or
+// zlib compressed and chunked; w/ "tcp" messages are uncompressed and
+// null byte delimited. Messages are decoded as by a GelfDecoder and
+// stamped w/ the details of their connection (see ConnFieldNames).
+type GelfInput struct {
+	acceptTracker
+	address    string
+	protocol   string
+	connFields *ConnFieldNames
+	decoder    GelfDecoder
+	udpConn    net.PacketConn
+	listener   net.Listener
+	recordChan chan *connRecord
+	incomplete map[string]*gelfChunks
+	expired    int64
+}
+
+func (self *GelfInput) Init(config *PluginConfig) error {
+	value, ok := (*config)["Address"]
+	if !ok {
+		return errors.New("GelfInput config: Missing Address")
+	}
+	self.address = value.(string)
+	self.protocol = "udp"
+	if value, ok = (*config)["Protocol"]; ok {
+		self.protocol = value.(string)
+	}
+	if self.protocol != "udp" && self.protocol != "tcp" {
+		return fmt.Errorf("GelfInput config: Unknown Protocol: %s",
+			self.protocol)
+	}
+	self.connFields = NewConnFieldNames(config)
+	self.recordChan = make(chan *connRecord, 100)
+	self.incomplete = make(map[string]*gelfChunks)
+	return nil
+}
+
+// Starts listening, reusing an inherited socket if there is one. This
+// happens here rather than in Init so configs can be validated w/o opening
+// sockets.
+func (self *GelfInput) Prepare() (err error) {
+	file := InheritedFile(self.address)
+	if self.protocol == "tcp" {
+		if file != nil {
+			self.listener, err = net.FileListener(file)
+			file.Close()
+		} else {
+			self.listener, err = net.Listen("tcp", self.address)
+		}
+		if err != nil {
+			return
+		}
+		go self.acceptLoop()
+		return nil
+	}
+	if file != nil {
+		self.udpConn, err = net.FilePacketConn(file)
+		file.Close()
+	} else {
+		self.udpConn, err = net.ListenPacket("udp", self.address)
+	}
+	if err != nil {
+		return
+	}
+	go self.udpLoop()
+	return nil
+}
+
+func (self *GelfInput) SocketFiles() (map[string]*os.File, error) {
+	var file *os.File
+	var err error
+	switch conn := self.udpConn.(type) {
+	case *net.UDPConn:
+		file, err = conn.File()
+	default:
+		tcpListener, ok := self.listener.(*net.TCPListener)
+		if !ok {
+			return nil, fmt.Errorf("Not a GELF socket: %s", self.address)
+		}
+		file, err = tcpListener.File()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*os.File{self.address: file}, nil
+}
+
+func (self *GelfInput) udpLoop() {
+	buffer := make([]byte, 65536)
+	local := self.udpConn.LocalAddr().String()
+	for {
+		n, addr, err := self.udpConn.ReadFrom(buffer)
+		if err != nil {
+			log.Printf("GelfInput read error: %s\n", err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		data := self.assemble(buffer[:n])
+		if data != nil {
+			fields := self.connFields.Fields(addr.String(), local, nil, "")
+			self.recordChan <- &connRecord{data, fields}
+		}
+	}
+}
+
+// Returns the message a datagram completes, if any. Unchunked datagrams
+// are complete messages; chunks are held until the rest of their message
+// arrives or it times out.
+func (self *GelfInput) assemble(datagram []byte) []byte {
+	if !bytes.HasPrefix(datagram, []byte(gelfChunkMagic)) {
+		data := make([]byte, len(datagram))
+		copy(data, datagram)
+		return data
+	}
+	now := time.Now()
+	for id, partial := range self.incomplete {
+		if now.Sub(partial.started) > gelfChunkTimeout {
+			delete(self.incomplete, id)
+			atomic.AddInt64(&self.expired, 1)
+		}
+	}
+	if len(datagram) < gelfChunkHeaderSize {
+		return nil
+	}
+	id := string(datagram[2:10])
+	seq, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		return nil
+	}
+	partial, ok := self.incomplete[id]
+	if !ok {
+		partial = &gelfChunks{chunks: make([][]byte, count), started: now}
+		self.incomplete[id] = partial
+	}
+	if len(partial.chunks) != count || partial.chunks[seq] != nil {
+		return nil
+	}
+	chunk := make([]byte, len(datagram)-gelfChunkHeaderSize)
+	copy(chunk, datagram[gelfChunkHeaderSize:])
+	partial.chunks[seq] = chunk
+	if partial.received++; partial.received < count {
+		return nil
+	}
+	delete(self.incomplete, id)
+	return bytes.Join(partial.chunks, nil)
+}
+
+// Closes the TCP listener, if any; open connections are read until the
+// clients close them
+func (self *GelfInput) StopAccepting() {
+	self.stopListener(self.listener)
+}
+
+func (self *GelfInput) acceptLoop() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil && !self.accepting() {
+			return
+		}
+		if err != nil {
+			log.Printf("GelfInput accept error: %s\n", err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go self.handleConnection(conn)
+	}
+}
+
+func (self *GelfInput) handleConnection(conn net.Conn) {
+	peer := peerHost(conn)
+	self.opened(peer)
+	defer self.closed(peer)
+	defer conn.Close()
+	fields := self.connFields.Fields(conn.RemoteAddr().String(),
+		conn.LocalAddr().String(), nil, NewConnectionId())
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := reader.ReadBytes(0)
+		if len(data) > 0 && data[len(data)-1] == 0 {
+			data = data[:len(data)-1]
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			self.recordChan <- &connRecord{data, fields}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("GelfInput error reading from %s: %s\n",
+					conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+	}
+}
+
+// Reports the chunked messages given up on
+func (self *GelfInput) Report() map[string]interface{} {
+	return map[string]interface{}{
+		"expired_chunked": atomic.LoadInt64(&self.expired),
+	}
+}
+
+func (self *GelfInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case record := <-self.recordChan:
+		msgBytes := pipelinePack.MsgBytes[:cap(pipelinePack.MsgBytes)]
+		if len(record.data) > len(msgBytes) {
+			return NewRecordError("GelfInput dropping %d byte message, max "+
+				"size is %d", len(record.data), len(msgBytes))
+		}
+		pipelinePack.MsgBytes = msgBytes[:copy(msgBytes, record.data)]
+		if err := self.decoder.Decode(pipelinePack); err != nil {
+			return NewRecordError("GelfInput error decoding message: %s",
+				err.Error())
+		}
+		pipelinePack.Fields = record.fields
+		return nil
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No messages to read")
+	return &err
+}
+
+// GelfOutput sends messages to a Graylog server (or anything else
+// accepting GELF) at `Address`, encoded by a GelfEncoder. W/ `Protocol`
+// "udp" (the default) messages are compressed as `Compress` says ("gzip",
+// the default, "zlib" or "none") and split into chunks of up to
+// `ChunkSize` bytes (1420 by default) when they don't fit in one
+// datagram. W/ "tcp" messages are null byte delimited, and the connection
+// is re-established as needed. Up to `QueueSize` messages (1000 by
+// default) wait to be sent; messages that don't fit are dropped and
+// counted, unless `Backpressure` says otherwise (see Backpressure).
+type GelfOutput struct {
+	dryRunnable
+	address   string
+	protocol  string
+	compress  string
+	chunkSize int
+	encoder   GelfEncoder
+	conn      net.Conn
+	queue     *Queue
+	// What to do when the queue is full
+	backpressure *Backpressure
+	helper       PluginHelper
+}
+
+func (self *GelfOutput) Init(config *PluginConfig) error {
+	value, ok := (*config)["Address"]
+	if !ok {
+		return errors.New("GelfOutput config: Missing Address")
+	}
+	self.address = value.(string)
+	self.protocol = "udp"
+	if value, ok = (*config)["Protocol"]; ok {
+		self.protocol = value.(string)
+	}
+	switch self.protocol {
+	case "udp":
+		self.compress = "gzip"
+	case "tcp":
+		self.compress = "none"
+	default:
+		return fmt.Errorf("GelfOutput config: Unknown Protocol: %s",
+			self.protocol)
+	}
+	if value, ok = (*config)["Compress"]; ok {
+		self.compress = value.(string)
+	}
+	switch self.compress {
+	case "gzip", "zlib", "none":
+	default:
+		return fmt.Errorf("GelfOutput config: Unknown Compress: %s",
+			self.compress)
+	}
+	if self.protocol == "tcp" && self.compress != "none" {
+		return errors.New("GelfOutput config: GELF over TCP can't be " +
+			"compressed")
+	}
+	self.chunkSize = 1420
+	if value, ok = (*config)["ChunkSize"]; ok {
+		self.chunkSize = int(value.(int64))
+	}
+	if self.chunkSize <= gelfChunkHeaderSize {
+		return fmt.Errorf("GelfOutput config: ChunkSize must be more than "+
+			"%d", gelfChunkHeaderSize)
+	}
+	queueSize := 1000
+	if value, ok = (*config)["QueueSize"]; ok {
+		queueSize = int(value.(int64))
+	}
+	var err error
+	self.backpressure, err = ConfigBackpressure(config, BackpressureDrop)
+	if err != nil {
+		return fmt.Errorf("GelfOutput config: %s", err.Error())
+	}
+	self.encoder.Init(config)
+	self.queue = NewQueue(queueSize, self.backpressure)
+	return nil
+}
+
+// Starts sending queued messages
+func (self *GelfOutput) Prepare() error {
+	superviseTask(self.helper, "sender", self.sender)
+	return nil
+}
+
+func (self *GelfOutput) SetPluginHelper(helper PluginHelper) {
+	self.helper = helper
+}
+
+func (self *GelfOutput) Deliver(pipelinePack *PipelinePack) {
+	data, err := self.encoder.Encode(pipelinePack)
+	if err == nil {
+		data, err = self.pack(data)
+	}
+	if err != nil {
+		log.Println(NewDeliveryError(pipelinePack, "GelfOutput", err))
+		return
+	}
+	self.queue.Send(data, nil)
+}
+
+// Compresses or delimits an encoded message, as the protocol requires
+func (self *GelfOutput) pack(data []byte) ([]byte, error) {
+	if self.protocol == "tcp" {
+		return append(data, 0), nil
+	}
+	buffer := new(bytes.Buffer)
+	var writer io.WriteCloser
+	switch self.compress {
+	case "gzip":
+		writer = gzip.NewWriter(buffer)
+	case "zlib":
+		writer = zlib.NewWriter(buffer)
+	default:
+		return data, nil
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Splits a message into datagrams of at most chunkSize bytes
+func (self *GelfOutput) chunk(data []byte) ([][]byte, error) {
+	if len(data) <= self.chunkSize {
+		return [][]byte{data}, nil
+	}
+	size := self.chunkSize - gelfChunkHeaderSize
+	count := (len(data) + size - 1) / size
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("%d byte message needs more than %d chunks",
+			len(data), gelfMaxChunks)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, count)
+	for i := range chunks {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, 0, gelfChunkHeaderSize+end-i*size)
+		chunk = append(chunk, gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunks[i] = append(chunk, data[i*size:end]...)
+	}
+	return chunks, nil
+}
+
+// Sends a message, connecting first if necessary
+func (self *GelfOutput) send(data []byte) (err error) {
+	if self.dryRun.Skip(data) {
+		return nil
+	}
+	if self.conn == nil {
+		self.conn, err = net.DialTimeout(self.protocol, self.address,
+			10*time.Second)
+		if err != nil {
+			return
+		}
+	}
+	datagrams := [][]byte{data}
+	if self.protocol == "udp" {
+		if datagrams, err = self.chunk(data); err != nil {
+			return
+		}
+	}
+	for _, datagram := range datagrams {
+		if _, err = self.conn.Write(datagram); err != nil {
+			self.conn.Close()
+			self.conn = nil
+			return
+		}
+	}
+	return nil
+}
+
+func (self *GelfOutput) sender() error {
+	interval := gelfMinRetryInterval
+	for item := range self.queue.Chan() {
+		data := item.([]byte)
+		for {
+			err := self.send(data)
+			if err == nil {
+				interval = gelfMinRetryInterval
+				break
+			}
+			log.Printf("GelfOutput error sending to %s: %s\n", self.address,
+				err.Error())
+			if self.protocol == "udp" {
+				// Datagrams aren't worth retrying
+				break
+			}
+			time.Sleep(interval)
+			if interval *= 2; interval > gelfMaxRetryInterval {
+				interval = gelfMaxRetryInterval
+			}
+		}
+	}
+	return nil
+}
+
+// Waits for the send queue to empty out
+func (self *GelfOutput) Drain() error {
+	for self.queue.Len() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (self *GelfOutput) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"dropped": self.backpressure.Lost(),
+	}
+	self.queue.report(report)
+	return report
+}
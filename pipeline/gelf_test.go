@@ -0,0 +1,264 @@
+//go:build !nogelf
+// +build !nogelf
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"strings"
+	"time"
+)
+
+func init() {
+	pluginSpecs = append(pluginSpecs, GelfDecoderSpec, GelfEncoderSpec,
+		GelfInputSpec, GelfOutputSpec)
+}
+
+// A GELF chunk datagram w/ the given header values
+func gelfChunk(id string, seq, count int, data string) []byte {
+	chunk := []byte(gelfChunkMagic + id)
+	chunk = append(chunk, byte(seq), byte(count))
+	return append(chunk, data...)
+}
+
+func GelfDecoderSpec(c gospec.Context) {
+	decoder := new(GelfDecoder)
+	decoder.Init(nil)
+	decode := func(data []byte) (*PipelinePack, error) {
+		pipelinePack := &PipelinePack{MsgBytes: data, Message: new(Message)}
+		return pipelinePack, decoder.Decode(pipelinePack)
+	}
+	gelf := `{"version": "1.1", "host": "web1", "short_message": "oops",
+		"full_message": "oops\nat line 2", "timestamp": 1350000000.5,
+		"level": 3, "facility": "app", "_type": "crash", "_pid": 42,
+		"_user": "bob", "_attempt": 2}`
+
+	c.Specify("Decodes GELF into a message", func() {
+		pipelinePack, err := decode([]byte(gelf))
+		c.Expect(err, gs.IsNil)
+		c.Expect(pipelinePack.Decoded, gs.IsTrue)
+		msg := pipelinePack.Message
+		c.Expect(msg.Hostname, gs.Equals, "web1")
+		c.Expect(msg.Payload, gs.Equals, "oops")
+		c.Expect(msg.Fields["full_message"], gs.Equals, "oops\nat line 2")
+		c.Expect(msg.Timestamp.Equal(time.Unix(1350000000, 5e8)), gs.IsTrue)
+		c.Expect(msg.Severity, gs.Equals, 3)
+		c.Expect(msg.Logger, gs.Equals, "app")
+		c.Expect(msg.Type, gs.Equals, "crash")
+		c.Expect(msg.Pid, gs.Equals, 42)
+		c.Expect(msg.Fields["user"], gs.Equals, "bob")
+		c.Expect(msg.Fields["attempt"], gs.Equals, 2.0)
+	})
+
+	c.Specify("Decodes compressed GELF", func() {
+		buffer := new(bytes.Buffer)
+		writer := zlib.NewWriter(buffer)
+		writer.Write([]byte(gelf))
+		writer.Close()
+		pipelinePack, err := decode(buffer.Bytes())
+		c.Expect(err, gs.IsNil)
+		c.Expect(pipelinePack.Message.Payload, gs.Equals, "oops")
+	})
+
+	c.Specify("Falls back to _logger and defaults the type", func() {
+		pipelinePack, err := decode([]byte(
+			`{"short_message": "hi", "_logger": "lib"}`))
+		c.Expect(err, gs.IsNil)
+		c.Expect(pipelinePack.Message.Logger, gs.Equals, "lib")
+		c.Expect(pipelinePack.Message.Type, gs.Equals, "gelf")
+		c.Expect(pipelinePack.Message.Severity, gs.Equals, SEVERITY_ALERT)
+	})
+
+	c.Specify("Rejects GELF w/o a short_message", func() {
+		pipelinePack, err := decode([]byte(`{"host": "web1"}`))
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(pipelinePack.Decoded, gs.IsFalse)
+	})
+}
+
+func GelfEncoderSpec(c gospec.Context) {
+	encoder := new(GelfEncoder)
+	encoder.Init(nil)
+	encode := func(msg *Message) map[string]interface{} {
+		data, err := encoder.Encode(&PipelinePack{Message: msg})
+		c.Assume(err, gs.IsNil)
+		var gelf map[string]interface{}
+		c.Assume(json.Unmarshal(data, &gelf), gs.IsNil)
+		return gelf
+	}
+
+	c.Specify("Splits multi-line payloads", func() {
+		gelf := encode(&Message{Type: "crash", Payload: "oops\nat line 2",
+			Hostname: "web1", Severity: 3, Logger: "app", Pid: 42})
+		c.Expect(gelf["version"], gs.Equals, "1.1")
+		c.Expect(gelf["host"], gs.Equals, "web1")
+		c.Expect(gelf["short_message"], gs.Equals, "oops")
+		c.Expect(gelf["full_message"], gs.Equals, "oops\nat line 2")
+		c.Expect(gelf["level"], gs.Equals, 3.0)
+		c.Expect(gelf["_type"], gs.Equals, "crash")
+		c.Expect(gelf["_logger"], gs.Equals, "app")
+		c.Expect(gelf["_pid"], gs.Equals, 42.0)
+	})
+
+	c.Specify("Sends fields as valid additional fields", func() {
+		gelf := encode(&Message{Payload: "", Fields: map[string]interface{}{
+			"user name": "bob", "id": "abc", "ok": true,
+			"tags": []interface{}{"a", "b"}}})
+		c.Expect(gelf["short_message"], gs.Equals, "-")
+		c.Expect(gelf["host"], gs.Equals, encoder.hostname)
+		c.Expect(gelf["_user_name"], gs.Equals, "bob")
+		c.Expect(gelf["_id_"], gs.Equals, "abc")
+		_, reserved := gelf["_id"]
+		c.Expect(reserved, gs.IsFalse)
+		c.Expect(gelf["_ok"], gs.Equals, "true")
+		c.Expect(gelf["_tags"], gs.Equals, `["a","b"]`)
+	})
+
+	c.Specify("Round trips through a GelfDecoder", func() {
+		output := new(GelfOutput)
+		c.Assume(output.Init(&PluginConfig{"Address": "localhost:12201"}),
+			gs.IsNil)
+		msg := &Message{Type: "crash", Payload: "oops", Hostname: "web1",
+			Severity: 3, Timestamp: time.Unix(1350000000, 0),
+			Fields: map[string]interface{}{"user": "bob"}}
+		data, err := encoder.Encode(&PipelinePack{Message: msg})
+		c.Assume(err, gs.IsNil)
+		data, err = output.pack(data)
+		c.Assume(err, gs.IsNil)
+		pipelinePack := &PipelinePack{MsgBytes: data, Message: new(Message)}
+		c.Expect(new(GelfDecoder).Decode(pipelinePack), gs.IsNil)
+		decoded := pipelinePack.Message
+		c.Expect(decoded.Type, gs.Equals, "crash")
+		c.Expect(decoded.Payload, gs.Equals, "oops")
+		c.Expect(decoded.Hostname, gs.Equals, "web1")
+		c.Expect(decoded.Severity, gs.Equals, 3)
+		c.Expect(decoded.Timestamp.Equal(msg.Timestamp), gs.IsTrue)
+		c.Expect(decoded.Fields["user"], gs.Equals, "bob")
+	})
+}
+
+func GelfInputSpec(c gospec.Context) {
+	input := new(GelfInput)
+	c.Assume(input.Init(&PluginConfig{"Address": "127.0.0.1:0"}), gs.IsNil)
+	assemble := func(datagram []byte) string {
+		return string(input.assemble(datagram))
+	}
+
+	c.Specify("Passes unchunked datagrams through", func() {
+		c.Expect(assemble([]byte(`{"short_message": "hi"}`)), gs.Equals,
+			`{"short_message": "hi"}`)
+	})
+
+	c.Specify("Reassembles chunks that arrive out of order", func() {
+		c.Expect(assemble(gelfChunk("message1", 2, 3, "ghi")), gs.Equals, "")
+		c.Expect(assemble(gelfChunk("message1", 0, 3, "abc")), gs.Equals, "")
+		c.Expect(assemble(gelfChunk("message1", 1, 3, "def")), gs.Equals,
+			"abcdefghi")
+		c.Expect(len(input.incomplete), gs.Equals, 0)
+	})
+
+	c.Specify("Keeps messages apart by ID", func() {
+		assemble(gelfChunk("message1", 0, 2, "abc"))
+		assemble(gelfChunk("message2", 0, 2, "xyz"))
+		c.Expect(assemble(gelfChunk("message2", 1, 2, "!")), gs.Equals,
+			"xyz!")
+		c.Expect(assemble(gelfChunk("message1", 1, 2, "?")), gs.Equals,
+			"abc?")
+	})
+
+	c.Specify("Ignores duplicate chunks", func() {
+		assemble(gelfChunk("message1", 0, 2, "abc"))
+		c.Expect(assemble(gelfChunk("message1", 0, 2, "xyz")), gs.Equals, "")
+		c.Expect(assemble(gelfChunk("message1", 1, 2, "def")), gs.Equals,
+			"abcdef")
+	})
+
+	c.Specify("Expires incomplete messages", func() {
+		assemble(gelfChunk("message1", 0, 2, "abc"))
+		input.incomplete["message1"].started = time.Now().Add(
+			-2 * gelfChunkTimeout)
+		assemble(gelfChunk("message2", 0, 2, "xyz"))
+		c.Expect(input.Report()["expired_chunked"], gs.Equals, int64(1))
+		// The rest of the expired message starts a new one
+		c.Expect(assemble(gelfChunk("message1", 1, 2, "def")), gs.Equals, "")
+		_, ok := input.incomplete["message2"]
+		c.Expect(ok, gs.IsTrue)
+	})
+
+	c.Specify("Drops chunks w/ bad headers", func() {
+		c.Expect(assemble([]byte(gelfChunkMagic+"short")), gs.Equals, "")
+		c.Expect(assemble(gelfChunk("message1", 0, 0, "abc")), gs.Equals, "")
+		c.Expect(assemble(gelfChunk("message1", 0, gelfMaxChunks+1, "abc")),
+			gs.Equals, "")
+		c.Expect(assemble(gelfChunk("message1", 2, 2, "abc")), gs.Equals, "")
+		c.Expect(len(input.incomplete), gs.Equals, 0)
+		// A chunk can't change its message's chunk count
+		assemble(gelfChunk("message1", 0, 2, "abc"))
+		c.Expect(assemble(gelfChunk("message1", 1, 1, "def")), gs.Equals, "")
+		c.Expect(assemble(gelfChunk("message1", 1, 2, "def")), gs.Equals,
+			"abcdef")
+	})
+}
+
+func GelfOutputSpec(c gospec.Context) {
+	output := new(GelfOutput)
+	c.Assume(output.Init(&PluginConfig{"Address": "localhost:12201",
+		"ChunkSize": int64(gelfChunkHeaderSize + 4)}), gs.IsNil)
+
+	c.Specify("Sends small messages in one datagram", func() {
+		chunks, err := output.chunk([]byte("abcd"))
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(chunks), gs.Equals, 1)
+		c.Expect(string(chunks[0]), gs.Equals, "abcd")
+	})
+
+	c.Specify("Chunks large messages", func() {
+		chunks, err := output.chunk([]byte("abcdefghijklmnopqr"))
+		c.Expect(err, gs.IsNil)
+		c.Assume(len(chunks), gs.Equals, 5)
+		id := string(chunks[0][2:10])
+		for i, chunk := range chunks {
+			c.Expect(strings.HasPrefix(string(chunk), gelfChunkMagic),
+				gs.IsTrue)
+			c.Expect(string(chunk[2:10]), gs.Equals, id)
+			c.Expect(int(chunk[10]), gs.Equals, i)
+			c.Expect(int(chunk[11]), gs.Equals, 5)
+			c.Expect(len(chunk) <= output.chunkSize, gs.IsTrue)
+		}
+		c.Expect(string(chunks[4][gelfChunkHeaderSize:]), gs.Equals, "qr")
+
+		input := new(GelfInput)
+		input.Init(&PluginConfig{"Address": "127.0.0.1:0"})
+		var data []byte
+		for i := len(chunks) - 1; i >= 0; i-- {
+			data = input.assemble(chunks[i])
+		}
+		c.Expect(string(data), gs.Equals, "abcdefghijklmnopqr")
+	})
+
+	c.Specify("Refuses messages that need too many chunks", func() {
+		_, err := output.chunk(make([]byte, 4*gelfMaxChunks+1))
+		c.Expect(err, gs.Not(gs.IsNil))
+		chunks, err := output.chunk(make([]byte, 4*gelfMaxChunks))
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(chunks), gs.Equals, gelfMaxChunks)
+	})
+}
@@ -0,0 +1,242 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MessageGeneratorInput feeds messages delivered to it by plugins, e.g.
+// the StatRollupFilter's rollups, into the pipeline.
+//
+// W/ `Generate` set it also makes up messages at `Rate` per second (as
+// fast as it can if 0, the default), so PoolSize, filters and outputs can
+// be benchmarked w/o a network hop or a load generator in the way. It
+// stops after `Count` messages if that's set, logging how long they took.
+//
+// The messages are of type `Type` ("heka.generated") and severity
+// `Severity` (6), w/ a `PayloadSize` (100B) payload, the fields in
+// `Fields` and `FieldCount` (0) more called field_0, field_1 etc. holding
+// the message number. W/ a `Format` of "decoded" (the default) the
+// messages skip decoding; "json" or "gob" hands them to the `Decoder` (the
+// default decoder if not set) as records instead, so decoders can be
+// benchmarked too. Records are encoded once, so they all carry the same
+// timestamp.
+//
+// The number of messages generated and the rate so far are reported (see
+// Reporter).
+type MessageGeneratorInput struct {
+	messages chan *Message
+	conf     *MessageGeneratorInputConfig
+	fields   map[string]interface{}
+	payload  string
+	hostname string
+	record   []byte
+	interval time.Duration
+	next     time.Time
+	// When the first message was generated, in Unix nanoseconds, and the
+	// number generated so far. Accessed atomically, for Report.
+	started   int64
+	generated int64
+}
+
+type MessageGeneratorInputConfig struct {
+	Generate    bool
+	Rate        float64  `default:"0" min:"0"`
+	Count       int64    `default:"0" min:"0"`
+	Type        string   `default:"heka.generated"`
+	Logger      string   `default:"MessageGeneratorInput"`
+	Severity    int      `default:"6" min:"0" max:"7"`
+	PayloadSize ByteSize `default:"100B" min:"0"`
+	FieldCount  int      `default:"0" min:"0"`
+	Format      string   `default:"decoded" choices:"decoded,json,gob"`
+	Decoder     string
+}
+
+func (self *MessageGeneratorInput) Init(config *PluginConfig) error {
+	self.conf = new(MessageGeneratorInputConfig)
+	if err := LoadConfigStruct(config, self.conf); err != nil {
+		return fmt.Errorf("MessageGeneratorInput config: %s", err.Error())
+	}
+	self.messages = make(chan *Message, 100)
+	self.fields = make(map[string]interface{})
+	if value, ok := (*config)["Fields"]; ok {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.New("MessageGeneratorInput config: Fields must " +
+				"be an object")
+		}
+		for name, value := range fields {
+			self.fields[name] = normalizeConfigValue(value)
+		}
+	}
+	size := int(self.conf.PayloadSize)
+	alphabet := "abcdefghijklmnopqrstuvwxyz"
+	self.payload = strings.Repeat(alphabet, size/len(alphabet)+1)[:size]
+	self.hostname, _ = os.Hostname()
+	if self.conf.Rate > 0 {
+		self.interval = time.Duration(float64(time.Second) / self.conf.Rate)
+	}
+	if self.conf.Format != "decoded" {
+		msg := new(Message)
+		self.fill(msg, 0)
+		var err error
+		if self.record, err = encodeGenerated(msg,
+			self.conf.Format); err != nil {
+			return fmt.Errorf("MessageGeneratorInput config: %s",
+				err.Error())
+		}
+		if len(self.record) > maxFrameSize {
+			return fmt.Errorf("MessageGeneratorInput config: %d byte "+
+				"records are too big for a pack, reduce PayloadSize",
+				len(self.record))
+		}
+	}
+	return nil
+}
+
+func encodeGenerated(msg *Message, format string) ([]byte, error) {
+	if format == "json" {
+		return msg.MarshalJSON()
+	}
+	buffer := new(bytes.Buffer)
+	err := gob.NewEncoder(buffer).Encode(msg)
+	return buffer.Bytes(), err
+}
+
+// Makes the message the nth generated one
+func (self *MessageGeneratorInput) fill(msg *Message, n int64) {
+	msg.Type = self.conf.Type
+	msg.Timestamp = time.Now()
+	msg.Logger = self.conf.Logger
+	msg.Severity = self.conf.Severity
+	msg.Payload = self.payload
+	msg.Env_version = "0.8"
+	msg.Pid = os.Getpid()
+	msg.Hostname = self.hostname
+	msg.Fields = make(map[string]interface{},
+		len(self.fields)+self.conf.FieldCount)
+	msg.Representations = nil
+	for name, value := range self.fields {
+		msg.Fields[name] = value
+	}
+	for i := 0; i < self.conf.FieldCount; i++ {
+		msg.Fields[fmt.Sprintf("field_%d", i)] = n
+	}
+}
+
+// Queues a copy of a message to be read into the pipeline
+func (self *MessageGeneratorInput) Deliver(msg *Message) {
+	newMessage := new(Message)
+	msg.Copy(newMessage)
+	self.messages <- newMessage
+}
+
+// Returns whether there are messages left to make up
+func (self *MessageGeneratorInput) generating() bool {
+	return self.conf.Generate && (self.conf.Count == 0 ||
+		atomic.LoadInt64(&self.generated) < self.conf.Count)
+}
+
+// Returns how long until the next message should be made up, at most the
+// timeout
+func (self *MessageGeneratorInput) untilNext(
+	timeout time.Duration) time.Duration {
+	now := time.Now()
+	if atomic.LoadInt64(&self.started) == 0 {
+		atomic.StoreInt64(&self.started, now.UnixNano())
+		self.next = now
+	}
+	wait := self.next.Sub(now)
+	if self.interval == 0 || wait < 0 {
+		return 0
+	}
+	if wait > timeout {
+		return timeout
+	}
+	return wait
+}
+
+// Makes up the next message in the pack
+func (self *MessageGeneratorInput) generate(pipelinePack *PipelinePack) {
+	if self.interval > 0 {
+		self.next = self.next.Add(self.interval)
+		// Don't burst to catch up after falling a long way behind
+		if time.Since(self.next) > time.Second {
+			self.next = time.Now()
+		}
+	}
+	if self.record != nil {
+		msgBytes := pipelinePack.MsgBytes[:cap(pipelinePack.MsgBytes)]
+		pipelinePack.MsgBytes = msgBytes[:copy(msgBytes, self.record)]
+		if self.conf.Decoder != "" {
+			pipelinePack.Decoder = self.conf.Decoder
+		}
+	} else {
+		self.fill(pipelinePack.Message, atomic.LoadInt64(&self.generated))
+		pipelinePack.Decoded = true
+	}
+	generated := atomic.AddInt64(&self.generated, 1)
+	if generated == self.conf.Count {
+		started := time.Unix(0, atomic.LoadInt64(&self.started))
+		elapsed := time.Since(started)
+		log.Printf("MessageGeneratorInput generated %d messages in %s "+
+			"(%.0f/s)\n", generated, elapsed,
+			float64(generated)/elapsed.Seconds())
+	}
+}
+
+func (self *MessageGeneratorInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	wait := *timeout
+	generating := self.generating()
+	if generating {
+		if wait = self.untilNext(*timeout); wait == 0 {
+			self.generate(pipelinePack)
+			return nil
+		}
+	}
+	select {
+	case msg := <-self.messages:
+		pipelinePack.Message = msg
+		pipelinePack.Decoded = true
+		return nil
+	case <-time.After(wait):
+	}
+	if generating && self.untilNext(*timeout) == 0 {
+		self.generate(pipelinePack)
+		return nil
+	}
+	err := TimeoutError("No messages to read")
+	return &err
+}
+
+func (self *MessageGeneratorInput) Report() map[string]interface{} {
+	generated := atomic.LoadInt64(&self.generated)
+	report := map[string]interface{}{"generated": generated}
+	if started := atomic.LoadInt64(&self.started); started != 0 {
+		report["rate"] = float64(generated) /
+			time.Since(time.Unix(0, started)).Seconds()
+	}
+	return report
+}
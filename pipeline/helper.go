@@ -0,0 +1,252 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PluginHelper is the supported API for plugins to interact w/ the
+// running pipeline, rather than reaching into the GraterConfig. Each
+// plugin gets its own helper, so state and logging are scoped to it.
+// Out-of-process and sandboxed plugins map onto the same operations.
+type PluginHelper interface {
+	// Takes a pack from the pool, blocking until one is free. The pack
+	// must be handed back via Inject.
+	PipelinePack() *PipelinePack
+	// Sends a pack through the pipeline, starting w/ decoding unless the
+	// pack is marked as decoded
+	Inject(pipelinePack *PipelinePack)
+	// Sends a copy of an already decoded message through the pipeline
+	InjectMessage(msg *Message)
+	// Looks up a decoder by name
+	Decoder(name string) (Decoder, bool)
+	// Key/value state for the plugin, kept across restarts of hekad if
+	// there's a state dir (see GraterConfig.StateDir)
+	State() *StateStore
+	// The current time, which tests can control via GraterConfig.Clock
+	Now() time.Time
+	// A logger prefixed w/ the plugin's kind and name
+	Logger() *log.Logger
+	// Runs one of the plugin's long-lived goroutines, e.g. an output's
+	// sender, restarting it per the plugin's restart policy if it panics
+	// or returns an error (see Supervise)
+	Supervise(task string, fn func() error)
+}
+
+// Runs a plugin goroutine under its helper's supervision, or unsupervised
+// if the plugin wasn't handed a helper, e.g. in tests
+func superviseTask(helper PluginHelper, task string, fn func() error) {
+	if helper == nil {
+		go fn()
+		return
+	}
+	helper.Supervise(task, fn)
+}
+
+// Plugins implementing HelperUser are handed their PluginHelper before
+// Prepare is called
+type HelperUser interface {
+	SetPluginHelper(helper PluginHelper)
+}
+
+// StateStore is a goroutine safe key/value store
+type StateStore struct {
+	values map[string][]byte
+	lock   sync.RWMutex
+}
+
+func NewStateStore() *StateStore {
+	return &StateStore{values: make(map[string][]byte)}
+}
+
+func (self *StateStore) Get(key string) ([]byte, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	value, ok := self.values[key]
+	return value, ok
+}
+
+func (self *StateStore) Set(key string, value []byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.values[key] = value
+}
+
+func (self *StateStore) Delete(key string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.values, key)
+}
+
+// Saves the store as alternating key and value records
+func (self *StateStore) save(path string) error {
+	self.lock.RLock()
+	records := make([][]byte, 0, len(self.values)*2)
+	for key, value := range self.values {
+		records = append(records, []byte(key), value)
+	}
+	self.lock.RUnlock()
+	return writeSnapshot(path, records)
+}
+
+func (self *StateStore) load(path string) error {
+	records, err := readSnapshot(path)
+	if err != nil {
+		return err
+	}
+	if len(records)%2 != 0 {
+		return fmt.Errorf("Corrupt state file: %s", path)
+	}
+	for i := 0; i < len(records); i += 2 {
+		self.Set(string(records[i]), records[i+1])
+	}
+	return nil
+}
+
+// pipelineHelpers hands out the PluginHelpers for a running pipeline and
+// keeps track of their state stores
+type pipelineHelpers struct {
+	config  *GraterConfig
+	pool    *PackPool
+	process func(pipelinePack *PipelinePack)
+	states  map[string]*StateStore
+}
+
+func statePath(dir string, p namedPlugin) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.state", p.kind, p.name))
+}
+
+// Gives every HelperUser plugin its helper, loading any saved state
+func (self *pipelineHelpers) setup(plugins []namedPlugin) {
+	for _, p := range plugins {
+		user, ok := p.plugin.(HelperUser)
+		if !ok {
+			continue
+		}
+		state := NewStateStore()
+		if dir := self.config.stateDir(); dir != "" {
+			err := state.load(statePath(dir, p))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Error loading state for %s %s: %s\n", p.kind,
+					p.name, err.Error())
+			}
+		}
+		self.states[p.kind+" "+p.name] = state
+		var helper PluginHelper = &pluginHelper{self, p, state}
+		if filter, ok := p.plugin.(Filter); ok && p.kind == "filter" {
+			if sandbox, ok := self.config.Sandboxes[filter]; ok {
+				helper = &sandboxHelper{helper, sandbox, self.config}
+			}
+		}
+		user.SetPluginHelper(helper)
+	}
+}
+
+// Saves the plugins' state stores, if there's a state dir
+func (self *pipelineHelpers) saveStates(plugins []namedPlugin) {
+	dir := self.config.stateDir()
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Error saving plugin state: %s\n", err.Error())
+		return
+	}
+	for _, p := range plugins {
+		state, ok := self.states[p.kind+" "+p.name]
+		if !ok {
+			continue
+		}
+		if err := state.save(statePath(dir, p)); err != nil {
+			log.Printf("Error saving state for %s %s: %s\n", p.kind, p.name,
+				err.Error())
+		}
+	}
+}
+
+type pluginHelper struct {
+	helpers *pipelineHelpers
+	plugin  namedPlugin
+	state   *StateStore
+}
+
+func (self *pluginHelper) PipelinePack() *PipelinePack {
+	return self.helpers.pool.Get()
+}
+
+func (self *pluginHelper) Inject(pipelinePack *PipelinePack) {
+	pipelinePack.InputName = self.plugin.name
+	pipelinePack.ReadTime = time.Now()
+	go self.helpers.process(pipelinePack)
+}
+
+func (self *pluginHelper) InjectMessage(msg *Message) {
+	pipelinePack := self.PipelinePack()
+	newMessage := new(Message)
+	msg.Copy(newMessage)
+	pipelinePack.Message = newMessage
+	pipelinePack.Decoded = true
+	self.Inject(pipelinePack)
+}
+
+func (self *pluginHelper) Decoder(name string) (Decoder, bool) {
+	decoder, ok := self.helpers.config.Decoders[name]
+	return decoder, ok
+}
+
+func (self *pluginHelper) State() *StateStore {
+	return self.state
+}
+
+func (self *pluginHelper) Now() time.Time {
+	if self.helpers.config.Clock != nil {
+		return self.helpers.config.Clock()
+	}
+	return time.Now()
+}
+
+func (self *pluginHelper) Logger() *log.Logger {
+	return log.New(os.Stderr, fmt.Sprintf("%s %s: ", self.plugin.kind,
+		self.plugin.name), log.LstdFlags)
+}
+
+func (self *pluginHelper) Supervise(task string, fn func() error) {
+	p := self.plugin
+	policies := self.helpers.config.RestartPolicies
+	if p.kind == "output" {
+		policies = self.helpers.config.OutputRestartPolicies
+	}
+	policy, ok := policies[p.name]
+	if !ok {
+		policy = DefaultRestartPolicy
+	}
+	name := fmt.Sprintf("%s %s %s", p.name, p.kind, task)
+	onRestart := restartNotifier(self.helpers, p.kind, p.name)
+	go Supervise(name, policy, fn, onRestart)
+}
+
+// Returns the directory state is kept in across restarts, if any
+func (self *GraterConfig) stateDir() string {
+	if self.StateDir != "" {
+		return self.StateDir
+	}
+	return self.SnapshotDir
+}
@@ -0,0 +1,301 @@
+//go:build !nohttpinput
+// +build !nohttpinput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("HttpListenInput", func() interface{} {
+		return new(HttpListenInput)
+	})
+}
+
+// Context key for the ID of a request's connection
+type httpConnectionIdKey struct{}
+
+// Content type for bodies made up of heka framed records (see
+// EncodeFramedGob)
+const httpFramedContentType = "application/x-heka-framed"
+
+// Largest request body HttpListenInput will accept
+const httpMaxBodySize = 10 * 1024 * 1024
+
+// A record from a request body, w/ the fields it should be stamped with
+type httpRecord struct {
+	data    []byte
+	decoder string
+	fields  map[string]interface{}
+}
+
+// HttpListenInput accepts records POSTed to it over HTTP, so webhook style
+// producers and browsers can feed the pipeline. Bodies sent as
+// application/x-heka-framed are split w/ heka's framing and handed to the
+// `FramedDecoder` (gob by default); anything else is treated as one or
+// more newline delimited JSON documents and handed to the `Decoder` (the
+// default decoder if not set). A malformed body is rejected as a whole w/
+// a 400.
+//
+// Messages are stamped w/ the details of the connection they came in on
+// (see ConnFieldNames), and each of the `HeaderFields` request headers is
+// stored in a field of the same name. If `BasicAuthUser` or
+// `ApiKeys` are set, requests must supply matching basic auth
+// credentials or an X-Api-Key header.
+type HttpListenInput struct {
+	acceptTracker
+	address       string
+	decoder       string
+	framedDecoder string
+	headerFields  []string
+	connFields    *ConnFieldNames
+	authUser      string
+	authPassword  string
+	apiKeys       []string
+	listener      net.Listener
+	server        *http.Server
+	recordChan    chan *httpRecord
+}
+
+func (self *HttpListenInput) Init(config *PluginConfig) error {
+	value, ok := (*config)["Address"]
+	if !ok {
+		return errors.New("HttpListenInput config: Missing Address")
+	}
+	self.address = value.(string)
+	if value, ok = (*config)["Decoder"]; ok {
+		self.decoder = value.(string)
+	}
+	self.framedDecoder = "gob"
+	if value, ok = (*config)["FramedDecoder"]; ok {
+		self.framedDecoder = value.(string)
+	}
+	if value, ok = (*config)["HeaderFields"]; ok {
+		self.headerFields = value.([]string)
+	}
+	self.connFields = NewConnFieldNames(config)
+	if value, ok = (*config)["BasicAuthUser"]; ok {
+		self.authUser = value.(string)
+		value, ok = (*config)["BasicAuthPassword"]
+		if !ok {
+			return errors.New("HttpListenInput config: BasicAuthUser needs " +
+				"BasicAuthPassword")
+		}
+		self.authPassword = value.(string)
+	}
+	if value, ok = (*config)["ApiKeys"]; ok {
+		self.apiKeys = value.([]string)
+	}
+	self.recordChan = make(chan *httpRecord, 100)
+	return nil
+}
+
+// Starts listening, reusing an inherited socket if there is one
+func (self *HttpListenInput) Prepare() (err error) {
+	if file := InheritedFile(self.address); file != nil {
+		self.listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		self.listener, err = net.Listen("tcp", self.address)
+	}
+	if err != nil {
+		return
+	}
+	self.server = &http.Server{
+		Handler: self,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnectionIdKey{},
+				NewConnectionId())
+		},
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				self.opened(peerHost(conn))
+			case http.StateHijacked, http.StateClosed:
+				self.closed(peerHost(conn))
+			}
+		},
+	}
+	go func() {
+		err := self.server.Serve(self.listener)
+		log.Printf("HttpListenInput %s stopped: %s\n", self.address,
+			err.Error())
+	}()
+	return nil
+}
+
+// Closes the listener and stops keeping connections alive, so clients
+// move on once their current requests are done
+func (self *HttpListenInput) StopAccepting() {
+	if self.server != nil {
+		self.server.SetKeepAlivesEnabled(false)
+	}
+	self.stopListener(self.listener)
+}
+
+func (self *HttpListenInput) SocketFiles() (map[string]*os.File, error) {
+	tcpListener, ok := self.listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("Not a TCP listener: %s", self.address)
+	}
+	file, err := tcpListener.File()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*os.File{self.address: file}, nil
+}
+
+// Returns whether no credentials are required or the request has valid
+// ones
+func (self *HttpListenInput) authorized(req *http.Request) bool {
+	if self.authUser == "" && len(self.apiKeys) == 0 {
+		return true
+	}
+	if user, password, ok := req.BasicAuth(); ok && self.authUser != "" {
+		if subtle.ConstantTimeCompare([]byte(user), []byte(self.authUser)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password),
+				[]byte(self.authPassword)) == 1 {
+			return true
+		}
+	}
+	if key := req.Header.Get("X-Api-Key"); key != "" {
+		for _, apiKey := range self.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Splits a request body into records, returning an error if any of them
+// are malformed. Corrupt frames fail the whole request, rather than being
+// skipped, so the client knows to resend.
+func (self *HttpListenInput) splitBody(body []byte,
+	framed bool) ([][]byte, error) {
+	records := make([][]byte, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	splitter := new(FramingSplitter)
+	if framed {
+		scanner.Buffer(make([]byte, 4096), frameHeaderSize+maxFrameSize)
+		scanner.Split(splitter.Split)
+	}
+	for scanner.Scan() {
+		record := bytes.TrimSpace(scanner.Bytes())
+		if len(record) == 0 {
+			continue
+		}
+		if !framed && !json.Valid(record) {
+			return nil, fmt.Errorf("Invalid JSON in record %d", len(records)+1)
+		}
+		records = append(records, append([]byte(nil), record...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if skipped := splitter.Skipped(); skipped > 0 {
+		return nil, fmt.Errorf("%d bytes of corrupt frames", skipped)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("Empty body")
+	}
+	return records, nil
+}
+
+func (self *HttpListenInput) ServeHTTP(w http.ResponseWriter,
+	req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !self.authorized(req) {
+		if self.authUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="heka"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body,
+		httpMaxBodySize))
+	if err != nil {
+		http.Error(w, "Request body too large",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	framed := contentType == httpFramedContentType
+	records, err := self.splitBody(body, framed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	decoder := self.decoder
+	if framed {
+		decoder = self.framedDecoder
+	}
+	var localAddr string
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr.String()
+	}
+	connectionId, _ := req.Context().Value(httpConnectionIdKey{}).(string)
+	fields := self.connFields.Fields(req.RemoteAddr, localAddr, req.TLS,
+		connectionId)
+	for _, header := range self.headerFields {
+		if value := req.Header.Get(header); value != "" {
+			fields[header] = value
+		}
+	}
+	for _, record := range records {
+		self.recordChan <- &httpRecord{record, decoder, fields}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (self *HttpListenInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case record := <-self.recordChan:
+		msgBytes := pipelinePack.MsgBytes[:cap(pipelinePack.MsgBytes)]
+		if len(record.data) > len(msgBytes) {
+			return NewRecordError("HttpListenInput dropping %d byte record, "+
+				"max size is %d", len(record.data), len(msgBytes))
+		}
+		pipelinePack.MsgBytes = msgBytes[:copy(msgBytes, record.data)]
+		pipelinePack.Fields = record.fields
+		if record.decoder != "" {
+			pipelinePack.Decoder = record.decoder
+		}
+		return nil
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No records to read")
+	return &err
+}
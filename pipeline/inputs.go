@@ -15,8 +15,8 @@ package pipeline
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
-	. "heka/message"
 	"log"
 	"net"
 	"os"
@@ -30,123 +30,318 @@ func (self *TimeoutError) Error() string {
 	return fmt.Sprint("Error: Read timed out")
 }
 
+// Returned by Read for a record the input had to drop, e.g. one too large
+// for a pack. The runner logs it and goes on reading, whereas any other
+// error, bar a timeout, restarts the read loop (see InputRunner.Start).
+type RecordError struct {
+	msg string
+}
+
+func NewRecordError(format string, args ...interface{}) *RecordError {
+	return &RecordError{fmt.Sprintf(format, args...)}
+}
+
+func (self *RecordError) Error() string {
+	return self.msg
+}
+
+// Returns whether a Read error just means nothing arrived in time
+func isReadTimeout(err error) bool {
+	if _, ok := err.(*TimeoutError); ok {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 type Input interface {
 	Plugin
 	Read(pipelinePack *PipelinePack, timeout *time.Duration) error
 }
 
-// InputRunner
+// InputRunner reads from an input until it's stopped. Each run of the
+// runner owns a stop channel, closed by Stop, which the read loop checks
+// between reads and selects on wherever it waits, so a stop can't be
+// missed however it races w/ Start or a restart of the read loop.
 type InputRunner struct {
-	input   Input
-	timeout *time.Duration
-	running bool
+	name      string
+	input     Input
+	timeout   *time.Duration
+	stop      chan struct{}
+	stopOnce  *sync.Once
+	policy    RestartPolicy
+	onRestart func(attempt int, err error)
+	scheduler *PackScheduler
+	// Reports whether the input has been disabled (see pluginSwitches)
+	disabled func() bool
+	// Held across restarts so a pack isn't lost when Read panics
+	pipelinePack *PipelinePack
+	// The pool's backpressure policy and, if it's to drop, the pack read
+	// into when the pool is empty (see PackPool)
+	backpressure *Backpressure
+	overflow     *PipelinePack
 }
 
-func (self *InputRunner) Start(pipeline func(*PipelinePack),
-	recycleChan <-chan *PipelinePack, wg *sync.WaitGroup) {
-	self.running = true
+func NewInputRunner(name string, input Input, timeout *time.Duration,
+	policy RestartPolicy) *InputRunner {
+	return &InputRunner{name: name, input: input, timeout: timeout,
+		policy: policy}
+}
 
-	go func() {
-		var err error
-		var pipelinePack *PipelinePack
-		needOne := true
-		for self.running {
-			if needOne {
-				pipelinePack = <-recycleChan
+// Returns whether the stop channel has been closed
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+	}
+	return false
+}
+
+func (self *InputRunner) readLoop(pipeline func(*PipelinePack),
+	recycle *Queue, stop <-chan struct{}) error {
+	var err error
+	for !stopped(stop) {
+		if self.disabled != nil && self.disabled() {
+			select {
+			case <-stop:
+			case <-time.After(*self.timeout):
+			}
+			continue
+		}
+		if self.pipelinePack == nil {
+			if self.scheduler != nil {
+				self.pipelinePack = self.scheduler.Get(self.name)
+			} else if !self.takePack(recycle, stop) {
+				return nil
 			}
-			err = self.input.Read(pipelinePack, self.timeout)
-			if err != nil {
-				needOne = false
+		}
+		err = self.input.Read(self.pipelinePack, self.timeout)
+		if err != nil {
+			if isReadTimeout(err) {
 				continue
 			}
-			go pipeline(pipelinePack)
-			needOne = true
+			if _, ok := err.(*RecordError); ok {
+				log.Printf("%s input: %s\n", self.name, err.Error())
+				continue
+			}
+			if stopped(stop) {
+				return nil
+			}
+			return err
+		}
+		if self.pipelinePack == self.overflow {
+			// Read while the pool was empty, so the record is dropped
+			input, ok := self.input.(AckAwareInput)
+			if ok && self.overflow.AckToken != nil {
+				input.Ack(self.overflow.AckToken, errAckDropped)
+			}
+			resetPack(self.overflow)
+			self.pipelinePack = nil
+			continue
+		}
+		self.pipelinePack.InputName = self.name
+		self.pipelinePack.ReadTime = time.Now()
+		go pipeline(self.pipelinePack)
+		self.pipelinePack = nil
+	}
+	return nil
+}
+
+// Takes a pack from the pool, applying the pool's backpressure policy if
+// it's empty. Returns false if the runner was stopped while waiting.
+func (self *InputRunner) takePack(recycle *Queue,
+	stop <-chan struct{}) bool {
+	wait := func() {
+		select {
+		case item := <-recycle.Chan():
+			// nil if the pool's been closed
+			self.pipelinePack, _ = item.(*PipelinePack)
+		case <-stop:
 		}
+	}
+	if self.backpressure == nil || self.overflow == nil {
+		wait()
+		return self.pipelinePack != nil
+	}
+	took := self.backpressure.Send(func() bool {
+		item, ok := recycle.TryPop()
+		if ok {
+			self.pipelinePack = item.(*PipelinePack)
+		}
+		return ok
+	}, wait, func() bool { return false })
+	if !took {
+		self.pipelinePack = self.overflow
+	}
+	return self.pipelinePack != nil
+}
+
+// Starts reading from the input, restarting the read loop according to
+// the runner's restart policy if the input panics or Read fails w/
+// anything but a timeout or a RecordError
+func (self *InputRunner) Start(pipeline func(*PipelinePack),
+	recycle *Queue, wg *sync.WaitGroup) {
+	stop := make(chan struct{})
+	self.stop = stop
+	self.stopOnce = new(sync.Once)
+
+	go func() {
+		Supervise(self.name+" input", self.policy, func() error {
+			return self.readLoop(pipeline, recycle, stop)
+		}, self.onRestart)
 		wg.Done()
 	}()
 }
 
+// Stops the runner once the current read returns. Safe to call more than
+// once, or before Start.
 func (self *InputRunner) Stop() {
-	self.running = false
+	if self.stop == nil {
+		return
+	}
+	stop := self.stop
+	self.stopOnce.Do(func() {
+		close(stop)
+	})
 }
 
-// UdpInput
+// UdpInput stamps each message w/ the sender's address and the local
+// port (see ConnFieldNames)
 type UdpInput struct {
-	listener *net.Conn
-	deadline time.Time
+	addrStr    string
+	listener   *net.Conn
+	deadline   time.Time
+	connFields *ConnFieldNames
 }
 
-func NewUdpInput(addrStr string, fd *uintptr) *UdpInput {
-	var listener net.Conn
+// Returns a UDP socket, using the explicitly provided fd if there is one,
+// then any socket for the address inherited from systemd or a parent
+// hekad, and otherwise listening on the address
+func listenUdp(addrStr string, fd *uintptr) net.Conn {
+	var udpFile *os.File
 	if *fd != 0 {
-		udpFile := os.NewFile(*fd, "udpFile")
+		udpFile = os.NewFile(*fd, "udpFile")
+	} else {
+		udpFile = InheritedFile(addrStr)
+	}
+	if udpFile != nil {
 		fdConn, err := net.FileConn(udpFile)
 		if err != nil {
 			log.Printf("Error accessing UDP fd: %s\n", err.Error())
 			return nil
 		}
-		listener = fdConn
-	} else {
-		udpAddr, err := net.ResolveUDPAddr("udp", addrStr)
-		if err != nil {
-			log.Printf("ResolveUDPAddr failed: %s\n", err.Error())
-			return nil
-		}
-		listener, err = net.ListenUDP("udp", udpAddr)
-		if err != nil {
-			log.Printf("ListenUDP failed: %s\n", err.Error())
-			return nil
-		}
+		return fdConn
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addrStr)
+	if err != nil {
+		log.Printf("ResolveUDPAddr failed: %s\n", err.Error())
+		return nil
 	}
-	return &UdpInput{listener: &listener}
+	listener, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		log.Printf("ListenUDP failed: %s\n", err.Error())
+		return nil
+	}
+	return listener
+}
+
+// Returns the file for a UDP socket so it can be handed to another process
+func udpSocketFiles(addrStr string, listener net.Conn) (map[string]*os.File,
+	error) {
+	udpConn, ok := listener.(*net.UDPConn)
+	if !ok {
+		return nil, fmt.Errorf("Not a UDP socket: %s", addrStr)
+	}
+	file, err := udpConn.File()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*os.File{addrStr: file}, nil
+}
+
+func NewUdpInput(addrStr string, fd *uintptr) *UdpInput {
+	listener := listenUdp(addrStr, fd)
+	if listener == nil {
+		return nil
+	}
+	return &UdpInput{addrStr: addrStr, listener: &listener}
 }
 
+// Reads the `Address` config setting if the input wasn't created by
+// NewUdpInput. Listening is left to Prepare so configs can be validated
+// w/o opening sockets.
 func (self *UdpInput) Init(config *PluginConfig) error {
+	self.connFields = NewConnFieldNames(config)
+	if self.listener != nil {
+		return nil
+	}
+	addrStr, ok := (*config)["Address"].(string)
+	if !ok {
+		return errors.New("UdpInput config: Missing Address")
+	}
+	self.addrStr = addrStr
 	return nil
 }
 
+func (self *UdpInput) Prepare() error {
+	if self.listener != nil {
+		return nil
+	}
+	var fd uintptr
+	listener := listenUdp(self.addrStr, &fd)
+	if listener == nil {
+		return fmt.Errorf("UdpInput unable to listen on %s", self.addrStr)
+	}
+	self.listener = &listener
+	return nil
+}
+
+func (self *UdpInput) SocketFiles() (map[string]*os.File, error) {
+	return udpSocketFiles(self.addrStr, *self.listener)
+}
+
 func (self *UdpInput) Read(pipelinePack *PipelinePack,
 	timeout *time.Duration) error {
 	self.deadline = time.Now().Add(*timeout)
 	(*self.listener).SetReadDeadline(self.deadline)
-	n, err := (*self.listener).Read(pipelinePack.MsgBytes)
+	packetConn, ok := (*self.listener).(net.PacketConn)
+	if !ok || self.connFields == nil {
+		n, err := (*self.listener).Read(pipelinePack.MsgBytes)
+		if err == nil {
+			pipelinePack.MsgBytes = pipelinePack.MsgBytes[:n]
+		}
+		return err
+	}
+	n, addr, err := packetConn.ReadFrom(pipelinePack.MsgBytes)
 	if err == nil {
 		pipelinePack.MsgBytes = pipelinePack.MsgBytes[:n]
+		pipelinePack.Fields = self.connFields.Fields(addr.String(),
+			packetConn.LocalAddr().String(), nil, "")
 	}
 	return err
 }
 
 // UdpGobInput
 type UdpGobInput struct {
+	addrStr  string
 	listener *net.Conn
 	deadline time.Time
 	decoder  *gob.Decoder
 }
 
 func NewUdpGobInput(addrStr string, fd *uintptr) *UdpGobInput {
-	var listener net.Conn
-	if *fd != 0 {
-		udpFile := os.NewFile(*fd, "udpFile")
-		fdConn, err := net.FileConn(udpFile)
-		if err != nil {
-			log.Printf("Error accessing UDP fd: %s\n", err.Error())
-			return nil
-		}
-		listener = fdConn
-	} else {
-		udpAddr, err := net.ResolveUDPAddr("udp", addrStr)
-		if err != nil {
-			log.Printf("ResolveUDPAddr failed: %s\n", err.Error())
-			return nil
-		}
-		listener, err = net.ListenUDP("udp", udpAddr)
-		if err != nil {
-			log.Printf("ListenUDP failed: %s\n", err.Error())
-			return nil
-		}
+	listener := listenUdp(addrStr, fd)
+	if listener == nil {
+		return nil
 	}
 	decoder := gob.NewDecoder(listener)
-	return &UdpGobInput{listener: &listener, decoder: decoder}
+	return &UdpGobInput{addrStr: addrStr, listener: &listener,
+		decoder: decoder}
+}
+
+func (self *UdpGobInput) SocketFiles() (map[string]*os.File, error) {
+	return udpSocketFiles(self.addrStr, *self.listener)
 }
 
 func (self *UdpGobInput) Init(config *PluginConfig) error {
@@ -163,34 +358,3 @@ func (self *UdpGobInput) Read(pipelinePack *PipelinePack,
 	}
 	return err
 }
-
-// MessageGeneratorInput
-type MessageGeneratorInput struct {
-	messages chan *Message
-}
-
-func (self *MessageGeneratorInput) Init(config *PluginConfig) error {
-	self.messages = make(chan *Message, 100)
-	return nil
-}
-
-func (self *MessageGeneratorInput) Deliver(msg *Message) {
-	newMessage := new(Message)
-	msg.Copy(newMessage)
-	self.messages <- newMessage
-}
-
-func (self *MessageGeneratorInput) Read(pipeline *PipelinePack,
-	timeout *time.Duration) error {
-	select {
-	case msg := <-self.messages:
-		pipeline.Message = msg
-		pipeline.Decoded = true
-		return nil
-	case <-time.After(*timeout):
-		err := TimeoutError("No messages to read")
-		return &err
-	}
-	// shouldn't get here, compiler makes us have a return
-	return nil
-}
@@ -0,0 +1,210 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"sync"
+	"time"
+)
+
+// An input that always has a message ready
+type busyInput struct{}
+
+func (self *busyInput) Init(config *PluginConfig) error {
+	return nil
+}
+
+func (self *busyInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	return nil
+}
+
+// An input whose Read fails w/ the queued errors, then times out
+type failingInput struct {
+	errs chan error
+}
+
+func (self *failingInput) Init(config *PluginConfig) error {
+	return nil
+}
+
+func (self *failingInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case err := <-self.errs:
+		return err
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No messages to read")
+	return &err
+}
+
+// Returns whether the wait group is done before the timeout
+func waitsFor(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+	return false
+}
+
+func InputRunnerSpec(c gospec.Context) {
+	timeout := 10 * time.Millisecond
+	recycle := NewQueue(10, nil)
+	for i := 0; i < recycle.Cap(); i++ {
+		recycle.Push(&PipelinePack{Message: new(Message)}, 0)
+	}
+	pipeline := func(pipelinePack *PipelinePack) {
+		recycle.Push(pipelinePack, 0)
+	}
+
+	c.Specify("An InputRunner stops while waiting for a pack", func() {
+		empty := NewQueue(1, nil)
+		var wg sync.WaitGroup
+		runner := NewInputRunner("busy", new(busyInput), &timeout,
+			DefaultRestartPolicy)
+		wg.Add(1)
+		runner.Start(pipeline, empty, &wg)
+		runner.Stop()
+		c.Expect(waitsFor(&wg, time.Second), gs.IsTrue)
+	})
+
+	c.Specify("InputRunners stop under load across restart storms", func() {
+		var wg sync.WaitGroup
+		runners := make([]*InputRunner, 10)
+		for round := 0; round < 50; round++ {
+			for i := range runners {
+				runners[i] = NewInputRunner("busy", new(busyInput),
+					&timeout, DefaultRestartPolicy)
+				wg.Add(1)
+				runners[i].Start(pipeline, recycle, &wg)
+			}
+			for _, runner := range runners {
+				runner.Stop()
+				runner.Stop()
+			}
+		}
+		c.Expect(waitsFor(&wg, 5*time.Second), gs.IsTrue)
+	})
+
+	c.Specify("A Stop before Start doesn't stop the next run",
+		func() {
+			runner := NewInputRunner("busy", new(busyInput), &timeout,
+				DefaultRestartPolicy)
+			runner.Stop()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			runner.Start(pipeline, recycle, &wg)
+			c.Expect(waitsFor(&wg, 50*time.Millisecond), gs.IsFalse)
+			runner.Stop()
+			c.Expect(waitsFor(&wg, time.Second), gs.IsTrue)
+		})
+
+	c.Specify("An InputRunner restarts after a Read error", func() {
+		input := &failingInput{errs: make(chan error, 2)}
+		policy := RestartPolicy{MaxRetries: 1, Delay: time.Millisecond,
+			MaxDelay: time.Millisecond}
+		runner := NewInputRunner("failing", input, &timeout, policy)
+		restarts := make(chan error, 2)
+		runner.onRestart = func(attempt int, err error) {
+			restarts <- err
+		}
+		input.errs <- NewRecordError("bad record")
+		input.errs <- errors.New("connection lost")
+		var wg sync.WaitGroup
+		wg.Add(1)
+		runner.Start(pipeline, recycle, &wg)
+
+		select {
+		case err := <-restarts:
+			c.Expect(err.Error(), gs.Equals, "connection lost")
+		case <-time.After(time.Second):
+			c.Expect("restart", gs.Equals, "no restart")
+		}
+		c.Expect(len(restarts), gs.Equals, 0)
+		runner.Stop()
+		c.Expect(waitsFor(&wg, time.Second), gs.IsTrue)
+	})
+}
+
+func MessageGeneratorInputSpec(c gospec.Context) {
+	timeout := 10 * time.Millisecond
+	newPack := func() *PipelinePack {
+		return &PipelinePack{MsgBytes: make([]byte, 65536),
+			Message: new(Message)}
+	}
+
+	c.Specify("A MessageGeneratorInput makes messages of the given shape",
+		func() {
+			input := new(MessageGeneratorInput)
+			fields := map[string]interface{}{"env": "bench"}
+			err := input.Init(&PluginConfig{"Generate": true,
+				"Count": int64(2), "PayloadSize": "30B",
+				"FieldCount": int64(2), "Fields": fields})
+			c.Assume(err, gs.IsNil)
+			for i := 0; i < 2; i++ {
+				pack := newPack()
+				c.Expect(input.Read(pack, &timeout), gs.IsNil)
+				c.Expect(pack.Decoded, gs.IsTrue)
+				msg := pack.Message
+				c.Expect(msg.Type, gs.Equals, "heka.generated")
+				c.Expect(len(msg.Payload), gs.Equals, 30)
+				c.Expect(msg.Fields["env"], gs.Equals, "bench")
+				c.Expect(msg.Fields["field_1"], gs.Equals, int64(i))
+			}
+			_, timedOut := input.Read(newPack(), &timeout).(*TimeoutError)
+			c.Expect(timedOut, gs.IsTrue)
+			c.Expect(input.Report()["generated"], gs.Equals, int64(2))
+		})
+
+	c.Specify("A MessageGeneratorInput can hand records to a decoder",
+		func() {
+			input := new(MessageGeneratorInput)
+			err := input.Init(&PluginConfig{"Generate": true,
+				"Format": "json", "Decoder": "json"})
+			c.Assume(err, gs.IsNil)
+			pack := newPack()
+			c.Expect(input.Read(pack, &timeout), gs.IsNil)
+			c.Expect(pack.Decoded, gs.IsFalse)
+			c.Expect(pack.Decoder, gs.Equals, "json")
+			decoder := new(JsonDecoder)
+			c.Assume(decoder.Init(&PluginConfig{}), gs.IsNil)
+			c.Expect(decoder.Decode(pack), gs.IsNil)
+			c.Expect(pack.Message.Type, gs.Equals, "heka.generated")
+		})
+
+	c.Specify("A MessageGeneratorInput sticks to its rate", func() {
+		input := new(MessageGeneratorInput)
+		err := input.Init(&PluginConfig{"Generate": true,
+			"Rate": int64(20)})
+		c.Assume(err, gs.IsNil)
+		wait := time.Second
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			c.Expect(input.Read(newPack(), &wait), gs.IsNil)
+		}
+		// The first message is immediate, then one every 50ms
+		c.Expect(time.Since(start) >= 100*time.Millisecond, gs.IsTrue)
+	})
+}
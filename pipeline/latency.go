@@ -0,0 +1,107 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Sub-buckets per power of two, so a percentile is off by at most 25%
+const latencySubBuckets = 4
+
+// Enough buckets for any time.Duration in microseconds
+const latencyBuckets = 64 * latencySubBuckets
+
+// LatencyHistogram counts latencies, e.g. from when a pack was read to
+// when an output accepted it, in log-linear buckets: four per power of two
+// microseconds. Recording is a single atomic add, so it's cheap enough to
+// do for every pack. Percentiles are read over the latencies recorded
+// since the last read, so they track the current state of the pipeline;
+// rising latency shows outputs falling behind before their queues fill
+// and messages start being dropped.
+type LatencyHistogram struct {
+	counts [latencyBuckets]uint64
+}
+
+// Returns the bucket for a latency in microseconds
+func latencyBucket(micros uint64) int {
+	shift := bits.Len64(micros) - 3
+	if shift < 0 {
+		return int(micros)
+	}
+	return shift*latencySubBuckets + int(micros>>uint(shift))
+}
+
+// Returns the midpoint of a bucket, in milliseconds
+func latencyBucketMillis(bucket int) float64 {
+	if bucket < latencySubBuckets {
+		return float64(bucket) / 1000
+	}
+	shift := uint(bucket/latencySubBuckets - 1)
+	lower := uint64(bucket%latencySubBuckets+latencySubBuckets) << shift
+	upper := lower + 1<<shift
+	return float64(lower+upper) / 2000
+}
+
+// Records a latency
+func (self *LatencyHistogram) Record(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+	bucket := latencyBucket(uint64(latency / time.Microsecond))
+	atomic.AddUint64(&self.counts[bucket], 1)
+}
+
+// Adds the number of latencies recorded since the last report and their
+// 50th, 95th and 99th percentiles in ms, to a report under the prefix,
+// e.g. "latency_p99_ms", and starts counting afresh
+func (self *LatencyHistogram) report(report map[string]interface{},
+	prefix string) {
+	var counts [latencyBuckets]uint64
+	var total uint64
+	for i := range self.counts {
+		counts[i] = atomic.SwapUint64(&self.counts[i], 0)
+		total += counts[i]
+	}
+	report[prefix+"_samples"] = int64(total)
+	if total == 0 {
+		return
+	}
+	percentiles := []struct {
+		key      string
+		fraction float64
+	}{{"_p50_ms", 0.5}, {"_p95_ms", 0.95}, {"_p99_ms", 0.99}}
+	var seen uint64
+	next := 0
+	for bucket, count := range counts {
+		seen += count
+		for next < len(percentiles) &&
+			float64(seen) >= percentiles[next].fraction*float64(total) {
+			report[prefix+percentiles[next].key] =
+				latencyBucketMillis(bucket)
+			next++
+		}
+	}
+}
+
+// End-to-end latency of packs through the whole pipeline, i.e. from being
+// read until every output is done w/ them, reported as the "pipeline
+// latency" plugin
+func (self *LatencyHistogram) Report() map[string]interface{} {
+	report := make(map[string]interface{})
+	self.report(report, "latency")
+	return report
+}
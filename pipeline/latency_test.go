@@ -0,0 +1,54 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	"math"
+	"time"
+)
+
+func LatencyHistogramSpec(c gospec.Context) {
+	// Whether a reported percentile is w/in a bucket's width of want
+	near := func(value interface{}, want float64) bool {
+		got, ok := value.(float64)
+		return ok && math.Abs(got-want) <= want/4
+	}
+
+	c.Specify("Bucket midpoints are close to the latencies", func() {
+		for _, micros := range []uint64{0, 3, 7, 100, 12345, 1 << 40} {
+			millis := latencyBucketMillis(latencyBucket(micros))
+			c.Expect(math.Abs(millis*1000-float64(micros)) <=
+				float64(micros)/4, gs.IsTrue)
+		}
+	})
+
+	c.Specify("Percentiles are reported since the last report", func() {
+		histogram := new(LatencyHistogram)
+		for i := 1; i <= 100; i++ {
+			histogram.Record(time.Duration(i) * time.Millisecond)
+		}
+		report := histogram.Report()
+		c.Expect(report["latency_samples"], gs.Equals, int64(100))
+		c.Expect(near(report["latency_p50_ms"], 50), gs.IsTrue)
+		c.Expect(near(report["latency_p95_ms"], 95), gs.IsTrue)
+		c.Expect(near(report["latency_p99_ms"], 99), gs.IsTrue)
+
+		report = histogram.Report()
+		c.Expect(report["latency_samples"], gs.Equals, int64(0))
+		_, ok := report["latency_p50_ms"]
+		c.Expect(ok, gs.IsFalse)
+	})
+}
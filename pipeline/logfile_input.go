@@ -0,0 +1,501 @@
+//go:build !nologfileinput
+// +build !nologfileinput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("LogfileInput", func() interface{} {
+		return new(LogfileInput)
+	})
+}
+
+// A record read from a log file, along w/ the offset just past it
+type logfileRecord struct {
+	file     *logfileFile
+	data     []byte
+	offset   int64
+	backfill bool
+	// Whether it's the first record in the file
+	first bool
+}
+
+// One of the files read from the path, which changes w/ each rotation or
+// truncation. Offsets are acked per file, since a rotation starts them
+// again from 0.
+type logfileFile struct {
+	// Bumped w/ each reopen, so acks for an old file can't move the
+	// journal back to it
+	generation  int
+	device      uint64
+	inode       uint64
+	size        int64
+	checkpoints *Checkpoints
+}
+
+func newLogfileFile(info os.FileInfo, generation int,
+	offset int64) *logfileFile {
+	device, inode := fileIdentity(info)
+	return &logfileFile{generation: generation, device: device,
+		inode: inode, size: info.Size(),
+		checkpoints: NewCheckpoints(offset)}
+}
+
+// Returns the device and inode numbers that identify a file
+func fileIdentity(info os.FileInfo) (device, inode uint64) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), uint64(stat.Ino)
+	}
+	return 0, 0
+}
+
+// The ack token for a record: its checkpoint in the file it came from
+type logfileToken struct {
+	file       *logfileFile
+	checkpoint interface{}
+}
+
+// Where the last run got to, as saved in the journal: the offset, the
+// file's device and inode numbers and its size when the journal was
+// written, e.g. "1234 2049 131077 5678". Journals from before the file
+// was recorded hold just the offset.
+type logfileJournal struct {
+	offset int64
+	device uint64
+	inode  uint64
+	size   int64
+}
+
+// Returns whether reading can carry on from the journal's offset in the
+// file, i.e. it's the same file and hasn't been truncated since
+func (self *logfileJournal) resumes(info os.FileInfo) bool {
+	if info.Size() < self.offset {
+		return false
+	}
+	if self.inode == 0 {
+		return true
+	}
+	device, inode := fileIdentity(info)
+	return device == self.device && inode == self.inode &&
+		info.Size() >= self.size
+}
+
+// LogfileInput tails `File`, splitting what's appended to it into records
+// w/ the configured splitter (newline by default) and handing them to the
+// decoder. The file is checked for new data every `PollInterval`
+// milliseconds (1000 by default), and is reopened if it's rotated or
+// truncated.
+//
+// If `Journal` is set, the offset of the last record delivered is saved
+// there so a restart picks up where the last run left off; otherwise
+// reading starts at the end of the file. The journal records which file
+// the offset is in, so if the file was rotated or truncated in between
+// the restart reads the new one from the start. The offset only moves past a
+// record once every output it was routed to has it (see AckAwareInput),
+// so records in flight when graterd stops are read again on restart.
+// Records that failed to be delivered still move it, since they can't be
+// read again once later ones have been, but they're counted.
+//
+// On the first run (i.e. when the journal doesn't exist yet) w/ `Backfill`
+// set, the content already in the file is read too, but at no more than
+// `BackfillRate` records per second (1000 by default) so the initial
+// import doesn't swamp the outputs. Backfilled records get a "backfill"
+// field set to true, which filters working on real time data can use to
+// skip them (AlertFilter does by default).
+type LogfileInput struct {
+	path         string
+	journal      string
+	decoder      string
+	splitter     Splitter
+	backfill     bool
+	backfillRate float64
+	pollInterval time.Duration
+	recordChan   chan *logfileRecord
+	// The file being read, and the file and offset of the last record
+	// delivered
+	lock        sync.Mutex
+	current     *logfileFile
+	file        *logfileFile
+	offset      int64
+	ackFailures int64
+	backfilling int32
+	backfilled  int64
+}
+
+func (self *LogfileInput) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["File"]
+	if !ok {
+		return errors.New("LogfileInput config: Missing File")
+	}
+	self.path = value.(string)
+	if value, ok = (*config)["Journal"]; ok {
+		self.journal = value.(string)
+	}
+	if value, ok = (*config)["Decoder"]; ok {
+		self.decoder = value.(string)
+	}
+	if value, ok = (*config)["Backfill"]; ok {
+		self.backfill = value.(bool)
+	}
+	if self.backfill && self.journal == "" {
+		return errors.New("LogfileInput config: Backfill needs a Journal")
+	}
+	self.backfillRate = 1000
+	if value, ok = (*config)["BackfillRate"]; ok {
+		self.backfillRate, err = toFloat64(value)
+		if err != nil || self.backfillRate <= 0 {
+			return errors.New("LogfileInput config: BackfillRate must be a " +
+				"positive number")
+		}
+	}
+	self.pollInterval, err = ConfigDuration(config, "PollInterval",
+		time.Millisecond, time.Second)
+	if err != nil {
+		return fmt.Errorf("LogfileInput config: %s", err.Error())
+	}
+	splitterKind := "newline"
+	if value, ok = (*config)["Splitter"]; ok {
+		splitterKind = value.(string)
+	}
+	if self.splitter, err = NewSplitter(splitterKind); err != nil {
+		return
+	}
+	if err = self.splitter.Init(config); err != nil {
+		return
+	}
+	self.recordChan = make(chan *logfileRecord, 100)
+	return nil
+}
+
+// Reads the saved position, returning nil if there's no journal yet
+func (self *LogfileInput) readJournal() (*logfileJournal, error) {
+	if self.journal == "" {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(self.journal)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	values := strings.Fields(string(contents))
+	if len(values) != 1 && len(values) != 4 {
+		return nil, fmt.Errorf("Invalid journal %s: %q", self.journal,
+			contents)
+	}
+	journal := new(logfileJournal)
+	journal.offset, err = strconv.ParseInt(values[0], 10, 64)
+	if err == nil && len(values) == 4 {
+		if journal.device, err = strconv.ParseUint(values[1], 10,
+			64); err == nil {
+			if journal.inode, err = strconv.ParseUint(values[2], 10,
+				64); err == nil {
+				journal.size, err = strconv.ParseInt(values[3], 10, 64)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid journal %s: %s", self.journal,
+			err.Error())
+	}
+	return journal, nil
+}
+
+// Saves the position of the last record handed to the pipeline. It's
+// written to a temporary file first, so a crash can't leave a partial
+// journal.
+func (self *LogfileInput) writeJournal(file *logfileFile, offset int64) error {
+	tmpPath := self.journal + ".tmp"
+	contents := fmt.Sprintf("%d %d %d %d", offset, file.device, file.inode,
+		atomic.LoadInt64(&file.size))
+	if err := ioutil.WriteFile(tmpPath, []byte(contents), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, self.journal)
+}
+
+// Returns the file and offset of the last record delivered
+func (self *LogfileInput) position() (*logfileFile, int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.file, self.offset
+}
+
+// Opens the file and works out where to start reading, then starts
+// tailing it
+func (self *LogfileInput) Prepare() error {
+	file, err := os.Open(self.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	journal, err := self.readJournal()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	var offset, backfillEnd int64
+	switch {
+	case journal != nil && journal.resumes(info):
+		offset = journal.offset
+	case journal != nil:
+		log.Printf("LogfileInput %s was rotated or truncated since the "+
+			"last run, reading it from the start\n", self.path)
+	case self.backfill:
+		backfillEnd = info.Size()
+	default:
+		offset = info.Size()
+	}
+	if _, err = file.Seek(offset, os.SEEK_SET); err != nil {
+		file.Close()
+		return err
+	}
+	self.current = newLogfileFile(info, 0, offset)
+	self.file, self.offset = self.current, offset
+	if offset < backfillEnd {
+		atomic.StoreInt32(&self.backfilling, 1)
+		log.Printf("LogfileInput backfilling %d bytes of %s\n", backfillEnd,
+			self.path)
+	}
+	go self.tail(file, offset, backfillEnd)
+	return nil
+}
+
+func (self *LogfileInput) tail(file *os.File, offset, backfillEnd int64) {
+	var throttle *time.Ticker
+	if offset < backfillEnd {
+		throttle = time.NewTicker(time.Duration(float64(time.Second) /
+			self.backfillRate))
+	}
+	chunk := make([]byte, 4096)
+	pending := make([]byte, 0, 4096)
+	current := self.current
+	saved, savedOffset := self.position()
+	savedSize := current.size
+	lastSave := time.Now()
+	for {
+		n, err := file.Read(chunk)
+		if n > 0 {
+			pending = append(pending, chunk[:n]...)
+		} else if err != nil && err != io.EOF {
+			log.Printf("LogfileInput error reading %s: %s\n", self.path,
+				err.Error())
+		}
+		// Pending data is split even w/o new data, so splitters that wait
+		// for a record's end (see MultilineSplitter) can time out
+		if len(pending) > 0 {
+			start := 0
+			for {
+				advance, token, splitErr := self.splitter.Split(pending[start:],
+					false)
+				if splitErr != nil {
+					log.Printf("LogfileInput error splitting %s: %s\n",
+						self.path, splitErr.Error())
+					advance = len(pending) - start
+				}
+				if advance == 0 {
+					break
+				}
+				start += advance
+				offset += int64(advance)
+				if token == nil {
+					continue
+				}
+				record := &logfileRecord{file: current,
+					data: make([]byte, len(token)), offset: offset,
+					first: offset == int64(advance)}
+				copy(record.data, token)
+				if throttle != nil {
+					if offset <= backfillEnd {
+						record.backfill = true
+						<-throttle.C
+					} else {
+						throttle = self.backfillDone(throttle)
+					}
+				}
+				self.recordChan <- record
+			}
+			pending = append(pending[:0], pending[start:]...)
+			if len(pending) >= bufio.MaxScanTokenSize {
+				log.Printf("LogfileInput dropping %d bytes of %s w/o a "+
+					"record boundary\n", len(pending), self.path)
+				offset += int64(len(pending))
+				pending = pending[:0]
+			}
+		}
+		if throttle != nil && offset >= backfillEnd {
+			throttle = self.backfillDone(throttle)
+		}
+		if self.journal != "" &&
+			(n == 0 || time.Since(lastSave) >= time.Second) {
+			acked, ackedOffset := self.position()
+			size := atomic.LoadInt64(&acked.size)
+			if acked != saved || ackedOffset != savedOffset ||
+				size != savedSize {
+				if err = self.writeJournal(acked, ackedOffset); err != nil {
+					log.Printf("LogfileInput error saving journal: %s\n",
+						err.Error())
+				}
+				saved, savedOffset, savedSize = acked, ackedOffset, size
+			}
+			lastSave = time.Now()
+		}
+		if n > 0 {
+			continue
+		}
+		time.Sleep(self.pollInterval)
+		reopened, info := self.reopen(file, offset)
+		if reopened != nil {
+			file.Close()
+			file = reopened
+			offset = 0
+			pending = pending[:0]
+			current = newLogfileFile(info, current.generation+1, 0)
+			self.lock.Lock()
+			self.current = current
+			self.lock.Unlock()
+		} else if info != nil {
+			atomic.StoreInt64(&current.size, info.Size())
+		}
+	}
+}
+
+// Stops throttling once the content that was there at startup has been
+// read
+func (self *LogfileInput) backfillDone(throttle *time.Ticker) *time.Ticker {
+	throttle.Stop()
+	atomic.StoreInt32(&self.backfilling, 0)
+	log.Printf("LogfileInput finished backfilling %s\n", self.path)
+	return nil
+}
+
+// Returns a new handle on the file if it's been rotated or truncated, i.e.
+// replaced by a different file or now shorter than what's been read,
+// along w/ the file's details, which are those of the file still being
+// read if it hasn't
+func (self *LogfileInput) reopen(file *os.File, offset int64) (*os.File,
+	os.FileInfo) {
+	info, err := os.Stat(self.path)
+	if err != nil {
+		// Rotated but not yet recreated
+		return nil, nil
+	}
+	current, err := file.Stat()
+	if err != nil {
+		return nil, nil
+	}
+	if os.SameFile(info, current) && info.Size() >= offset {
+		return nil, current
+	}
+	reopened, err := os.Open(self.path)
+	if err == nil {
+		info, err = reopened.Stat()
+	}
+	if err != nil {
+		log.Printf("LogfileInput error reopening %s: %s\n", self.path,
+			err.Error())
+		if reopened != nil {
+			reopened.Close()
+		}
+		return nil, nil
+	}
+	return reopened, info
+}
+
+func (self *LogfileInput) Report() map[string]interface{} {
+	self.lock.Lock()
+	offset, unacked := self.offset, 0
+	if self.current != nil {
+		unacked = self.current.checkpoints.Pending()
+	}
+	self.lock.Unlock()
+	return map[string]interface{}{
+		"offset":           offset,
+		"unacked":          unacked,
+		"ack_failures":     atomic.LoadInt64(&self.ackFailures),
+		"backfilling":      atomic.LoadInt32(&self.backfilling) == 1,
+		"backfill_records": atomic.LoadInt64(&self.backfilled),
+	}
+}
+
+// Moves the offset on once the records before it have all been delivered
+func (self *LogfileInput) Ack(token interface{}, err error) {
+	if err != nil {
+		atomic.AddInt64(&self.ackFailures, 1)
+	}
+	ackToken, ok := token.(*logfileToken)
+	if !ok {
+		return
+	}
+	offset, moved := ackToken.file.checkpoints.Ack(ackToken.checkpoint)
+	if !moved {
+		return
+	}
+	self.lock.Lock()
+	if ackToken.file.generation >= self.file.generation {
+		self.file, self.offset = ackToken.file, offset
+	}
+	self.lock.Unlock()
+}
+
+func (self *LogfileInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case record := <-self.recordChan:
+		token := &logfileToken{record.file,
+			record.file.checkpoints.Add(record.offset)}
+		msgBytes := pipelinePack.MsgBytes[:cap(pipelinePack.MsgBytes)]
+		if len(record.data) > len(msgBytes) {
+			err := NewRecordError("LogfileInput dropping %d byte "+
+				"record, max size is %d", len(record.data), len(msgBytes))
+			self.Ack(token, err)
+			return err
+		}
+		pipelinePack.AckToken = token
+		pipelinePack.MsgBytes = msgBytes[:copy(msgBytes, record.data)]
+		pipelinePack.FirstRecord = record.first
+		if record.backfill {
+			atomic.AddInt64(&self.backfilled, 1)
+			pipelinePack.Fields = map[string]interface{}{"backfill": true}
+		}
+		if self.decoder != "" {
+			pipelinePack.Decoder = self.decoder
+		}
+		return nil
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No records to read")
+	return &err
+}
@@ -0,0 +1,187 @@
+//go:build !nologfileinput
+// +build !nologfileinput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	pluginSpecs = append(pluginSpecs, LogfileInputSpec)
+}
+
+func LogfileInputSpec(c gospec.Context) {
+	dir, err := ioutil.TempDir("", "logfile")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	journal := filepath.Join(dir, "app.journal")
+	timeout := time.Second
+	appendLines := func(lines ...string) {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+			0644)
+		c.Assume(err, gs.IsNil)
+		for _, line := range lines {
+			file.WriteString(line + "\n")
+		}
+		file.Close()
+	}
+	newInput := func(settings PluginConfig) *LogfileInput {
+		settings["File"] = path
+		settings["PollInterval"] = int64(10)
+		input := new(LogfileInput)
+		c.Assume(input.Init(&settings), gs.IsNil)
+		c.Assume(input.Prepare(), gs.IsNil)
+		return input
+	}
+	// Reads and acks a record, returning "" if there wasn't one
+	read := func(input *LogfileInput) (string, *PipelinePack) {
+		pipelinePack := &PipelinePack{MsgBytes: make([]byte, 100),
+			Message: new(Message)}
+		if err := input.Read(pipelinePack, &timeout); err != nil {
+			return "", pipelinePack
+		}
+		input.Ack(pipelinePack.AckToken, nil)
+		return strings.TrimSpace(string(pipelinePack.MsgBytes)), pipelinePack
+	}
+	// Waits for the journal to be saved w/ the given offset
+	journaled := func(offset int64) bool {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(
+			deadline); time.Sleep(10 * time.Millisecond) {
+			contents, _ := ioutil.ReadFile(journal)
+			if strings.HasPrefix(string(contents),
+				fmt.Sprintf("%d ", offset)) {
+				return true
+			}
+		}
+		return false
+	}
+	appendLines("one", "two")
+
+	c.Specify("Starts at the end of the file w/o a journal", func() {
+		input := newInput(PluginConfig{})
+		appendLines("three")
+		record, _ := read(input)
+		c.Expect(record, gs.Equals, "three")
+	})
+
+	c.Specify("Backfills w/o backfill fields after the backfill", func() {
+		input := newInput(PluginConfig{"Journal": journal, "Backfill": true,
+			"BackfillRate": int64(20)})
+		c.Expect(input.Report()["backfilling"], gs.IsTrue)
+		started := time.Now()
+		for _, line := range []string{"one", "two"} {
+			record, pipelinePack := read(input)
+			c.Expect(record, gs.Equals, line)
+			c.Expect(pipelinePack.Fields["backfill"], gs.Equals, true)
+		}
+		// The second record had to wait for the throttle
+		c.Expect(time.Since(started) >= 50*time.Millisecond, gs.IsTrue)
+		appendLines("three")
+		record, pipelinePack := read(input)
+		c.Expect(record, gs.Equals, "three")
+		c.Expect(pipelinePack.Fields == nil, gs.IsTrue)
+		report := input.Report()
+		c.Expect(report["backfilling"], gs.IsFalse)
+		c.Expect(report["backfill_records"], gs.Equals, int64(2))
+	})
+
+	c.Specify("Resumes from the journal", func() {
+		input := newInput(PluginConfig{"Journal": journal, "Backfill": true,
+			"BackfillRate": int64(1000)})
+		read(input)
+		c.Expect(journaled(4), gs.IsTrue)
+		appendLines("three")
+
+		c.Specify("in the same file", func() {
+			input = newInput(PluginConfig{"Journal": journal})
+			record, _ := read(input)
+			c.Expect(record, gs.Equals, "two")
+		})
+
+		c.Specify("w/ an offset only journal", func() {
+			ioutil.WriteFile(journal, []byte("4\n"), 0644)
+			input = newInput(PluginConfig{"Journal": journal})
+			record, _ := read(input)
+			c.Expect(record, gs.Equals, "two")
+		})
+
+		c.Specify("from the start of a rotated file", func() {
+			c.Assume(os.Rename(path, path+".1"), gs.IsNil)
+			appendLines("four", "five")
+			input = newInput(PluginConfig{"Journal": journal})
+			record, _ := read(input)
+			c.Expect(record, gs.Equals, "four")
+		})
+
+		c.Specify("from the start of a truncated file", func() {
+			c.Assume(os.Truncate(path, 0), gs.IsNil)
+			// Past the offset, but shorter than when the journal was saved
+			appendLines("4", "5", "6")
+			input = newInput(PluginConfig{"Journal": journal})
+			record, _ := read(input)
+			c.Expect(record, gs.Equals, "4")
+		})
+	})
+
+	c.Specify("Rejects a corrupt journal", func() {
+		ioutil.WriteFile(journal, []byte("4 oops"), 0644)
+		input := new(LogfileInput)
+		c.Assume(input.Init(&PluginConfig{"File": path, "Journal": journal}),
+			gs.IsNil)
+		c.Expect(input.Prepare(), gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Follows the file while tailing", func() {
+		input := newInput(PluginConfig{"Journal": journal, "Backfill": true,
+			"BackfillRate": int64(1000)})
+		read(input)
+		read(input)
+
+		c.Specify("when it's truncated", func() {
+			c.Assume(os.Truncate(path, 0), gs.IsNil)
+			appendLines("3")
+			record, _ := read(input)
+			c.Expect(record, gs.Equals, "3")
+			c.Expect(journaled(2), gs.IsTrue)
+		})
+
+		c.Specify("when it's rotated", func() {
+			c.Assume(os.Rename(path, path+".1"), gs.IsNil)
+			appendLines("three")
+			record, pipelinePack := read(input)
+			c.Expect(record, gs.Equals, "three")
+			c.Expect(pipelinePack.FirstRecord, gs.IsTrue)
+			c.Expect(journaled(6), gs.IsTrue)
+			// The journal's for the new file now
+			info, err := os.Stat(path)
+			c.Assume(err, gs.IsNil)
+			device, inode := fileIdentity(info)
+			contents, _ := ioutil.ReadFile(journal)
+			c.Expect(string(contents), gs.Equals, fmt.Sprintf("6 %d %d 6",
+				device, inode))
+		})
+	})
+}
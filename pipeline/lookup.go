@@ -0,0 +1,201 @@
+//go:build !nolookup
+// +build !nolookup
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("LookupFilter", func() interface{} {
+		return new(LookupFilter)
+	})
+}
+
+type lookupTable map[string]map[string]interface{}
+
+// LookupFilter enriches messages from a lookup table, e.g. mapping a
+// service name to its owning team. The value of the `Key` message variable
+// (e.g. "Fields[service]") is looked up in the table loaded from `File`,
+// and the matching row's fields are added to the message. Fields already
+// on the message are kept unless `Overwrite` is set.
+//
+// The table is a CSV file whose first row names the columns, w/ the key in
+// the first column, or a JSON object mapping keys to objects of fields.
+// `Format` is "csv" or "json", by default guessed from the file extension.
+// The file is reloaded when it changes (checked every `ReloadInterval`
+// seconds, 10 by default) and on SIGHUP. If a reload fails the old table
+// is kept.
+type LookupFilter struct {
+	path           string
+	format         string
+	key            string
+	overwrite      bool
+	reloadInterval time.Duration
+	table          lookupTable
+	modTime        time.Time
+	lock           sync.RWMutex
+}
+
+func (self *LookupFilter) Init(config *PluginConfig) error {
+	value, ok := (*config)["File"]
+	if !ok {
+		return errors.New("LookupFilter config: Missing File")
+	}
+	self.path = value.(string)
+	if value, ok = (*config)["Key"]; !ok {
+		return errors.New("LookupFilter config: Missing Key")
+	}
+	self.key = value.(string)
+	if !isMessageVariable(self.key) {
+		return fmt.Errorf("LookupFilter config: Invalid Key: %s", self.key)
+	}
+	self.format = filepath.Ext(self.path)
+	if self.format != "" {
+		self.format = self.format[1:]
+	}
+	if value, ok = (*config)["Format"]; ok {
+		self.format = value.(string)
+	}
+	if self.format != "csv" && self.format != "json" {
+		return fmt.Errorf("LookupFilter config: Unknown Format: %s",
+			self.format)
+	}
+	if value, ok = (*config)["Overwrite"]; ok {
+		self.overwrite = value.(bool)
+	}
+	var err error
+	self.reloadInterval, err = ConfigDuration(config, "ReloadInterval",
+		time.Second, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("LookupFilter config: %s", err.Error())
+	}
+	if err := self.load(); err != nil {
+		return fmt.Errorf("LookupFilter config: %s", err.Error())
+	}
+	return nil
+}
+
+// Starts watching the file for changes
+func (self *LookupFilter) Prepare() error {
+	go self.watch()
+	return nil
+}
+
+// Loads the table from the file, replacing the current one
+func (self *LookupFilter) load() error {
+	file, err := os.Open(self.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	table := make(lookupTable)
+	if self.format == "json" {
+		err = json.NewDecoder(file).Decode(&table)
+	} else {
+		err = readLookupCsv(csv.NewReader(file), table)
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %s", self.path, err.Error())
+	}
+	self.lock.Lock()
+	self.table = table
+	self.modTime = info.ModTime()
+	self.lock.Unlock()
+	return nil
+}
+
+func readLookupCsv(reader *csv.Reader, table lookupTable) error {
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	if len(header) < 2 {
+		return errors.New("need a key column and at least one other")
+	}
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		fields := make(map[string]interface{}, len(header)-1)
+		for i, name := range header[1:] {
+			fields[name] = row[i+1]
+		}
+		table[row[0]] = fields
+	}
+	return nil
+}
+
+// Reloads the table when the file changes or on SIGHUP
+func (self *LookupFilter) watch() {
+	ticker := time.NewTicker(self.reloadInterval)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(self.path)
+			self.lock.RLock()
+			changed := err == nil && !info.ModTime().Equal(self.modTime)
+			self.lock.RUnlock()
+			if !changed {
+				continue
+			}
+		case <-hupChan:
+		}
+		if err := self.load(); err != nil {
+			log.Printf("LookupFilter error reloading: %s\n", err.Error())
+		} else {
+			log.Printf("LookupFilter reloaded %s\n", self.path)
+		}
+	}
+}
+
+func (self *LookupFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	key, ok := MessageVariable(msg, self.key)
+	if !ok {
+		return
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	row, ok := self.table[fmt.Sprint(key)]
+	if !ok {
+		return
+	}
+	for name, value := range row {
+		if _, exists := msg.Fields[name]; exists && !self.overwrite {
+			continue
+		}
+		msg.ReplaceField(name, value)
+	}
+}
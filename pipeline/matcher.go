@@ -0,0 +1,377 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A MessageMatcher decides whether a message is selected by a matcher
+// expression, e.g.
+//
+//	Type == 'nginx.access' && (Fields[status] >= 500 || Payload =~ /panic/)
+//
+// Comparisons take a message variable on the left (Type, Logger,
+// Hostname, Payload, Env_version, Severity, Pid, Timestamp or
+// Fields[name]) and a string, number, regex (/.../), TRUE, FALSE or NIL on
+// the right. The operators are ==, !=, <, <=, >, >=, =~ and !~, combined
+// w/ &&, || and parentheses. Comparing a missing field to NIL w/ ==
+// matches; any other comparison against a missing field doesn't.
+// Timestamps compare as nanoseconds since the epoch.
+type MessageMatcher struct {
+	expr string
+	root matcherNode
+	// Whether the expression only tests Type and Logger (see Router)
+	signatureOnly bool
+}
+
+type matcherNode interface {
+	match(msg *Message) bool
+}
+
+type matcherAnd struct{ left, right matcherNode }
+type matcherOr struct{ left, right matcherNode }
+type matcherConst bool
+
+func (self *matcherAnd) match(msg *Message) bool {
+	return self.left.match(msg) && self.right.match(msg)
+}
+
+func (self *matcherOr) match(msg *Message) bool {
+	return self.left.match(msg) || self.right.match(msg)
+}
+
+func (self matcherConst) match(msg *Message) bool {
+	return bool(self)
+}
+
+type matcherTest struct {
+	variable string
+	op       string
+	str      string
+	num      float64
+	isNum    bool
+	isNil    bool
+	regex    *regexp.Regexp
+}
+
+// Returns the value of a message variable, i.e. Type, Logger, Hostname,
+// Payload, Env_version, Severity, Pid, Timestamp (as nanoseconds since the
+// epoch) or Fields[name], and whether it exists
+func MessageVariable(msg *Message, name string) (interface{}, bool) {
+	switch name {
+	case "Type":
+		return msg.Type, true
+	case "Logger":
+		return msg.Logger, true
+	case "Hostname":
+		return msg.Hostname, true
+	case "Payload":
+		return msg.Payload, true
+	case "Env_version":
+		return msg.Env_version, true
+	case "Severity":
+		return msg.Severity, true
+	case "Pid":
+		return msg.Pid, true
+	case "Timestamp":
+		return msg.Timestamp.UnixNano(), true
+	}
+	if len(name) > 8 && name[:7] == "Fields[" && name[len(name)-1] == ']' {
+		value, ok := msg.Fields[name[7:len(name)-1]]
+		return value, ok
+	}
+	return nil, false
+}
+
+// Returns whether name is a valid message variable
+func isMessageVariable(name string) bool {
+	switch name {
+	case "Type", "Logger", "Hostname", "Payload", "Env_version", "Severity",
+		"Pid", "Timestamp":
+		return true
+	}
+	return len(name) > 8 && name[:7] == "Fields[" && name[len(name)-1] == ']'
+}
+
+func (self *matcherTest) match(msg *Message) bool {
+	value, ok := MessageVariable(msg, self.variable)
+	if self.isNil {
+		return ok == (self.op == "!=")
+	}
+	if !ok {
+		return false
+	}
+	if self.regex != nil {
+		matched := self.regex.MatchString(fmt.Sprint(value))
+		return matched == (self.op == "=~")
+	}
+	if self.isNum {
+		// Numeric strings compare as numbers too
+		num, err := toFloat64(value)
+		if err != nil {
+			return false
+		}
+		return compareOp(self.op, compareFloats(num, self.num))
+	}
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case bool:
+		str = strings.ToUpper(strconv.FormatBool(v))
+	default:
+		str = fmt.Sprint(v)
+	}
+	return compareOp(self.op, strings.Compare(str, self.str))
+}
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareOp(op string, cmp int) bool {
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// Parses a matcher expression
+func NewMessageMatcher(expr string) (*MessageMatcher, error) {
+	parser := &matcherParser{input: expr}
+	if err := parser.tokenize(); err != nil {
+		return nil, fmt.Errorf("Invalid matcher %q: %s", expr, err.Error())
+	}
+	root, err := parser.parseOr()
+	if err == nil && parser.pos < len(parser.tokens) {
+		err = fmt.Errorf("unexpected %q", parser.tokens[parser.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid matcher %q: %s", expr, err.Error())
+	}
+	return &MessageMatcher{expr, root, testsSignatureOnly(root)}, nil
+}
+
+// Returns whether a node only tests the message's Type and Logger
+func testsSignatureOnly(node matcherNode) bool {
+	switch n := node.(type) {
+	case *matcherAnd:
+		return testsSignatureOnly(n.left) && testsSignatureOnly(n.right)
+	case *matcherOr:
+		return testsSignatureOnly(n.left) && testsSignatureOnly(n.right)
+	case matcherConst:
+		return true
+	case *matcherTest:
+		return n.variable == "Type" || n.variable == "Logger"
+	}
+	return false
+}
+
+func (self *MessageMatcher) Match(msg *Message) bool {
+	return self.root.match(msg)
+}
+
+func (self *MessageMatcher) String() string {
+	return self.expr
+}
+
+type matcherParser struct {
+	input  string
+	tokens []string
+	pos    int
+}
+
+var matcherOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~",
+	"<", ">", "(", ")"}
+
+func (self *matcherParser) tokenize() error {
+	input := self.input
+	for i := 0; i < len(input); {
+		c := input[i]
+		if c == ' ' || c == '\t' || c == '\n' {
+			i++
+			continue
+		}
+		if c == '\'' || c == '"' || c == '/' {
+			// Quoted strings and regexes, w/ backslash escaped delimiters
+			j := i + 1
+			for ; j < len(input) && input[j] != c; j++ {
+				if input[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(input) {
+				return fmt.Errorf("unterminated %c", c)
+			}
+			self.tokens = append(self.tokens, input[i:j+1])
+			i = j + 1
+			continue
+		}
+		matched := false
+		for _, op := range matcherOps {
+			if strings.HasPrefix(input[i:], op) {
+				self.tokens = append(self.tokens, op)
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		j := i
+		for ; j < len(input); j++ {
+			r := rune(input[j])
+			if !(unicode.IsLetter(r) || unicode.IsDigit(r) ||
+				strings.ContainsRune("_.-+[]", r)) {
+				break
+			}
+		}
+		if j == i {
+			return fmt.Errorf("unexpected %q", c)
+		}
+		self.tokens = append(self.tokens, input[i:j])
+		i = j
+	}
+	return nil
+}
+
+func (self *matcherParser) next() string {
+	if self.pos >= len(self.tokens) {
+		return ""
+	}
+	token := self.tokens[self.pos]
+	self.pos++
+	return token
+}
+
+func (self *matcherParser) peek() string {
+	if self.pos >= len(self.tokens) {
+		return ""
+	}
+	return self.tokens[self.pos]
+}
+
+func (self *matcherParser) parseOr() (matcherNode, error) {
+	left, err := self.parseAnd()
+	for err == nil && self.peek() == "||" {
+		self.next()
+		var right matcherNode
+		if right, err = self.parseAnd(); err == nil {
+			left = &matcherOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (self *matcherParser) parseAnd() (matcherNode, error) {
+	left, err := self.parseTerm()
+	for err == nil && self.peek() == "&&" {
+		self.next()
+		var right matcherNode
+		if right, err = self.parseTerm(); err == nil {
+			left = &matcherAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (self *matcherParser) parseTerm() (matcherNode, error) {
+	token := self.next()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "(":
+		node, err := self.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if self.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return node, nil
+	case "TRUE":
+		return matcherConst(true), nil
+	case "FALSE":
+		return matcherConst(false), nil
+	}
+	if !isMessageVariable(token) {
+		return nil, fmt.Errorf("unknown variable %q", token)
+	}
+	test := &matcherTest{variable: token}
+	test.op = self.next()
+	switch test.op {
+	case "==", "!=", "<", "<=", ">", ">=", "=~", "!~":
+	default:
+		return nil, fmt.Errorf("expected operator after %s, got %q", token,
+			test.op)
+	}
+	value := self.next()
+	switch {
+	case value == "":
+		return nil, fmt.Errorf("missing value after %s %s", token, test.op)
+	case value[0] == '/':
+		if test.op != "=~" && test.op != "!~" {
+			return nil, fmt.Errorf("regex used w/ %s", test.op)
+		}
+		regex, err := regexp.Compile(value[1 : len(value)-1])
+		if err != nil {
+			return nil, err
+		}
+		test.regex = regex
+		return test, nil
+	case test.op == "=~" || test.op == "!~":
+		return nil, fmt.Errorf("%s needs a regex", test.op)
+	case value[0] == '\'' || value[0] == '"':
+		unquoted := value[1 : len(value)-1]
+		test.str = strings.Replace(unquoted, `\`+value[:1], value[:1], -1)
+	case value == "NIL":
+		if test.op != "==" && test.op != "!=" {
+			return nil, fmt.Errorf("NIL used w/ %s", test.op)
+		}
+		test.isNil = true
+	case value == "TRUE" || value == "FALSE":
+		test.str = value
+	default:
+		num, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", value)
+		}
+		test.num = num
+		test.isNum = true
+	}
+	return test, nil
+}
@@ -0,0 +1,91 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+)
+
+func MatcherSpec(c gospec.Context) {
+	msg := getTestMessage()
+	msg.Fields["status"] = 503.0
+	msg.Fields["code"] = "404"
+
+	matches := func(expr string) bool {
+		matcher, err := NewMessageMatcher(expr)
+		c.Assume(err, gs.IsNil)
+		return matcher.Match(msg)
+	}
+
+	c.Specify("A MessageMatcher", func() {
+		c.Specify("compares strings", func() {
+			c.Expect(matches("Type == 'TEST'"), gs.IsTrue)
+			c.Expect(matches("Logger != 'GoSpec'"), gs.IsFalse)
+		})
+
+		c.Specify("compares numbers, including numeric strings", func() {
+			c.Expect(matches("Severity <= 6 && Fields[status] > 500"), gs.IsTrue)
+			c.Expect(matches("Fields[code] == 404"), gs.IsTrue)
+		})
+
+		c.Specify("matches regexes", func() {
+			c.Expect(matches("Payload =~ /^Test/"), gs.IsTrue)
+			c.Expect(matches("Payload !~ /Test/"), gs.IsFalse)
+		})
+
+		c.Specify("checks for missing fields w/ NIL", func() {
+			c.Expect(matches("Fields[missing] == NIL"), gs.IsTrue)
+			c.Expect(matches("Fields[foo] == NIL"), gs.IsFalse)
+			c.Expect(matches("Fields[missing] < 5"), gs.IsFalse)
+		})
+
+		c.Specify("groups w/ parentheses", func() {
+			c.Expect(matches("Type == 'x' && (TRUE || FALSE)"), gs.IsFalse)
+			c.Expect(matches("(Type == 'x' && TRUE) || TRUE"), gs.IsTrue)
+		})
+
+		c.Specify("rejects invalid expressions", func() {
+			for _, expr := range []string{"Type = 'x'", "Type ==", "(TRUE",
+				"Bogus == 1", "Severity < /1/", "Payload =~ 'x'"} {
+				_, err := NewMessageMatcher(expr)
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+	})
+
+	c.Specify("A Router", func() {
+		byType, _ := NewMessageMatcher("Type == 'TEST'")
+		bySeverity, _ := NewMessageMatcher("Severity < 3")
+		config := &GraterConfig{OutputMatchers: map[string]*MessageMatcher{
+			"tests": byType, "errors": bySeverity}}
+		router := NewRouter(config)
+
+		c.Specify("adds the outputs whose matchers match", func() {
+			pipelinePack := &PipelinePack{Message: msg,
+				Outputs: map[string]bool{"default": true}}
+			router.RouteOutputs(pipelinePack)
+			c.Expect(len(pipelinePack.Outputs), gs.Equals, 2)
+			c.Expect(pipelinePack.Outputs["tests"], gs.IsTrue)
+		})
+
+		c.Specify("caches matchers that only test Type and Logger", func() {
+			c.Expect(byType.signatureOnly, gs.IsTrue)
+			c.Expect(bySeverity.signatureOnly, gs.IsFalse)
+			c.Expect(router.Match(byType, msg), gs.IsTrue)
+			c.Expect(router.Match(bySeverity, msg), gs.IsFalse)
+			c.Expect(len(router.cache), gs.Equals, 1)
+		})
+	})
+}
@@ -0,0 +1,179 @@
+//go:build !nomultidecoder
+// +build !nomultidecoder
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+	"strings"
+)
+
+func init() {
+	RegisterPlugin("MultiDecoder", func() interface{} {
+		return new(MultiDecoder)
+	})
+}
+
+// A child of a MultiDecoder
+type multiDecoderChild struct {
+	name     string
+	required bool
+}
+
+// MultiDecoder runs the configured decoders named in `Decoders`, in
+// order, on the same data. Each entry is a decoder name or an object w/ a
+// `Name` and `Required`, e.g.
+//
+//	"Decoders": ["json", {"Name": "nginx", "Required": true}]
+//
+// W/ the "first-wins" `Strategy` (the default) the first child to decode
+// the data successfully provides the message, so e.g. JSON can be tried
+// before falling back to a more lenient format. W/ "all" every child is
+// run; the first successful one provides the message and the fields of
+// the others are added to it, w/o replacing fields it already has.
+//
+// A failing child is skipped unless it's `Required`, in which case the
+// decode fails w/ its error straight away. The decode also fails if no
+// child succeeds. If `DecoderField` is set, the names of the children
+// that succeeded are stored in a field of that name.
+type MultiDecoder struct {
+	children     []multiDecoderChild
+	all          bool
+	decoderField string
+}
+
+func (self *MultiDecoder) Init(config *PluginConfig) error {
+	value, ok := (*config)["Decoders"]
+	if !ok {
+		return errors.New("MultiDecoder config: Missing Decoders")
+	}
+	switch items := value.(type) {
+	case []string:
+		for _, name := range items {
+			self.children = append(self.children,
+				multiDecoderChild{name: name})
+		}
+	case []interface{}:
+		for i, item := range items {
+			var child multiDecoderChild
+			switch v := item.(type) {
+			case string:
+				child.name = v
+			case map[string]interface{}:
+				child.name, _ = v["Name"].(string)
+				child.required, _ = v["Required"].(bool)
+			}
+			if child.name == "" {
+				return fmt.Errorf("MultiDecoder config: Decoder %d has no "+
+					"name", i)
+			}
+			self.children = append(self.children, child)
+		}
+	default:
+		return errors.New("MultiDecoder config: Decoders must be a list")
+	}
+	if len(self.children) == 0 {
+		return errors.New("MultiDecoder config: Decoders is empty")
+	}
+	strategy := "first-wins"
+	if value, ok = (*config)["Strategy"]; ok {
+		strategy = value.(string)
+	}
+	switch strategy {
+	case "first-wins":
+	case "all":
+		self.all = true
+	default:
+		return fmt.Errorf("MultiDecoder config: Unknown Strategy: %s",
+			strategy)
+	}
+	if value, ok = (*config)["DecoderField"]; ok {
+		self.decoderField = value.(string)
+	}
+	return nil
+}
+
+// Returns the names of the child decoders, so ValidateConfig can check
+// they exist
+func (self *MultiDecoder) decoderRefs() []string {
+	names := make([]string, len(self.children))
+	for i, child := range self.children {
+		names[i] = child.name
+	}
+	return names
+}
+
+// Runs a child decoder on a copy of the pack, so a failed attempt leaves
+// nothing behind in the message
+func (self *MultiDecoder) run(pipelinePack *PipelinePack,
+	name string) (*Message, error) {
+	decoder, ok := pipelinePack.Config.Decoders[name]
+	if !ok {
+		return nil, fmt.Errorf("Decoder doesn't exist: %s", name)
+	}
+	if decoder == Decoder(self) {
+		return nil, errors.New("MultiDecoder can't run itself")
+	}
+	attempt := *pipelinePack
+	attempt.Message = new(Message)
+	attempt.Decoded = false
+	if err := decoder.Decode(&attempt); err != nil {
+		return nil, err
+	}
+	return attempt.Message, nil
+}
+
+func (self *MultiDecoder) Decode(pipelinePack *PipelinePack) error {
+	var msg *Message
+	succeeded := make([]string, 0, 1)
+	failures := make([]string, 0)
+	for _, child := range self.children {
+		decoded, err := self.run(pipelinePack, child.name)
+		if err != nil {
+			if child.required {
+				return fmt.Errorf("%s decoder: %s", child.name, err.Error())
+			}
+			failures = append(failures, fmt.Sprintf("%s: %s", child.name,
+				err.Error()))
+			continue
+		}
+		succeeded = append(succeeded, child.name)
+		if msg == nil {
+			msg = decoded
+			if !self.all {
+				break
+			}
+			continue
+		}
+		for name, value := range decoded.Fields {
+			if _, ok := msg.Fields[name]; !ok {
+				msg.ReplaceField(name, value)
+			}
+		}
+	}
+	if msg == nil {
+		return fmt.Errorf("No decoder succeeded (%s)",
+			strings.Join(failures, "; "))
+	}
+	if self.decoderField != "" {
+		msg.ReplaceField(self.decoderField, strings.Join(succeeded, ","))
+	}
+	*pipelinePack.Message = *msg
+	pipelinePack.Decoded = true
+	return nil
+}
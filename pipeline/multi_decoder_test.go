@@ -0,0 +1,86 @@
+//go:build !nomultidecoder
+// +build !nomultidecoder
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+)
+
+func init() {
+	pluginSpecs = append(pluginSpecs, MultiDecoderSpec)
+}
+
+func MultiDecoderSpec(c gospec.Context) {
+	config := &GraterConfig{Decoders: map[string]Decoder{
+		"json":       &JsonDecoder{mode: "strict"},
+		"statmetric": new(StatMetricDecoder),
+	}}
+	metricLine := "web.requests 3 counter 1350000000 host=web1"
+	newPack := func(data string) *PipelinePack {
+		return &PipelinePack{MsgBytes: []byte(data),
+			Message: new(Message), Config: config}
+	}
+	newDecoder := func(settings PluginConfig) (*MultiDecoder, error) {
+		decoder := new(MultiDecoder)
+		err := decoder.Init(&settings)
+		return decoder, err
+	}
+
+	c.Specify("Falls back to later decoders", func() {
+		decoder, err := newDecoder(PluginConfig{
+			"Decoders":     []string{"json", "statmetric"},
+			"DecoderField": "decoded_by"})
+		c.Assume(err, gs.IsNil)
+		pipelinePack := newPack(metricLine)
+		c.Expect(decoder.Decode(pipelinePack), gs.IsNil)
+		c.Expect(pipelinePack.Decoded, gs.IsTrue)
+		c.Expect(pipelinePack.Message.Type, gs.Equals, StatMetricType)
+		c.Expect(pipelinePack.Message.Fields["decoded_by"], gs.Equals,
+			"statmetric")
+	})
+
+	c.Specify("Stops at the first success", func() {
+		decoder, _ := newDecoder(PluginConfig{
+			"Decoders": []string{"statmetric", "json"}})
+		pipelinePack := newPack(metricLine)
+		c.Expect(decoder.Decode(pipelinePack), gs.IsNil)
+		c.Expect(pipelinePack.Message.Fields["tags.host"], gs.Equals,
+			"web1")
+	})
+
+	c.Specify("Fails when a required decoder fails", func() {
+		decoder, _ := newDecoder(PluginConfig{
+			"Decoders": []interface{}{
+				map[string]interface{}{"Name": "json", "Required": true},
+				"statmetric"}})
+		c.Expect(decoder.Decode(newPack(metricLine)), gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Fails when every decoder fails", func() {
+		decoder, _ := newDecoder(PluginConfig{
+			"Decoders": []string{"json", "statmetric"}})
+		c.Expect(decoder.Decode(newPack("garbage")), gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Rejects unknown strategies", func() {
+		_, err := newDecoder(PluginConfig{
+			"Decoders": []string{"json"}, "Strategy": "most"})
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,223 @@
+//go:build !nomutate
+// +build !nomutate
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterPlugin("MutateFilter", func() interface{} {
+		return new(MutateFilter)
+	})
+}
+
+type mutation struct {
+	op         string
+	field      string
+	to         string
+	from       string
+	pattern    *regexp.Regexp
+	conversion *FieldConversion
+}
+
+// MutateFilter reshapes the messages matching its `Matcher` (every
+// message, if not set) w/ the `Operations` listed in its config, applied
+// in order. Each operation is an object w/ an "Op" and its settings:
+//
+//	{"Op": "rename", "Field": "host", "To": "hostname"}
+//	{"Op": "drop", "Pattern": "^tmp_"}
+//	{"Op": "cast", "Field": "bytes", "Type": "int"}
+//	{"Op": "extract", "Pattern": "user=(\\S+)", "To": "user"}
+//	{"Op": "upper", "Field": "level"}
+//	{"Op": "lower", "Field": "level"}
+//
+// drop removes the fields whose names match the pattern, and cast takes
+// the types of a FieldConversion. extract sets a field to the part of
+// "From" (a message variable, "Payload" by default) matched by the
+// pattern's first group, or the whole match if it has none. Operations
+// on missing fields are skipped; ones that fail, e.g. casting "abc" to
+// an int, are counted in the plugin report (see Reporter).
+type MutateFilter struct {
+	matcher   *MessageMatcher
+	mutations []mutation
+	errors    int64
+}
+
+// Reads an operation's settings, returning an error naming the first
+// missing one
+func mutationSettings(operation map[string]interface{},
+	names ...string) ([]string, error) {
+	values := make([]string, len(names))
+	for i, name := range names {
+		value, ok := operation[name].(string)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("Missing %s", name)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// The settings each Op requires
+var mutationSettingNames = map[string][]string{
+	"rename":  {"Field", "To"},
+	"drop":    {"Pattern"},
+	"cast":    {"Field", "Type"},
+	"extract": {"Pattern", "To"},
+	"upper":   {"Field"},
+	"lower":   {"Field"},
+}
+
+func newMutation(operation map[string]interface{}) (m mutation, err error) {
+	m.op, _ = operation["Op"].(string)
+	names, ok := mutationSettingNames[m.op]
+	if !ok {
+		return m, fmt.Errorf("Unknown Op %q", m.op)
+	}
+	values, err := mutationSettings(operation, names...)
+	if err != nil {
+		return
+	}
+	switch m.op {
+	case "rename":
+		m.field, m.to = values[0], values[1]
+	case "drop":
+		m.pattern, err = regexp.Compile(values[0])
+	case "cast":
+		m.conversion, err = ParseFieldConversion(fmt.Sprintf(
+			"Fields[%s] as %s", values[0], values[1]))
+	case "extract":
+		if m.pattern, err = regexp.Compile(values[0]); err != nil {
+			return
+		}
+		m.to = values[1]
+		m.from = "Payload"
+		if from, ok := operation["From"].(string); ok {
+			m.from = from
+		}
+		if !isMessageVariable(m.from) {
+			err = fmt.Errorf("Invalid message variable: %s", m.from)
+		}
+	case "upper", "lower":
+		m.field = values[0]
+	}
+	return
+}
+
+func (self *MutateFilter) Init(config *PluginConfig) (err error) {
+	if value, ok := (*config)["Matcher"]; ok {
+		if self.matcher, err = NewMessageMatcher(value.(string)); err != nil {
+			return fmt.Errorf("MutateFilter config: %s", err.Error())
+		}
+	}
+	value, ok := (*config)["Operations"]
+	if !ok {
+		return errors.New("MutateFilter config: Missing Operations")
+	}
+	operations, ok := value.([]interface{})
+	if !ok {
+		return errors.New("MutateFilter config: Operations must be a list " +
+			"of objects")
+	}
+	for i, item := range operations {
+		operation, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("MutateFilter config: Operation %d isn't an "+
+				"object", i)
+		}
+		m, err := newMutation(operation)
+		if err != nil {
+			return fmt.Errorf("MutateFilter config: Operation %d: %s", i,
+				err.Error())
+		}
+		self.mutations = append(self.mutations, m)
+	}
+	return nil
+}
+
+func (self *mutation) apply(msg *Message) error {
+	switch self.op {
+	case "rename":
+		value, ok := msg.Fields[self.field]
+		if !ok {
+			return nil
+		}
+		repr := msg.FieldRepresentation(self.field)
+		msg.DeleteField(self.field)
+		msg.ReplaceField(self.to, value)
+		return msg.SetFieldRepresentation(self.to, repr)
+	case "drop":
+		for _, name := range msg.FieldNames() {
+			if self.pattern.MatchString(name) {
+				msg.DeleteField(name)
+			}
+		}
+	case "cast":
+		return self.conversion.Apply(msg)
+	case "extract":
+		value, ok := MessageVariable(msg, self.from)
+		if !ok {
+			return nil
+		}
+		match := self.pattern.FindStringSubmatch(fmt.Sprint(value))
+		if match == nil {
+			return nil
+		}
+		if len(match) > 1 {
+			msg.ReplaceField(self.to, match[1])
+		} else {
+			msg.ReplaceField(self.to, match[0])
+		}
+	case "upper", "lower":
+		value, ok := msg.Fields[self.field]
+		if !ok {
+			return nil
+		}
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("Fields[%s] isn't a string", self.field)
+		}
+		if self.op == "upper" {
+			msg.Fields[self.field] = strings.ToUpper(str)
+		} else {
+			msg.Fields[self.field] = strings.ToLower(str)
+		}
+	}
+	return nil
+}
+
+func (self *MutateFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	if self.matcher != nil && !self.matcher.Match(msg) {
+		return
+	}
+	for i := range self.mutations {
+		if err := self.mutations[i].apply(msg); err != nil {
+			atomic.AddInt64(&self.errors, 1)
+		}
+	}
+}
+
+func (self *MutateFilter) Report() map[string]interface{} {
+	return map[string]interface{}{"errors": atomic.LoadInt64(&self.errors)}
+}
@@ -0,0 +1,684 @@
+//go:build !nonsq
+// +build !nonsq
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("NsqInput", func() interface{} { return new(NsqInput) })
+	RegisterPlugin("NsqOutput", func() interface{} { return new(NsqOutput) })
+}
+
+// NSQ frame types
+const (
+	nsqFrameResponse = 0
+	nsqFrameError    = 1
+	nsqFrameMessage  = 2
+)
+
+const (
+	// Largest frame accepted from nsqd
+	nsqMaxFrameSize = 4 * 1024 * 1024
+	// Message frames start w/ an 8 byte timestamp, 2 byte attempt count
+	// and 16 byte id
+	nsqMessageHeaderSize = 26
+	defaultNsqQueueSize  = 1000
+)
+
+var (
+	nsqMagic     = []byte("  V2")
+	nsqHeartbeat = []byte("_heartbeat_")
+	nsqNameRegex = regexp.MustCompile(`^[.a-zA-Z0-9_-]{1,64}(#ephemeral)?$`)
+)
+
+// A connection to nsqd speaking the V2 TCP protocol
+type nsqConn struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	// Serializes writes, since messages are FINished from the input's Read
+	// while the connection's reader answers heartbeats
+	lock sync.Mutex
+}
+
+func dialNsq(addr string) (*nsqConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(nsqMagic); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &nsqConn{addr: addr, conn: conn, reader: bufio.NewReader(conn)},
+		nil
+}
+
+// Sends a command, followed by a length prefixed body if there is one
+func (self *nsqConn) command(body []byte, params ...string) error {
+	buffer := new(bytes.Buffer)
+	buffer.WriteString(strings.Join(params, " "))
+	buffer.WriteByte('\n')
+	if body != nil {
+		binary.Write(buffer, binary.BigEndian, uint32(len(body)))
+		buffer.Write(body)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := self.conn.Write(buffer.Bytes())
+	return err
+}
+
+func (self *nsqConn) readFrame() (int32, []byte, error) {
+	var size uint32
+	if err := binary.Read(self.reader, binary.BigEndian, &size); err != nil {
+		return 0, nil, err
+	}
+	if size < 4 || size > nsqMaxFrameSize {
+		return 0, nil, fmt.Errorf("Invalid NSQ frame size: %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(self.reader, data); err != nil {
+		return 0, nil, err
+	}
+	return int32(binary.BigEndian.Uint32(data[:4])), data[4:], nil
+}
+
+// Waits for the response to a command, answering any heartbeats
+func (self *nsqConn) response() ([]byte, error) {
+	for {
+		self.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		frameType, data, err := self.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch frameType {
+		case nsqFrameResponse:
+			if !bytes.Equal(data, nsqHeartbeat) {
+				return data, nil
+			}
+			if err = self.command(nil, "NOP"); err != nil {
+				return nil, err
+			}
+		case nsqFrameError:
+			return nil, fmt.Errorf("nsqd %s error: %s", self.addr, data)
+		default:
+			return nil, fmt.Errorf("Unexpected NSQ frame type %d", frameType)
+		}
+	}
+}
+
+func (self *nsqConn) Close() error {
+	return self.conn.Close()
+}
+
+// A message received from nsqd, along w/ the connection it has to be
+// FINished or REQueued on
+type nsqMessage struct {
+	id       string
+	attempts uint16
+	body     []byte
+	conn     *nsqConn
+}
+
+// NsqLookupdResolver returns the TCP addresses of the nsqd instances
+// nsqlookupd knows to have a topic
+type NsqLookupdResolver struct {
+	Addresses []string // nsqlookupd HTTP addresses, e.g. "127.0.0.1:4161"
+	Topic     string
+}
+
+type nsqProducer struct {
+	BroadcastAddress string `json:"broadcast_address"`
+	TcpPort          int    `json:"tcp_port"`
+}
+
+// Queries one nsqlookupd. A topic it doesn't know about yet isn't an
+// error, there are just no producers for it.
+func (self *NsqLookupdResolver) lookup(addr string) ([]nsqProducer, error) {
+	if !strings.HasPrefix(addr, "http://") &&
+		!strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	rawUrl := fmt.Sprintf("%s/lookup?topic=%s", addr,
+		url.QueryEscape(self.Topic))
+	resp, err := discoveryClient.Get(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", rawUrl, resp.Status)
+	}
+	// Older versions of nsqlookupd wrap the result in a "data" object
+	var result struct {
+		Producers []nsqProducer `json:"producers"`
+		Data      struct {
+			Producers []nsqProducer `json:"producers"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return append(result.Producers, result.Data.Producers...), nil
+}
+
+// Returns the nsqd addresses known to any of the nsqlookupd instances,
+// failing only if none of them can be reached
+func (self *NsqLookupdResolver) Resolve() ([]string, error) {
+	addrs := make([]string, 0)
+	seen := make(map[string]bool)
+	var lastErr error
+	reached := false
+	for _, lookupdAddr := range self.Addresses {
+		producers, err := self.lookup(lookupdAddr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reached = true
+		for _, producer := range producers {
+			addr := net.JoinHostPort(producer.BroadcastAddress,
+				strconv.Itoa(producer.TcpPort))
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if !reached {
+		return nil, lastErr
+	}
+	return addrs, nil
+}
+
+// Reads the `Topic` setting and builds the resolver for the nsqd
+// addresses, using `LookupdAddresses` (a list of nsqlookupd HTTP
+// addresses) if set and otherwise any of the settings accepted by
+// NewResolverFromConfig
+func nsqEndpointsFromConfig(config *PluginConfig, name string) (string,
+	*Endpoints, error) {
+	value, ok := (*config)["Topic"]
+	if !ok {
+		return "", nil, fmt.Errorf("%s config: Missing Topic", name)
+	}
+	topic := value.(string)
+	if !nsqNameRegex.MatchString(topic) {
+		return "", nil, fmt.Errorf("%s config: Invalid Topic: %s", name, topic)
+	}
+	var resolver Resolver
+	var err error
+	if value, ok = (*config)["LookupdAddresses"]; ok {
+		resolver = &NsqLookupdResolver{value.([]string), topic}
+	} else if resolver, err = NewResolverFromConfig(config); err != nil {
+		return "", nil, fmt.Errorf("%s config: %s", name, err.Error())
+	}
+	interval, err := ConfigDuration(config, "ResolveInterval", time.Second,
+		60*time.Second)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s config: %s", name, err.Error())
+	}
+	endpoints, err := NewEndpoints(resolver, interval)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s error resolving nsqd addresses: %s",
+			name, err.Error())
+	}
+	return topic, endpoints, nil
+}
+
+// NsqInput subscribes to `Topic` on `Channel` on each nsqd that has the
+// topic, found via nsqlookupd w/ `LookupdAddresses` or given directly w/
+// `Address` (see nsqEndpointsFromConfig), and hands the message bodies to
+// the decoder. The nsqd list is refreshed every `ResolveInterval` seconds
+// (60 by default), connecting to any new ones.
+//
+// Up to `MaxInFlight` messages (1 by default) are outstanding per
+// connection. Messages are FINished once every output they're routed to
+// has them (see AckAwareInput); ones that can't be read into a pipeline
+// pack (e.g. because they're too large) or fail to be delivered are
+// requeued after `RequeueDelay` milliseconds (5000 by default) until
+// they've been attempted `MaxAttempts` times (5 by default), when they're
+// dropped.
+type NsqInput struct {
+	topic        string
+	channel      string
+	endpoints    *Endpoints
+	maxInFlight  int64
+	maxAttempts  uint16
+	requeueDelay time.Duration
+	decoder      string
+	msgChan      chan *nsqMessage
+	conns        map[string]*nsqConn
+	lock         sync.Mutex
+	finished     int64
+	requeued     int64
+	dropped      int64
+}
+
+func (self *NsqInput) Init(config *PluginConfig) (err error) {
+	self.topic, self.endpoints, err = nsqEndpointsFromConfig(config,
+		"NsqInput")
+	if err != nil {
+		return
+	}
+	value, ok := (*config)["Channel"]
+	if !ok {
+		return errors.New("NsqInput config: Missing Channel")
+	}
+	self.channel = value.(string)
+	if !nsqNameRegex.MatchString(self.channel) {
+		return fmt.Errorf("NsqInput config: Invalid Channel: %s", self.channel)
+	}
+	self.maxInFlight = 1
+	if value, ok = (*config)["MaxInFlight"]; ok {
+		if self.maxInFlight = value.(int64); self.maxInFlight < 1 {
+			return errors.New("NsqInput config: MaxInFlight must be at least 1")
+		}
+	}
+	self.maxAttempts = 5
+	if value, ok = (*config)["MaxAttempts"]; ok {
+		self.maxAttempts = uint16(value.(int64))
+	}
+	self.requeueDelay, err = ConfigDuration(config, "RequeueDelay",
+		time.Millisecond, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("NsqInput config: %s", err.Error())
+	}
+	if value, ok = (*config)["Decoder"]; ok {
+		self.decoder = value.(string)
+	}
+	self.msgChan = make(chan *nsqMessage, self.maxInFlight)
+	self.conns = make(map[string]*nsqConn)
+	return nil
+}
+
+// Connects to the current nsqd instances, then keeps checking for new
+// ones (and reconnecting to any that dropped)
+func (self *NsqInput) Prepare() error {
+	self.connectAll()
+	go func() {
+		for _ = range time.Tick(10 * time.Second) {
+			self.connectAll()
+		}
+	}()
+	return nil
+}
+
+func (self *NsqInput) connectAll() {
+	for _, addr := range self.endpoints.Current() {
+		self.lock.Lock()
+		_, connected := self.conns[addr]
+		self.lock.Unlock()
+		if connected {
+			continue
+		}
+		conn, err := self.subscribe(addr)
+		if err != nil {
+			log.Printf("NsqInput error subscribing on %s: %s\n", addr,
+				err.Error())
+			continue
+		}
+		self.lock.Lock()
+		self.conns[addr] = conn
+		self.lock.Unlock()
+		go self.consume(conn)
+	}
+}
+
+func (self *NsqInput) subscribe(addr string) (*nsqConn, error) {
+	conn, err := dialNsq(addr)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.command(nil, "SUB", self.topic, self.channel)
+	if err == nil {
+		_, err = conn.response()
+	}
+	if err == nil {
+		err = conn.command(nil, "RDY", strconv.FormatInt(self.maxInFlight, 10))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Reads messages from a connection until it fails
+func (self *NsqInput) consume(conn *nsqConn) {
+	var err error
+	for err == nil {
+		// nsqd sends a heartbeat every 30 seconds by default
+		conn.conn.SetReadDeadline(time.Now().Add(time.Minute))
+		var frameType int32
+		var data []byte
+		if frameType, data, err = conn.readFrame(); err != nil {
+			break
+		}
+		switch frameType {
+		case nsqFrameResponse:
+			if bytes.Equal(data, nsqHeartbeat) {
+				err = conn.command(nil, "NOP")
+			}
+		case nsqFrameError:
+			// e.g. a FIN for a message that timed out; not fatal
+			log.Printf("NsqInput nsqd %s error: %s\n", conn.addr, data)
+		case nsqFrameMessage:
+			if len(data) < nsqMessageHeaderSize {
+				err = errors.New("short message frame")
+				break
+			}
+			self.msgChan <- &nsqMessage{
+				id:       string(data[10:26]),
+				attempts: binary.BigEndian.Uint16(data[8:10]),
+				body:     data[nsqMessageHeaderSize:],
+				conn:     conn,
+			}
+		}
+	}
+	log.Printf("NsqInput lost connection to %s: %s\n", conn.addr, err.Error())
+	conn.Close()
+	self.lock.Lock()
+	delete(self.conns, conn.addr)
+	self.lock.Unlock()
+}
+
+// Requeues a message that couldn't be processed, or drops it if it's
+// been tried too many times already
+func (self *NsqInput) requeue(msg *nsqMessage) {
+	var err error
+	if self.maxAttempts > 0 && msg.attempts >= self.maxAttempts {
+		atomic.AddInt64(&self.dropped, 1)
+		log.Printf("NsqInput dropping message %s after %d attempts\n",
+			msg.id, msg.attempts)
+		err = msg.conn.command(nil, "FIN", msg.id)
+	} else {
+		atomic.AddInt64(&self.requeued, 1)
+		err = msg.conn.command(nil, "REQ", msg.id,
+			strconv.FormatInt(int64(self.requeueDelay/time.Millisecond), 10))
+	}
+	if err != nil {
+		log.Printf("NsqInput error requeueing message %s: %s\n", msg.id,
+			err.Error())
+	}
+}
+
+// FINishes a delivered message, or requeues it if delivery failed
+func (self *NsqInput) Ack(token interface{}, err error) {
+	msg := token.(*nsqMessage)
+	if err != nil {
+		self.requeue(msg)
+		return
+	}
+	if err = msg.conn.command(nil, "FIN", msg.id); err != nil {
+		log.Printf("NsqInput error finishing message %s: %s\n", msg.id,
+			err.Error())
+	}
+	atomic.AddInt64(&self.finished, 1)
+}
+
+func (self *NsqInput) Report() map[string]interface{} {
+	self.lock.Lock()
+	connections := len(self.conns)
+	self.lock.Unlock()
+	return map[string]interface{}{
+		"connections": connections,
+		"finished":    atomic.LoadInt64(&self.finished),
+		"requeued":    atomic.LoadInt64(&self.requeued),
+		"dropped":     atomic.LoadInt64(&self.dropped),
+	}
+}
+
+func (self *NsqInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case msg := <-self.msgChan:
+		msgBytes := pipelinePack.MsgBytes[:cap(pipelinePack.MsgBytes)]
+		if len(msg.body) > len(msgBytes) {
+			self.requeue(msg)
+			return NewRecordError("NsqInput can't read %d byte message, max "+
+				"size is %d", len(msg.body), len(msgBytes))
+		}
+		pipelinePack.MsgBytes = msgBytes[:copy(msgBytes, msg.body)]
+		if self.decoder != "" {
+			pipelinePack.Decoder = self.decoder
+		}
+		pipelinePack.AckToken = msg
+		return nil
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No messages to read")
+	return &err
+}
+
+// NsqOutput publishes encoded messages (JSON by default) to `Topic` on
+// nsqd, at `Address` or found via nsqlookupd w/ `LookupdAddresses` (see
+// nsqEndpointsFromConfig); the first reachable nsqd is used. Messages are
+// queued in memory (up to `QueueSize`, 1000 by default, beyond which
+// they're dropped unless `Backpressure` says otherwise, see Backpressure)
+// and published by a separate goroutine, up to
+// `BatchSize` (100 by default) at a time w/ MPUB. A batch that can't be
+// published is retried `Retries` times (3 by default), a second apart,
+// and w/ `BreakerThreshold` set a circuit breaker stops publish attempts
+// while nsqd is down (see CircuitBreaker).
+type NsqOutput struct {
+	EncodingOutput
+	dryRunnable
+	topic     string
+	endpoints *Endpoints
+	batchSize int
+	retries   int
+	queue     *Queue
+	drainChan chan chan error
+	conn      *nsqConn
+	// Messages in batches that couldn't be published
+	dropped int64
+	// What to do when the queue is full
+	backpressure *Backpressure
+	breaker      *CircuitBreaker
+}
+
+func (self *NsqOutput) Init(config *PluginConfig) (err error) {
+	self.topic, self.endpoints, err = nsqEndpointsFromConfig(config,
+		"NsqOutput")
+	if err != nil {
+		return
+	}
+	if err = self.InitEncoder(config, &JsonEncoder{}); err != nil {
+		return fmt.Errorf("NsqOutput config: %s", err.Error())
+	}
+	self.batchSize = 100
+	if value, ok := (*config)["BatchSize"]; ok {
+		if self.batchSize = int(value.(int64)); self.batchSize < 1 {
+			return errors.New("NsqOutput config: BatchSize must be at least 1")
+		}
+	}
+	self.retries = 3
+	if value, ok := (*config)["Retries"]; ok {
+		self.retries = int(value.(int64))
+	}
+	queueSize := int64(defaultNsqQueueSize)
+	if value, ok := (*config)["QueueSize"]; ok {
+		queueSize = value.(int64)
+	}
+	self.backpressure, err = ConfigBackpressure(config, BackpressureDrop)
+	if err != nil {
+		return fmt.Errorf("NsqOutput config: %s", err.Error())
+	}
+	self.breaker, err = ConfigCircuitBreaker(config, "NsqOutput")
+	if err != nil {
+		return fmt.Errorf("NsqOutput config: %s", err.Error())
+	}
+	self.queue = NewQueue(int(queueSize), self.backpressure)
+	self.drainChan = make(chan chan error)
+	go self.sender()
+	return nil
+}
+
+func (self *NsqOutput) Deliver(pipelinePack *PipelinePack) {
+	msgBytes, err := self.Encode(pipelinePack)
+	if err != nil {
+		log.Println(NewDeliveryError(pipelinePack, "NsqOutput", err))
+		return
+	}
+	if !self.queue.Send(msgBytes, nil) {
+		if dropped := self.backpressure.Lost(); dropped%1000 == 1 {
+			log.Printf("%s, %d messages dropped so far\n",
+				NewDeliveryError(pipelinePack, "NsqOutput",
+					errors.New("queue full")), dropped)
+		}
+	}
+}
+
+// Connects to the first reachable nsqd
+func (self *NsqOutput) connect() (err error) {
+	addrs := self.endpoints.Current()
+	if len(addrs) == 0 {
+		return errors.New("No nsqd addresses")
+	}
+	for _, addr := range addrs {
+		if self.conn, err = dialNsq(addr); err == nil {
+			return nil
+		}
+	}
+	return
+}
+
+// Publishes a batch, w/ PUB for a single message and MPUB otherwise
+func (self *NsqOutput) publish(batch [][]byte) (err error) {
+	if self.dryRun.Skip(batch...) {
+		return nil
+	}
+	if self.conn == nil {
+		if err = self.connect(); err != nil {
+			return
+		}
+	}
+	if len(batch) == 1 {
+		err = self.conn.command(batch[0], "PUB", self.topic)
+	} else {
+		body := new(bytes.Buffer)
+		binary.Write(body, binary.BigEndian, uint32(len(batch)))
+		for _, msgBytes := range batch {
+			binary.Write(body, binary.BigEndian, uint32(len(msgBytes)))
+			body.Write(msgBytes)
+		}
+		err = self.conn.command(body.Bytes(), "MPUB", self.topic)
+	}
+	if err == nil {
+		_, err = self.conn.response()
+	}
+	if err != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+	return
+}
+
+func (self *NsqOutput) publishRetrying(batch [][]byte) (err error) {
+	for attempt := 0; attempt <= self.retries; attempt++ {
+		if !self.breaker.Allow() {
+			err = ErrCircuitOpen
+			break
+		}
+		if attempt > 0 {
+			time.Sleep(time.Second)
+		}
+		if err = self.publish(batch); err == nil {
+			self.breaker.Success()
+			return nil
+		}
+		self.breaker.Failure()
+	}
+	atomic.AddInt64(&self.dropped, int64(len(batch)))
+	if err == ErrCircuitOpen {
+		return
+	}
+	log.Printf("NsqOutput dropping %d messages: %s\n", len(batch),
+		err.Error())
+	return
+}
+
+// Publishes any queued messages
+func (self *NsqOutput) Drain() error {
+	done := make(chan error)
+	self.drainChan <- done
+	return <-done
+}
+
+func (self *NsqOutput) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"dropped": atomic.LoadInt64(&self.dropped) +
+			self.backpressure.Lost(),
+	}
+	self.queue.report(report)
+	self.breaker.report(report)
+	return report
+}
+
+func (self *NsqOutput) sender() {
+	batch := make([][]byte, 0, self.batchSize)
+	// Fills the batch w/ whatever else is already queued
+	fill := func() {
+		for len(batch) < self.batchSize {
+			item, ok := self.queue.TryPop()
+			if !ok {
+				return
+			}
+			batch = append(batch, item.([]byte))
+		}
+	}
+	for {
+		select {
+		case item := <-self.queue.Chan():
+			batch = append(batch[:0], item.([]byte))
+			fill()
+			self.publishRetrying(batch)
+		case done := <-self.drainChan:
+			var err error
+			for self.queue.Len() > 0 {
+				batch = batch[:0]
+				fill()
+				if publishErr := self.publishRetrying(batch); publishErr != nil {
+					err = publishErr
+				}
+			}
+			done <- err
+		}
+	}
+}
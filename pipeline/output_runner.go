@@ -0,0 +1,302 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Delivery goroutines each output gets unless its section sets
+// `delivery_workers`
+const defaultDeliveryWorkers = 4
+
+// OutputRunner delivers packs to one output from a pool of goroutines of
+// its own, fed by a queue. The pipeline function hands a pack to the
+// runner of every output it's routed to and moves on, so the outputs work
+// on the pack side by side and a slow output only backs up its own queue,
+// rather than holding up delivery to every output after it. The pack
+// isn't recycled until the last of them is done w/ it (see packRefs).
+//
+// An output section can set `delivery_workers` (4 by default) and
+// `delivery_queue_size` (the pool size by default). Outputs that need to
+// see messages in the order they were routed should use one worker.
+//
+// Outputs that alert, e.g. to a pager or chat, can give urgent messages a
+// priority lane w/ `priority_severity` and/or `priority_matcher` (see
+// DeliveryPriority). Prioritized messages are queued separately and the
+// workers always take from that queue first, so they get ahead of bulk
+// traffic queued for the same output when it can't keep up.
+type OutputRunner struct {
+	name        string
+	output      Output
+	config      *GraterConfig
+	workers     int
+	deliveries  chan *delivery
+	priority    *DeliveryPriority
+	prioritized chan *delivery
+	// Held for sends to the queues, and taken by Stop to close them
+	lock      sync.RWMutex
+	stopped   bool
+	running   sync.WaitGroup
+	delivered int64
+	failed    int64
+	promoted  int64
+	// From reading a pack to this output accepting it
+	latency LatencyHistogram
+}
+
+// DeliveryPriority picks the messages that take an output's priority
+// lane: those at least as severe as Severity (i.e. w/ a severity number
+// no higher), if it's set, and those matching Matcher, if there is one.
+type DeliveryPriority struct {
+	// -1 if prioritizing by matcher only
+	Severity int
+	Matcher  *MessageMatcher
+}
+
+// Returns whether the message takes the priority lane
+func (self *DeliveryPriority) Match(router *Router, msg *Message) bool {
+	if self.Severity >= 0 && msg.Severity <= self.Severity {
+		return true
+	}
+	return self.Matcher != nil && router.Match(self.Matcher, msg)
+}
+
+// A pack on its way to one output
+type delivery struct {
+	// The pack as routed, for errors and auditing
+	pipelinePack *PipelinePack
+	// What the output is handed, i.e. after any transform
+	delivered *PipelinePack
+	ack       *PackAck
+	refs      *packRefs
+	audited   bool
+}
+
+// Creates the runner for an output, using the output's delivery settings
+// from the config
+func NewOutputRunner(config *GraterConfig, name string,
+	output Output) *OutputRunner {
+	workers := config.DeliveryWorkers[name]
+	if workers <= 0 {
+		workers = defaultDeliveryWorkers
+	}
+	queueSize, ok := config.DeliveryQueueSizes[name]
+	if !ok {
+		queueSize = config.PoolSize
+	}
+	self := &OutputRunner{
+		name:       name,
+		output:     output,
+		config:     config,
+		workers:    workers,
+		deliveries: make(chan *delivery, queueSize),
+	}
+	if priority, ok := config.DeliveryPriorities[name]; ok {
+		self.priority = priority
+		self.prioritized = make(chan *delivery, queueSize)
+	}
+	return self
+}
+
+// Starts the runner's workers. They run until the runner is stopped.
+func (self *OutputRunner) Start() {
+	self.running.Add(self.workers)
+	for i := 0; i < self.workers; i++ {
+		go self.work()
+	}
+}
+
+func (self *OutputRunner) work() {
+	defer self.running.Done()
+	// A nil channel is never ready, so w/o a priority lane, or once it's
+	// been closed and emptied, this only takes from the other queue
+	deliveries, prioritized := self.deliveries, self.prioritized
+	for deliveries != nil || prioritized != nil {
+		select {
+		case d, ok := <-prioritized:
+			if !ok {
+				prioritized = nil
+			} else {
+				self.deliver(d)
+			}
+			continue
+		default:
+		}
+		select {
+		case d, ok := <-prioritized:
+			if !ok {
+				prioritized = nil
+				continue
+			}
+			self.deliver(d)
+		case d, ok := <-deliveries:
+			if !ok {
+				deliveries = nil
+				continue
+			}
+			self.deliver(d)
+		}
+	}
+}
+
+// Queues a delivery, in the priority lane if it qualifies, blocking while
+// the queue is full. Once the runner's stopped, e.g. for messages
+// injected by filters as they're drained, it delivers right away instead.
+func (self *OutputRunner) Deliver(d *delivery) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.stopped {
+		self.deliver(d)
+		return
+	}
+	if self.priority != nil &&
+		self.priority.Match(self.config.router, d.delivered.Message) {
+		atomic.AddInt64(&self.promoted, 1)
+		self.prioritized <- d
+		return
+	}
+	self.deliveries <- d
+}
+
+// Closes the queues and waits for the workers to deliver everything
+// that's queued
+func (self *OutputRunner) Stop() {
+	self.lock.Lock()
+	if self.stopped {
+		self.lock.Unlock()
+		return
+	}
+	self.stopped = true
+	close(self.deliveries)
+	if self.prioritized != nil {
+		close(self.prioritized)
+	}
+	self.lock.Unlock()
+	self.running.Wait()
+}
+
+// Delivers to the output, then releases the delivery's holds on the ack
+// and the pack
+func (self *OutputRunner) deliver(d *delivery) {
+	defer func() {
+		d.ack.Done(nil)
+		d.refs.Done()
+	}()
+	// A pack that's waited in the queue past the max age is evicted like
+	// one held up anywhere else, except on its way to the dead letter
+	// output itself
+	if packExpired(self.config, d.pipelinePack) &&
+		self.name != self.config.DeadLetterOutput {
+		d.pipelinePack.Trace.Record("output."+self.name, "evicted")
+		evictPack(self.config, d.pipelinePack, self.name+" output",
+			d.refs)
+		d.ack.fail(errAckEvicted)
+		return
+	}
+	// A panicking output loses this message but mustn't take the worker
+	// down
+	err := deliverAcked(self.output, d.delivered, d.ack)
+	if err != nil {
+		atomic.AddInt64(&self.failed, 1)
+		log.Println(NewDeliveryError(d.pipelinePack, self.name, err))
+		d.pipelinePack.Trace.Record("output."+self.name,
+			"failed: "+err.Error())
+		return
+	}
+	atomic.AddInt64(&self.delivered, 1)
+	if readTime := d.pipelinePack.ReadTime; !readTime.IsZero() {
+		self.latency.Record(time.Since(readTime))
+	}
+	d.pipelinePack.Trace.Record("output."+self.name, "delivered")
+	if d.audited {
+		self.config.Auditor.Record(d.pipelinePack, self.name, "delivered",
+			time.Since(d.pipelinePack.ReadTime))
+	}
+}
+
+// Queue depth, delivery counts and delivery latency (see
+// LatencyHistogram), reported as the "pipeline delivery.<output>" plugin
+func (self *OutputRunner) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"workers":    int64(self.workers),
+		"queued":     int64(len(self.deliveries)),
+		"queue_size": int64(cap(self.deliveries)),
+		"delivered":  atomic.LoadInt64(&self.delivered),
+		"failed":     atomic.LoadInt64(&self.failed),
+	}
+	self.latency.report(report, "latency")
+	if self.priority != nil {
+		report["priority_queued"] = int64(len(self.prioritized))
+		report["prioritized"] = atomic.LoadInt64(&self.promoted)
+	}
+	return report
+}
+
+// Records an output section's `delivery_workers`, `delivery_queue_size`,
+// `priority_severity` and `priority_matcher`, if set
+func outputDelivery(config *GraterConfig, name string,
+	section PluginConfig) error {
+	if value, ok := section["delivery_workers"]; ok {
+		workers, ok := value.(float64)
+		if !ok || workers < 1 || workers != float64(int(workers)) {
+			return fmt.Errorf("delivery_workers must be a positive integer")
+		}
+		config.DeliveryWorkers[name] = int(workers)
+	}
+	if value, ok := section["delivery_queue_size"]; ok {
+		size, ok := value.(float64)
+		if !ok || size < 0 || size != float64(int(size)) {
+			return fmt.Errorf("delivery_queue_size must be a non-negative " +
+				"integer")
+		}
+		config.DeliveryQueueSizes[name] = int(size)
+	}
+	expr, hasMatcher := section["priority_matcher"]
+	_, hasSeverity := section["priority_severity"]
+	if !hasMatcher && !hasSeverity {
+		return nil
+	}
+	priority := &DeliveryPriority{Severity: -1}
+	if hasSeverity {
+		severity := PluginConfig{
+			"priority_severity": normalizeConfigValue(
+				section["priority_severity"]),
+		}
+		var err error
+		priority.Severity, err = ConfigSeverity(&severity,
+			"priority_severity", -1)
+		if err != nil {
+			return err
+		}
+	}
+	if hasMatcher {
+		exprStr, ok := expr.(string)
+		if !ok {
+			return fmt.Errorf("priority_matcher must be a string")
+		}
+		matcher, err := NewMessageMatcher(exprStr)
+		if err != nil {
+			return fmt.Errorf("priority_matcher: %s", err.Error())
+		}
+		priority.Matcher = matcher
+	}
+	config.DeliveryPriorities[name] = priority
+	return nil
+}
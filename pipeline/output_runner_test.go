@@ -0,0 +1,154 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"time"
+)
+
+// Hands each pack's message to a channel, blocking until it's taken
+type channelOutput struct {
+	messages chan *Message
+}
+
+func (self *channelOutput) Init(config *PluginConfig) error {
+	return nil
+}
+
+func (self *channelOutput) Deliver(pipelinePack *PipelinePack) {
+	self.messages <- pipelinePack.Message
+}
+
+func OutputRunnerSpec(c gospec.Context) {
+	config := &GraterConfig{PoolSize: 10,
+		DeliveryWorkers: map[string]int{"slow": 1}}
+	pipelinePack := &PipelinePack{Message: &Message{Type: "test"}}
+
+	c.Specify("A slow output doesn't hold up the others", func() {
+		slow := &channelOutput{make(chan *Message)}
+		fast := &channelOutput{make(chan *Message, 1)}
+		slowRunner := NewOutputRunner(config, "slow", slow)
+		fastRunner := NewOutputRunner(config, "fast", fast)
+		slowRunner.Start()
+		fastRunner.Start()
+		released := make(chan bool, 1)
+		refs := newPackRefs(func() { released <- true })
+		for _, runner := range []*OutputRunner{slowRunner, fastRunner} {
+			refs.hold()
+			runner.Deliver(&delivery{pipelinePack: pipelinePack,
+				delivered: pipelinePack, refs: refs})
+		}
+		refs.Done()
+		select {
+		case msg := <-fast.messages:
+			c.Expect(msg.Type, gs.Equals, "test")
+		case <-time.After(time.Second):
+			c.Expect("fast output delivered", gs.Equals, "timed out")
+		}
+		c.Expect(len(released), gs.Equals, 0)
+		c.Expect(<-slow.messages, gs.Equals, pipelinePack.Message)
+		<-released
+		c.Expect(fastRunner.Report()["delivered"], gs.Equals, int64(1))
+		c.Expect(slowRunner.Report()["workers"], gs.Equals, int64(1))
+		c.Expect(fastRunner.Report()["workers"], gs.Equals,
+			int64(defaultDeliveryWorkers))
+	})
+
+	c.Specify("Prioritized messages get ahead of queued ones", func() {
+		config := &GraterConfig{PoolSize: 10,
+			DeliveryWorkers: map[string]int{"alerts": 1},
+			DeliveryPriorities: map[string]*DeliveryPriority{
+				"alerts": &DeliveryPriority{Severity: SEVERITY_ERROR},
+			}}
+		output := &channelOutput{make(chan *Message)}
+		runner := NewOutputRunner(config, "alerts", output)
+		runner.Start()
+		refs := newPackRefs(func() {})
+		for i, severity := range []int{SEVERITY_DEBUG, SEVERITY_DEBUG,
+			SEVERITY_CRITICAL} {
+			pack := &PipelinePack{Message: &Message{Severity: severity}}
+			refs.hold()
+			runner.Deliver(&delivery{pipelinePack: pack, delivered: pack,
+				refs: refs})
+			// Let the worker take the first message and block on it
+			for i == 0 && len(runner.deliveries) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		c.Expect((<-output.messages).Severity, gs.Equals, SEVERITY_DEBUG)
+		c.Expect((<-output.messages).Severity, gs.Equals, SEVERITY_CRITICAL)
+		c.Expect((<-output.messages).Severity, gs.Equals, SEVERITY_DEBUG)
+		c.Expect(runner.Report()["prioritized"], gs.Equals, int64(1))
+	})
+
+	c.Specify("Stopping delivers everything queued", func() {
+		output := &channelOutput{make(chan *Message, 3)}
+		runner := NewOutputRunner(config, "slow", output)
+		refs := newPackRefs(func() {})
+		for i := 0; i < 2; i++ {
+			refs.hold()
+			runner.Deliver(&delivery{pipelinePack: pipelinePack,
+				delivered: pipelinePack, refs: refs})
+		}
+		// Queued before there are workers, so Stop has to wait for both
+		runner.Start()
+		runner.Stop()
+		c.Expect(len(output.messages), gs.Equals, 2)
+		refs.hold()
+		runner.Deliver(&delivery{pipelinePack: pipelinePack,
+			delivered: pipelinePack, refs: refs})
+		c.Expect(len(output.messages), gs.Equals, 3)
+	})
+
+	c.Specify("Packs that expire while queued are evicted", func() {
+		config := &GraterConfig{PoolSize: 10, MaxPackAge: time.Second}
+		output := &channelOutput{make(chan *Message, 1)}
+		runner := NewOutputRunner(config, "out", output)
+		runner.Start()
+		stale := &PipelinePack{Message: &Message{Type: "test"},
+			ReadTime: time.Now().Add(-time.Minute)}
+		runner.Deliver(&delivery{pipelinePack: stale, delivered: stale,
+			refs: newPackRefs(func() {})})
+		runner.Stop()
+		c.Expect(len(output.messages), gs.Equals, 0)
+	})
+
+	c.Specify("Delivery settings are read from the output section", func() {
+		config := &GraterConfig{DeliveryWorkers: make(map[string]int),
+			DeliveryQueueSizes: make(map[string]int)}
+		err := outputDelivery(config, "out", PluginConfig{
+			"delivery_workers": float64(2), "delivery_queue_size": float64(0)})
+		c.Expect(err, gs.IsNil)
+		runner := NewOutputRunner(config, "out", new(channelOutput))
+		c.Expect(runner.workers, gs.Equals, 2)
+		c.Expect(cap(runner.deliveries), gs.Equals, 0)
+		err = outputDelivery(config, "out",
+			PluginConfig{"delivery_workers": float64(0)})
+		c.Expect(err, gs.Not(gs.IsNil))
+		config.DeliveryPriorities = make(map[string]*DeliveryPriority)
+		err = outputDelivery(config, "out", PluginConfig{
+			"priority_severity": "err", "priority_matcher": "Type == 'page'"})
+		c.Expect(err, gs.IsNil)
+		priority := config.DeliveryPriorities["out"]
+		c.Expect(priority.Match(nil, &Message{Severity: SEVERITY_ERROR}),
+			gs.IsTrue)
+		c.Expect(priority.Match(nil, &Message{Type: "page",
+			Severity: SEVERITY_DEBUG}), gs.IsTrue)
+		c.Expect(priority.Match(nil, &Message{Severity: SEVERITY_INFO}),
+			gs.IsFalse)
+	})
+}
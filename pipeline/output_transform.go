@@ -0,0 +1,89 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+)
+
+// Loads the filters of an output's `transform` setting, naming them
+// "<output>.transform[<index>]"
+func loadTransform(name string, value interface{},
+	load func(name string, section PluginConfig) Plugin) ([]Filter, error) {
+	sections, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("transform must be a list of filter sections")
+	}
+	filters := make([]Filter, 0, len(sections))
+	for i, item := range sections {
+		section, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("transform %d isn't an object", i)
+		}
+		plugin := load(fmt.Sprintf("%s.transform[%d]", name, i), section)
+		if filter, ok := plugin.(Filter); ok {
+			filters = append(filters, filter)
+		}
+	}
+	return filters, nil
+}
+
+// An output section's `transform` setting is a list of filter sections,
+// like a filter chain's, run on each message after it's been routed to
+// the output and before the output encodes it. This is the place for
+// destination specific tweaks, e.g. a RewriteFilter renaming fields the
+// way a SaaS API wants them, which would otherwise have to be made in the
+// global filter chain and so affect every output. The filters work on a
+// copy of the message, so other outputs are unaffected; a filter dropping
+// the message keeps it from this output only, and changes to the routing
+// are ignored.
+//
+// Returns the transformed copy of the pack, or nil if a filter dropped the
+// message.
+func transformPack(config *GraterConfig, filters []Filter,
+	pipelinePack *PipelinePack) (*PipelinePack, error) {
+	transformed := *pipelinePack
+	transformed.Message = new(Message)
+	pipelinePack.Message.Copy(transformed.Message)
+	transformed.Outputs = make(map[string]bool)
+	for name, use := range pipelinePack.Outputs {
+		transformed.Outputs[name] = use
+	}
+	err := runRecovered(func() error {
+		for _, filter := range filters {
+			msg := transformed.Message
+			if !config.router.FilterWants(config, filter, msg) {
+				continue
+			}
+			if sandbox, ok := config.Sandboxes[filter]; ok {
+				sandbox.Run(filter, &transformed)
+				continue
+			}
+			filter.FilterMsg(&transformed)
+			if transformed.Message == nil {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transform failed: %s", err.Error())
+	}
+	if transformed.Message == nil {
+		return nil, nil
+	}
+	return &transformed, nil
+}
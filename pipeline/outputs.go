@@ -14,8 +14,10 @@
 package pipeline
 
 import (
+	"fmt"
 	"log"
 	"runtime"
+	"strconv"
 	"time"
 )
 
@@ -24,6 +26,40 @@ type Output interface {
 	Deliver(pipelinePack *PipelinePack)
 }
 
+// DeliveryError describes a failure to deliver a message, w/ enough
+// context to trace the message back to its producer. The message values
+// are copied, so the error remains valid after the pack is recycled.
+type DeliveryError struct {
+	Output    string
+	Input     string
+	MessageId string
+	Type      string
+	Logger    string
+	Hostname  string
+	Err       error
+}
+
+func NewDeliveryError(pipelinePack *PipelinePack, output string,
+	err error) *DeliveryError {
+	msg := pipelinePack.Message
+	return &DeliveryError{
+		Output:    output,
+		Input:     pipelinePack.InputName,
+		MessageId: strconv.FormatUint(MessageFingerprint(msg), 16),
+		Type:      msg.Type,
+		Logger:    msg.Logger,
+		Hostname:  msg.Hostname,
+		Err:       err,
+	}
+}
+
+func (self *DeliveryError) Error() string {
+	return fmt.Sprintf("%s output: delivery of message %s failed: %s "+
+		"(type=%q logger=%q hostname=%q input=%q)", self.Output,
+		self.MessageId, self.Err.Error(), self.Type, self.Logger,
+		self.Hostname, self.Input)
+}
+
 type LogOutput struct {
 }
 
@@ -32,7 +68,7 @@ func (self *LogOutput) Init(config *PluginConfig) error {
 }
 
 func (self *LogOutput) Deliver(pipelinePack *PipelinePack) {
-	log.Printf("%+v\n", *(pipelinePack.Message))
+	log.Println(pipelinePack.Message.String())
 }
 
 type CounterOutput struct {
@@ -0,0 +1,183 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"log"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// What's done w/ a decoded message bigger than max_message_size
+const (
+	OversizeReject   = "reject"
+	OversizeTruncate = "truncate"
+	OversizeSplit    = "split"
+)
+
+// OversizeGuard enforces max_message_size on decoded messages, so one
+// runaway payload can't blow up every output downstream of it (most of
+// which assume a message fits in a pack's 64KB buffer once encoded). W/
+// the "reject" policy (the default) oversized messages are dropped. W/
+// "truncate" the payload is cut to fit and a "truncated" field set to
+// true. W/ "split" the payload is cut into as many messages as it takes,
+// each a copy of the original w/ its share of the payload and
+// "split_part" and "split_parts" fields (counting from 1). Messages that
+// are still too big w/ an empty payload, i.e. their fields are to blame,
+// are rejected whatever the policy. Payloads are only ever cut between
+// UTF-8 characters.
+//
+// The size is an estimate of the message's encoded size: the lengths of
+// its strings and field names and values, w/ 8 bytes for each number.
+// It's reported as the "pipeline message_size" plugin.
+type OversizeGuard struct {
+	max       int
+	policy    string
+	rejected  int64
+	truncated int64
+	split     int64
+}
+
+// Returns the guard for the config's max_message_size, or nil if there's
+// no max
+func NewOversizeGuard(config *GraterConfig) *OversizeGuard {
+	if config.MaxMessageSize <= 0 {
+		return nil
+	}
+	policy := config.OversizePolicy
+	if policy == "" {
+		policy = OversizeReject
+	}
+	return &OversizeGuard{max: config.MaxMessageSize, policy: policy}
+}
+
+// Checks an oversize_policy setting
+func checkOversizePolicy(policy string) error {
+	switch policy {
+	case "", OversizeReject, OversizeTruncate, OversizeSplit:
+		return nil
+	}
+	return fmt.Errorf("oversize_policy must be %s, %s or %s",
+		OversizeReject, OversizeTruncate, OversizeSplit)
+}
+
+// Estimates the encoded size of a message
+func messageSize(msg *Message) int {
+	size := len(msg.Type) + len(msg.Logger) + len(msg.Payload) +
+		len(msg.Env_version) + len(msg.Hostname) + 3*8
+	for name, value := range msg.Fields {
+		size += len(name) + fieldValueSize(value)
+	}
+	return size
+}
+
+func fieldValueSize(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case []interface{}:
+		size := 0
+		for _, item := range v {
+			size += fieldValueSize(item)
+		}
+		return size
+	case map[string]interface{}:
+		size := 0
+		for key, item := range v {
+			size += len(key) + fieldValueSize(item)
+		}
+		return size
+	}
+	return 8
+}
+
+// Returns whether the message is over the max. Works on a nil guard.
+func (self *OversizeGuard) Oversized(msg *Message) bool {
+	return self != nil && messageSize(msg) > self.max
+}
+
+// Applies the policy to an oversized message, returning the messages to
+// carry on w/ in its place: none if it's rejected, the message itself
+// truncated, or the parts it's split into
+func (self *OversizeGuard) Apply(msg *Message) []*Message {
+	overhead := messageSize(msg) - len(msg.Payload)
+	switch self.policy {
+	case OversizeTruncate:
+		// Room for the truncated field too
+		room := self.max - overhead - len("truncated") - 8
+		if room >= 0 {
+			atomic.AddInt64(&self.truncated, 1)
+			msg.Payload = truncateUtf8(msg.Payload, room)
+			msg.ReplaceField("truncated", true)
+			return []*Message{msg}
+		}
+	case OversizeSplit:
+		room := self.max - overhead - len("split_part") -
+			len("split_parts") - 2*8
+		if room >= utf8.UTFMax {
+			atomic.AddInt64(&self.split, 1)
+			return splitPayload(msg, room)
+		}
+	}
+	if rejected := atomic.AddInt64(&self.rejected, 1); rejected%1000 == 1 {
+		log.Printf("Rejecting %d byte %s message over max_message_size %d "+
+			"(%d rejected so far)\n", messageSize(msg), msg.Type, self.max,
+			rejected)
+	}
+	return nil
+}
+
+// Cuts a string to at most size bytes w/o splitting a UTF-8 character
+func truncateUtf8(str string, size int) string {
+	if len(str) <= size {
+		return str
+	}
+	for size > 0 && !utf8.RuneStart(str[size]) {
+		size--
+	}
+	return str[:size]
+}
+
+// Copies the message once for each chunk of up to size bytes of payload
+func splitPayload(msg *Message, size int) []*Message {
+	chunks := make([]string, 0, len(msg.Payload)/size+1)
+	for payload := msg.Payload; len(payload) > 0; {
+		chunk := truncateUtf8(payload, size)
+		chunks = append(chunks, chunk)
+		payload = payload[len(chunk):]
+	}
+	parts := make([]*Message, len(chunks))
+	for i, chunk := range chunks {
+		parts[i] = new(Message)
+		msg.Copy(parts[i])
+		parts[i].Payload = chunk
+		parts[i].ReplaceField("split_part", int64(i+1))
+		parts[i].ReplaceField("split_parts", int64(len(chunks)))
+	}
+	return parts
+}
+
+func (self *OversizeGuard) Report() map[string]interface{} {
+	return map[string]interface{}{
+		"max_message_size": int64(self.max),
+		"policy":           self.policy,
+		"rejected":         atomic.LoadInt64(&self.rejected),
+		"truncated":        atomic.LoadInt64(&self.truncated),
+		"split":            atomic.LoadInt64(&self.split),
+	}
+}
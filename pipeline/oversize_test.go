@@ -0,0 +1,73 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"strings"
+)
+
+func OversizeGuardSpec(c gospec.Context) {
+	config := &GraterConfig{MaxMessageSize: 200}
+	msg := &Message{Type: "test", Payload: strings.Repeat("é", 150)}
+
+	c.Specify("There's no guard w/o a max", func() {
+		var guard *OversizeGuard
+		c.Expect(guard.Oversized(msg), gs.IsFalse)
+		c.Expect(NewOversizeGuard(&GraterConfig{}) == nil, gs.IsTrue)
+	})
+
+	c.Specify("Oversized messages are rejected by default", func() {
+		guard := NewOversizeGuard(config)
+		c.Expect(guard.Oversized(&Message{Payload: "small"}), gs.IsFalse)
+		c.Expect(guard.Oversized(msg), gs.IsTrue)
+		c.Expect(len(guard.Apply(msg)), gs.Equals, 0)
+		c.Expect(guard.Report()["rejected"], gs.Equals, int64(1))
+	})
+
+	c.Specify("Truncated messages fit and are marked", func() {
+		config.OversizePolicy = OversizeTruncate
+		guard := NewOversizeGuard(config)
+		parts := guard.Apply(msg)
+		c.Expect(len(parts), gs.Equals, 1)
+		c.Expect(guard.Oversized(parts[0]), gs.IsFalse)
+		c.Expect(parts[0].Fields["truncated"], gs.Equals, true)
+		c.Expect(strings.Trim(parts[0].Payload, "é"), gs.Equals, "")
+	})
+
+	c.Specify("Split messages carry the whole payload", func() {
+		config.OversizePolicy = OversizeSplit
+		guard := NewOversizeGuard(config)
+		parts := guard.Apply(msg)
+		c.Expect(len(parts) > 1, gs.IsTrue)
+		payload := ""
+		for i, part := range parts {
+			c.Expect(guard.Oversized(part), gs.IsFalse)
+			c.Expect(part.Fields["split_part"], gs.Equals, int64(i+1))
+			c.Expect(part.Fields["split_parts"], gs.Equals,
+				int64(len(parts)))
+			payload += part.Payload
+		}
+		c.Expect(payload, gs.Equals, msg.Payload)
+	})
+
+	c.Specify("Messages too big w/o their payload are rejected", func() {
+		config.OversizePolicy = OversizeSplit
+		guard := NewOversizeGuard(config)
+		msg.ReplaceField("huge", strings.Repeat("x", 300))
+		c.Expect(len(guard.Apply(msg)), gs.Equals, 0)
+	})
+}
@@ -0,0 +1,117 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"plugin"
+	"sort"
+	"sync"
+)
+
+// The version of the plugin API, i.e. of the interfaces plugins implement
+// and the types they're handed. It's bumped whenever a change would break
+// plugins built against an older tree.
+const PluginAPIVersion = 1
+
+// Out-of-tree plugins are built as Go plugins (`go build
+// -buildmode=plugin`) against the same heka tree as hekad and dropped into
+// the `plugins_dir` named in the config. Each shared object must export
+//
+//	func HekaPluginAPIVersion() int
+//	func RegisterHekaPlugins(register PluginRegistrar) error
+//
+// The version is checked against PluginAPIVersion before anything else is
+// called, and RegisterHekaPlugins then registers the object's plugin types
+// by name, just as RegisterPlugin does for plugins compiled in. A type
+// can't replace one that's already registered.
+type PluginRegistrar func(typeName string, factory func() interface{}) error
+
+// Shared objects already loaded, by path. A Go plugin can't be unloaded,
+// or loaded twice, so a config that's loaded again (e.g. validated and
+// then run) reuses the earlier registration.
+var (
+	loadedPlugins     = make(map[string]error)
+	loadedPluginsLock sync.Mutex
+)
+
+// Loads every *.so in dir, returning the errors for those that couldn't be
+// loaded
+func loadPluginsDir(dir string) []error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return []error{err}
+	}
+	sort.Strings(paths)
+	errs := make([]error, 0)
+	for _, path := range paths {
+		if err = loadPluginObject(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", path, err.Error()))
+		}
+	}
+	return errs
+}
+
+func loadPluginObject(path string) error {
+	loadedPluginsLock.Lock()
+	defer loadedPluginsLock.Unlock()
+	if err, ok := loadedPlugins[path]; ok {
+		return err
+	}
+	err := openPluginObject(path)
+	loadedPlugins[path] = err
+	return err
+}
+
+func openPluginObject(path string) error {
+	object, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	symbol, err := object.Lookup("HekaPluginAPIVersion")
+	if err != nil {
+		return err
+	}
+	apiVersion, ok := symbol.(func() int)
+	if !ok {
+		return fmt.Errorf("HekaPluginAPIVersion must be a func() int")
+	}
+	if version := apiVersion(); version != PluginAPIVersion {
+		return fmt.Errorf("built for plugin API version %d, hekad has %d",
+			version, PluginAPIVersion)
+	}
+	if symbol, err = object.Lookup("RegisterHekaPlugins"); err != nil {
+		return err
+	}
+	register, ok := symbol.(func(PluginRegistrar) error)
+	if !ok {
+		return fmt.Errorf("RegisterHekaPlugins must be a " +
+			"func(pipeline.PluginRegistrar) error")
+	}
+	registered := make([]string, 0)
+	err = register(func(typeName string, factory func() interface{}) error {
+		if err := registerPlugin(typeName, factory); err != nil {
+			return err
+		}
+		registered = append(registered, typeName)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded plugins from %s: %v\n", path, registered)
+	return nil
+}
@@ -0,0 +1,336 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracks a pack while it's checked out of the pool, i.e. from the time it
+// enters the pipeline function until it's recycled
+type packState struct {
+	lock       sync.Mutex
+	generation uint64
+	out        bool
+	since      time.Time
+	holderKind string
+	holderName string
+	// Set once a leak has been logged for this checkout
+	reported bool
+	// Set when a replacement pack was added to the pool in this pack's place
+	replaced bool
+}
+
+// PackPool holds the PipelinePacks shared by the inputs. The pool is a
+// fixed size on purpose, it's what pushes back on the inputs when outputs
+// can't keep up, so the free packs live in a bounded Queue. Each
+// checkout bumps the pack's generation and records which stage is holding
+// the pack, so that when the pool runs dry the leak detector can say who
+// has the packs rather than the pipeline silently stalling.
+//
+// With ReplaceLeakedPacks set a pack held past the leak timeout is written
+// off and a replacement added to the pool. When the leaked pack does come
+// back it's parked in a sync.Pool rather than the free queue, so the
+// number of usable packs never exceeds PoolSize and parked packs are
+// reused for later replacements (or left for the GC).
+//
+// PoolBackpressure says what inputs do when the pool is empty: wait for a
+// pack ("block", the default) or read into a spare pack and drop the
+// record ("drop"), so e.g. a UDP socket keeps being drained and the loss
+// is counted rather than happening silently in the kernel. Inputs w/
+// InputWeights set always wait, via the PackScheduler.
+type PackPool struct {
+	config       *GraterConfig
+	free         *Queue
+	surplus      sync.Pool
+	backpressure *Backpressure
+	// Every pack in circulation, i.e. not parked in surplus, for the
+	// leak detector
+	packs     []*PipelinePack
+	packsLock sync.Mutex
+	// Bumped for every checkout, stamped on the pack's state
+	generation uint64
+	leaked     uint64
+	replaced   uint64
+	exhausted  uint64
+}
+
+// Creates the pool w/ config.PoolSize packs
+func NewPackPool(config *GraterConfig) *PackPool {
+	self := &PackPool{
+		config: config,
+		free:   NewQueue(config.PoolSize+1, nil),
+		packs:  make([]*PipelinePack, 0, config.PoolSize),
+	}
+	backpressure, err := NewBackpressure(config.PoolBackpressure,
+		BackpressureBlock)
+	if err != nil || backpressure.Policy == BackpressureShedOldest {
+		log.Printf("Invalid pool backpressure policy '%s', using %s\n",
+			config.PoolBackpressure, BackpressureBlock)
+		backpressure, _ = NewBackpressure(BackpressureBlock, "")
+	}
+	self.backpressure = backpressure
+	self.surplus.New = func() interface{} { return self.newPack() }
+	for i := 0; i < config.PoolSize; i++ {
+		self.add(self.newPack())
+	}
+	return self
+}
+
+func (self *PackPool) newPack() *PipelinePack {
+	pipelinePack := &PipelinePack{
+		MsgBytes: make([]byte, 65536),
+		Message:  new(Message),
+		Config:   self.config,
+		state:    new(packState),
+	}
+	resetPack(pipelinePack)
+	return pipelinePack
+}
+
+// Puts a fresh pack in the free queue and starts tracking it
+func (self *PackPool) add(pipelinePack *PipelinePack) {
+	self.packsLock.Lock()
+	self.packs = append(self.packs, pipelinePack)
+	self.packsLock.Unlock()
+	self.free.Push(pipelinePack, 0)
+}
+
+// Returns the pack to the state inputs expect to find it in
+func resetPack(pipelinePack *PipelinePack) {
+	config := pipelinePack.Config
+	msgBytes := pipelinePack.MsgBytes
+	pipelinePack.MsgBytes = msgBytes[:cap(msgBytes)]
+	pipelinePack.Decoder = config.DefaultDecoder
+	pipelinePack.Decoded = false
+	pipelinePack.InputName = ""
+	pipelinePack.Fields = nil
+	pipelinePack.FirstRecord = false
+	pipelinePack.AckToken = nil
+	pipelinePack.Trace = nil
+	// Filters drop messages by clearing them
+	if pipelinePack.Message == nil {
+		pipelinePack.Message = new(Message)
+	}
+	pipelinePack.FilterChain = config.DefaultFilterChain
+	resetOutputs(config, pipelinePack)
+}
+
+// The queue inputs take free packs from
+func (self *PackPool) Free() *Queue {
+	return self.free
+}
+
+// Blocks until a free pack is available
+func (self *PackPool) Get() *PipelinePack {
+	item, _ := self.free.Pop(0)
+	return item.(*PipelinePack)
+}
+
+// Marks the pack as checked out by the pipeline, starting w/ the input
+// that read it
+func (self *PackPool) checkout(pipelinePack *PipelinePack) {
+	state := pipelinePack.state
+	if state == nil {
+		return
+	}
+	generation := atomic.AddUint64(&self.generation, 1)
+	state.lock.Lock()
+	state.generation = generation
+	state.out = true
+	state.since = time.Now()
+	state.holderKind = "input"
+	state.holderName = pipelinePack.InputName
+	state.reported = false
+	state.replaced = false
+	state.lock.Unlock()
+}
+
+// Records the stage that's now holding the pack. Only tracked when leak
+// detection is on, so it costs nothing otherwise.
+func (self *PackPool) hold(pipelinePack *PipelinePack, kind, name string) {
+	state := pipelinePack.state
+	if state == nil || self.config.PackLeakTimeout <= 0 {
+		return
+	}
+	state.lock.Lock()
+	state.holderKind = kind
+	state.holderName = name
+	state.lock.Unlock()
+}
+
+// Resets the pack and returns it to the pool. Packs that were written off
+// as leaked and replaced go to the surplus pool instead.
+func (self *PackPool) Recycle(pipelinePack *PipelinePack) {
+	resetPack(pipelinePack)
+	state := pipelinePack.state
+	if state == nil {
+		// Not one of ours (e.g. a sandbox pack), let the GC have it
+		return
+	}
+	state.lock.Lock()
+	state.out = false
+	replaced := state.replaced
+	if replaced {
+		log.Printf("Leaked pack returned by %s %s after %s (generation "+
+			"%d)\n", state.holderKind, state.holderName,
+			time.Since(state.since), state.generation)
+	}
+	state.lock.Unlock()
+	if replaced {
+		self.packsLock.Lock()
+		for i, tracked := range self.packs {
+			if tracked == pipelinePack {
+				self.packs = append(self.packs[:i], self.packs[i+1:]...)
+				break
+			}
+		}
+		self.packsLock.Unlock()
+		self.surplus.Put(pipelinePack)
+		return
+	}
+	self.free.Push(pipelinePack, 0)
+}
+
+// Number of packs that aren't in the free queue
+func (self *PackPool) inUse() int {
+	return self.config.PoolSize - self.free.Len()
+}
+
+// Checks every checked out pack against the leak timeout, logging each
+// leak once and replacing the pack if configured to. When the pool is
+// empty it also logs who's holding the packs, since that's a stalled
+// pipeline.
+func (self *PackPool) checkLeaks(now time.Time) {
+	timeout := self.config.PackLeakTimeout
+	self.packsLock.Lock()
+	packs := append([]*PipelinePack(nil), self.packs...)
+	self.packsLock.Unlock()
+	holders := make(map[string]int)
+	replace := 0
+	for _, pipelinePack := range packs {
+		state := pipelinePack.state
+		state.lock.Lock()
+		if !state.out || state.replaced {
+			state.lock.Unlock()
+			continue
+		}
+		holder := state.holderKind + " " + state.holderName
+		holders[holder]++
+		held := now.Sub(state.since)
+		if held > timeout && !state.reported {
+			state.reported = true
+			atomic.AddUint64(&self.leaked, 1)
+			log.Printf("Pack held by %s for %s (generation %d), possible "+
+				"leak\n", holder, held, state.generation)
+			if self.config.ReplaceLeakedPacks {
+				state.replaced = true
+				replace++
+			}
+		}
+		state.lock.Unlock()
+	}
+	for i := 0; i < replace; i++ {
+		atomic.AddUint64(&self.replaced, 1)
+		replacement := self.surplus.Get().(*PipelinePack)
+		resetPack(replacement)
+		self.add(replacement)
+	}
+	if self.free.Len() == 0 && len(holders) > 0 {
+		atomic.AddUint64(&self.exhausted, 1)
+		log.Printf("Pack pool exhausted, packs held by: %s\n",
+			formatHolders(holders))
+	}
+}
+
+// Formats the holder counts busiest first, e.g. "output foo (10), ..."
+func formatHolders(holders map[string]int) string {
+	names := make([]string, 0, len(holders))
+	for name := range holders {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if holders[names[i]] != holders[names[j]] {
+			return holders[names[i]] > holders[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s (%d)", name, holders[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Runs the leak detector until the process exits, checking at a quarter
+// of the leak timeout
+func (self *PackPool) watchLeaks() {
+	ticker := time.NewTicker(self.config.PackLeakTimeout / 4)
+	for now := range ticker.C {
+		self.checkLeaks(now)
+	}
+}
+
+// Pool utilization, reported as the "pipeline pack_pool" plugin
+func (self *PackPool) Report() map[string]interface{} {
+	inUse := self.inUse()
+	report := map[string]interface{}{
+		"size":        int64(self.config.PoolSize),
+		"free":        int64(self.free.Len()),
+		"in_use":      int64(inUse),
+		"utilization": float64(inUse) / float64(self.config.PoolSize),
+		"generation":  int64(atomic.LoadUint64(&self.generation)),
+		"leaked":      int64(atomic.LoadUint64(&self.leaked)),
+		"replaced":    int64(atomic.LoadUint64(&self.replaced)),
+		"exhausted":   int64(atomic.LoadUint64(&self.exhausted)),
+	}
+	self.backpressure.report(report)
+	return report
+}
+
+// packRefs counts the stages still using a pack. A pack routed to several
+// outputs is shared by their OutputRunners rather than copied for each,
+// and only goes back to the pool once the last of them is done w/ it, so
+// the outputs consume it independently and nothing writes to a pack
+// another stage can still see. The pipeline function holds one reference
+// while it filters and routes the pack, and each queued delivery one more.
+type packRefs struct {
+	pending int32
+	release func()
+}
+
+// Returns the references to a pack, w/ the pipeline function's held.
+// release is called once they've all been released.
+func newPackRefs(release func()) *packRefs {
+	return &packRefs{pending: 1, release: release}
+}
+
+// Takes another reference, for a queued delivery
+func (self *packRefs) hold() {
+	atomic.AddInt32(&self.pending, 1)
+}
+
+// Releases a reference, releasing the pack if it was the last
+func (self *packRefs) Done() {
+	if atomic.AddInt32(&self.pending, -1) == 0 {
+		self.release()
+	}
+}
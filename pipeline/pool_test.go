@@ -0,0 +1,66 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	"time"
+)
+
+func PackPoolSpec(c gospec.Context) {
+	config := &GraterConfig{PoolSize: 2, DefaultDecoder: "json",
+		DefaultOutputs: []string{"log"}, PackLeakTimeout: time.Minute}
+	pool := NewPackPool(config)
+
+	c.Specify("Recycled packs are reset and back in the pool", func() {
+		pack := pool.Get()
+		pack.InputName = "udp"
+		pool.checkout(pack)
+		c.Expect(pool.Report()["in_use"], gs.Equals, int64(1))
+		pack.Decoder = "other"
+		pack.MsgBytes = pack.MsgBytes[:10]
+		pool.Recycle(pack)
+		c.Expect(pool.Free().Len(), gs.Equals, 2)
+		c.Expect(pack.Decoder, gs.Equals, "json")
+		c.Expect(len(pack.MsgBytes), gs.Equals, 65536)
+		c.Expect(pack.Outputs["log"], gs.IsTrue)
+		c.Expect(pool.Report()["generation"], gs.Equals, int64(1))
+	})
+
+	c.Specify("Packs held past the timeout are reported", func() {
+		pack := pool.Get()
+		pool.checkout(pack)
+		pool.hold(pack, "output", "stuck")
+		pool.checkLeaks(time.Now().Add(30 * time.Second))
+		c.Expect(pool.Report()["leaked"], gs.Equals, int64(0))
+		pool.checkLeaks(time.Now().Add(2 * time.Minute))
+		pool.checkLeaks(time.Now().Add(3 * time.Minute))
+		c.Expect(pool.Report()["leaked"], gs.Equals, int64(1))
+		c.Expect(pool.Free().Len(), gs.Equals, 1)
+		pool.Recycle(pack)
+	})
+
+	c.Specify("Leaked packs are replaced w/o growing the pool", func() {
+		config.ReplaceLeakedPacks = true
+		leaked := pool.Get()
+		pool.checkout(leaked)
+		pool.checkLeaks(time.Now().Add(2 * time.Minute))
+		c.Expect(pool.Report()["replaced"], gs.Equals, int64(1))
+		c.Expect(pool.Free().Len(), gs.Equals, 2)
+		pool.Recycle(leaked)
+		c.Expect(pool.Free().Len(), gs.Equals, 2)
+		c.Expect(len(pool.packs), gs.Equals, 2)
+	})
+}
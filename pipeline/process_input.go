@@ -0,0 +1,219 @@
+//go:build !noprocessinput
+// +build !noprocessinput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("ProcessInput", func() interface{} { return new(ProcessInput) })
+}
+
+// A record read from a process, or the message reporting its exit
+type processRecord struct {
+	data   []byte
+	stream string
+	msg    *Message
+}
+
+// ProcessInput runs a command, either every `Interval` seconds or, if no
+// interval is set, continuously (restarting it whenever it exits). The
+// command's stdout and stderr are split into records w/ the configured
+// splitter (newline by default) and handed to the decoder, w/ a "stream"
+// field of "stdout" or "stderr" added to each decoded message. When the
+// command exits a heka.process-exit message is emitted w/ the exit status
+// in its "exit_status" field.
+type ProcessInput struct {
+	command    string
+	args       []string
+	env        []string
+	dir        string
+	interval   time.Duration
+	decoder    string
+	splitter   Splitter
+	recordChan chan *processRecord
+}
+
+func (self *ProcessInput) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Command"]
+	if !ok {
+		return errors.New("ProcessInput config: Missing Command")
+	}
+	self.command = value.(string)
+	if value, ok = (*config)["Args"]; ok {
+		self.args = value.([]string)
+	}
+	// `Env` is a list of "KEY=value" strings, added to hekad's environment
+	if value, ok = (*config)["Env"]; ok {
+		self.env = value.([]string)
+	}
+	if value, ok = (*config)["Dir"]; ok {
+		self.dir = value.(string)
+	}
+	self.interval, err = ConfigDuration(config, "Interval", time.Second,
+		0)
+	if err != nil {
+		return fmt.Errorf("ProcessInput config: %s", err.Error())
+	}
+	if value, ok = (*config)["Decoder"]; ok {
+		self.decoder = value.(string)
+	}
+	splitterKind := "newline"
+	if value, ok = (*config)["Splitter"]; ok {
+		splitterKind = value.(string)
+	}
+	if self.splitter, err = NewSplitter(splitterKind); err != nil {
+		return
+	}
+	if err = self.splitter.Init(config); err != nil {
+		return
+	}
+	self.recordChan = make(chan *processRecord, 100)
+	return nil
+}
+
+// Starts running the command. This happens here rather than in Init so
+// configs can be validated w/o running anything.
+func (self *ProcessInput) Prepare() error {
+	if _, err := exec.LookPath(self.command); err != nil {
+		return err
+	}
+	go self.runLoop()
+	return nil
+}
+
+func (self *ProcessInput) runLoop() {
+	for {
+		start := time.Now()
+		self.recordChan <- &processRecord{msg: self.run()}
+		if self.interval == 0 {
+			// Avoid spinning on a command that exits immediately
+			time.Sleep(time.Second)
+		} else if wait := self.interval - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// Runs the command once, returning the message reporting how it exited
+func (self *ProcessInput) run() *Message {
+	cmd := exec.Command(self.command, self.args...)
+	cmd.Dir = self.dir
+	if len(self.env) > 0 {
+		cmd.Env = append(os.Environ(), self.env...)
+	}
+	exitStatus := -1
+	stdout, err := cmd.StdoutPipe()
+	var stderr io.ReadCloser
+	if err == nil {
+		stderr, err = cmd.StderrPipe()
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go self.readStream(stdout, "stdout", &wg)
+		go self.readStream(stderr, "stderr", &wg)
+		// Wait closes the pipes, so the streams have to be read first
+		wg.Wait()
+		err = cmd.Wait()
+		if err == nil {
+			exitStatus = 0
+		} else if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				exitStatus = status.ExitStatus()
+			}
+		}
+	}
+	hostname, _ := os.Hostname()
+	msg := &Message{
+		Type:      "heka.process-exit",
+		Timestamp: time.Now(),
+		Logger:    "hekad",
+		Severity:  SEVERITY_INFO,
+		Pid:       os.Getpid(),
+		Hostname:  hostname,
+		Fields: map[string]interface{}{
+			"command": strings.Join(append([]string{self.command},
+				self.args...), " "),
+			"exit_status": exitStatus,
+		},
+	}
+	if err != nil {
+		msg.Severity = SEVERITY_WARNING
+		msg.Payload = err.Error()
+		log.Printf("ProcessInput %s failed: %s\n", self.command, err.Error())
+	}
+	return msg
+}
+
+func (self *ProcessInput) readStream(stream io.Reader, name string,
+	wg *sync.WaitGroup) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(stream)
+	scanner.Split(self.splitter.Split)
+	for scanner.Scan() {
+		// The scanner reuses its buffer, so each record needs a copy
+		record := make([]byte, len(scanner.Bytes()))
+		copy(record, scanner.Bytes())
+		self.recordChan <- &processRecord{data: record, stream: name}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("ProcessInput error reading %s of %s: %s\n", name,
+			self.command, err.Error())
+	}
+}
+
+func (self *ProcessInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case record := <-self.recordChan:
+		if record.msg != nil {
+			pipelinePack.Message = record.msg
+			pipelinePack.Decoded = true
+			return nil
+		}
+		msgBytes := pipelinePack.MsgBytes[:cap(pipelinePack.MsgBytes)]
+		if len(record.data) > len(msgBytes) {
+			return NewRecordError("ProcessInput dropping %d byte record, max "+
+				"size is %d", len(record.data), len(msgBytes))
+		}
+		pipelinePack.MsgBytes = msgBytes[:copy(msgBytes, record.data)]
+		pipelinePack.Fields = map[string]interface{}{"stream": record.stream}
+		if self.decoder != "" {
+			pipelinePack.Decoder = self.decoder
+		}
+		return nil
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No records to read")
+	return &err
+}
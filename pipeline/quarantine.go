@@ -0,0 +1,237 @@
+//go:build !noquarantine
+// +build !noquarantine
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("QuarantineFilter", func() interface{} {
+		return new(QuarantineFilter)
+	})
+}
+
+// Idle producers are cleaned up once there are more than this many
+const maxQuarantineKeys = 10000
+
+// What QuarantineFilter knows about a producer
+type producer struct {
+	windowStart time.Time
+	total       int64
+	failed      int64
+	examples    []string
+	until       time.Time
+	count       int64
+}
+
+// QuarantineFilter watches for producers responsible for a high fraction
+// of parse failures and quarantines them for a while, so one broken
+// client can't flood the pipeline (and the logs) w/ garbage. Producers
+// are told apart by the message variable `Key`, "Fields[remote_addr]" by
+// default, or e.g. "Logger" or "Fields[tls_peer_cn]". A failure is a
+// decode error message (see GraterConfig.DecodeErrorMessages, which
+// should be set) or a message w/ a "decode_errors" field (see
+// JsonDecoder's lenient mode); every other message counts as a success.
+//
+// Each producer's messages are counted over a `Window` (60s by default).
+// At the end of a window, a producer w/ at least `MinMessages` (100)
+// messages of which at least `FailureRatio` ("50%") failed is quarantined
+// for `Duration` (10m): w/ an `Action` of "block" (the default) all of
+// its messages are dropped, and w/ "sample" only 1 in `SampleRate` (100)
+// is kept. When a producer is quarantined an alert of type `Type`
+// ("heka.quarantine") is sent at severity 2, w/ the producer's "key",
+// "failed", "total", "action", "until" and up to `Examples` (3) of its
+// errors as "examples". Producers are released automatically, and are
+// watched from scratch after that.
+type QuarantineFilter struct {
+	helper    PluginHelper
+	conf      *QuarantineFilterConfig
+	producers map[string]*producer
+	blocked   int64
+	lock      sync.Mutex
+}
+
+type QuarantineFilterConfig struct {
+	Key          string        `default:"Fields[remote_addr]"`
+	Window       time.Duration `default:"60s" min:"1s"`
+	MinMessages  int64         `default:"100" min:"1"`
+	FailureRatio Percent       `default:"50%" min:"0" max:"100"`
+	Duration     time.Duration `default:"10m" min:"1s"`
+	Action       string        `default:"block" choices:"block,sample"`
+	SampleRate   int64         `default:"100" min:"1"`
+	Examples     int           `default:"3" min:"0"`
+	Type         string        `default:"heka.quarantine"`
+}
+
+func (self *QuarantineFilter) Init(config *PluginConfig) error {
+	self.conf = new(QuarantineFilterConfig)
+	if err := LoadConfigStruct(config, self.conf); err != nil {
+		return fmt.Errorf("QuarantineFilter config: %s", err.Error())
+	}
+	if !isMessageVariable(self.conf.Key) {
+		return fmt.Errorf("QuarantineFilter config: Invalid Key: %s",
+			self.conf.Key)
+	}
+	self.producers = make(map[string]*producer)
+	return nil
+}
+
+func (self *QuarantineFilter) SetPluginHelper(helper PluginHelper) {
+	self.helper = helper
+}
+
+func (self *QuarantineFilter) Prepare() error {
+	if self.helper == nil {
+		return errors.New("QuarantineFilter needs a PluginHelper")
+	}
+	return nil
+}
+
+// Returns the error a message records, or "" if it isn't a failure
+func parseFailure(msg *Message) string {
+	if msg.Type == decodeErrorType {
+		return msg.Payload
+	}
+	if problems, ok := msg.Fields["decode_errors"]; ok {
+		return fmt.Sprint(problems)
+	}
+	return ""
+}
+
+// Removes the producers that aren't quarantined and haven't been seen for
+// a window. Must be called w/ the lock held.
+func (self *QuarantineFilter) cleanup(now time.Time) {
+	for key, p := range self.producers {
+		if now.After(p.until) &&
+			now.Sub(p.windowStart) >= 2*self.conf.Window {
+			delete(self.producers, key)
+		}
+	}
+}
+
+// Ends a producer's window, quarantining it if it's failing too much.
+// Returns the alert to send if it was quarantined. Must be called w/ the
+// lock held.
+func (self *QuarantineFilter) endWindow(key string, p *producer,
+	now time.Time) *Message {
+	var alert *Message
+	if p.total >= self.conf.MinMessages &&
+		float64(p.failed) >= self.conf.FailureRatio.Fraction()*
+			float64(p.total) {
+		p.until = now.Add(self.conf.Duration)
+		p.count = 0
+		alert = self.alert(key, p)
+	}
+	p.windowStart = now
+	p.total, p.failed = 0, 0
+	p.examples = nil
+	return alert
+}
+
+func (self *QuarantineFilter) alert(key string, p *producer) *Message {
+	hostname, _ := os.Hostname()
+	return &Message{
+		Type:      self.conf.Type,
+		Timestamp: self.helper.Now(),
+		Logger:    "hekad",
+		Severity:  SEVERITY_CRITICAL,
+		Payload: fmt.Sprintf("Quarantined %s %s until %s: %d of %d "+
+			"messages failed to parse", self.conf.Key, key,
+			p.until.Format(time.RFC3339), p.failed, p.total),
+		Pid:      os.Getpid(),
+		Hostname: hostname,
+		Fields: map[string]interface{}{
+			"key":      key,
+			"failed":   p.failed,
+			"total":    p.total,
+			"action":   self.conf.Action,
+			"until":    p.until.Format(time.RFC3339),
+			"examples": strings.Join(p.examples, "\n"),
+		},
+	}
+}
+
+func (self *QuarantineFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	if msg.Type == self.conf.Type {
+		return
+	}
+	value, ok := MessageVariable(msg, self.conf.Key)
+	if !ok {
+		return
+	}
+	key := fmt.Sprint(value)
+	now := self.helper.Now()
+	var alert *Message
+	self.lock.Lock()
+	p, ok := self.producers[key]
+	if !ok {
+		if len(self.producers) >= maxQuarantineKeys {
+			self.cleanup(now)
+		}
+		p = &producer{windowStart: now}
+		self.producers[key] = p
+	}
+	if !now.Before(p.until) && now.Sub(p.windowStart) >= self.conf.Window {
+		alert = self.endWindow(key, p, now)
+	}
+	if now.Before(p.until) {
+		p.count++
+		keep := self.conf.Action == "sample" &&
+			p.count%self.conf.SampleRate == 1%self.conf.SampleRate
+		if !keep {
+			self.blocked++
+			pipelinePack.Message = nil
+		}
+	} else {
+		p.total++
+		if failure := parseFailure(msg); failure != "" {
+			p.failed++
+			if len(p.examples) < self.conf.Examples {
+				p.examples = append(p.examples, failure)
+			}
+		}
+	}
+	self.lock.Unlock()
+	if alert != nil {
+		self.helper.InjectMessage(alert)
+	}
+}
+
+func (self *QuarantineFilter) Report() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	quarantined := int64(0)
+	now := self.helper.Now()
+	for _, p := range self.producers {
+		if now.Before(p.until) {
+			quarantined++
+		}
+	}
+	return map[string]interface{}{
+		"blocked":     self.blocked,
+		"quarantined": quarantined,
+		"producers":   len(self.producers),
+	}
+}
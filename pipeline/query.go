@@ -0,0 +1,50 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	. "heka/message"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Parses a time given in a query, as an RFC 3339 time or Unix seconds
+func parseQueryTime(value string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Responds to a query w/ a JSON list of messages in the metlog format
+func writeMessagesJson(w http.ResponseWriter, msgs []*Message) {
+	buffer := bytes.NewBufferString("[")
+	written := 0
+	for _, msg := range msgs {
+		msgJson, err := msg.MarshalJSON()
+		if err != nil {
+			continue
+		}
+		if written > 0 {
+			buffer.WriteString(",\n")
+		}
+		buffer.Write(msgJson)
+		written++
+	}
+	buffer.WriteString("]\n")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buffer.Bytes())
+}
@@ -0,0 +1,214 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrQueueClosed = errors.New("queue is closed")
+
+// Queue is a bounded FIFO shared by any number of producers and
+// consumers, e.g. the pipeline goroutines delivering to an output and
+// the output's sender, or the inputs and the pack pool. It's a buffered
+// channel underneath, so consumers can still select on it (see Chan),
+// w/ timeouts on both ends, close semantics and counters so its depth
+// shows up in the owning plugin's report.
+//
+// Once closed, pushes fail w/ ErrQueueClosed but queued items can still
+// be popped, and Pop returns ErrQueueClosed once they're gone.
+type Queue struct {
+	items  chan interface{}
+	closed chan struct{}
+	// Held by pushers, so Close only closes the items channel once no
+	// send on it can be in progress
+	lock      sync.RWMutex
+	closeOnce sync.Once
+	// Applied by Send, may be nil if Send isn't used
+	backpressure *Backpressure
+	pushed       int64
+	peak         int64
+}
+
+// Creates a queue holding up to size items
+func NewQueue(size int, backpressure *Backpressure) *Queue {
+	return &Queue{
+		items:        make(chan interface{}, size),
+		closed:       make(chan struct{}),
+		backpressure: backpressure,
+	}
+}
+
+// Returns a channel for a timer of the given length, or nil (which never
+// delivers) if it's not positive
+func queueTimer(timeout time.Duration) (<-chan time.Time, func() bool) {
+	if timeout <= 0 {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(timeout)
+	return timer.C, timer.Stop
+}
+
+// Adds an item, waiting up to timeout (forever if it's not positive) for
+// room. Returns a *TimeoutError if there was no room in time.
+func (self *Queue) Push(item interface{}, timeout time.Duration) error {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.IsClosed() {
+		return ErrQueueClosed
+	}
+	expired, stop := queueTimer(timeout)
+	defer stop()
+	select {
+	case self.items <- item:
+		self.count()
+		return nil
+	case <-self.closed:
+		return ErrQueueClosed
+	case <-expired:
+	}
+	err := TimeoutError("Queue full")
+	return &err
+}
+
+// Adds an item if there's room, returning whether it was added
+func (self *Queue) TryPush(item interface{}) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.IsClosed() {
+		return false
+	}
+	select {
+	case self.items <- item:
+		self.count()
+		return true
+	default:
+	}
+	return false
+}
+
+// Removes the oldest item, waiting up to timeout (forever if it's not
+// positive) for one. Returns a *TimeoutError if none arrived in time.
+func (self *Queue) Pop(timeout time.Duration) (interface{}, error) {
+	expired, stop := queueTimer(timeout)
+	defer stop()
+	select {
+	case item, ok := <-self.items:
+		if !ok {
+			return nil, ErrQueueClosed
+		}
+		return item, nil
+	case <-expired:
+	}
+	err := TimeoutError("Queue empty")
+	return nil, &err
+}
+
+// Removes the oldest item if there is one
+func (self *Queue) TryPop() (interface{}, bool) {
+	select {
+	case item, ok := <-self.items:
+		return item, ok
+	default:
+	}
+	return nil, false
+}
+
+// Adds an item according to the queue's Backpressure policy, returning
+// whether it was added. shed, if not nil, is called w/ each item
+// discarded to make room for it.
+func (self *Queue) Send(item interface{}, shed func(interface{})) bool {
+	closed := false
+	queued := self.backpressure.Send(func() bool {
+		if self.TryPush(item) {
+			return true
+		}
+		// Nothing will ever make room, so stop trying
+		closed = self.IsClosed()
+		return closed
+	}, func() {
+		closed = self.Push(item, 0) != nil
+	}, func() bool {
+		oldest, ok := self.TryPop()
+		if ok && shed != nil {
+			shed(oldest)
+		}
+		return ok
+	})
+	return queued && !closed
+}
+
+// The queued items, for consumers that need to select on them. The
+// channel is closed once the queue's closed and empty.
+func (self *Queue) Chan() <-chan interface{} {
+	return self.items
+}
+
+// Stops the queue accepting items. Safe to call more than once.
+func (self *Queue) Close() {
+	self.closeOnce.Do(func() {
+		// Wakes blocked pushers, so they give up the lock
+		close(self.closed)
+		self.lock.Lock()
+		close(self.items)
+		self.lock.Unlock()
+	})
+}
+
+func (self *Queue) IsClosed() bool {
+	select {
+	case <-self.closed:
+		return true
+	default:
+	}
+	return false
+}
+
+// Number of items queued
+func (self *Queue) Len() int {
+	return len(self.items)
+}
+
+// Number of items the queue can hold
+func (self *Queue) Cap() int {
+	return cap(self.items)
+}
+
+// Counts a push and updates the high water mark
+func (self *Queue) count() {
+	atomic.AddInt64(&self.pushed, 1)
+	depth := int64(len(self.items))
+	for {
+		peak := atomic.LoadInt64(&self.peak)
+		if depth <= peak || atomic.CompareAndSwapInt64(&self.peak, peak,
+			depth) {
+			return
+		}
+	}
+}
+
+// Adds the queue's depth and counters, and its Backpressure's, to a
+// plugin's report
+func (self *Queue) report(report map[string]interface{}) {
+	report["queued"] = int64(self.Len())
+	report["queue_size"] = int64(self.Cap())
+	report["queue_peak"] = atomic.LoadInt64(&self.peak)
+	report["queue_pushed"] = atomic.LoadInt64(&self.pushed)
+	if self.backpressure != nil {
+		self.backpressure.report(report)
+	}
+}
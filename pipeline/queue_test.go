@@ -0,0 +1,114 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	"time"
+)
+
+func QueueSpec(c gospec.Context) {
+	queue := NewQueue(2, nil)
+
+	c.Specify("A Queue hands items out in order", func() {
+		c.Expect(queue.Push("one", 0), gs.IsNil)
+		c.Expect(queue.TryPush("two"), gs.IsTrue)
+		item, err := queue.Pop(0)
+		c.Expect(err, gs.IsNil)
+		c.Expect(item, gs.Equals, "one")
+		item, ok := queue.TryPop()
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(item, gs.Equals, "two")
+	})
+
+	c.Specify("A full Queue refuses or times out pushes", func() {
+		queue.Push("one", 0)
+		queue.Push("two", 0)
+		c.Expect(queue.TryPush("three"), gs.IsFalse)
+		err := queue.Push("three", 10*time.Millisecond)
+		_, timedOut := err.(*TimeoutError)
+		c.Expect(timedOut, gs.IsTrue)
+		c.Expect(queue.Len(), gs.Equals, 2)
+	})
+
+	c.Specify("An empty Queue refuses or times out pops", func() {
+		_, ok := queue.TryPop()
+		c.Expect(ok, gs.IsFalse)
+		_, err := queue.Pop(10 * time.Millisecond)
+		_, timedOut := err.(*TimeoutError)
+		c.Expect(timedOut, gs.IsTrue)
+	})
+
+	c.Specify("A blocked Push goes through once there's room", func() {
+		queue.Push("one", 0)
+		queue.Push("two", 0)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			queue.TryPop()
+		}()
+		c.Expect(queue.Push("three", time.Second), gs.IsNil)
+	})
+
+	c.Specify("A closed Queue", func() {
+		queue.Push("one", 0)
+
+		c.Specify("refuses pushes", func() {
+			queue.Close()
+			c.Expect(queue.Push("two", 0), gs.Equals, ErrQueueClosed)
+			c.Expect(queue.TryPush("two"), gs.IsFalse)
+			backpressure, _ := NewBackpressure(BackpressureBlock, "")
+			queue.backpressure = backpressure
+			c.Expect(queue.Send("two", nil), gs.IsFalse)
+		})
+
+		c.Specify("still hands out what's queued", func() {
+			queue.Close()
+			item, err := queue.Pop(0)
+			c.Expect(err, gs.IsNil)
+			c.Expect(item, gs.Equals, "one")
+			_, err = queue.Pop(0)
+			c.Expect(err, gs.Equals, ErrQueueClosed)
+			_, ok := <-queue.Chan()
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("wakes blocked pushers", func() {
+			queue.Push("two", 0)
+			result := make(chan error, 1)
+			go func() { result <- queue.Push("three", 0) }()
+			time.Sleep(10 * time.Millisecond)
+			queue.Close()
+			queue.Close()
+			select {
+			case err := <-result:
+				c.Expect(err, gs.Equals, ErrQueueClosed)
+			case <-time.After(time.Second):
+				c.Expect("woken", gs.Equals, "still blocked")
+			}
+		})
+	})
+
+	c.Specify("A Queue reports its depth", func() {
+		queue.Push("one", 0)
+		queue.Push("two", 0)
+		queue.TryPop()
+		report := make(map[string]interface{})
+		queue.report(report)
+		c.Expect(report["queued"], gs.Equals, int64(1))
+		c.Expect(report["queue_size"], gs.Equals, int64(2))
+		c.Expect(report["queue_peak"], gs.Equals, int64(2))
+		c.Expect(report["queue_pushed"], gs.Equals, int64(2))
+	})
+}
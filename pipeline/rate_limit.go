@@ -0,0 +1,159 @@
+//go:build !noratelimit
+// +build !noratelimit
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("RateLimitFilter", func() interface{} {
+		return new(RateLimitFilter)
+	})
+}
+
+// Idle buckets are cleaned up once there are more than this many keys
+const maxRateLimitKeys = 10000
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimitFilter limits messages to `Rate` per second, w/ bursts of up to
+// `Burst` messages (Rate, by default). If `Key` names a message variable,
+// e.g. "Hostname" or "Fields[user]", each of its values gets its own
+// limit; otherwise the limit is global. Messages over the limit are
+// dropped, or w/ an `Action` of "tag" are passed on w/ a "rate_limited"
+// field set to true. Counts of limited messages are available as a
+// plugin report (see Reporter).
+type RateLimitFilter struct {
+	rate    float64
+	burst   float64
+	key     string
+	tag     bool
+	buckets map[string]*tokenBucket
+	dropped int64
+	tagged  int64
+	lock    sync.Mutex
+}
+
+func (self *RateLimitFilter) Init(config *PluginConfig) error {
+	value, ok := (*config)["Rate"]
+	if !ok {
+		return errors.New("RateLimitFilter config: Missing Rate")
+	}
+	rate, err := toFloat64(value)
+	if err != nil || rate <= 0 {
+		return errors.New("RateLimitFilter config: Rate must be a positive " +
+			"number")
+	}
+	self.rate = rate
+	self.burst = rate
+	if value, ok = (*config)["Burst"]; ok {
+		if self.burst, err = toFloat64(value); err != nil || self.burst < 1 {
+			return errors.New("RateLimitFilter config: Burst must be at " +
+				"least 1")
+		}
+	}
+	if value, ok = (*config)["Key"]; ok {
+		self.key = value.(string)
+		if !isMessageVariable(self.key) {
+			return fmt.Errorf("RateLimitFilter config: Invalid Key: %s",
+				self.key)
+		}
+	}
+	if value, ok = (*config)["Action"]; ok {
+		switch value.(string) {
+		case "drop":
+		case "tag":
+			self.tag = true
+		default:
+			return fmt.Errorf("RateLimitFilter config: Unknown Action: %s",
+				value)
+		}
+	}
+	self.buckets = make(map[string]*tokenBucket)
+	return nil
+}
+
+// Takes a token from the key's bucket, returning false if there are none
+// left. Must be called w/ the lock held.
+func (self *RateLimitFilter) take(key string, now time.Time) bool {
+	bucket, ok := self.buckets[key]
+	if !ok {
+		if len(self.buckets) >= maxRateLimitKeys {
+			self.cleanup(now)
+		}
+		bucket = &tokenBucket{self.burst, now}
+		self.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * self.rate
+	if bucket.tokens > self.burst {
+		bucket.tokens = self.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Removes the buckets that have refilled, which are the same as new ones
+func (self *RateLimitFilter) cleanup(now time.Time) {
+	full := time.Duration(self.burst / self.rate * float64(time.Second))
+	for key, bucket := range self.buckets {
+		if now.Sub(bucket.last) >= full {
+			delete(self.buckets, key)
+		}
+	}
+}
+
+func (self *RateLimitFilter) FilterMsg(pipelinePack *PipelinePack) {
+	var key string
+	if self.key != "" {
+		if value, ok := MessageVariable(pipelinePack.Message, self.key); ok {
+			key = fmt.Sprint(value)
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.take(key, time.Now()) {
+		return
+	}
+	if self.tag {
+		self.tagged++
+		pipelinePack.Message.ReplaceField("rate_limited", true)
+		return
+	}
+	self.dropped++
+	pipelinePack.Message = nil
+}
+
+func (self *RateLimitFilter) Report() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return map[string]interface{}{
+		"dropped": self.dropped,
+		"tagged":  self.tagged,
+		"keys":    len(self.buckets),
+	}
+}
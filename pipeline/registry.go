@@ -0,0 +1,71 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Maps the `type` value of a config section to a function returning a new
+// instance of that plugin
+var (
+	pluginFactories     = make(map[string]func() interface{})
+	pluginFactoriesLock sync.RWMutex
+)
+
+// Registers a plugin type under the name config sections refer to it by
+// in their `type` value. Plugins call this from an init function, so any
+// package linked into hekad can add plugin types, including ones outside
+// this repo. Like database/sql's Register it panics if the name is taken
+// or the factory is nil, since either is a programming error.
+func RegisterPlugin(name string, factory func() interface{}) {
+	if err := registerPlugin(name, factory); err != nil {
+		panic(err)
+	}
+}
+
+func registerPlugin(name string, factory func() interface{}) error {
+	if factory == nil {
+		return fmt.Errorf("nil factory for plugin type %s", name)
+	}
+	pluginFactoriesLock.Lock()
+	defer pluginFactoriesLock.Unlock()
+	if _, ok := pluginFactories[name]; ok {
+		return fmt.Errorf("plugin type %s is already registered", name)
+	}
+	pluginFactories[name] = factory
+	return nil
+}
+
+// Returns the factory registered for a plugin type
+func PluginFactory(name string) (func() interface{}, bool) {
+	pluginFactoriesLock.RLock()
+	defer pluginFactoriesLock.RUnlock()
+	factory, ok := pluginFactories[name]
+	return factory, ok
+}
+
+// Returns the names of the registered plugin types, sorted
+func PluginTypes() []string {
+	pluginFactoriesLock.RLock()
+	defer pluginFactoriesLock.RUnlock()
+	names := make([]string, 0, len(pluginFactories))
+	for name := range pluginFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,47 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+)
+
+func RegistrySpec(c gospec.Context) {
+	c.Specify("Core plugins are registered", func() {
+		_, ok := PluginFactory("LogOutput")
+		c.Expect(ok, gs.IsTrue)
+		_, ok = PluginFactory("NoSuchOutput")
+		c.Expect(ok, gs.IsFalse)
+	})
+
+	c.Specify("Registered types can be loaded by config sections", func() {
+		// The registry is global, so this only registers on the first run
+		name := "RegistrySpecOutput"
+		if _, ok := PluginFactory(name); !ok {
+			RegisterPlugin(name, func() interface{} {
+				return new(LogOutput)
+			})
+		}
+		plugin, err := loadPlugin(PluginConfig{"type": name})
+		c.Expect(err, gs.IsNil)
+		_, ok := plugin.(*LogOutput)
+		c.Expect(ok, gs.IsTrue)
+
+		err = registerPlugin(name, func() interface{} {
+			return new(LogOutput)
+		})
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,109 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	. "heka/message"
+	"os"
+	"sort"
+	"time"
+)
+
+// The message type of plugin reports
+const pluginReportType = "heka.plugin-report"
+
+// Plugins implementing Reporter expose internal counters, e.g. the number
+// of messages dropped. When GraterConfig.ReportInterval is set each
+// Reporter is polled on that interval and its report is injected into the
+// pipeline as a heka.plugin-report message, w/ the report values as
+// fields alongside "plugin_kind" and "plugin_name", so reports can be
+// routed, stored and alerted on like any other message.
+type Reporter interface {
+	Report() map[string]interface{}
+}
+
+// Returns the report message for a plugin
+func pluginReport(p namedPlugin, reporter Reporter, now time.Time) *Message {
+	hostname, _ := os.Hostname()
+	fields := map[string]interface{}{
+		"plugin_kind": p.kind,
+		"plugin_name": p.name,
+	}
+	for name, value := range reporter.Report() {
+		fields[name] = value
+	}
+	return &Message{
+		Type:      pluginReportType,
+		Timestamp: now,
+		Logger:    "hekad",
+		Severity:  SEVERITY_DEBUG,
+		Pid:       os.Getpid(),
+		Hostname:  hostname,
+		Fields:    fields,
+	}
+}
+
+// Injects a report for every Reporter plugin on each tick of the interval,
+// until the process exits. The pack pool reports alongside them as the
+// "pipeline pack_pool" plugin, and the max_message_size and clock skew
+// counters as "pipeline message_size" and "pipeline clock_skew".
+func (self *pipelineHelpers) reportLoop(plugins []namedPlugin,
+	interval time.Duration) {
+	// The parts of the pipeline itself that report like plugins
+	internals := make([]namedPlugin, 0)
+	reporters := make([]Reporter, 0)
+	internal := func(name string, reporter Reporter) {
+		internals = append(internals,
+			namedPlugin{kind: "pipeline", name: name})
+		reporters = append(reporters, reporter)
+	}
+	if self.pool != nil {
+		internal("pack_pool", self.pool)
+	}
+	if self.config.oversize != nil {
+		internal("message_size", self.config.oversize)
+	}
+	if self.config.clockSkew != nil {
+		internal("clock_skew", self.config.clockSkew)
+	}
+	if self.config.latency != nil {
+		internal("latency", self.config.latency)
+	}
+	if self.config.tracer != nil {
+		internal("tracer", self.config.tracer)
+	}
+	outputNames := make([]string, 0, len(self.config.outputRunners))
+	for name := range self.config.outputRunners {
+		outputNames = append(outputNames, name)
+	}
+	sort.Strings(outputNames)
+	for _, name := range outputNames {
+		internal("delivery."+name, self.config.outputRunners[name])
+	}
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		for _, p := range plugins {
+			reporter, ok := p.plugin.(Reporter)
+			if !ok {
+				continue
+			}
+			helper := &pluginHelper{helpers: self, plugin: p}
+			helper.InjectMessage(pluginReport(p, reporter, now))
+		}
+		for i, p := range internals {
+			helper := &pluginHelper{helpers: self, plugin: p}
+			helper.InjectMessage(pluginReport(p, reporters[i], now))
+		}
+	}
+}
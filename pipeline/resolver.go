@@ -0,0 +1,213 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolvers return the list of addresses an output should send to, in
+// order of preference
+type Resolver interface {
+	Resolve() ([]string, error)
+}
+
+// StaticResolver always returns the same addresses
+type StaticResolver struct {
+	Addresses []string
+}
+
+func (self *StaticResolver) Resolve() ([]string, error) {
+	return self.Addresses, nil
+}
+
+// SrvResolver looks up addresses using a DNS SRV record, e.g.
+// "_heka._tcp.example.com". Targets are ordered by priority and randomly
+// by weight within each priority, per RFC 2782.
+type SrvResolver struct {
+	Name string
+}
+
+func (self *SrvResolver) Resolve() ([]string, error) {
+	_, records, err := net.LookupSRV("", "", self.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(records))
+	for i, record := range records {
+		addrs[i] = fmt.Sprintf("%s:%d", strings.TrimSuffix(record.Target, "."),
+			record.Port)
+	}
+	return addrs, nil
+}
+
+// ShardedResolver reorders another resolver's addresses by rendezvous
+// hashing of a key, typically the hostname. Every process w/ the same key
+// prefers the same address, keys spread evenly across the addresses, and
+// the rest of the order is a failover order which only changes for the
+// keys that preferred an address when it's added or removed. Edge hekads
+// can spread themselves across an aggregator cluster this way w/o any
+// coordination.
+type ShardedResolver struct {
+	Resolver Resolver
+	Key      string
+}
+
+func shardWeight(key, addr string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write([]byte(addr))
+	// FNV alone mixes similar keys poorly, so finish w/ splitmix64's
+	// finalizer to spread them evenly
+	weight := hash.Sum64()
+	weight = (weight ^ (weight >> 30)) * 0xbf58476d1ce4e5b9
+	weight = (weight ^ (weight >> 27)) * 0x94d049bb133111eb
+	return weight ^ (weight >> 31)
+}
+
+func (self *ShardedResolver) Resolve() ([]string, error) {
+	addrs, err := self.Resolver.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	sharded := make([]string, len(addrs))
+	copy(sharded, addrs)
+	sort.SliceStable(sharded, func(i, j int) bool {
+		return shardWeight(self.Key, sharded[i]) >
+			shardWeight(self.Key, sharded[j])
+	})
+	return sharded, nil
+}
+
+// Builds a resolver from an output's config, using `SrvName`,
+// `ConsulService` (w/ `ConsulAddress`) or `EtcdDir` (w/ `EtcdAddress`) if
+// set, and otherwise `Address` (a single address or a list of them). If
+// `Shard` is set the addresses are ordered by hashing `ShardKey` (the
+// hostname by default, see ShardedResolver).
+func NewResolverFromConfig(config *PluginConfig) (Resolver, error) {
+	resolver, err := newBaseResolverFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if shard, ok := (*config)["Shard"]; !ok || !shard.(bool) {
+		return resolver, nil
+	}
+	key, ok := (*config)["ShardKey"].(string)
+	if !ok {
+		if key, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("Can't shard by hostname: %s",
+				err.Error())
+		}
+	}
+	return &ShardedResolver{resolver, key}, nil
+}
+
+func newBaseResolverFromConfig(config *PluginConfig) (Resolver, error) {
+	if value, ok := (*config)["SrvName"]; ok {
+		return &SrvResolver{value.(string)}, nil
+	}
+	if value, ok := (*config)["ConsulService"]; ok {
+		consulAddress, ok := (*config)["ConsulAddress"].(string)
+		if !ok {
+			consulAddress = "127.0.0.1:8500"
+		}
+		return &ConsulResolver{consulAddress, value.(string)}, nil
+	}
+	if value, ok := (*config)["EtcdDir"]; ok {
+		etcdAddress, ok := (*config)["EtcdAddress"].(string)
+		if !ok {
+			etcdAddress = "127.0.0.1:2379"
+		}
+		return &EtcdResolver{etcdAddress, value.(string)}, nil
+	}
+	value, ok := (*config)["Address"]
+	if !ok {
+		return nil, errors.New("Missing Address or SrvName")
+	}
+	switch addrs := value.(type) {
+	case string:
+		return &StaticResolver{[]string{addrs}}, nil
+	case []string:
+		return &StaticResolver{addrs}, nil
+	}
+	return nil, errors.New("Address must be a string or list of strings")
+}
+
+// Endpoints holds the current address list for an output, re-resolving
+// it periodically so endpoints can be managed in DNS. If a resolution
+// fails the previous list is kept.
+type Endpoints struct {
+	resolver Resolver
+	addrs    []string
+	lock     sync.RWMutex
+}
+
+// Resolves the initial address list and, if interval is non-zero, starts
+// re-resolving it every interval
+func NewEndpoints(resolver Resolver, interval time.Duration) (*Endpoints,
+	error) {
+	addrs, err := resolver.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	self := &Endpoints{resolver: resolver, addrs: addrs}
+	if interval > 0 {
+		go self.refresh(interval)
+	}
+	return self, nil
+}
+
+func (self *Endpoints) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for _ = range ticker.C {
+		addrs, err := self.resolver.Resolve()
+		if err != nil {
+			log.Printf("Error resolving endpoints: %s\n", err.Error())
+			continue
+		}
+		self.lock.Lock()
+		if strings.Join(addrs, ",") != strings.Join(self.addrs, ",") {
+			log.Printf("Endpoints changed: %s\n", strings.Join(addrs, ", "))
+		}
+		self.addrs = addrs
+		self.lock.Unlock()
+	}
+}
+
+// Returns the current addresses, in order of preference
+func (self *Endpoints) Current() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.addrs
+}
+
+// Returns whether addr is still one of the current addresses
+func (self *Endpoints) Contains(addr string) bool {
+	for _, current := range self.Current() {
+		if current == addr {
+			return true
+		}
+	}
+	return false
+}
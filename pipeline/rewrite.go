@@ -0,0 +1,129 @@
+//go:build !norewrite
+// +build !norewrite
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	RegisterPlugin("RewriteFilter", func() interface{} {
+		return new(RewriteFilter)
+	})
+}
+
+type rewriteRule struct {
+	regex   *regexp.Regexp
+	replace string
+}
+
+// RewriteFilter normalizes messy upstream formats by applying regex
+// find/replace `Rules` to the messages matching its `Matcher` (every
+// message, if not set). Each rule is an object like
+//
+//	{"Pattern": "^(\\w+) user=(\\S+)", "Replace": "user ${2}: ${1}"}
+//
+// where the replacement can refer to capture groups by number or name, as
+// in regexp.Expand. Rules are applied in order, each to the result of the
+// last. `Targets` lists what gets rewritten, as message variables; it
+// defaults to ["Payload"], and can also name string fields, e.g.
+// "Fields[path]". Fields that are missing or not strings are left alone.
+type RewriteFilter struct {
+	matcher *MessageMatcher
+	rules   []rewriteRule
+	targets []string
+}
+
+func (self *RewriteFilter) Init(config *PluginConfig) (err error) {
+	if value, ok := (*config)["Matcher"]; ok {
+		if self.matcher, err = NewMessageMatcher(value.(string)); err != nil {
+			return fmt.Errorf("RewriteFilter config: %s", err.Error())
+		}
+	}
+	value, ok := (*config)["Rules"]
+	if !ok {
+		return errors.New("RewriteFilter config: Missing Rules")
+	}
+	rules, ok := value.([]interface{})
+	if !ok {
+		return errors.New("RewriteFilter config: Rules must be a list of " +
+			"objects")
+	}
+	for i, item := range rules {
+		rule, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("RewriteFilter config: Rule %d isn't an object",
+				i)
+		}
+		pattern, ok := rule["Pattern"].(string)
+		if !ok {
+			return fmt.Errorf("RewriteFilter config: Rule %d is missing "+
+				"Pattern", i)
+		}
+		replace, ok := rule["Replace"].(string)
+		if !ok {
+			return fmt.Errorf("RewriteFilter config: Rule %d is missing "+
+				"Replace", i)
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("RewriteFilter config: Rule %d: %s", i,
+				err.Error())
+		}
+		self.rules = append(self.rules, rewriteRule{regex, replace})
+	}
+	self.targets = []string{"Payload"}
+	if value, ok = (*config)["Targets"]; ok {
+		self.targets = value.([]string)
+	}
+	for _, target := range self.targets {
+		isField := isMessageVariable(target) &&
+			strings.HasPrefix(target, "Fields[")
+		if target != "Payload" && !isField {
+			return fmt.Errorf("RewriteFilter config: Can't rewrite %s",
+				target)
+		}
+	}
+	return nil
+}
+
+func (self *RewriteFilter) rewrite(value string) string {
+	for _, rule := range self.rules {
+		value = rule.regex.ReplaceAllString(value, rule.replace)
+	}
+	return value
+}
+
+func (self *RewriteFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	if self.matcher != nil && !self.matcher.Match(msg) {
+		return
+	}
+	for _, target := range self.targets {
+		if target == "Payload" {
+			msg.Payload = self.rewrite(msg.Payload)
+			continue
+		}
+		name := target[7 : len(target)-1]
+		if value, ok := msg.Fields[name].(string); ok {
+			msg.Fields[name] = self.rewrite(value)
+		}
+	}
+}
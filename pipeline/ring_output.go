@@ -0,0 +1,254 @@
+//go:build !noringoutput
+// +build !noringoutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("RingBufferOutput", func() interface{} {
+		return new(RingBufferOutput)
+	})
+}
+
+type ringEntry struct {
+	seq uint64
+	msg *Message
+}
+
+// RingBufferOutput keeps the last `Size` (1000 by default) messages that
+// match its `Matcher` (all of them, if not set) in memory, and serves
+// them over HTTP on `Address`, giving small deployments a "recent events"
+// view w/o needing a search cluster. Queries look like
+//
+//	GET /messages?match=Severity<=3&since=2013-01-02T15:04:05Z&limit=50
+//
+// where `match` is a matcher expression (see MessageMatcher), `since` and
+// `until` are RFC 3339 times or Unix seconds, and `limit` (100 by
+// default) caps the number of messages returned, newest first. Type,
+// Logger and any `IndexFields` are indexed, and can be looked up directly
+// w/ e.g. `Type=nginx.access` or `Fields[request_id]=abc`.
+type RingBufferOutput struct {
+	size     int
+	matcher  *MessageMatcher
+	indexed  map[string]bool
+	address  string
+	listener net.Listener
+	entries  []*ringEntry
+	nextSeq  uint64
+	// Index key, e.g. "Type", to value to the seqs of messages w/ it
+	index map[string]map[string]map[uint64]bool
+	lock  sync.RWMutex
+}
+
+func (self *RingBufferOutput) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Address"]
+	if !ok {
+		return errors.New("RingBufferOutput config: Missing Address")
+	}
+	self.address = value.(string)
+	self.size = 1000
+	if value, ok = (*config)["Size"]; ok {
+		self.size = int(value.(int64))
+	}
+	if self.size <= 0 {
+		return errors.New("RingBufferOutput config: Size must be positive")
+	}
+	if value, ok = (*config)["Matcher"]; ok {
+		if self.matcher, err = NewMessageMatcher(value.(string)); err != nil {
+			return fmt.Errorf("RingBufferOutput config: %s", err.Error())
+		}
+	}
+	self.indexed = map[string]bool{"Type": true, "Logger": true}
+	if value, ok = (*config)["IndexFields"]; ok {
+		for _, name := range value.([]string) {
+			self.indexed["Fields["+name+"]"] = true
+		}
+	}
+	self.entries = make([]*ringEntry, 0, self.size)
+	self.index = make(map[string]map[string]map[uint64]bool)
+	return nil
+}
+
+// Starts serving queries, reusing an inherited socket if there is one
+func (self *RingBufferOutput) Prepare() (err error) {
+	if file := InheritedFile(self.address); file != nil {
+		self.listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		self.listener, err = net.Listen("tcp", self.address)
+	}
+	if err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/messages", self.serveMessages)
+	go func() {
+		err := http.Serve(self.listener, mux)
+		log.Printf("RingBufferOutput %s stopped: %s\n", self.address,
+			err.Error())
+	}()
+	return nil
+}
+
+// Returns the indexed values of a message, keyed by index key
+func (self *RingBufferOutput) indexValues(msg *Message) map[string]string {
+	values := map[string]string{"Type": msg.Type, "Logger": msg.Logger}
+	for key := range self.indexed {
+		if len(key) > 8 && key[:7] == "Fields[" {
+			if value, ok := msg.Fields[key[7:len(key)-1]]; ok {
+				values[key] = fmt.Sprint(value)
+			}
+		}
+	}
+	return values
+}
+
+func (self *RingBufferOutput) updateIndex(entry *ringEntry, add bool) {
+	for key, value := range self.indexValues(entry.msg) {
+		byValue, ok := self.index[key]
+		if !ok {
+			byValue = make(map[string]map[uint64]bool)
+			self.index[key] = byValue
+		}
+		seqs, ok := byValue[value]
+		if !ok {
+			if !add {
+				continue
+			}
+			seqs = make(map[uint64]bool)
+			byValue[value] = seqs
+		}
+		if add {
+			seqs[entry.seq] = true
+		} else if delete(seqs, entry.seq); len(seqs) == 0 {
+			delete(byValue, value)
+		}
+	}
+}
+
+func (self *RingBufferOutput) Deliver(pipelinePack *PipelinePack) {
+	if self.matcher != nil && !self.matcher.Match(pipelinePack.Message) {
+		return
+	}
+	msg := new(Message)
+	pipelinePack.Message.Copy(msg)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	entry := &ringEntry{self.nextSeq, msg}
+	self.nextSeq++
+	if len(self.entries) < self.size {
+		self.entries = append(self.entries, entry)
+	} else {
+		slot := int(entry.seq % uint64(self.size))
+		self.updateIndex(self.entries[slot], false)
+		self.entries[slot] = entry
+	}
+	self.updateIndex(entry, true)
+}
+
+// A parsed /messages query
+type ringQuery struct {
+	matcher *MessageMatcher
+	since   time.Time
+	until   time.Time
+	limit   int
+	lookups map[string]string
+}
+
+func (self *RingBufferOutput) parseQuery(req *http.Request) (*ringQuery,
+	error) {
+	query := &ringQuery{limit: 100, lookups: make(map[string]string)}
+	var err error
+	for key, values := range req.URL.Query() {
+		value := values[0]
+		switch key {
+		case "match":
+			query.matcher, err = NewMessageMatcher(value)
+		case "since":
+			query.since, err = parseQueryTime(value)
+		case "until":
+			query.until, err = parseQueryTime(value)
+		case "limit":
+			query.limit, err = strconv.Atoi(value)
+		default:
+			if !self.indexed[key] {
+				err = fmt.Errorf("%s isn't indexed, use match instead", key)
+			}
+			query.lookups[key] = value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return query, nil
+}
+
+func (self *RingBufferOutput) entryMatches(query *ringQuery,
+	entry *ringEntry) bool {
+	for key, value := range query.lookups {
+		if !self.index[key][value][entry.seq] {
+			return false
+		}
+	}
+	msg := entry.msg
+	if !query.since.IsZero() && msg.Timestamp.Before(query.since) {
+		return false
+	}
+	if !query.until.IsZero() && msg.Timestamp.After(query.until) {
+		return false
+	}
+	return query.matcher == nil || query.matcher.Match(msg)
+}
+
+// Returns the messages matching a query, newest first
+func (self *RingBufferOutput) query(query *ringQuery) []*Message {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	results := make([]*Message, 0)
+	count := len(self.entries)
+	for i := 1; i <= count && len(results) < query.limit; i++ {
+		entry := self.entries[int((self.nextSeq-uint64(i))%uint64(self.size))]
+		if self.entryMatches(query, entry) {
+			results = append(results, entry.msg)
+		}
+	}
+	return results
+}
+
+func (self *RingBufferOutput) serveMessages(w http.ResponseWriter,
+	req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := self.parseQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeMessagesJson(w, self.query(query))
+}
@@ -0,0 +1,111 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	. "heka/message"
+	"sort"
+	"sync"
+)
+
+// Router routes messages by the matcher expressions declared on filter
+// and output config sections w/ `message_matcher` (see MessageMatcher),
+// so each plugin says which messages it wants rather than everything
+// hanging off a message's one filter chain. A filter w/ a matcher only
+// sees the messages in its chain that match. An output w/ a matcher gets
+// every message that matches, as well as any sent to it by default or by
+// a filter.
+//
+// Most matchers only test Type and Logger, e.g. "Type == 'nginx.access'",
+// and a busy pipeline sees the same few Type/Logger combinations over and
+// over, so the results of those matchers are cached by that signature.
+type Router struct {
+	outputs []routedOutput
+	lock    sync.RWMutex
+	cache   map[routeKey]bool
+}
+
+type routedOutput struct {
+	name    string
+	matcher *MessageMatcher
+}
+
+type routeKey struct {
+	matcher *MessageMatcher
+	msgType string
+	logger  string
+}
+
+// The cache is cleared when it grows past this, e.g. if Type is derived
+// from something unbounded
+const routerCacheSize = 10000
+
+// Creates a router for the config's output matchers
+func NewRouter(config *GraterConfig) *Router {
+	self := &Router{
+		outputs: make([]routedOutput, 0, len(config.OutputMatchers)),
+		cache:   make(map[routeKey]bool),
+	}
+	for name, matcher := range config.OutputMatchers {
+		self.outputs = append(self.outputs, routedOutput{name, matcher})
+	}
+	sort.Slice(self.outputs, func(i, j int) bool {
+		return self.outputs[i].name < self.outputs[j].name
+	})
+	return self
+}
+
+// Returns whether the message matches, consulting the cache for
+// matchers that only test Type and Logger. Works on a nil Router too,
+// w/o caching.
+func (self *Router) Match(matcher *MessageMatcher, msg *Message) bool {
+	if self == nil || !matcher.signatureOnly {
+		return matcher.Match(msg)
+	}
+	key := routeKey{matcher, msg.Type, msg.Logger}
+	self.lock.RLock()
+	matched, ok := self.cache[key]
+	self.lock.RUnlock()
+	if ok {
+		return matched
+	}
+	matched = matcher.Match(msg)
+	self.lock.Lock()
+	if len(self.cache) >= routerCacheSize {
+		self.cache = make(map[routeKey]bool)
+	}
+	self.cache[key] = matched
+	self.lock.Unlock()
+	return matched
+}
+
+// Adds the outputs whose matchers match the pack's message to its outputs
+func (self *Router) RouteOutputs(pipelinePack *PipelinePack) {
+	if self == nil {
+		return
+	}
+	for _, output := range self.outputs {
+		if self.Match(output.matcher, pipelinePack.Message) {
+			pipelinePack.Outputs[output.name] = true
+		}
+	}
+}
+
+// Returns whether a filter should see the message, i.e. it has no
+// matcher or its matcher matches
+func (self *Router) FilterWants(config *GraterConfig, filter Filter,
+	msg *Message) bool {
+	matcher, ok := config.FilterMatchers[filter]
+	return !ok || self.Match(matcher, msg)
+}
@@ -14,11 +14,14 @@
 package pipeline
 
 import (
+	"errors"
+	"fmt"
 	. "heka/message"
 	"log"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -29,18 +32,207 @@ type Plugin interface {
 	Init(config *PluginConfig) error
 }
 
+// Plugins that need to do work before any messages flow (e.g. opening
+// connections or loading databases) can implement Preparer. Prepare is
+// called after Init, before any inputs are started, and gets
+// `prepare_timeout` (5s by default) to complete.
+type Preparer interface {
+	Prepare() error
+}
+
+// Plugins that hold buffered data can implement Drainer. Drain is called
+// after the inputs have stopped and the messages in flight have been
+// delivered, before shutdown completes, and gets `drain_timeout` (5s by
+// default) to complete.
+type Drainer interface {
+	Drain() error
+}
+
+const defaultHookTimeout = time.Duration(5 * time.Second)
+
+type namedPlugin struct {
+	kind   string
+	name   string
+	plugin Plugin
+}
+
+// Returns all of the configured plugins in pipeline order, i.e. inputs,
+// decoders, filters, encoders, outputs
+func pipelinePlugins(config *GraterConfig) []namedPlugin {
+	plugins := make([]namedPlugin, 0)
+	for name, input := range config.Inputs {
+		plugins = append(plugins, namedPlugin{"input", name, input})
+	}
+	for name, decoder := range config.Decoders {
+		plugins = append(plugins, namedPlugin{"decoder", name, decoder})
+	}
+	for chainName, chain := range config.FilterChains {
+		for i, filter := range chain {
+			name := fmt.Sprintf("%s[%d]", chainName, i)
+			plugins = append(plugins, namedPlugin{"filter", name, filter})
+		}
+	}
+	for name, encoder := range config.Encoders {
+		plugins = append(plugins, namedPlugin{"encoder", name, encoder})
+	}
+	for outputName, transform := range config.Transforms {
+		for i, filter := range transform {
+			name := fmt.Sprintf("%s.transform[%d]", outputName, i)
+			plugins = append(plugins, namedPlugin{"filter", name, filter})
+		}
+	}
+	for name, output := range config.Outputs {
+		plugins = append(plugins, namedPlugin{"output", name, output})
+	}
+	return plugins
+}
+
+// Runs a lifecycle hook, giving up on it if it doesn't complete within
+// the timeout
+func runHook(hook func() error, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- hook()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+	return fmt.Errorf("timed out after %s", timeout)
+}
+
+// Calls Prepare on every plugin that implements it, returning false if
+// any of them fail
+func preparePlugins(plugins []namedPlugin, timeout time.Duration) bool {
+	ok := true
+	for _, p := range plugins {
+		preparer, isPreparer := p.plugin.(Preparer)
+		if !isPreparer {
+			continue
+		}
+		start := time.Now()
+		if err := runHook(preparer.Prepare, timeout); err != nil {
+			log.Printf("Error preparing %s %s: %s\n", p.kind, p.name,
+				err.Error())
+			ok = false
+			continue
+		}
+		log.Printf("Prepared %s %s (%s)\n", p.kind, p.name, time.Since(start))
+	}
+	return ok
+}
+
+// Calls Drain on every plugin that implements it, in pipeline order so
+// that data drained from filters can still reach the outputs
+func drainPlugins(plugins []namedPlugin, timeout time.Duration) {
+	for _, p := range plugins {
+		drainer, isDrainer := p.plugin.(Drainer)
+		if !isDrainer {
+			continue
+		}
+		start := time.Now()
+		if err := runHook(drainer.Drain, timeout); err != nil {
+			log.Printf("Error draining %s %s: %s\n", p.kind, p.name,
+				err.Error())
+			continue
+		}
+		log.Printf("Drained %s %s (%s)\n", p.kind, p.name, time.Since(start))
+	}
+}
+
 type GraterConfig struct {
 	Inputs             map[string]Input
 	Decoders           map[string]Decoder
 	DefaultDecoder     string
 	FilterChains       map[string][]Filter
 	DefaultFilterChain string
-	Outputs            map[string]Output
-	DefaultOutputs     []string
-	PoolSize           int
+	// Applied to matching messages before their filter chain, in order
+	FieldConversions []*MatchedConversions
+	// Filters running in a sandbox (see FilterSandbox)
+	Sandboxes        map[Filter]*FilterSandbox
+	Encoders         map[string]Encoder
+	Outputs          map[string]Output
+	DefaultOutputs   []string
+	PoolSize         int
+	Auditor          *DeliveryAuditor
+	SnapshotDir      string
+	MaxPackAge       time.Duration
+	RestartPolicies  map[string]RestartPolicy
+	InputWeights     map[string]float64
+	DeadLetterOutput string
+	PrepareTimeout   time.Duration
+	DrainTimeout     time.Duration
+	// How often Reporter plugins are polled, if at all (see Reporter)
+	ReportInterval time.Duration
+	// Whether heka.control messages are acted on (see controlMessageType)
+	AllowControl bool
+	// Whether messages that fail to decode are replaced by decode error
+	// messages rather than dropped (see decodeErrorType)
+	DecodeErrorMessages bool
+	// Holds the inputs at startup until the pipeline is healthy, if set to
+	// StagedStartAuto or StagedStartManual
+	StagedStart string
+	// Filters applied to messages for one output only, by output name
+	// (see transformPack)
+	Transforms map[string][]Filter
+	// Where the pipeline tap is served, if at all, and how many messages
+	// it keeps for each stage (see PipelineTap)
+	TapAddress string
+	TapSize    int
+	tap        *PipelineTap
+	// How long a pack can be held by the pipeline before the leak detector
+	// logs it, and whether leaked packs are replaced (see PackPool)
+	PackLeakTimeout    time.Duration
+	ReplaceLeakedPacks bool
+	// What inputs do when the pool is empty, "block" or "drop" (see
+	// PackPool)
+	PoolBackpressure string
+	// Matchers from the `message_matcher` of filter and output sections
+	// (see Router)
+	FilterMatchers map[Filter]*MessageMatcher
+	OutputMatchers map[string]*MessageMatcher
+	router         *Router
+	// Where shared objects w/ out-of-tree plugins are loaded from, if
+	// anywhere (see PluginRegistrar)
+	PluginsDir string
+	// The largest decoded message let through, in bytes, and what's done
+	// w/ bigger ones (see OversizeGuard)
+	MaxMessageSize int
+	OversizePolicy string
+	oversize       *OversizeGuard
+	// How far timestamps can be from arrival times before they're tagged
+	// or corrected, and which (see ClockSkewGuard)
+	MaxFutureSkew   time.Duration
+	MaxPastSkew     time.Duration
+	ClockSkewPolicy string
+	clockSkew       *ClockSkewGuard
+	// Delivery goroutines and queue size for each output, by output name
+	// (see OutputRunner)
+	DeliveryWorkers    map[string]int
+	DeliveryQueueSizes map[string]int
+	DeliveryPriorities map[string]*DeliveryPriority
+	outputRunners      map[string]*OutputRunner
+	// Whether every message is traced, not just those w/ a TraceField,
+	// and how many finished traces are kept (see MessageTracer)
+	TraceMessages bool
+	TraceSize     int
+	tracer        *MessageTracer
+	// From reading each pack until it's recycled
+	latency *LatencyHistogram
+	// Where plugin state and the disabled plugins are kept across
+	// restarts, the SnapshotDir if not set
+	StateDir string
+	// How the goroutines outputs run via their PluginHelper are restarted,
+	// by output name; RestartPolicies are the inputs'
+	OutputRestartPolicies map[string]RestartPolicy
+	// Overrides the clock plugins see via their PluginHelper, for testing
+	Clock func() time.Time
 }
 
 type PipelinePack struct {
+	InputName   string
+	ReadTime    time.Time
 	MsgBytes    []byte
 	Message     *Message
 	Config      *GraterConfig
@@ -48,25 +240,121 @@ type PipelinePack struct {
 	Decoded     bool
 	FilterChain string
 	Outputs     map[string]bool
+	// Fields supplied by the input, added to the message once it's decoded
+	Fields map[string]interface{}
+	// Set by inputs for the first record of a stream, e.g. of each file
+	// LogfileInput opens, so decoders can pick up headers
+	FirstRecord bool
+	// Set by AckAwareInputs, handed back to the input's Ack once the pack
+	// has been delivered
+	AckToken interface{}
+	// The pack's path through the pipeline, if it's being traced (see
+	// MessageTracer)
+	Trace *PackTrace
+	// Checkout tracking for packs from the PackPool, nil for other packs
+	state *packState
 }
 
-func filterProcessor(pipelinePack *PipelinePack) {
-	pipelinePack.Outputs = map[string]bool{}
-	config := pipelinePack.Config
+// Routes the pack to the default outputs only. The pack's map is cleared
+// and reused rather than replaced, so routing doesn't allocate per message.
+func resetOutputs(config *GraterConfig, pipelinePack *PipelinePack) {
+	if pipelinePack.Outputs == nil {
+		pipelinePack.Outputs = make(map[string]bool,
+			len(config.DefaultOutputs))
+	}
+	for outputName := range pipelinePack.Outputs {
+		delete(pipelinePack.Outputs, outputName)
+	}
 	for _, outputName := range config.DefaultOutputs {
 		pipelinePack.Outputs[outputName] = true
 	}
+}
+
+func filterProcessor(pipelinePack *PipelinePack) {
+	config := pipelinePack.Config
+	resetOutputs(config, pipelinePack)
 	filterChainName := pipelinePack.FilterChain
 	filterChain, ok := config.FilterChains[filterChainName]
 	if !ok {
 		log.Printf("Filter chain doesn't exist: %s", filterChainName)
+		pipelinePack.Trace.Record("filter."+filterChainName, "missing")
 		return
 	}
-	for _, filter := range filterChain {
+	// Normalize field types before any of the chain's filters see them
+	for _, matched := range config.FieldConversions {
+		matched.Apply(config.router, pipelinePack.Message)
+	}
+	trace := pipelinePack.Trace
+	for i, filter := range filterChain {
+		msg := pipelinePack.Message
+		stage := fmt.Sprintf("filter.%s[%d]", filterChainName, i)
+		if !config.router.FilterWants(config, filter, msg) {
+			trace.Record(stage, "not matched")
+			continue
+		}
+		if sandbox, ok := config.Sandboxes[filter]; ok {
+			sandbox.Run(filter, pipelinePack)
+			trace.Record(stage, "sandboxed")
+			continue
+		}
 		filter.FilterMsg(pipelinePack)
 		if pipelinePack.Message == nil {
+			trace.Record(stage, "dropped")
 			return
 		}
+		trace.Record(stage, "passed")
+		if config.tap != nil {
+			config.tap.Record(stage, pipelinePack.Message)
+		}
+	}
+}
+
+// Number of packs evicted for exceeding the max pack age
+var evictedPacks uint64
+
+// Number of packs being processed by the pipeline function
+var inFlightPacks int64
+
+// Waits up to timeout for the packs in flight to be recycled, returning
+// how many still aren't
+func waitIdle(timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight := atomic.LoadInt64(&inFlightPacks)
+		if inFlight == 0 || time.Now().After(deadline) {
+			return inFlight
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Returns whether the pack has been in flight longer than the configured
+// max age
+func packExpired(config *GraterConfig, pipelinePack *PipelinePack) bool {
+	return config.MaxPackAge > 0 &&
+		time.Since(pipelinePack.ReadTime) > config.MaxPackAge
+}
+
+// Diverts a pack that has exceeded the max age to the dead letter output,
+// if there is one, so it stops tying up the pipeline. Note that the check
+// happens between stages, so a pack blocked inside a stage is evicted once
+// that stage lets go of it. The dead letter output is handed the pack
+// through its OutputRunner, w/ another hold on the pack's refs.
+func evictPack(config *GraterConfig, pipelinePack *PipelinePack,
+	stage string, refs *packRefs) {
+	evicted := atomic.AddUint64(&evictedPacks, 1)
+	if evicted%1000 == 1 {
+		log.Printf("Evicting pack from %s input before %s after %s (%d "+
+			"evicted so far)\n", pipelinePack.InputName, stage,
+			time.Since(pipelinePack.ReadTime), evicted)
+	}
+	if config.DeadLetterOutput == "" {
+		return
+	}
+	if runner, ok := config.outputRunners[config.DeadLetterOutput]; ok {
+		refs.hold()
+		runner.Deliver(&delivery{pipelinePack: pipelinePack,
+			delivered: pipelinePack, refs: refs})
 	}
 }
 
@@ -74,30 +362,127 @@ func Run(config *GraterConfig) {
 	log.Println("Starting hekagrater...")
 
 	// Used for recycling PipelinePack objects
-	recycleChan := make(chan *PipelinePack, config.PoolSize+1)
+	pool := NewPackPool(config)
+	config.router = NewRouter(config)
+	config.oversize = NewOversizeGuard(config)
+	config.clockSkew = NewClockSkewGuard(config)
+	config.tracer = NewMessageTracer(config)
+	config.latency = new(LatencyHistogram)
+	config.outputRunners = make(map[string]*OutputRunner)
+	for name, output := range config.Outputs {
+		runner := NewOutputRunner(config, name, output)
+		runner.Start()
+		config.outputRunners[name] = runner
+	}
+	switches := newPluginSwitches(config)
+
+	// Filters, routes and delivers a decoded message, the rest of the
+	// pipeline function. It runs once for each part of a split message.
+	process := func(pipelinePack *PipelinePack, ack *PackAck,
+		refs *packRefs) {
+		// Run message through the appropriate filters
+		if packExpired(config, pipelinePack) {
+			evictPack(config, pipelinePack, "filters", refs)
+			ack.fail(errAckEvicted)
+			return
+		}
+		pool.hold(pipelinePack, "filter chain", pipelinePack.FilterChain)
+		filterProcessor(pipelinePack)
+		if pipelinePack.Message == nil {
+			return
+		}
+		config.router.RouteOutputs(pipelinePack)
+		trace := pipelinePack.Trace
+		trace.attach(pipelinePack.Message)
+
+		// Hand the message to the runners of the appropriate outputs, each
+		// holding the ack and the pack until it's delivered
+		audited := config.Auditor != nil &&
+			config.Auditor.Sampled(pipelinePack.Message)
+		for outputName, use := range pipelinePack.Outputs {
+			if !use {
+				continue
+			}
+			stage := "output." + outputName
+			if switches.Disabled("output", outputName) {
+				trace.Record(stage, "disabled")
+				continue
+			}
+			runner, ok := config.outputRunners[outputName]
+			if !ok {
+				trace.Record(stage, "missing")
+				err := errors.New("output doesn't exist")
+				ack.fail(err)
+				log.Println(NewDeliveryError(pipelinePack, outputName, err))
+				if audited {
+					config.Auditor.Record(pipelinePack, outputName, "missing",
+						time.Since(pipelinePack.ReadTime))
+				}
+				continue
+			}
+			if packExpired(config, pipelinePack) {
+				trace.Record(stage, "evicted")
+				evictPack(config, pipelinePack, outputName+" output",
+					refs)
+				ack.fail(errAckEvicted)
+				return
+			}
+			delivered := pipelinePack
+			if transform, ok := config.Transforms[outputName]; ok {
+				var err error
+				delivered, err = transformPack(config, transform,
+					pipelinePack)
+				if err != nil {
+					trace.Record(stage, err.Error())
+					ack.fail(err)
+					log.Println(NewDeliveryError(pipelinePack, outputName, err))
+					continue
+				}
+				if delivered == nil {
+					trace.Record(stage, "dropped by transform")
+					continue
+				}
+			}
+			if config.tap != nil {
+				config.tap.Record(stage, delivered.Message)
+			}
+			trace.Record(stage, "queued")
+			pool.hold(pipelinePack, "output", outputName)
+			ack.hold()
+			refs.hold()
+			runner.Deliver(&delivery{pipelinePack: pipelinePack,
+				delivered: delivered, ack: ack, refs: refs, audited: audited})
+		}
+	}
 
 	// Main pipeline function, inputs spawn a goroutine of this for every
 	// message
 	pipeline := func(pipelinePack *PipelinePack) {
-
-		// When finished, reset and recycle the allocated PipelinePack
-		defer func() {
-			msgBytes := pipelinePack.MsgBytes
-			msgBytes = msgBytes[:cap(msgBytes)]
-			pipelinePack.Decoder = config.DefaultDecoder
-			pipelinePack.Decoded = false
-			pipelinePack.FilterChain = config.DefaultFilterChain
-			outputs := make(map[string]bool)
-			for _, outputName := range config.DefaultOutputs {
-				outputs[outputName] = true
+		atomic.AddInt64(&inFlightPacks, 1)
+		pool.checkout(pipelinePack)
+		ack := packAckFor(config, pipelinePack)
+		// Once every output is done w/ the pack it's reset and recycled
+		refs := newPackRefs(func() {
+			atomic.AddInt64(&inFlightPacks, -1)
+			if !pipelinePack.ReadTime.IsZero() {
+				config.latency.Record(time.Since(pipelinePack.ReadTime))
 			}
-			pipelinePack.Outputs = outputs
-			recycleChan <- pipelinePack
+			config.tracer.Finish(pipelinePack.Trace)
+			pool.Recycle(pipelinePack)
+		})
+		// When finished, release the pipeline's holds on the ack and the
+		// pack
+		defer func() {
+			ack.Done(nil)
+			refs.Done()
 		}()
 
 		// Decode messgae if necessary
+		decodedBy, decodeOutcome := "", "decoded"
 		if !pipelinePack.Decoded {
 			decoderName := pipelinePack.Decoder
+			decodedBy = decoderName
+			pool.hold(pipelinePack, "decoder", decoderName)
 			decoder, ok := config.Decoders[decoderName]
 			if !ok {
 				log.Printf("Decoder doesn't exist: %s\n", decoderName)
@@ -105,72 +490,162 @@ func Run(config *GraterConfig) {
 			}
 			err := decoder.Decode(pipelinePack)
 			if err != nil {
-				log.Printf("Error decoding message (%s decoder): %s",
-					decoderName, err.Error())
+				log.Printf("Error decoding message from %s input (%s decoder): %s",
+					pipelinePack.InputName, decoderName, err.Error())
+				if !config.DecodeErrorMessages {
+					return
+				}
+				setDecodeError(pipelinePack, decoderName, err)
+				decodeOutcome = "decode error"
+			}
+			// Decoders skip records that aren't messages, e.g. CSV header
+			// rows, by clearing the message like filters do
+			if pipelinePack.Message == nil {
 				return
 			}
 		}
-
-		// Run message through the appropriate filters
-		filterProcessor(pipelinePack)
-		if pipelinePack.Message == nil {
+		if len(pipelinePack.Fields) > 0 {
+			for name, value := range pipelinePack.Fields {
+				pipelinePack.Message.ReplaceField(name, value)
+			}
+		}
+		config.tracer.Start(pipelinePack, decodedBy, decodeOutcome)
+		if config.clockSkew != nil {
+			arrival := pipelinePack.ReadTime
+			if arrival.IsZero() {
+				arrival = time.Now()
+			}
+			config.clockSkew.Check(pipelinePack.Message, arrival)
+		}
+		if config.tap != nil {
+			config.tap.Record("input."+pipelinePack.InputName,
+				pipelinePack.Message)
+		}
+		if config.AllowControl &&
+			pipelinePack.Message.Type == controlMessageType {
+			pipelinePack.Trace.Record("control", "handled")
+			if err := switches.Handle(pipelinePack.Message); err != nil {
+				log.Printf("Error handling control message from %s input: "+
+					"%s\n", pipelinePack.InputName, err.Error())
+			}
 			return
 		}
 
-		// Deliver message to appropriate outputs
-		for outputName, use := range pipelinePack.Outputs {
-			if !use {
-				continue
-			}
-			output, ok := config.Outputs[outputName]
-			if !ok {
-				log.Printf("Output doesn't exist: %s\n", outputName)
+		if !config.oversize.Oversized(pipelinePack.Message) {
+			process(pipelinePack, ack, refs)
+			return
+		}
+		parts := config.oversize.Apply(pipelinePack.Message)
+		pipelinePack.Trace.Record("message_size",
+			fmt.Sprintf("oversized, %d part(s) kept", len(parts)))
+		for _, msg := range parts {
+			// Each part gets a pack of its own, since the outputs may still
+			// be delivering the one before
+			part := *pipelinePack
+			part.Message = msg
+			part.Outputs = make(map[string]bool)
+			for name, use := range pipelinePack.Outputs {
+				part.Outputs[name] = use
 			}
-			output.Deliver(pipelinePack)
+			process(&part, ack, refs)
 		}
 	}
 
-	// Initialize all of the PipelinePacks that we'll need
-	for i := 0; i < config.PoolSize; i++ {
-		msgBytes := make([]byte, 65536)
-		message := Message{}
-		outputs := make(map[string]bool)
-		for _, outputName := range config.DefaultOutputs {
-			outputs[outputName] = true
+	if config.PackLeakTimeout > 0 {
+		go pool.watchLeaks()
+	}
+
+	if config.TapAddress != "" {
+		tap := NewPipelineTap(config.TapSize)
+		tap.tracer = config.tracer
+		if err := tap.Serve(config.TapAddress); err != nil {
+			log.Printf("Pipeline tap disabled: %s\n", err.Error())
+		} else {
+			config.tap = tap
 		}
-		pipelinePack := PipelinePack{
-			MsgBytes:    msgBytes,
-			Message:     &message,
-			Config:      config,
-			Decoder:     config.DefaultDecoder,
-			Decoded:     false,
-			FilterChain: config.DefaultFilterChain,
-			Outputs:     outputs,
+	}
+
+	plugins := pipelinePlugins(config)
+	helpers := &pipelineHelpers{config, pool, pipeline,
+		make(map[string]*StateStore)}
+	helpers.setup(plugins)
+	if config.ReportInterval > 0 {
+		go helpers.reportLoop(plugins, config.ReportInterval)
+	}
+	prepareTimeout := config.PrepareTimeout
+	if prepareTimeout == 0 {
+		prepareTimeout = defaultHookTimeout
+	}
+	if !preparePlugins(plugins, prepareTimeout) {
+		log.Println("Plugin preparation failed, aborting startup.")
+		return
+	}
+	if config.SnapshotDir != "" {
+		if err := RestorePipeline(config, config.SnapshotDir); err != nil {
+			log.Printf("Snapshot import failed: %s\n", err.Error())
+			return
 		}
-		recycleChan <- &pipelinePack
+	}
+
+	if config.StagedStart != "" {
+		switches.Hold()
+		go switches.stagedStart(plugins, config.StagedStart)
 	}
 
 	var wg sync.WaitGroup
-	var runner InputRunner
 	timeout := time.Duration(time.Second / 2)
 	inputRunners := make(map[string]*InputRunner)
+	// Inputs only compete for packs via the scheduler if weights are set
+	var scheduler *PackScheduler
+	if len(config.InputWeights) > 0 {
+		scheduler = NewPackScheduler(pool.Free(), config.InputWeights)
+	}
 
 	for name, input := range config.Inputs {
-		runner = InputRunner{input, &timeout, false}
-		inputRunners[name] = &runner
-		runner.Start(pipeline, recycleChan, &wg)
+		policy := DefaultRestartPolicy
+		if custom, ok := config.RestartPolicies[name]; ok {
+			policy = custom
+		}
+		runner := NewInputRunner(name, input, &timeout, policy)
+		runner.onRestart = restartNotifier(helpers, "input", name)
+		runner.scheduler = scheduler
+		runner.backpressure = pool.backpressure
+		if pool.backpressure.Policy == BackpressureDrop {
+			runner.overflow = pool.newPack()
+		}
+		runner.disabled = func(name string) func() bool {
+			return func() bool { return switches.Disabled("input", name) }
+		}(name)
+		inputRunners[name] = runner
 		wg.Add(1)
+		runner.Start(pipeline, pool.Free(), &wg)
 		log.Printf("Input started: %s\n", name)
 	}
 
-	// wait for sigint
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT)
-	for {
-		sigint := <-sigChan
-		if sigint != nil {
+	// wait for sigint, exporting queued data on sigusr1. On sigusr2 we
+	// shut down gracefully, snapshot anything still queued, and then start
+	// a new hekad w/ our sockets. The sockets stay open throughout, so
+	// the kernel buffers incoming data until the new process picks it up.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
+	restart := false
+	for sig := range sigChan {
+		if sig == syscall.SIGINT {
+			break
+		}
+		if sig == syscall.SIGUSR2 {
+			restart = true
 			break
 		}
+		if config.SnapshotDir == "" {
+			log.Println("Snapshot requested but no SnapshotDir configured")
+			continue
+		}
+		exportDir := snapshotExportPath(config.SnapshotDir)
+		if err := SnapshotPipeline(config, exportDir); err != nil {
+			log.Printf("Snapshot failed: %s\n", err.Error())
+		}
+		helpers.saveStates(plugins)
 	}
 
 	for name, runner := range inputRunners {
@@ -178,5 +653,30 @@ func Run(config *GraterConfig) {
 		log.Printf("Stopping input: %s\n", name)
 	}
 	wg.Wait()
+
+	drainTimeout := config.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = defaultHookTimeout
+	}
+	// Let the messages in flight through the output queues before the
+	// plugins are drained
+	if inFlight := waitIdle(drainTimeout); inFlight > 0 {
+		log.Printf("Gave up waiting for %d messages in flight\n", inFlight)
+	}
+	for _, runner := range config.outputRunners {
+		runner.Stop()
+	}
+	drainPlugins(plugins, drainTimeout)
+	helpers.saveStates(plugins)
+	if restart {
+		if config.SnapshotDir != "" {
+			if err := SnapshotPipeline(config, config.SnapshotDir); err != nil {
+				log.Printf("Snapshot failed: %s\n", err.Error())
+			}
+		}
+		if _, err := Reexec(config); err != nil {
+			log.Printf("Restart failed: %s\n", err.Error())
+		}
+	}
 	log.Println("Shutdown complete.")
 }
@@ -0,0 +1,117 @@
+//go:build !nosampling
+// +build !nosampling
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterPlugin("SamplingFilter", func() interface{} {
+		return new(SamplingFilter)
+	})
+}
+
+// Sampling decisions are made in steps of 1/sampleScale
+const sampleScale = 1000000
+
+// SamplingFilter drops all but a sample of the messages matching its
+// `Matcher` (every message, if not set), passing the rest through
+// untouched. The sample is 1 in `SampleRate` messages or `Percent`
+// percent of them.
+//
+// By default exactly every Nth message is kept; w/ `Random` set each
+// message is kept at random w/ the same probability. If `KeyField` is
+// set, the decision is instead made by hashing that field's value, so
+// e.g. all of the messages for a request ID are kept or dropped together.
+// Messages w/o the key field are sampled as if it weren't set.
+type SamplingFilter struct {
+	matcher   *MessageMatcher
+	threshold uint64 // messages are kept if their sample point is below
+	every     uint64
+	random    bool
+	keyField  string
+	count     uint64
+}
+
+func (self *SamplingFilter) Init(config *PluginConfig) (err error) {
+	if value, ok := (*config)["Matcher"]; ok {
+		if self.matcher, err = NewMessageMatcher(value.(string)); err != nil {
+			return fmt.Errorf("SamplingFilter config: %s", err.Error())
+		}
+	}
+	if value, ok := (*config)["SampleRate"]; ok {
+		rate, ok := value.(int64)
+		if !ok || rate < 1 {
+			return errors.New("SamplingFilter config: SampleRate must be a " +
+				"positive whole number")
+		}
+		self.every = uint64(rate)
+		self.threshold = sampleScale / self.every
+	} else if _, ok := (*config)["Percent"]; ok {
+		percent, err := ConfigPercent(config, "Percent", 0)
+		if err != nil || percent < 0 || percent > 100 {
+			return errors.New("SamplingFilter config: Percent must be " +
+				"between 0 and 100")
+		}
+		self.threshold = uint64(percent.Fraction() * sampleScale)
+		if self.threshold > 0 {
+			self.every = sampleScale / self.threshold
+		}
+	} else {
+		return errors.New("SamplingFilter config: Missing SampleRate or " +
+			"Percent")
+	}
+	if value, ok := (*config)["Random"]; ok {
+		self.random = value.(bool)
+	}
+	if value, ok := (*config)["KeyField"]; ok {
+		self.keyField = value.(string)
+	}
+	return nil
+}
+
+// Returns whether the message should be kept
+func (self *SamplingFilter) keep(pipelinePack *PipelinePack) bool {
+	if self.threshold == 0 {
+		return false
+	}
+	if self.keyField != "" {
+		if key, ok := pipelinePack.Message.Fields[self.keyField]; ok {
+			hash := fnv.New64a()
+			fmt.Fprint(hash, key)
+			return hash.Sum64()%sampleScale < self.threshold
+		}
+	}
+	if self.random {
+		return uint64(rand.Int63n(sampleScale)) < self.threshold
+	}
+	return atomic.AddUint64(&self.count, 1)%self.every == 1%self.every
+}
+
+func (self *SamplingFilter) FilterMsg(pipelinePack *PipelinePack) {
+	if self.matcher != nil && !self.matcher.Match(pipelinePack.Message) {
+		return
+	}
+	if !self.keep(pipelinePack) {
+		pipelinePack.Message = nil
+	}
+}
@@ -0,0 +1,182 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	. "heka/message"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FilterSandbox runs a filter w/ its `sandbox` filter section setting
+// against live traffic w/o letting it affect anything, so new filters
+// (e.g. an ExternalFilter script) can be developed against production
+// data safely. The filter sees copies of a `sandbox_sample` fraction (1 by
+// default) of the chain's messages, and the messages carry on down the
+// chain as if it wasn't there. What it would have done is written to the
+// file named by `sandbox` as JSON lines instead, each w/ an "effect":
+//
+//	dropped   it dropped the message
+//	modified  it changed the message, which is included as changed
+//	routed    it changed the outputs, which are included
+//	emitted   it injected a new message (via its PluginHelper)
+//	failed    it panicked, w/ the "error"
+type FilterSandbox struct {
+	name   string
+	path   string
+	sample float64
+	file   *os.File
+	lock   sync.Mutex
+}
+
+func NewFilterSandbox(name, path string, sample float64) *FilterSandbox {
+	return &FilterSandbox{name: name, path: path, sample: sample}
+}
+
+// A line of a sandbox capture file
+type sandboxRecord struct {
+	Time    string          `json:"time"`
+	Filter  string          `json:"filter"`
+	Effect  string          `json:"effect"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Outputs []string        `json:"outputs,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Appends a record to the capture file, opening it on first use
+func (self *FilterSandbox) capture(effect string, msg *Message,
+	outputs []string, err error) {
+	record := &sandboxRecord{Time: time.Now().Format(time.RFC3339Nano),
+		Filter: self.name, Effect: effect, Outputs: outputs}
+	if msg != nil {
+		if msgJson, jsonErr := msg.MarshalJSON(); jsonErr == nil {
+			record.Message = msgJson
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	line, jsonErr := json.Marshal(record)
+	if jsonErr != nil {
+		log.Printf("Error capturing sandboxed %s: %s\n", self.name,
+			jsonErr.Error())
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file == nil {
+		self.file, err = os.OpenFile(self.path,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Printf("Error opening sandbox file for %s: %s\n", self.name,
+				err.Error())
+			return
+		}
+	}
+	if _, err = self.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing sandbox file for %s: %s\n", self.name,
+			err.Error())
+	}
+}
+
+// Returns the names of the outputs a pack is routed to, sorted
+func sandboxOutputs(outputs map[string]bool) []string {
+	names := make([]string, 0, len(outputs))
+	for name, use := range outputs {
+		if use {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Runs the filter on a copy of the pack, if it's sampled, and captures
+// what the filter did to it. The pack itself is left alone.
+func (self *FilterSandbox) Run(filter Filter, pipelinePack *PipelinePack) {
+	if self.sample < 1 && rand.Float64() >= self.sample {
+		return
+	}
+	sandboxed := *pipelinePack
+	sandboxed.Message = new(Message)
+	pipelinePack.Message.Copy(sandboxed.Message)
+	sandboxed.Outputs = make(map[string]bool)
+	for name, use := range pipelinePack.Outputs {
+		sandboxed.Outputs[name] = use
+	}
+	before, _ := pipelinePack.Message.MarshalJSON()
+	err := runRecovered(func() error {
+		filter.FilterMsg(&sandboxed)
+		return nil
+	})
+	switch {
+	case err != nil:
+		self.capture("failed", pipelinePack.Message, nil, err)
+		return
+	case sandboxed.Message == nil:
+		self.capture("dropped", pipelinePack.Message, nil, nil)
+		return
+	}
+	if after, _ := sandboxed.Message.MarshalJSON(); string(after) !=
+		string(before) {
+		self.capture("modified", sandboxed.Message, nil, nil)
+	}
+	outputs := sandboxOutputs(sandboxed.Outputs)
+	if fmt.Sprint(outputs) != fmt.Sprint(sandboxOutputs(
+		pipelinePack.Outputs)) {
+		self.capture("routed", sandboxed.Message, outputs, nil)
+	}
+}
+
+// sandboxHelper is the PluginHelper of a sandboxed filter, capturing the
+// messages it injects rather than sending them through the pipeline. Its
+// packs come from outside the pool, so the filter can't starve the pipeline
+// of them either.
+type sandboxHelper struct {
+	PluginHelper
+	sandbox *FilterSandbox
+	config  *GraterConfig
+}
+
+func (self *sandboxHelper) PipelinePack() *PipelinePack {
+	return &PipelinePack{MsgBytes: make([]byte, 65536),
+		Message: new(Message), Config: self.config,
+		Decoder: self.config.DefaultDecoder}
+}
+
+func (self *sandboxHelper) Inject(pipelinePack *PipelinePack) {
+	if !pipelinePack.Decoded {
+		decoder, ok := self.Decoder(pipelinePack.Decoder)
+		if !ok {
+			self.sandbox.capture("failed", nil, nil, fmt.Errorf(
+				"Decoder doesn't exist: %s", pipelinePack.Decoder))
+			return
+		}
+		if err := decoder.Decode(pipelinePack); err != nil {
+			self.sandbox.capture("failed", nil, nil, err)
+			return
+		}
+	}
+	self.sandbox.capture("emitted", pipelinePack.Message, nil, nil)
+}
+
+func (self *sandboxHelper) InjectMessage(msg *Message) {
+	self.sandbox.capture("emitted", msg, nil, nil)
+}
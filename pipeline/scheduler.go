@@ -0,0 +1,101 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+type packRequest struct {
+	name  string
+	reply chan *PipelinePack
+}
+
+// PackScheduler hands out recycled packs to inputs using weighted fair
+// queuing, so a firehose input can't starve a low volume one of packs.
+// When several inputs are waiting, the one that has received the fewest
+// packs relative to its weight goes first.
+type PackScheduler struct {
+	recycle  *Queue
+	requests chan *packRequest
+	weights  map[string]float64
+	served   map[string]float64
+}
+
+// Halve the served counts after this many packs, so history from long
+// ago doesn't dominate the scheduling decisions
+const schedulerDecayInterval = 10000
+
+// Creates a scheduler for the given input weights. Inputs w/o a weight
+// get a weight of 1.
+func NewPackScheduler(recycle *Queue,
+	weights map[string]float64) *PackScheduler {
+	self := &PackScheduler{
+		recycle:  recycle,
+		requests: make(chan *packRequest),
+		weights:  weights,
+		served:   make(map[string]float64),
+	}
+	go self.run()
+	return self
+}
+
+func (self *PackScheduler) weight(name string) float64 {
+	if weight, ok := self.weights[name]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// Returns the waiting input that is furthest behind its fair share
+func (self *PackScheduler) pick(pending map[string]chan *PipelinePack) string {
+	var picked string
+	var lowest float64
+	for name := range pending {
+		share := self.served[name] / self.weight(name)
+		if picked == "" || share < lowest {
+			picked, lowest = name, share
+		}
+	}
+	return picked
+}
+
+func (self *PackScheduler) run() {
+	pending := make(map[string]chan *PipelinePack)
+	handedOut := 0
+	for {
+		// Only take packs from the pool when someone is waiting for one
+		var recycleChan <-chan interface{}
+		if len(pending) > 0 {
+			recycleChan = self.recycle.Chan()
+		}
+		select {
+		case request := <-self.requests:
+			pending[request.name] = request.reply
+		case item := <-recycleChan:
+			name := self.pick(pending)
+			pending[name] <- item.(*PipelinePack)
+			delete(pending, name)
+			self.served[name]++
+			if handedOut++; handedOut%schedulerDecayInterval == 0 {
+				for name := range self.served {
+					self.served[name] /= 2
+				}
+			}
+		}
+	}
+}
+
+// Blocks until the scheduler hands the named input a pack
+func (self *PackScheduler) Get(name string) *PipelinePack {
+	reply := make(chan *PipelinePack, 1)
+	self.requests <- &packRequest{name, reply}
+	return <-reply
+}
@@ -0,0 +1,339 @@
+//go:build !noschemaexport
+// +build !noschemaexport
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/bits"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("SchemaExportOutput", func() interface{} {
+		return new(SchemaExportOutput)
+	})
+}
+
+const (
+	// Cardinality is estimated w/ a HyperLogLog of 2^schemaHllBits
+	// registers, i.e. 1KB per field and a standard error of about 3%
+	schemaHllBits = 10
+	// Example values longer than this are truncated
+	schemaExampleSize = 100
+)
+
+// A HyperLogLog cardinality estimator
+type schemaHll [1 << schemaHllBits]uint8
+
+func (self *schemaHll) Add(value string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	// As for shardWeight, FNV needs a finalizer to spread similar values
+	x := hash.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	register := x >> (64 - schemaHllBits)
+	rank := uint8(bits.LeadingZeros64(x<<schemaHllBits|1<<(schemaHllBits-1))) +
+		1
+	if rank > self[register] {
+		self[register] = rank
+	}
+}
+
+func (self *schemaHll) Estimate() int64 {
+	m := float64(len(self))
+	sum, zeros := 0.0, 0
+	for _, rank := range self {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// What's been seen of a field of one message type
+type schemaField struct {
+	count       int64
+	types       map[string]int64
+	cardinality schemaHll
+	examples    []string
+}
+
+// What's been seen of one message type
+type schemaType struct {
+	messages int64
+	loggers  map[string]int64
+	fields   map[string]*schemaField
+}
+
+// The schema observed over one sampling window
+type schemaWindow struct {
+	start time.Time
+	end   time.Time
+	types map[string]*schemaType
+}
+
+func newSchemaWindow(start time.Time) *schemaWindow {
+	return &schemaWindow{start: start, types: make(map[string]*schemaType)}
+}
+
+// Returns the JSON type name of a field value
+func schemaTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int32, int64, uint, uint32, uint64:
+		return "integer"
+	case float32, float64:
+		return "number"
+	case []interface{}, []string:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// SchemaExportOutput records the fields seen on messages of each Type
+// over a sampling window, so teams can document what their producers
+// actually emit and set up e.g. ElasticSearch mappings or SQL columns to
+// match. For every field it keeps the number of messages w/ it, the value
+// types seen, an estimate of the number of distinct values, and up to
+// `Examples` (3 by default) example values. Only messages matching
+// `Matcher` (all of them, if not set) are sampled, and once a window of
+// `Window`, a duration such as "10m" or a number of seconds (600 by
+// default), has passed, it becomes the exported schema and a new window
+// starts.
+//
+// The schema is served as JSON over HTTP on `Address`:
+//
+//	GET /schema?type=nginx.access&window=current
+//
+// where `type` limits the schema to one message type and `window` is
+// "last" (the last complete window, the default, or the current one if
+// none has completed yet) or "current".
+type SchemaExportOutput struct {
+	address  string
+	matcher  *MessageMatcher
+	window   time.Duration
+	examples int
+	listener net.Listener
+	current  *schemaWindow
+	last     *schemaWindow
+	lock     sync.Mutex
+}
+
+func (self *SchemaExportOutput) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Address"]
+	if !ok {
+		return errors.New("SchemaExportOutput config: Missing Address")
+	}
+	self.address = value.(string)
+	if value, ok = (*config)["Matcher"]; ok {
+		if self.matcher, err = NewMessageMatcher(value.(string)); err != nil {
+			return fmt.Errorf("SchemaExportOutput config: %s", err.Error())
+		}
+	}
+	self.window, err = ConfigDuration(config, "Window", time.Second,
+		600*time.Second)
+	if err != nil {
+		return fmt.Errorf("SchemaExportOutput config: %s", err.Error())
+	}
+	if self.window <= 0 {
+		return errors.New("SchemaExportOutput config: Window must be " +
+			"positive")
+	}
+	examples, err := ConfigInt(config, "Examples", 3)
+	if err != nil {
+		return fmt.Errorf("SchemaExportOutput config: %s", err.Error())
+	}
+	if examples < 0 {
+		return errors.New("SchemaExportOutput config: Examples can't be " +
+			"negative")
+	}
+	self.examples = int(examples)
+	self.current = newSchemaWindow(time.Now())
+	return nil
+}
+
+// Starts serving the schema, reusing an inherited socket if there is one
+func (self *SchemaExportOutput) Prepare() (err error) {
+	if file := InheritedFile(self.address); file != nil {
+		self.listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		self.listener, err = net.Listen("tcp", self.address)
+	}
+	if err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/schema", self.serveSchema)
+	go func() {
+		err := http.Serve(self.listener, mux)
+		log.Printf("SchemaExportOutput %s stopped: %s\n", self.address,
+			err.Error())
+	}()
+	return nil
+}
+
+// Moves on to a new window if the current one is over. Expects the lock
+// to be held.
+func (self *SchemaExportOutput) rotate(now time.Time) {
+	if now.Sub(self.current.start) < self.window {
+		return
+	}
+	self.current.end = now
+	self.last = self.current
+	self.current = newSchemaWindow(now)
+}
+
+func (self *SchemaExportOutput) Deliver(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	if self.matcher != nil && !self.matcher.Match(msg) {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.rotate(time.Now())
+	msgType, ok := self.current.types[msg.Type]
+	if !ok {
+		msgType = &schemaType{loggers: make(map[string]int64),
+			fields: make(map[string]*schemaField)}
+		self.current.types[msg.Type] = msgType
+	}
+	msgType.messages++
+	msgType.loggers[msg.Logger]++
+	for name, value := range msg.Fields {
+		field, ok := msgType.fields[name]
+		if !ok {
+			field = &schemaField{types: make(map[string]int64)}
+			msgType.fields[name] = field
+		}
+		field.count++
+		field.types[schemaTypeName(value)]++
+		example := fmt.Sprint(value)
+		field.cardinality.Add(example)
+		if len(field.examples) < self.examples {
+			if len(example) > schemaExampleSize {
+				example = example[:schemaExampleSize]
+			}
+			field.addExample(example)
+		}
+	}
+}
+
+// Keeps an example value unless it's already been kept
+func (self *schemaField) addExample(example string) {
+	for _, existing := range self.examples {
+		if existing == example {
+			return
+		}
+	}
+	self.examples = append(self.examples, example)
+}
+
+// Returns a window's schema in the form it's exported in, limited to
+// msgType if it's set
+func (self *schemaWindow) export(msgType string) map[string]interface{} {
+	types := make(map[string]interface{})
+	for name, seen := range self.types {
+		if msgType != "" && name != msgType {
+			continue
+		}
+		fields := make(map[string]interface{})
+		for fieldName, field := range seen.fields {
+			fields[fieldName] = map[string]interface{}{
+				"count":       field.count,
+				"types":       field.types,
+				"cardinality": field.cardinality.Estimate(),
+				"examples":    field.examples,
+			}
+		}
+		types[name] = map[string]interface{}{
+			"messages": seen.messages,
+			"loggers":  seen.loggers,
+			"fields":   fields,
+		}
+	}
+	schema := map[string]interface{}{
+		"start": self.start.Format(time.RFC3339),
+		"types": types,
+	}
+	if !self.end.IsZero() {
+		schema["end"] = self.end.Format(time.RFC3339)
+	}
+	return schema
+}
+
+// Returns the exported schema of the "last" or "current" window
+func (self *SchemaExportOutput) Schema(window,
+	msgType string) (map[string]interface{}, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.rotate(time.Now())
+	switch window {
+	case "", "last":
+		if self.last != nil {
+			return self.last.export(msgType), nil
+		}
+		fallthrough
+	case "current":
+		return self.current.export(msgType), nil
+	}
+	return nil, fmt.Errorf("Unknown window: %s", window)
+}
+
+func (self *SchemaExportOutput) serveSchema(w http.ResponseWriter,
+	req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	schema, err := self.Schema(query.Get("window"), query.Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	schemaJson, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(schemaJson, '\n'))
+}
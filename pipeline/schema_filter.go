@@ -0,0 +1,323 @@
+//go:build !noschemafilter
+// +build !noschemafilter
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "heka/message"
+	"math"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterPlugin("SchemaFilter", func() interface{} {
+		return new(SchemaFilter)
+	})
+}
+
+// The field types a schema can require. Decoded JSON numbers are
+// float64s, or json.Numbers w/ UseNumber, so "int" takes whole ones.
+var schemaFieldTypes = map[string]func(interface{}) bool{
+	"string": func(value interface{}) bool {
+		_, ok := value.(string)
+		return ok
+	},
+	"int": func(value interface{}) bool {
+		switch v := value.(type) {
+		case int, int64:
+			return true
+		case float64:
+			return v == math.Trunc(v) && !math.IsInf(v, 0)
+		case json.Number:
+			_, err := v.Int64()
+			return err == nil
+		}
+		return false
+	},
+	"float": func(value interface{}) bool {
+		_, ok := value.(float64)
+		return ok
+	},
+	"number": func(value interface{}) bool {
+		switch value.(type) {
+		case int, int64, float64, json.Number:
+			return true
+		}
+		return false
+	},
+	"bool": func(value interface{}) bool {
+		_, ok := value.(bool)
+		return ok
+	},
+	"list": func(value interface{}) bool {
+		_, ok := value.([]interface{})
+		return ok
+	},
+	"object": func(value interface{}) bool {
+		_, ok := value.(map[string]interface{})
+		return ok
+	},
+}
+
+// Violations are only counted by type for this many types, in case
+// RequireSchema meets types derived from something unbounded
+const maxSchemaReportTypes = 100
+
+// The contract for messages of one type
+type messageSchema struct {
+	required    []string
+	fieldTypes  map[string]string
+	minSeverity int
+	maxSeverity int
+	closed      bool
+}
+
+// SchemaFilter enforces a logging contract: `Schemas` maps message types
+// to what messages of that type must look like, e.g.
+//
+//	"Schemas": {
+//		"nginx.access": {
+//			"Required": ["status", "path"],
+//			"Fields": {"status": "int", "path": "string"},
+//			"Severity": ["error", "info"],
+//			"AllowOtherFields": false
+//		}
+//	}
+//
+// `Required` fields must be present, and `Fields` gives the types of
+// fields, when they're present: string, int, float, number (either),
+// bool, list or object. `Severity` is the allowed range, most severe
+// first, as numbers or names (see SeverityFromString). W/
+// `AllowOtherFields` false, fields not named in Required or Fields are
+// violations too. W/ `RequireSchema` set messages of types w/o a schema
+// are violations; otherwise they pass unchecked.
+//
+// W/ an `Action` of "tag" (the default) non-conforming messages are
+// passed on w/ a "schema_violations" field listing the problems, and w/
+// "drop" they're dropped. Counts of checked and non-conforming messages,
+// in total and by type, are available as a plugin report (see Reporter).
+type SchemaFilter struct {
+	schemas       map[string]*messageSchema
+	requireSchema bool
+	drop          bool
+	lock          sync.Mutex
+	checked       int64
+	violations    int64
+	byType        map[string]int64
+}
+
+func (self *SchemaFilter) Init(config *PluginConfig) error {
+	value, ok := (*config)["Schemas"]
+	if !ok {
+		return errors.New("SchemaFilter config: Missing Schemas")
+	}
+	specs, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("SchemaFilter config: Schemas must be an object")
+	}
+	self.schemas = make(map[string]*messageSchema, len(specs))
+	for msgType, spec := range specs {
+		schema, err := newMessageSchema(spec)
+		if err != nil {
+			return fmt.Errorf("SchemaFilter config: Schemas[%s]: %s",
+				msgType, err.Error())
+		}
+		self.schemas[msgType] = schema
+	}
+	if value, ok = (*config)["RequireSchema"]; ok {
+		if self.requireSchema, ok = value.(bool); !ok {
+			return errors.New("SchemaFilter config: RequireSchema must be " +
+				"a boolean")
+		}
+	}
+	if value, ok = (*config)["Action"]; ok {
+		action, ok := value.(string)
+		if !ok {
+			return errors.New("SchemaFilter config: Action must be a string")
+		}
+		switch action {
+		case "tag":
+		case "drop":
+			self.drop = true
+		default:
+			return fmt.Errorf("SchemaFilter config: Unknown Action: %s",
+				value)
+		}
+	}
+	self.byType = make(map[string]int64)
+	return nil
+}
+
+// Parses a schema from its config object. Nested config values aren't
+// normalized, so numbers are float64s and lists []interface{}s.
+func newMessageSchema(spec interface{}) (*messageSchema, error) {
+	settings, ok := spec.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("must be an object")
+	}
+	schema := &messageSchema{fieldTypes: make(map[string]string),
+		minSeverity: SEVERITY_EMERGENCY, maxSeverity: SEVERITY_DEBUG}
+	if value, ok := settings["Required"]; ok {
+		names, ok := value.([]interface{})
+		if !ok {
+			return nil, errors.New("Required must be a list of field names")
+		}
+		for _, name := range names {
+			str, ok := name.(string)
+			if !ok {
+				return nil, errors.New("Required must be a list of field " +
+					"names")
+			}
+			schema.required = append(schema.required, str)
+		}
+	}
+	if value, ok := settings["Fields"]; ok {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Fields must be an object")
+		}
+		for name, fieldType := range fields {
+			str, _ := fieldType.(string)
+			if _, ok := schemaFieldTypes[str]; !ok {
+				return nil, fmt.Errorf("Fields[%s] has unknown type %v", name,
+					fieldType)
+			}
+			schema.fieldTypes[name] = str
+		}
+	}
+	if value, ok := settings["Severity"]; ok {
+		bounds, ok := value.([]interface{})
+		if !ok || len(bounds) != 2 {
+			return nil, errors.New("Severity must be a [most, least] severe " +
+				"range")
+		}
+		var err error
+		if schema.minSeverity, err = schemaSeverity(bounds[0]); err != nil {
+			return nil, err
+		}
+		if schema.maxSeverity, err = schemaSeverity(bounds[1]); err != nil {
+			return nil, err
+		}
+		// No message could be in a range w/ its bounds the wrong way round
+		if schema.minSeverity > schema.maxSeverity {
+			return nil, fmt.Errorf("Severity range %v is reversed; it "+
+				"must be most severe first", value)
+		}
+	}
+	if value, ok := settings["AllowOtherFields"]; ok {
+		allow, ok := value.(bool)
+		if !ok {
+			return nil, errors.New("AllowOtherFields must be a boolean")
+		}
+		schema.closed = !allow
+	}
+	return schema, nil
+}
+
+func schemaSeverity(value interface{}) (int, error) {
+	if name, ok := value.(string); ok {
+		return SeverityFromString(name)
+	}
+	num, err := toFloat64(value)
+	if err != nil || SeverityName(int(num)) == "" ||
+		num != float64(int(num)) {
+		return 0, fmt.Errorf("invalid severity %v", value)
+	}
+	return int(num), nil
+}
+
+// Returns the ways the message breaks the schema, if any
+func (self *messageSchema) check(msg *Message) []string {
+	var problems []string
+	for _, name := range self.required {
+		if _, ok := msg.Fields[name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing field %s", name))
+		}
+	}
+	for _, name := range msg.FieldNames() {
+		fieldType, ok := self.fieldTypes[name]
+		if !ok {
+			if self.closed && !self.isRequired(name) {
+				problems = append(problems, fmt.Sprintf("unexpected field %s",
+					name))
+			}
+			continue
+		}
+		if !schemaFieldTypes[fieldType](msg.Fields[name]) {
+			problems = append(problems, fmt.Sprintf("field %s should be "+
+				"%s, not %T", name, fieldType, msg.Fields[name]))
+		}
+	}
+	if msg.Severity < self.minSeverity || msg.Severity > self.maxSeverity {
+		problems = append(problems, fmt.Sprintf("severity %d outside %d-%d",
+			msg.Severity, self.minSeverity, self.maxSeverity))
+	}
+	return problems
+}
+
+func (self *messageSchema) isRequired(name string) bool {
+	for _, required := range self.required {
+		if name == required {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *SchemaFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	var problems []string
+	if schema, ok := self.schemas[msg.Type]; ok {
+		problems = schema.check(msg)
+	} else if self.requireSchema {
+		problems = []string{"no schema for type " + msg.Type}
+	}
+	self.lock.Lock()
+	self.checked++
+	if len(problems) > 0 {
+		self.violations++
+		if _, ok := self.byType[msg.Type]; ok ||
+			len(self.byType) < maxSchemaReportTypes {
+			self.byType[msg.Type]++
+		}
+	}
+	self.lock.Unlock()
+	if len(problems) == 0 {
+		return
+	}
+	if self.drop {
+		pipelinePack.Message = nil
+		return
+	}
+	msg.ReplaceField("schema_violations", strings.Join(problems, "; "))
+}
+
+func (self *SchemaFilter) Report() map[string]interface{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	report := map[string]interface{}{
+		"checked":    self.checked,
+		"violations": self.violations,
+	}
+	for msgType, count := range self.byType {
+		report["violations."+msgType] = count
+	}
+	return report
+}
@@ -0,0 +1,125 @@
+//go:build !noschemafilter
+// +build !noschemafilter
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+)
+
+func init() {
+	pluginSpecs = append(pluginSpecs, SchemaFilterSpec)
+}
+
+func SchemaFilterSpec(c gospec.Context) {
+	// Schemas come from the config file, so nested numbers are float64s
+	newFilter := func(configJson string) (*SchemaFilter, error) {
+		var config PluginConfig
+		if err := json.Unmarshal([]byte(configJson), &config); err != nil {
+			panic(err)
+		}
+		filter := new(SchemaFilter)
+		return filter, filter.Init(&config)
+	}
+	schemas := `"Schemas": {"access": {
+		"Required": ["status"],
+		"Fields": {"status": "int", "path": "string"},
+		"Severity": ["error", "info"],
+		"AllowOtherFields": false}}`
+	newPack := func(msgType string,
+		fields map[string]interface{}) *PipelinePack {
+		return &PipelinePack{Message: &Message{Type: msgType,
+			Severity: SEVERITY_INFO, Fields: fields}}
+	}
+	violations := func(pipelinePack *PipelinePack) interface{} {
+		return pipelinePack.Message.Fields["schema_violations"]
+	}
+
+	c.Specify("Conforming messages pass untouched", func() {
+		filter, err := newFilter("{" + schemas + "}")
+		c.Assume(err, gs.IsNil)
+		pipelinePack := newPack("access", map[string]interface{}{
+			"status": int64(200), "path": "/"})
+		filter.FilterMsg(pipelinePack)
+		c.Expect(violations(pipelinePack), gs.IsNil)
+		c.Expect(filter.Report()["checked"], gs.Equals, int64(1))
+		c.Expect(filter.Report()["violations"], gs.Equals, int64(0))
+	})
+
+	c.Specify("Decoded JSON numbers are ints if they're whole", func() {
+		isInt := schemaFieldTypes["int"]
+		c.Expect(isInt(float64(200)), gs.IsTrue)
+		c.Expect(isInt(json.Number("200")), gs.IsTrue)
+		c.Expect(isInt(2.5), gs.IsFalse)
+		c.Expect(isInt(json.Number("2.5")), gs.IsFalse)
+		c.Expect(isInt("200"), gs.IsFalse)
+	})
+
+	c.Specify("Non-conforming messages are tagged w/ the problems", func() {
+		filter, err := newFilter("{" + schemas + "}")
+		c.Assume(err, gs.IsNil)
+		pipelinePack := newPack("access", map[string]interface{}{
+			"status": "200", "extra": true})
+		filter.FilterMsg(pipelinePack)
+		c.Expect(violations(pipelinePack), gs.Equals,
+			"unexpected field extra; field status should be int, not string")
+
+		pipelinePack = newPack("access", map[string]interface{}{})
+		pipelinePack.Message.Severity = SEVERITY_DEBUG
+		filter.FilterMsg(pipelinePack)
+		c.Expect(violations(pipelinePack), gs.Equals,
+			"missing field status; severity 7 outside 3-6")
+		c.Expect(filter.Report()["violations.access"], gs.Equals, int64(2))
+	})
+
+	c.Specify("Types w/o a schema pass unless one is required", func() {
+		filter, err := newFilter("{" + schemas + "}")
+		c.Assume(err, gs.IsNil)
+		pipelinePack := newPack("other", map[string]interface{}{})
+		filter.FilterMsg(pipelinePack)
+		c.Expect(violations(pipelinePack), gs.IsNil)
+
+		filter, err = newFilter("{" + schemas + `, "RequireSchema": true}`)
+		c.Assume(err, gs.IsNil)
+		filter.FilterMsg(pipelinePack)
+		c.Expect(violations(pipelinePack), gs.Equals,
+			"no schema for type other")
+	})
+
+	c.Specify("Non-conforming messages can be dropped", func() {
+		filter, err := newFilter("{" + schemas + `, "Action": "drop"}`)
+		c.Assume(err, gs.IsNil)
+		pipelinePack := newPack("access", map[string]interface{}{})
+		filter.FilterMsg(pipelinePack)
+		c.Expect(pipelinePack.Message == nil, gs.IsTrue)
+	})
+
+	c.Specify("Bad config is an error", func() {
+		_, err := newFilter(`{"Schemas": {"access": {
+			"Severity": ["info", "error"]}}}`)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = newFilter("{" + schemas + `, "RequireSchema": "yes"}`)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = newFilter("{" + schemas + `, "Action": 1}`)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = newFilter(`{"Schemas": {"access": {
+			"Fields": {"status": "integer"}}}}`)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,130 @@
+//go:build !noscribble
+// +build !noscribble
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+)
+
+func init() {
+	RegisterPlugin("ScribbleFilter", func() interface{} {
+		return new(ScribbleFilter)
+	})
+	RegisterPlugin("ScribbleDecoder", func() interface{} {
+		return new(ScribbleDecoder)
+	})
+}
+
+// scribbler stamps the static `Fields` object of a config onto messages,
+// e.g. {"datacenter": "us-west", "team": "ops"}, so deployment metadata
+// doesn't have to be added by every producer. Existing fields are
+// overwritten unless `Overwrite` is false.
+type scribbler struct {
+	fields    map[string]interface{}
+	overwrite bool
+}
+
+func (self *scribbler) init(config *PluginConfig, plugin string) error {
+	value, ok := (*config)["Fields"]
+	if !ok {
+		return fmt.Errorf("%s config: Missing Fields", plugin)
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok || len(fields) == 0 {
+		return fmt.Errorf("%s config: Fields must be an object of field "+
+			"values", plugin)
+	}
+	self.fields = make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		self.fields[name] = normalizeConfigValue(value)
+	}
+	self.overwrite = true
+	if value, ok = (*config)["Overwrite"]; ok {
+		self.overwrite = value.(bool)
+	}
+	return nil
+}
+
+func (self *scribbler) scribble(msg *Message) {
+	for name, value := range self.fields {
+		if !self.overwrite {
+			if _, ok := msg.Fields[name]; ok {
+				continue
+			}
+		}
+		msg.ReplaceField(name, value)
+	}
+}
+
+// ScribbleFilter stamps static fields onto every message passing through
+// its filter chain (see scribbler)
+type ScribbleFilter struct {
+	scribbler
+}
+
+func (self *ScribbleFilter) Init(config *PluginConfig) error {
+	return self.init(config, "ScribbleFilter")
+}
+
+func (self *ScribbleFilter) FilterMsg(pipelinePack *PipelinePack) {
+	self.scribble(pipelinePack.Message)
+}
+
+// ScribbleDecoder runs the decoder named by `Decoder` and then stamps
+// static fields onto the messages it decodes (see scribbler), for
+// metadata that depends on where messages come from rather than the
+// filter chain they go through
+type ScribbleDecoder struct {
+	scribbler
+	decoder string
+}
+
+func (self *ScribbleDecoder) Init(config *PluginConfig) error {
+	value, ok := (*config)["Decoder"]
+	if !ok {
+		return errors.New("ScribbleDecoder config: Missing Decoder")
+	}
+	self.decoder = value.(string)
+	return self.init(config, "ScribbleDecoder")
+}
+
+// Returns the name of the wrapped decoder, so ValidateConfig can check it
+// exists
+func (self *ScribbleDecoder) decoderRefs() []string {
+	return []string{self.decoder}
+}
+
+func (self *ScribbleDecoder) Decode(pipelinePack *PipelinePack) error {
+	decoder, ok := pipelinePack.Config.Decoders[self.decoder]
+	if !ok {
+		return fmt.Errorf("Decoder doesn't exist: %s", self.decoder)
+	}
+	if decoder == Decoder(self) {
+		return errors.New("ScribbleDecoder can't wrap itself")
+	}
+	if err := decoder.Decode(pipelinePack); err != nil {
+		return err
+	}
+	if pipelinePack.Message == nil {
+		return nil
+	}
+	self.scribble(pipelinePack.Message)
+	pipelinePack.Decoded = true
+	return nil
+}
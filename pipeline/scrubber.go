@@ -0,0 +1,115 @@
+//go:build !noscrubber
+// +build !noscrubber
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+func init() {
+	RegisterPlugin("ScrubberFilter", func() interface{} {
+		return new(ScrubberFilter)
+	})
+}
+
+// ScrubberFilter strips sensitive values (emails, IPs, tokens, ...) from
+// messages before they reach any outputs. The `Fields` setting lists
+// fields whose values are scrubbed, and text matching any of the
+// `PayloadPatterns` regular expressions is scrubbed from the payload.
+//
+// `Action` says what happens to scrubbed values: "mask" (the default)
+// replaces them w/ `Mask` ("****" by default), "hash" replaces them w/ the
+// hex SHA-256 of `Salt` plus the value, so they can still be correlated,
+// and "remove" drops them (removing scrubbed fields entirely).
+type ScrubberFilter struct {
+	fields   []string
+	patterns []*regexp.Regexp
+	action   string
+	mask     string
+	salt     string
+}
+
+func (self *ScrubberFilter) Init(config *PluginConfig) error {
+	if value, ok := (*config)["Fields"]; ok {
+		self.fields = value.([]string)
+	}
+	if value, ok := (*config)["PayloadPatterns"]; ok {
+		for _, pattern := range value.([]string) {
+			regex, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("ScrubberFilter config: %s", err.Error())
+			}
+			self.patterns = append(self.patterns, regex)
+		}
+	}
+	if len(self.fields) == 0 && len(self.patterns) == 0 {
+		return errors.New("ScrubberFilter config: Missing Fields or " +
+			"PayloadPatterns")
+	}
+	self.action = "mask"
+	if value, ok := (*config)["Action"]; ok {
+		self.action = value.(string)
+	}
+	switch self.action {
+	case "mask", "hash", "remove":
+	default:
+		return fmt.Errorf("ScrubberFilter config: Unknown Action: %s",
+			self.action)
+	}
+	self.mask = "****"
+	if value, ok := (*config)["Mask"]; ok {
+		self.mask = value.(string)
+	}
+	if value, ok := (*config)["Salt"]; ok {
+		self.salt = value.(string)
+	}
+	return nil
+}
+
+// Returns what a sensitive value is replaced with
+func (self *ScrubberFilter) scrub(value string) string {
+	switch self.action {
+	case "hash":
+		sum := sha256.Sum256([]byte(self.salt + value))
+		return hex.EncodeToString(sum[:])
+	case "remove":
+		return ""
+	}
+	return self.mask
+}
+
+func (self *ScrubberFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	for _, name := range self.fields {
+		value, ok := msg.Fields[name]
+		if !ok {
+			continue
+		}
+		if self.action == "remove" {
+			msg.DeleteField(name)
+		} else {
+			msg.Fields[name] = self.scrub(fmt.Sprint(value))
+		}
+	}
+	for _, regex := range self.patterns {
+		msg.Payload = regex.ReplaceAllStringFunc(msg.Payload, self.scrub)
+	}
+}
@@ -0,0 +1,69 @@
+//go:build !noscrubber
+// +build !noscrubber
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+)
+
+func init() {
+	pluginSpecs = append(pluginSpecs, ScrubberSpec)
+}
+
+func ScrubberSpec(c gospec.Context) {
+	msg := getTestMessage()
+	msg.Payload = "login from bob@example.com failed"
+	msg.Fields["ip"] = "10.0.0.1"
+	pipelinePack := &PipelinePack{Message: msg}
+	filter := new(ScrubberFilter)
+	config := PluginConfig{
+		"Fields":          []string{"ip"},
+		"PayloadPatterns": []string{`[\w.]+@[\w.]+`},
+	}
+
+	c.Specify("masks fields and payload matches by default", func() {
+		err := filter.Init(&config)
+		c.Expect(err, gs.IsNil)
+		filter.FilterMsg(pipelinePack)
+		c.Expect(msg.Fields["ip"], gs.Equals, "****")
+		c.Expect(msg.Payload, gs.Equals, "login from **** failed")
+	})
+
+	c.Specify("hashes w/ the salt", func() {
+		config["Action"] = "hash"
+		config["Salt"] = "pepper"
+		filter.Init(&config)
+		filter.FilterMsg(pipelinePack)
+		c.Expect(msg.Fields["ip"], gs.Equals, filter.scrub("10.0.0.1"))
+		c.Expect(len(msg.Fields["ip"].(string)), gs.Equals, 64)
+	})
+
+	c.Specify("removes fields", func() {
+		config["Action"] = "remove"
+		filter.Init(&config)
+		filter.FilterMsg(pipelinePack)
+		_, ok := msg.Fields["ip"]
+		c.Expect(ok, gs.IsFalse)
+		c.Expect(msg.Payload, gs.Equals, "login from  failed")
+	})
+
+	c.Specify("rejects unknown actions", func() {
+		config["Action"] = "shred"
+		c.Expect(filter.Init(&config), gs.Not(gs.IsNil))
+	})
+}
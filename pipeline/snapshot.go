@@ -0,0 +1,157 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Plugins that queue messages internally can implement Snapshotter so the
+// queue contents can be exported while traffic is flowing, e.g. to move a
+// collector to another host, and imported again on startup.
+//
+// Only snapshots in the `snapshot_dir` itself are imported, i.e. those
+// written on a SIGUSR2 handoff, when the queues are snapshotted after
+// shutdown and nothing in them has been sent. A SIGUSR1 export is written
+// to the "export" directory under it instead: the process carries on
+// sending those records, so importing them on the next start would
+// deliver them twice. To move them to another host copy them into that
+// host's snapshot_dir.
+type Snapshotter interface {
+	// Returns a copy of the currently queued records, oldest first
+	Snapshot() ([][]byte, error)
+	// Queues previously snapshotted records ahead of any new data
+	Restore(records [][]byte) error
+}
+
+// Snapshot records are preceded by a big-endian 4 byte length. Snapshots
+// are written atomically, so they don't need the checks of stream framing.
+const snapshotHeaderSize = 4
+
+// Where SIGUSR1 exports are written, under the snapshot dir
+const snapshotExportDir = "export"
+
+func snapshotExportPath(dir string) string {
+	return filepath.Join(dir, snapshotExportDir)
+}
+
+func snapshotPath(dir string, p namedPlugin) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.snap", p.kind, p.name))
+}
+
+func writeSnapshot(path string, records [][]byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	header := make([]byte, snapshotHeaderSize)
+	for _, record := range records {
+		binary.BigEndian.PutUint32(header, uint32(len(record)))
+		writer.Write(header)
+		writer.Write(record)
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// Only replace a previous snapshot once the new one is complete
+	return os.Rename(tmpPath, path)
+}
+
+func readSnapshot(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	records := make([][]byte, 0)
+	header := make([]byte, snapshotHeaderSize)
+	for {
+		if _, err = io.ReadFull(reader, header); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		record := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err = io.ReadFull(reader, record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// Writes the queued records of every plugin that supports it to one file
+// per plugin in dir. Traffic keeps flowing while the snapshot is taken.
+func SnapshotPipeline(config *GraterConfig, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, p := range pipelinePlugins(config) {
+		snapshotter, ok := p.plugin.(Snapshotter)
+		if !ok {
+			continue
+		}
+		records, err := snapshotter.Snapshot()
+		if err != nil {
+			return fmt.Errorf("Error snapshotting %s %s: %s", p.kind, p.name,
+				err.Error())
+		}
+		if err = writeSnapshot(snapshotPath(dir, p), records); err != nil {
+			return err
+		}
+		log.Printf("Snapshotted %d records from %s %s\n", len(records),
+			p.kind, p.name)
+	}
+	return nil
+}
+
+// Loads any snapshots found in dir back into their plugins, removing each
+// snapshot file once it's been restored so it won't be imported twice.
+func RestorePipeline(config *GraterConfig, dir string) error {
+	for _, p := range pipelinePlugins(config) {
+		snapshotter, ok := p.plugin.(Snapshotter)
+		if !ok {
+			continue
+		}
+		path := snapshotPath(dir, p)
+		records, err := readSnapshot(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Error reading snapshot %s: %s", path,
+				err.Error())
+		}
+		if err = snapshotter.Restore(records); err != nil {
+			return fmt.Errorf("Error restoring %s %s: %s", p.kind, p.name,
+				err.Error())
+		}
+		os.Remove(path)
+		log.Printf("Restored %d records to %s %s\n", len(records), p.kind,
+			p.name)
+	}
+	return nil
+}
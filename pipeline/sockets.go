@@ -0,0 +1,151 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+var (
+	inheritedFiles     map[string]*os.File
+	inheritedFilesLock sync.Mutex
+)
+
+// Plugins that own listening sockets implement SocketOwner so the sockets
+// can be handed off to a new hekad process on restart. Sockets are keyed
+// by their listen address.
+type SocketOwner interface {
+	SocketFiles() (map[string]*os.File, error)
+}
+
+// LISTEN_FDNAMES is colon separated, so colons in listen addresses (as
+// in every address, and IPv6 ones more than once) are percent encoded,
+// e.g. "[::1]:5565" is passed as "[%3A%3A1]%3A5565"
+var fdNameEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
+// Returns the LISTEN_FDNAMES name for a listen address
+func fdName(address string) string {
+	return fdNameEscaper.Replace(address)
+}
+
+// Returns the listen address for a LISTEN_FDNAMES name. Names w/o
+// escapes are taken as is.
+func fdNameAddress(name string) string {
+	if address, err := url.PathUnescape(name); err == nil {
+		return address
+	}
+	return name
+}
+
+// Loads the sockets passed in using the systemd socket activation
+// protocol (LISTEN_FDS, LISTEN_FDNAMES). Each socket is named by its
+// listen address w/ colons percent encoded (see fdName), e.g.
+// FileDescriptorName=127.0.0.1%3A5565 in the systemd socket unit.
+// LISTEN_PID is checked if set.
+func loadInheritedFiles() {
+	inheritedFiles = make(map[string]*os.File)
+	if pid := os.Getenv("LISTEN_PID"); pid != "" {
+		if pid != strconv.Itoa(os.Getpid()) {
+			return
+		}
+	}
+	numFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFds <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < numFds; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = fdNameAddress(names[i])
+		}
+		inheritedFiles[name] = os.NewFile(uintptr(fd), name)
+	}
+	// Don't pass these on to any child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
+
+// Returns the inherited socket for the given listen address, or nil if
+// there isn't one. Each socket can only be claimed once.
+func InheritedFile(name string) *os.File {
+	inheritedFilesLock.Lock()
+	defer inheritedFilesLock.Unlock()
+	if inheritedFiles == nil {
+		loadInheritedFiles()
+	}
+	file, ok := inheritedFiles[name]
+	if ok {
+		delete(inheritedFiles, name)
+	}
+	return file
+}
+
+// Starts a new copy of the running hekad binary, handing it all of the
+// listening sockets using the same protocol systemd uses. The caller is
+// expected to exit once this returns.
+func Reexec(config *GraterConfig) (int, error) {
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	names := make([]string, 0)
+	for _, p := range pipelinePlugins(config) {
+		owner, ok := p.plugin.(SocketOwner)
+		if !ok {
+			continue
+		}
+		sockets, err := owner.SocketFiles()
+		if err != nil {
+			return 0, fmt.Errorf("Error getting sockets from %s %s: %s",
+				p.kind, p.name, err.Error())
+		}
+		for address, file := range sockets {
+			names = append(names, fdName(address))
+			files = append(files, file)
+		}
+	}
+	env := append(os.Environ(),
+		fmt.Sprintf("LISTEN_FDS=%d", len(names)),
+		fmt.Sprintf("LISTEN_FDNAMES=%s", strings.Join(names, ":")))
+	// os.Args[0] may be relative to a directory we've since left, or just
+	// a name looked up on the PATH
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("Error finding the hekad binary: %s",
+			err.Error())
+	}
+	wd, _ := os.Getwd()
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Dir:   wd,
+		Env:   env,
+		Files: files,
+	})
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Started new hekad process (pid %d) w/ %d sockets\n",
+		process.Pid, len(names))
+	return process.Pid, nil
+}
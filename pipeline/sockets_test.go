@@ -0,0 +1,40 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	"strings"
+)
+
+func FdNameSpec(c gospec.Context) {
+	c.Specify("Listen addresses survive LISTEN_FDNAMES", func() {
+		addresses := []string{"127.0.0.1:5565", "[::1]:5565",
+			"[fe80::1%eth0]:5565", "/var/run/hekad.sock"}
+		names := make([]string, len(addresses))
+		for i, address := range addresses {
+			names[i] = fdName(address)
+			c.Expect(strings.Contains(names[i], ":"), gs.IsFalse)
+		}
+		for i, name := range strings.Split(strings.Join(names, ":"), ":") {
+			c.Expect(fdNameAddress(name), gs.Equals, addresses[i])
+		}
+	})
+
+	c.Specify("Names w/o escapes are taken as is", func() {
+		c.Expect(fdNameAddress("web"), gs.Equals, "web")
+		c.Expect(fdNameAddress("100%"), gs.Equals, "100%")
+	})
+}
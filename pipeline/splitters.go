@@ -0,0 +1,317 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Splitters break a byte stream into records before decoding, so stream
+// based inputs don't each need their own record boundary logic. Split
+// follows the bufio.SplitFunc contract, so a splitter can be handed
+// straight to a bufio.Scanner.
+type Splitter interface {
+	Plugin
+	Split(data []byte, atEOF bool) (advance int, record []byte, err error)
+}
+
+// Returns a new splitter of the given kind, i.e. "newline", "token",
+// "regex", "multiline" or "framing". The caller is responsible for
+// calling Init.
+func NewSplitter(kind string) (Splitter, error) {
+	switch kind {
+	case "newline":
+		return &NewlineSplitter{}, nil
+	case "token":
+		return &TokenSplitter{}, nil
+	case "regex":
+		return &RegexSplitter{}, nil
+	case "multiline":
+		return &MultilineSplitter{}, nil
+	case "framing":
+		return &FramingSplitter{}, nil
+	}
+	return nil, fmt.Errorf("Unknown splitter: %s", kind)
+}
+
+// NewlineSplitter emits one record per line, w/o the line ending
+type NewlineSplitter struct {
+}
+
+func (self *NewlineSplitter) Init(config *PluginConfig) error {
+	return nil
+}
+
+func (self *NewlineSplitter) Split(data []byte, atEOF bool) (int, []byte,
+	error) {
+	return bufio.ScanLines(data, atEOF)
+}
+
+// TokenSplitter emits records separated by the `Delimiter` config string
+type TokenSplitter struct {
+	delimiter []byte
+}
+
+func (self *TokenSplitter) Init(config *PluginConfig) error {
+	value, ok := (*config)["Delimiter"]
+	if !ok {
+		return errors.New("TokenSplitter config: Missing Delimiter")
+	}
+	self.delimiter = []byte(value.(string))
+	if len(self.delimiter) == 0 {
+		return errors.New("TokenSplitter config: Empty Delimiter")
+	}
+	return nil
+}
+
+func (self *TokenSplitter) Split(data []byte, atEOF bool) (int, []byte,
+	error) {
+	if i := bytes.Index(data, self.delimiter); i >= 0 {
+		return i + len(self.delimiter), data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// RegexSplitter emits records separated by matches of the `Delimiter`
+// config regular expression. If `DelimiterEOL` is true the matched text
+// is kept at the end of the preceding record.
+type RegexSplitter struct {
+	delimiter    *regexp.Regexp
+	delimiterEOL bool
+}
+
+func (self *RegexSplitter) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Delimiter"]
+	if !ok {
+		return errors.New("RegexSplitter config: Missing Delimiter")
+	}
+	if self.delimiter, err = regexp.Compile(value.(string)); err != nil {
+		return fmt.Errorf("RegexSplitter config: %s", err.Error())
+	}
+	if value, ok = (*config)["DelimiterEOL"]; ok {
+		self.delimiterEOL = value.(bool)
+	}
+	return nil
+}
+
+func (self *RegexSplitter) Split(data []byte, atEOF bool) (int, []byte,
+	error) {
+	loc := self.delimiter.FindIndex(data)
+	// A match at the very end of the buffer might continue into data we
+	// haven't seen yet
+	if loc != nil && (loc[1] < len(data) || atEOF) && loc[1] > 0 {
+		if self.delimiterEOL {
+			return loc[1], data[:loc[1]], nil
+		}
+		return loc[1], data[:loc[0]], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// MultilineSplitter joins continuation lines onto the line that starts
+// their record, so e.g. a Java or Python stack trace or a wrapped syslog
+// line becomes one record rather than one per line. A line starts a new
+// record if it matches the `StartPattern` regular expression, or, if
+// `ContinuePattern` is set instead, if it doesn't match that (e.g.
+// `^\s` for indented continuations). Records keep their inner newlines
+// but not the final one.
+//
+// Since the end of a record is only known once the next one starts, a
+// record w/ no line after it is emitted once it's been waiting for
+// `FlushTimeout` milliseconds (1000 by default), as long as the input
+// calls Split again in the meantime (LogfileInput does each time it
+// polls; stream inputs emit it when more data arrives or the stream
+// ends). Records are also cut off at `MaxLines` lines (500 by default).
+type MultilineSplitter struct {
+	startPattern    *regexp.Regexp
+	continuePattern *regexp.Regexp
+	flushTimeout    time.Duration
+	maxLines        int
+	// When the data waiting for its record to end was first seen
+	waitingSince time.Time
+	lock         sync.Mutex
+}
+
+func (self *MultilineSplitter) Init(config *PluginConfig) (err error) {
+	if value, ok := (*config)["StartPattern"]; ok {
+		self.startPattern, err = regexp.Compile(value.(string))
+	} else if value, ok = (*config)["ContinuePattern"]; ok {
+		self.continuePattern, err = regexp.Compile(value.(string))
+	} else {
+		return errors.New("MultilineSplitter config: Missing StartPattern " +
+			"or ContinuePattern")
+	}
+	if err != nil {
+		return fmt.Errorf("MultilineSplitter config: %s", err.Error())
+	}
+	self.flushTimeout, err = ConfigDuration(config, "FlushTimeout",
+		time.Millisecond, time.Second)
+	if err != nil {
+		return fmt.Errorf("MultilineSplitter config: %s", err.Error())
+	}
+	self.maxLines = 500
+	if value, ok := (*config)["MaxLines"]; ok {
+		self.maxLines = int(value.(int64))
+	}
+	if self.maxLines <= 0 {
+		return errors.New("MultilineSplitter config: MaxLines must be " +
+			"positive")
+	}
+	return nil
+}
+
+func (self *MultilineSplitter) startsRecord(line []byte) bool {
+	if self.startPattern != nil {
+		return self.startPattern.Match(line)
+	}
+	return !self.continuePattern.Match(line)
+}
+
+// Returns a record w/o its final line ending
+func (self *MultilineSplitter) record(data []byte) []byte {
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	return bytes.TrimSuffix(data, []byte("\r"))
+}
+
+func (self *MultilineSplitter) Split(data []byte, atEOF bool) (int, []byte,
+	error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	end, lines := 0, 0
+	for lines < self.maxLines {
+		i := bytes.IndexByte(data[end:], '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(data[end:end+i], []byte("\r"))
+		if lines > 0 && self.startsRecord(line) {
+			break
+		}
+		end += i + 1
+		lines++
+	}
+	if lines == self.maxLines || bytes.IndexByte(data[end:], '\n') >= 0 {
+		self.waitingSince = time.Time{}
+		return end, self.record(data[:end]), nil
+	}
+	if atEOF && len(data) > 0 {
+		self.waitingSince = time.Time{}
+		return len(data), self.record(data), nil
+	}
+	if end == 0 {
+		return 0, nil, nil
+	}
+	if self.waitingSince.IsZero() {
+		self.waitingSince = time.Now()
+	} else if time.Since(self.waitingSince) >= self.flushTimeout {
+		self.waitingSince = time.Time{}
+		return end, self.record(data[:end]), nil
+	}
+	return 0, nil, nil
+}
+
+// FramingSplitter emits records written w/ heka's framing (see
+// EncodeFrame), w/o the frame header, decompressing compressed ones (see
+// CompressFrame). When it hits a corrupt frame, i.e. a missing separator,
+// an impossible length, a checksum mismatch or a record that won't
+// decompress, it skips ahead to the next frame separator and carries on,
+// rather than giving up on the rest of the stream. Skipped bytes are
+// counted, see Skipped.
+type FramingSplitter struct {
+	skipped int64
+}
+
+func (self *FramingSplitter) Init(config *PluginConfig) error {
+	return nil
+}
+
+// Returns the number of bytes skipped over as corrupt so far
+func (self *FramingSplitter) Skipped() int64 {
+	return atomic.LoadInt64(&self.skipped)
+}
+
+// Returns the size of the frame at the start of data, 0 if more data is
+// needed to tell, or -1 if it's corrupt
+func frameAt(data []byte, atEOF bool) int {
+	if data[0] != frameSeparator {
+		return -1
+	}
+	if len(data) < frameHeaderSize {
+		if atEOF {
+			return -1
+		}
+		return 0
+	}
+	size, err := parseFrameHeader(data)
+	if err != nil {
+		return -1
+	}
+	frameSize := frameHeaderSize + size
+	if len(data) < frameSize {
+		if atEOF {
+			return -1
+		}
+		return 0
+	}
+	if checkFrame(data, data[frameHeaderSize:frameSize]) != nil {
+		return -1
+	}
+	return frameSize
+}
+
+func (self *FramingSplitter) Split(data []byte, atEOF bool) (int, []byte,
+	error) {
+	// Corrupt data is skipped here rather than by returning w/o a record,
+	// since a bufio.Scanner at EOF stops at the first call w/o one
+	skip := 0
+	for skip < len(data) {
+		frameSize := frameAt(data[skip:], atEOF)
+		if frameSize > 0 {
+			frame := data[skip : skip+frameSize]
+			record, err := frameRecord(frame, frame[frameHeaderSize:])
+			if err == nil {
+				atomic.AddInt64(&self.skipped, int64(skip))
+				return skip + frameSize, record, nil
+			}
+			// A compressed record that won't decompress is as corrupt as
+			// one failing its checksum
+			skip += frameSize
+			continue
+		}
+		if frameSize == 0 {
+			break
+		}
+		next := bytes.IndexByte(data[skip+1:], frameSeparator)
+		if next < 0 {
+			skip = len(data)
+		} else {
+			skip += next + 1
+		}
+	}
+	atomic.AddInt64(&self.skipped, int64(skip))
+	return skip, nil, nil
+}
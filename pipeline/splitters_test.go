@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+)
+
+func splitAll(splitter Splitter, data []byte) []string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Split(splitter.Split)
+	records := make([]string, 0)
+	for scanner.Scan() {
+		records = append(records, scanner.Text())
+	}
+	return records
+}
+
+func SplittersSpec(c gospec.Context) {
+	c.Specify("A NewlineSplitter", func() {
+		splitter, _ := NewSplitter("newline")
+		records := splitAll(splitter, []byte("one\ntwo\r\nthree"))
+		c.Expect(records, gs.ContainsExactly, []string{"one", "two", "three"})
+	})
+
+	c.Specify("A TokenSplitter", func() {
+		splitter, _ := NewSplitter("token")
+		config := PluginConfig{"Delimiter": "||"}
+		c.Assume(splitter.Init(&config), gs.IsNil)
+		records := splitAll(splitter, []byte("one||two||three"))
+		c.Expect(records, gs.ContainsExactly, []string{"one", "two", "three"})
+	})
+
+	c.Specify("A RegexSplitter", func() {
+		splitter, _ := NewSplitter("regex")
+		config := PluginConfig{"Delimiter": `\n-+\n`}
+		c.Assume(splitter.Init(&config), gs.IsNil)
+		records := splitAll(splitter, []byte("foo\n  bar\n---\nbaz"))
+		c.Expect(records, gs.ContainsExactly, []string{"foo\n  bar", "baz"})
+	})
+
+	c.Specify("A MultilineSplitter", func() {
+		splitter, _ := NewSplitter("multiline")
+		trace := "ERROR boom\nTraceback:\n  File \"x.py\"\n"
+
+		c.Specify("joins lines up to the next start", func() {
+			config := PluginConfig{"StartPattern": `^(INFO|ERROR) `}
+			c.Assume(splitter.Init(&config), gs.IsNil)
+			records := splitAll(splitter, []byte(trace+"INFO ok\r\n"))
+			c.Expect(records, gs.ContainsExactly, []string{
+				"ERROR boom\nTraceback:\n  File \"x.py\"", "INFO ok"})
+		})
+
+		c.Specify("treats unmatched lines as starts w/ ContinuePattern",
+			func() {
+				config := PluginConfig{"ContinuePattern": `^\s`}
+				c.Assume(splitter.Init(&config), gs.IsNil)
+				records := splitAll(splitter, []byte(trace))
+				c.Expect(records, gs.ContainsExactly, []string{"ERROR boom",
+					"Traceback:\n  File \"x.py\""})
+			})
+
+		c.Specify("waits for the flush timeout", func() {
+			config := PluginConfig{"StartPattern": `^E`,
+				"FlushTimeout": int64(0)}
+			c.Assume(splitter.Init(&config), gs.IsNil)
+			advance, record, _ := splitter.Split([]byte(trace), false)
+			c.Expect(advance, gs.Equals, 0)
+			advance, record, _ = splitter.Split([]byte(trace), false)
+			c.Expect(advance, gs.Equals, len(trace))
+			c.Expect(string(record), gs.Equals, trace[:len(trace)-1])
+		})
+
+		c.Specify("cuts records off at MaxLines", func() {
+			config := PluginConfig{"StartPattern": `^E`,
+				"MaxLines": int64(2)}
+			c.Assume(splitter.Init(&config), gs.IsNil)
+			records := splitAll(splitter, []byte(trace))
+			c.Expect(records, gs.ContainsExactly, []string{
+				"ERROR boom\nTraceback:", "  File \"x.py\""})
+		})
+	})
+
+	c.Specify("A FramingSplitter", func() {
+		splitter, _ := NewSplitter("framing")
+		msg := getTestMessage()
+		frame, err := EncodeFramedGob(msg)
+		c.Assume(err, gs.IsNil)
+		stream := append(append([]byte{}, frame...), frame...)
+
+		c.Specify("finds each frame", func() {
+			records := splitAll(splitter, stream)
+			c.Expect(len(records), gs.Equals, 2)
+			c.Expect(records[0], gs.Equals, string(frame[frameHeaderSize:]))
+		})
+
+		c.Specify("skips a truncated frame", func() {
+			records := splitAll(splitter, frame[:len(frame)-1])
+			c.Expect(len(records), gs.Equals, 0)
+			skipped := splitter.(*FramingSplitter).Skipped()
+			c.Expect(skipped, gs.Equals, int64(len(frame)-1))
+		})
+
+		c.Specify("resyncs after garbage and corrupt frames", func() {
+			corrupt := append([]byte{}, frame...)
+			corrupt[len(corrupt)-1]++
+			stream := append([]byte("junk"), corrupt...)
+			stream = append(stream, frame...)
+			records := splitAll(splitter, stream)
+			c.Expect(len(records), gs.Equals, 1)
+			c.Expect(records[0], gs.Equals, string(frame[frameHeaderSize:]))
+			skipped := splitter.(*FramingSplitter).Skipped()
+			c.Expect(skipped, gs.Equals, int64(4+len(corrupt)))
+		})
+
+		c.Specify("decompresses compressed frames", func() {
+			big := EncodeFrame(bytes.Repeat([]byte("payload "), 512))
+			compressed := CompressFrame(big, FrameCompressionGzip, 1024)
+			c.Expect(len(compressed) < len(big), gs.IsTrue)
+			c.Expect(CompressFrame(frame, FrameCompressionGzip, 1024),
+				gs.Equals, frame)
+			stream := append(append([]byte{}, compressed...), frame...)
+			records := splitAll(splitter, stream)
+			c.Expect(len(records), gs.Equals, 2)
+			c.Expect(records[0], gs.Equals, string(big[frameHeaderSize:]))
+			record, err := ReadFrame(bytes.NewReader(compressed))
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(record), gs.Equals, records[0])
+		})
+	})
+}
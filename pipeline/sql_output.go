@@ -0,0 +1,382 @@
+//go:build !nosqloutput
+// +build !nosqloutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	. "heka/message"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("SqlOutput", func() interface{} {
+		return new(SqlOutput)
+	})
+}
+
+// Table and column names are quoted, but are also restricted to plain
+// identifiers so they can't be used to inject SQL
+var sqlIdentifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// A table column and the message variable (see MessageVariable) it's
+// filled from
+type sqlColumn struct {
+	name     string
+	variable string
+	sqlType  string
+	// The representation the field's value is converted to, if any
+	unit string
+}
+
+// SqlOutput writes messages as rows of the `Table` table in a SQLite or
+// PostgreSQL database, for querying logs w/ SQL. `Driver` is "sqlite3"
+// (the default) or "postgres", and `DataSource` is the driver's
+// connection string, e.g. a file path or
+// "postgres://heka@db/logs?sslmode=disable".
+//
+// `Columns` maps the table's columns to message variables, in order:
+//
+//	"Columns": [
+//		{"Name": "ts", "Field": "Timestamp"},
+//		{"Name": "host", "Field": "Hostname"},
+//		{"Name": "status", "Field": "Fields[status]", "Type": "INTEGER"}
+//	]
+//
+// Missing fields are written as NULL, and fields holding objects or lists
+// as JSON. A column w/ a `Unit`, e.g. "ms", gets the field's value
+// converted to that representation (see Representation) from the field's
+// own, so e.g. latencies recorded in "s" and "us" by different inputs
+// land in the same units; fields w/o a representation are taken to be in
+// the column's already, and values that can't be converted are NULL.
+// Unless `CreateTable` is false the table is created if it doesn't exist,
+// w/ each column's `Type` (TIMESTAMP for the timestamp, INTEGER for the
+// severity and pid, REAL for columns w/ a unit, and TEXT otherwise, by
+// default).
+//
+// Rows are inserted w/ a prepared statement, in transactions of up to
+// `BatchSize` rows (100 by default) committed at least every
+// `FlushInterval` (1s by default). Up to `QueueSize` messages (1000 by
+// default) wait while the database is slow or down; messages that don't
+// fit are dropped and counted.
+type SqlOutput struct {
+	dryRunnable
+	driver        string
+	dataSource    string
+	table         string
+	columns       []sqlColumn
+	createTable   bool
+	batchSize     int
+	queueSize     int
+	flushInterval time.Duration
+	db            *sql.DB
+	insert        *sql.Stmt
+	msgChan       chan *Message
+	drainChan     chan chan error
+	pending       []*Message
+	dropped       int64
+}
+
+func (self *SqlOutput) Init(config *PluginConfig) error {
+	self.driver = "sqlite3"
+	if value, ok := (*config)["Driver"]; ok {
+		self.driver = value.(string)
+	}
+	if self.driver != "sqlite3" && self.driver != "postgres" {
+		return fmt.Errorf("SqlOutput config: Unknown Driver: %s", self.driver)
+	}
+	value, ok := (*config)["DataSource"]
+	if !ok {
+		return errors.New("SqlOutput config: Missing DataSource")
+	}
+	self.dataSource = value.(string)
+	if value, ok = (*config)["Table"]; !ok {
+		return errors.New("SqlOutput config: Missing Table")
+	}
+	self.table = value.(string)
+	if !sqlIdentifierRegex.MatchString(self.table) {
+		return fmt.Errorf("SqlOutput config: Invalid Table: %s", self.table)
+	}
+	if err := self.initColumns(config); err != nil {
+		return fmt.Errorf("SqlOutput config: %s", err.Error())
+	}
+	self.createTable = true
+	if value, ok = (*config)["CreateTable"]; ok {
+		self.createTable = value.(bool)
+	}
+	self.batchSize = 100
+	if value, ok = (*config)["BatchSize"]; ok {
+		self.batchSize = int(value.(int64))
+	}
+	self.queueSize = 1000
+	if value, ok = (*config)["QueueSize"]; ok {
+		self.queueSize = int(value.(int64))
+	}
+	if self.batchSize < 1 || self.queueSize < 1 {
+		return errors.New("SqlOutput config: BatchSize and QueueSize must " +
+			"be positive")
+	}
+	var err error
+	self.flushInterval, err = ConfigDuration(config, "FlushInterval",
+		time.Millisecond, time.Second)
+	if err != nil {
+		return fmt.Errorf("SqlOutput config: %s", err.Error())
+	}
+	self.msgChan = make(chan *Message, self.queueSize)
+	self.drainChan = make(chan chan error)
+	return nil
+}
+
+func (self *SqlOutput) initColumns(config *PluginConfig) error {
+	value, ok := (*config)["Columns"]
+	if !ok {
+		return errors.New("Missing Columns")
+	}
+	items, ok := value.([]interface{})
+	if !ok || len(items) == 0 {
+		return errors.New("Columns must be a list of objects")
+	}
+	for i, item := range items {
+		spec, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Column %d isn't an object", i)
+		}
+		var column sqlColumn
+		column.name, _ = spec["Name"].(string)
+		if !sqlIdentifierRegex.MatchString(column.name) {
+			return fmt.Errorf("Column %d has an invalid Name: '%s'", i,
+				column.name)
+		}
+		column.variable, _ = spec["Field"].(string)
+		if !isMessageVariable(column.variable) {
+			return fmt.Errorf("Column %s has an invalid Field: '%s'",
+				column.name, column.variable)
+		}
+		if column.unit, _ = spec["Unit"].(string); column.unit != "" {
+			repr, ok := GetRepresentation(column.unit)
+			if !ok || !repr.Numeric() || !strings.HasPrefix(column.variable,
+				"Fields[") {
+				return fmt.Errorf("Column %s has an invalid Unit: '%s'",
+					column.name, column.unit)
+			}
+		}
+		column.sqlType, _ = spec["Type"].(string)
+		if column.sqlType == "" && column.unit != "" {
+			column.sqlType = "REAL"
+		}
+		if column.sqlType == "" {
+			switch column.variable {
+			case "Timestamp":
+				column.sqlType = "TIMESTAMP"
+			case "Severity", "Pid":
+				column.sqlType = "INTEGER"
+			default:
+				column.sqlType = "TEXT"
+			}
+		}
+		self.columns = append(self.columns, column)
+	}
+	return nil
+}
+
+// Returns the CREATE TABLE and INSERT statements for the table
+func (self *SqlOutput) statements() (create, insert string) {
+	defs := make([]string, len(self.columns))
+	names := make([]string, len(self.columns))
+	params := make([]string, len(self.columns))
+	for i, column := range self.columns {
+		names[i] = `"` + column.name + `"`
+		defs[i] = names[i] + " " + column.sqlType
+		if self.driver == "postgres" {
+			params[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			params[i] = "?"
+		}
+	}
+	create = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (%s)`, self.table,
+		strings.Join(defs, ", "))
+	insert = fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES (%s)`, self.table,
+		strings.Join(names, ", "), strings.Join(params, ", "))
+	return
+}
+
+// Connects, creates the table and prepares the insert. This happens here
+// rather than in Init so configs can be validated w/o a database.
+func (self *SqlOutput) Prepare() (err error) {
+	if self.dryRun != nil {
+		// Rows are only rendered, so there's no need for a database
+		go self.writer()
+		return nil
+	}
+	if self.db, err = sql.Open(self.driver, self.dataSource); err != nil {
+		return
+	}
+	create, insert := self.statements()
+	if self.createTable {
+		if _, err = self.db.Exec(create); err != nil {
+			return fmt.Errorf("Error creating table %s: %s", self.table,
+				err.Error())
+		}
+	}
+	if self.insert, err = self.db.Prepare(insert); err != nil {
+		return fmt.Errorf("Error preparing insert into %s: %s", self.table,
+			err.Error())
+	}
+	go self.writer()
+	return nil
+}
+
+func (self *SqlOutput) Deliver(pipelinePack *PipelinePack) {
+	// Copied, since the pack will be recycled as soon as Deliver returns
+	msg := new(Message)
+	pipelinePack.Message.Copy(msg)
+	select {
+	case self.msgChan <- msg:
+	default:
+		atomic.AddInt64(&self.dropped, 1)
+	}
+}
+
+// Returns a message's row
+func (self *SqlOutput) row(msg *Message) []interface{} {
+	values := make([]interface{}, len(self.columns))
+	for i, column := range self.columns {
+		if column.variable == "Timestamp" {
+			values[i] = msg.Timestamp
+			continue
+		}
+		if column.unit != "" {
+			field := column.variable[7 : len(column.variable)-1]
+			if num, err := msg.FieldValueIn(field, column.unit); err == nil {
+				values[i] = num
+			}
+			continue
+		}
+		value, ok := MessageVariable(msg, column.variable)
+		if !ok {
+			continue
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			if data, err := json.Marshal(value); err == nil {
+				value = string(data)
+			} else {
+				value = nil
+			}
+		}
+		values[i] = value
+	}
+	return values
+}
+
+// Writes up to a batch of the pending messages in a single transaction
+func (self *SqlOutput) flushBatch() error {
+	batch := self.pending
+	if len(batch) > self.batchSize {
+		batch = batch[:self.batchSize]
+	}
+	if self.dryRun != nil {
+		for _, msg := range batch {
+			self.dryRun.Skip([]byte(fmt.Sprint(self.row(msg))))
+		}
+		self.pending = self.pending[len(batch):]
+		return nil
+	}
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := tx.Stmt(self.insert)
+	for _, msg := range batch {
+		if _, err = stmt.Exec(self.row(msg)...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	self.pending = self.pending[len(batch):]
+	return nil
+}
+
+// Writes all the pending messages
+func (self *SqlOutput) flush() error {
+	for len(self.pending) > 0 {
+		if err := self.flushBatch(); err != nil {
+			return err
+		}
+	}
+	self.pending = nil
+	return nil
+}
+
+// Writes out any queued messages
+func (self *SqlOutput) Drain() error {
+	done := make(chan error)
+	self.drainChan <- done
+	return <-done
+}
+
+func (self *SqlOutput) Report() map[string]interface{} {
+	return map[string]interface{}{
+		"queued":  len(self.msgChan),
+		"dropped": atomic.LoadInt64(&self.dropped),
+	}
+}
+
+// All writes happen on this goroutine
+func (self *SqlOutput) writer() {
+	ticker := time.NewTicker(self.flushInterval)
+	logError := func(err error) {
+		if err != nil {
+			log.Printf("SqlOutput error writing %d messages to %s: %s\n",
+				len(self.pending), self.table, err.Error())
+		}
+	}
+	for {
+		select {
+		case msg := <-self.msgChan:
+			// While the database is failing, the oldest messages give way
+			if len(self.pending) >= self.queueSize {
+				self.pending = self.pending[1:]
+				atomic.AddInt64(&self.dropped, 1)
+			}
+			self.pending = append(self.pending, msg)
+			if len(self.pending) >= self.batchSize {
+				logError(self.flushBatch())
+			}
+		case <-ticker.C:
+			logError(self.flush())
+		case done := <-self.drainChan:
+			for queued := len(self.msgChan); queued > 0; queued-- {
+				self.pending = append(self.pending, <-self.msgChan)
+			}
+			done <- self.flush()
+		}
+	}
+}
@@ -0,0 +1,362 @@
+//go:build !nosqliteoutput
+// +build !nosqliteoutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	. "heka/message"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("SqliteOutput", func() interface{} {
+		return new(SqliteOutput)
+	})
+}
+
+// Bumped whenever sqliteSchema changes; stored as the database's
+// user_version
+const sqliteSchemaVersion = 1
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		logger TEXT NOT NULL,
+		severity INTEGER NOT NULL,
+		hostname TEXT NOT NULL,
+		pid INTEGER NOT NULL,
+		env_version TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		fields TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS messages_timestamp ON messages (timestamp)`,
+	`CREATE INDEX IF NOT EXISTS messages_type ON messages (type, timestamp)`,
+	`CREATE INDEX IF NOT EXISTS messages_logger ON messages (logger, timestamp)`,
+}
+
+const sqliteInsert = `INSERT INTO messages (timestamp, type, logger,
+	severity, hostname, pid, env_version, payload, fields)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// SqliteOutput stores messages in the SQLite database at `Path`, giving
+// single host deployments durable, searchable logs. The plugin creates
+// and upgrades the schema itself, and deletes messages older than
+// `Retention` seconds (7 days by default). Inserts are batched, and
+// committed every `FlushInterval` milliseconds (1000 by default).
+//
+// If `Address` is set, the messages can be queried over HTTP:
+//
+//	GET /messages?type=nginx.access&severity=3&since=1357139045&q=timeout
+//
+// `type`, `logger` and `hostname` match exactly, `severity` returns
+// messages of that severity or worse, `since` and `until` limit the time
+// range (RFC 3339 or Unix seconds), `q` searches the payload, `match`
+// applies a matcher expression (see MessageMatcher) and `limit` (100 by
+// default) caps the number of results, newest first.
+type SqliteOutput struct {
+	dryRunnable
+	path          string
+	retention     time.Duration
+	flushInterval time.Duration
+	address       string
+	db            *sql.DB
+	msgChan       chan *Message
+	drainChan     chan chan error
+	pending       []*Message
+}
+
+func (self *SqliteOutput) Init(config *PluginConfig) error {
+	value, ok := (*config)["Path"]
+	if !ok {
+		return errors.New("SqliteOutput config: Missing Path")
+	}
+	self.path = value.(string)
+	var err error
+	self.retention, err = ConfigDuration(config, "Retention", time.Second,
+		7*24*time.Hour)
+	if err != nil {
+		return fmt.Errorf("SqliteOutput config: %s", err.Error())
+	}
+	self.flushInterval, err = ConfigDuration(config, "FlushInterval",
+		time.Millisecond, time.Second)
+	if err != nil {
+		return fmt.Errorf("SqliteOutput config: %s", err.Error())
+	}
+	if value, ok = (*config)["Address"]; ok {
+		self.address = value.(string)
+	}
+	self.msgChan = make(chan *Message, 1000)
+	self.drainChan = make(chan chan error)
+	return nil
+}
+
+// Opens the database and starts the writer and query server. This happens
+// here rather than in Init so configs can be validated w/o touching the
+// database.
+func (self *SqliteOutput) Prepare() (err error) {
+	if self.db, err = sql.Open("sqlite3", self.path); err != nil {
+		return
+	}
+	// SQLite only allows one writer at a time anyway
+	self.db.SetMaxOpenConns(1)
+	if err = self.migrate(); err != nil {
+		return fmt.Errorf("Error setting up %s: %s", self.path, err.Error())
+	}
+	if self.address != "" {
+		var listener net.Listener
+		if file := InheritedFile(self.address); file != nil {
+			listener, err = net.FileListener(file)
+			file.Close()
+		} else {
+			listener, err = net.Listen("tcp", self.address)
+		}
+		if err != nil {
+			return
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/messages", self.serveMessages)
+		go func() {
+			err := http.Serve(listener, mux)
+			log.Printf("SqliteOutput %s stopped: %s\n", self.address,
+				err.Error())
+		}()
+	}
+	go self.writer()
+	return nil
+}
+
+// Brings the schema up to date
+func (self *SqliteOutput) migrate() error {
+	var version int
+	if err := self.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > sqliteSchemaVersion {
+		return fmt.Errorf("schema version %d is newer than this hekad (%d)",
+			version, sqliteSchemaVersion)
+	}
+	for _, statement := range sqliteSchema {
+		if _, err := self.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	_, err := self.db.Exec(fmt.Sprintf("PRAGMA user_version = %d",
+		sqliteSchemaVersion))
+	return err
+}
+
+func (self *SqliteOutput) Deliver(pipelinePack *PipelinePack) {
+	// Copied, since the pack will be recycled as soon as Deliver returns
+	msg := new(Message)
+	pipelinePack.Message.Copy(msg)
+	self.msgChan <- msg
+}
+
+// Writes the pending messages in a single transaction
+func (self *SqliteOutput) flush() error {
+	if len(self.pending) == 0 {
+		return nil
+	}
+	if self.dryRun != nil {
+		for _, msg := range self.pending {
+			self.dryRun.Skip([]byte(msg.String()))
+		}
+		self.pending = self.pending[:0]
+		return nil
+	}
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(sqliteInsert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, msg := range self.pending {
+		fieldsJson, err := json.Marshal(msg.Fields)
+		if err != nil {
+			fieldsJson = []byte("{}")
+		}
+		_, err = stmt.Exec(msg.Timestamp.UnixNano(), msg.Type, msg.Logger,
+			msg.Severity, msg.Hostname, msg.Pid, msg.Env_version, msg.Payload,
+			string(fieldsJson))
+		if err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	self.pending = self.pending[:0]
+	return nil
+}
+
+func (self *SqliteOutput) expire() error {
+	cutoff := time.Now().Add(-self.retention).UnixNano()
+	_, err := self.db.Exec("DELETE FROM messages WHERE timestamp < ?", cutoff)
+	return err
+}
+
+// Writes out any queued messages
+func (self *SqliteOutput) Drain() error {
+	done := make(chan error)
+	self.drainChan <- done
+	return <-done
+}
+
+// All writes happen on this goroutine
+func (self *SqliteOutput) writer() {
+	flushTicker := time.NewTicker(self.flushInterval)
+	expireTicker := time.NewTicker(time.Minute)
+	for {
+		select {
+		case msg := <-self.msgChan:
+			self.pending = append(self.pending, msg)
+		case <-flushTicker.C:
+			if err := self.flush(); err != nil {
+				log.Printf("SqliteOutput error writing %d messages: %s\n",
+					len(self.pending), err.Error())
+			}
+		case <-expireTicker.C:
+			if err := self.expire(); err != nil {
+				log.Printf("SqliteOutput error expiring messages: %s\n",
+					err.Error())
+			}
+		case done := <-self.drainChan:
+			for queued := len(self.msgChan); queued > 0; queued-- {
+				self.pending = append(self.pending, <-self.msgChan)
+			}
+			done <- self.flush()
+		}
+	}
+}
+
+// A parsed /messages query. The matcher, if any, is applied to the rows
+// the SQL returns, so the SQL can't apply the limit in that case.
+type sqliteQuery struct {
+	sql     string
+	args    []interface{}
+	matcher *MessageMatcher
+	limit   int
+}
+
+func parseSqliteQuery(req *http.Request) (*sqliteQuery, error) {
+	where := make([]string, 0)
+	query := &sqliteQuery{args: make([]interface{}, 0), limit: 100}
+	var err error
+	for key, values := range req.URL.Query() {
+		value := values[0]
+		switch key {
+		case "type", "logger", "hostname":
+			where = append(where, key+" = ?")
+			query.args = append(query.args, value)
+		case "severity":
+			var severity int
+			if severity, err = strconv.Atoi(value); err == nil {
+				where = append(where, "severity <= ?")
+				query.args = append(query.args, severity)
+			}
+		case "since", "until":
+			var t time.Time
+			if t, err = parseQueryTime(value); err == nil {
+				op := ">="
+				if key == "until" {
+					op = "<="
+				}
+				where = append(where, "timestamp "+op+" ?")
+				query.args = append(query.args, t.UnixNano())
+			}
+		case "q":
+			where = append(where, "payload LIKE ? ESCAPE '\\'")
+			escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).
+				Replace(value)
+			query.args = append(query.args, "%"+escaped+"%")
+		case "match":
+			query.matcher, err = NewMessageMatcher(value)
+		case "limit":
+			query.limit, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("Unknown query parameter: %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	query.sql = "SELECT timestamp, type, logger, severity, hostname, pid, " +
+		"env_version, payload, fields FROM messages"
+	if len(where) > 0 {
+		query.sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	query.sql += " ORDER BY timestamp DESC"
+	if query.matcher == nil {
+		query.sql += fmt.Sprintf(" LIMIT %d", query.limit)
+	}
+	return query, nil
+}
+
+func (self *SqliteOutput) serveMessages(w http.ResponseWriter,
+	req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := parseSqliteQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := self.db.Query(query.sql, query.args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	msgs := make([]*Message, 0)
+	for len(msgs) < query.limit && rows.Next() {
+		msg := new(Message)
+		var timestamp int64
+		var fieldsJson string
+		err = rows.Scan(&timestamp, &msg.Type, &msg.Logger, &msg.Severity,
+			&msg.Hostname, &msg.Pid, &msg.Env_version, &msg.Payload,
+			&fieldsJson)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		msg.Timestamp = time.Unix(0, timestamp)
+		json.Unmarshal([]byte(fieldsJson), &msg.Fields)
+		if query.matcher == nil || query.matcher.Match(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+	writeMessagesJson(w, msgs)
+}
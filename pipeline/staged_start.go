@@ -0,0 +1,109 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// How often a staged start checks the plugins' health, and how often it
+// logs the ones still failing
+const (
+	stagedCheckInterval = time.Second
+	stagedLogInterval   = 30 * time.Second
+)
+
+// Plugins that depend on something outside the process (e.g. a peer to
+// deliver to) can implement HealthChecker, so a staged start waits for
+// them to be ready. Healthy returns nil once the plugin can do its job.
+type HealthChecker interface {
+	Healthy() error
+}
+
+// The StagedStart modes. W/ a staged start the inputs are held when the
+// pipeline starts, so a restart w/ a large backlog doesn't hit the
+// decoders and outputs all at once before they're ready for it. The
+// filters, encoders and outputs are started and their health checked
+// (see HealthChecker) every stagedCheckInterval; once they're all healthy
+// the inputs are released, or for StagedStartManual the pipeline logs
+// that it's ready and waits for a "release" control message.
+const (
+	StagedStartAuto   = "auto"
+	StagedStartManual = "manual"
+)
+
+// Returns an error naming the filters, encoders and outputs that aren't
+// healthy, if any
+func checkHealth(plugins []namedPlugin) error {
+	unhealthy := make([]string, 0)
+	for _, p := range plugins {
+		checker, ok := p.plugin.(HealthChecker)
+		if !ok || p.kind == "input" || p.kind == "decoder" {
+			continue
+		}
+		if err := runRecovered(checker.Healthy); err != nil {
+			unhealthy = append(unhealthy, p.kind+" "+p.name+": "+err.Error())
+		}
+	}
+	if len(unhealthy) > 0 {
+		return errors.New(strings.Join(unhealthy, "; "))
+	}
+	return nil
+}
+
+// Holds the inputs until they're released
+func (self *pluginSwitches) Hold() {
+	self.lock.Lock()
+	self.held = true
+	self.lock.Unlock()
+	log.Println("Staged start, inputs held")
+}
+
+// Releases the inputs held for a staged start
+func (self *pluginSwitches) Release() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.held {
+		return errors.New("Inputs aren't held")
+	}
+	self.held = false
+	log.Println("Inputs released")
+	return nil
+}
+
+// Waits for the plugins to be healthy and then, in StagedStartAuto mode,
+// releases the inputs
+func (self *pluginSwitches) stagedStart(plugins []namedPlugin, mode string) {
+	lastLog := time.Now()
+	for {
+		err := checkHealth(plugins)
+		if err == nil {
+			break
+		}
+		if time.Since(lastLog) >= stagedLogInterval {
+			log.Printf("Staged start waiting on %s\n", err.Error())
+			lastLog = time.Now()
+		}
+		time.Sleep(stagedCheckInterval)
+	}
+	if mode == StagedStartManual {
+		log.Println("Staged start ready, waiting for release control " +
+			"message")
+		return
+	}
+	self.Release()
+}
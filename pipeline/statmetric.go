@@ -0,0 +1,233 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	. "heka/message"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The type of messages carrying a metric (see Metric)
+const StatMetricType = "statmetric"
+
+// Metric types
+const (
+	MetricCounter = "counter"
+	MetricGauge   = "gauge"
+	MetricTimer   = "timer"
+)
+
+// Prefix of the fields holding a metric's tags
+const metricTagPrefix = "tags."
+
+// Metric names, tag keys and tag values can't contain whitespace or the
+// characters used to separate them
+var metricNameRegex = regexp.MustCompile(`^[^\s=]+$`)
+
+// A Metric is a single measurement, in the form every plugin dealing w/
+// metrics shares. As a message it has type "statmetric", the metric's
+// timestamp, and fields "name", "value" (a float64), "metric_type"
+// (counter, gauge or timer) and "tags.<key>" for each tag. Timer values
+// are in milliseconds, and their "value" field has the "ms" representation;
+// a timer message whose value has another time representation is
+// converted to milliseconds when it's read back as a Metric.
+//
+// The statmetric text format is a line per metric:
+//
+//	<name> <value> <type> <unix timestamp> [<tag>=<value> ...]
+//
+// e.g. "web.requests 42 counter 1350000000 host=web1 env=prod".
+type Metric struct {
+	Name      string
+	Value     float64
+	Type      string
+	Tags      map[string]string
+	Timestamp time.Time
+}
+
+// Checks the metric is well formed
+func (self *Metric) Validate() error {
+	if !metricNameRegex.MatchString(self.Name) {
+		return fmt.Errorf("Invalid metric name: '%s'", self.Name)
+	}
+	switch self.Type {
+	case MetricCounter, MetricGauge, MetricTimer:
+	default:
+		return fmt.Errorf("Invalid metric type: '%s'", self.Type)
+	}
+	if math.IsNaN(self.Value) || math.IsInf(self.Value, 0) {
+		return fmt.Errorf("Invalid metric value: %v", self.Value)
+	}
+	for key, value := range self.Tags {
+		if !metricNameRegex.MatchString(key) ||
+			!metricNameRegex.MatchString(value) {
+			return fmt.Errorf("Invalid metric tag: '%s=%s'", key, value)
+		}
+	}
+	return nil
+}
+
+// Returns the metric as a statmetric message
+func (self *Metric) Message() *Message {
+	hostname, _ := os.Hostname()
+	msg := &Message{
+		Type:      StatMetricType,
+		Timestamp: self.Timestamp,
+		Logger:    "hekad",
+		Severity:  SEVERITY_INFO,
+		Pid:       os.Getpid(),
+		Hostname:  hostname,
+		Fields: map[string]interface{}{
+			"name":        self.Name,
+			"value":       self.Value,
+			"metric_type": self.Type,
+		},
+	}
+	for key, value := range self.Tags {
+		msg.Fields[metricTagPrefix+key] = value
+	}
+	if self.Type == MetricTimer {
+		msg.Representations = map[string]string{"value": "ms"}
+	}
+	return msg
+}
+
+// Extracts the metric from a statmetric message
+func MetricFromMessage(msg *Message) (*Metric, error) {
+	if msg.Type != StatMetricType {
+		return nil, fmt.Errorf("Not a %s message: %s", StatMetricType,
+			msg.Type)
+	}
+	metric := &Metric{Timestamp: msg.Timestamp}
+	metric.Name, _ = msg.Fields["name"].(string)
+	metric.Type, _ = msg.Fields["metric_type"].(string)
+	value, err := toFloat64(msg.Fields["value"])
+	if err == nil && metric.Type == MetricTimer &&
+		msg.FieldRepresentation("value") != "" {
+		value, err = msg.FieldValueIn("value", "ms")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metric value: %v",
+			msg.Fields["value"])
+	}
+	metric.Value = value
+	for name, value := range msg.Fields {
+		if strings.HasPrefix(name, metricTagPrefix) {
+			if metric.Tags == nil {
+				metric.Tags = make(map[string]string)
+			}
+			metric.Tags[name[len(metricTagPrefix):]] = fmt.Sprint(value)
+		}
+	}
+	if err = metric.Validate(); err != nil {
+		return nil, err
+	}
+	return metric, nil
+}
+
+// Parses a line of the statmetric text format
+func ParseMetric(line string) (*Metric, error) {
+	parts := strings.Fields(line)
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("Invalid metric line: '%s'", line)
+	}
+	metric := &Metric{Name: parts[0], Type: parts[2]}
+	value, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metric value: '%s'", parts[1])
+	}
+	metric.Value = value
+	seconds, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metric timestamp: '%s'", parts[3])
+	}
+	metric.Timestamp = time.Unix(seconds, 0)
+	for _, tag := range parts[4:] {
+		pair := strings.SplitN(tag, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Invalid metric tag: '%s'", tag)
+		}
+		if metric.Tags == nil {
+			metric.Tags = make(map[string]string)
+		}
+		metric.Tags[pair[0]] = pair[1]
+	}
+	if err = metric.Validate(); err != nil {
+		return nil, err
+	}
+	return metric, nil
+}
+
+// Returns the metric as a line of the statmetric text format, w/ its tags
+// sorted
+func (self *Metric) String() string {
+	buffer := new(bytes.Buffer)
+	fmt.Fprintf(buffer, "%s %s %s %d", self.Name,
+		strconv.FormatFloat(self.Value, 'f', -1, 64), self.Type,
+		self.Timestamp.Unix())
+	keys := make([]string, 0, len(self.Tags))
+	for key := range self.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(buffer, " %s=%s", key, self.Tags[key])
+	}
+	return buffer.String()
+}
+
+// StatMetricDecoder decodes a line of the statmetric text format (see
+// Metric) into a statmetric message
+type StatMetricDecoder struct {
+}
+
+func (self *StatMetricDecoder) Init(config *PluginConfig) error {
+	return nil
+}
+
+func (self *StatMetricDecoder) Decode(pipelinePack *PipelinePack) error {
+	metric, err := ParseMetric(string(pipelinePack.MsgBytes))
+	if err != nil {
+		return err
+	}
+	*pipelinePack.Message = *metric.Message()
+	pipelinePack.Decoded = true
+	return nil
+}
+
+// StatMetricEncoder emits statmetric messages in the statmetric text
+// format, one line each. Other messages can't be encoded.
+type StatMetricEncoder struct {
+}
+
+func (self *StatMetricEncoder) Init(config *PluginConfig) error {
+	return nil
+}
+
+func (self *StatMetricEncoder) Encode(pipelinePack *PipelinePack) ([]byte,
+	error) {
+	metric, err := MetricFromMessage(pipelinePack.Message)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(metric.String() + "\n"), nil
+}
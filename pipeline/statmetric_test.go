@@ -0,0 +1,113 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"math"
+	"time"
+)
+
+func StatMetricSpec(c gospec.Context) {
+	line := "web.requests 42.5 counter 1350000000 host=web1 env=prod"
+
+	c.Specify("A metric line", func() {
+		c.Specify("is parsed", func() {
+			metric, err := ParseMetric(line)
+			c.Expect(err, gs.IsNil)
+			c.Expect(metric.Name, gs.Equals, "web.requests")
+			c.Expect(metric.Value, gs.Equals, 42.5)
+			c.Expect(metric.Type, gs.Equals, MetricCounter)
+			c.Expect(metric.Timestamp.Unix(), gs.Equals, int64(1350000000))
+			c.Expect(metric.Tags["host"], gs.Equals, "web1")
+			c.Expect(metric.Tags["env"], gs.Equals, "prod")
+		})
+
+		c.Specify("round trips w/ sorted tags", func() {
+			metric, _ := ParseMetric(line)
+			c.Expect(metric.String(), gs.Equals,
+				"web.requests 42.5 counter 1350000000 env=prod host=web1")
+		})
+
+		c.Specify("is rejected when malformed", func() {
+			for _, bad := range []string{
+				"web.requests 42",
+				"web.requests forty counter 1350000000",
+				"web.requests 42 histogram 1350000000",
+				"web.requests 42 counter soon",
+				"web.requests 42 counter 1350000000 host",
+				"web.requests NaN counter 1350000000",
+			} {
+				_, err := ParseMetric(bad)
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+	})
+
+	c.Specify("A metric", func() {
+		metric := &Metric{Name: "queue.depth", Value: 7, Type: MetricGauge,
+			Tags: map[string]string{"queue": "mail"}, Timestamp: time.Now()}
+
+		c.Specify("survives a message round trip", func() {
+			msg := metric.Message()
+			c.Expect(msg.Type, gs.Equals, StatMetricType)
+			c.Expect(msg.Fields["tags.queue"], gs.Equals, "mail")
+			copy, err := MetricFromMessage(msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(copy.Name, gs.Equals, metric.Name)
+			c.Expect(copy.Value, gs.Equals, metric.Value)
+			c.Expect(copy.Type, gs.Equals, metric.Type)
+			c.Expect(copy.Tags["queue"], gs.Equals, "mail")
+		})
+
+		c.Specify("is read back from a timer in milliseconds", func() {
+			metric.Type = MetricTimer
+			msg := metric.Message()
+			c.Expect(msg.FieldRepresentation("value"), gs.Equals, "ms")
+			msg.ReplaceFieldWithRepresentation("value", 1.5, "s")
+			timer, err := MetricFromMessage(msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(timer.Value, gs.Equals, 1500.0)
+		})
+
+		c.Specify("is validated", func() {
+			metric.Value = math.Inf(1)
+			c.Expect(metric.Validate(), gs.Not(gs.IsNil))
+			metric.Value = 7
+			metric.Tags["bad key"] = "x"
+			c.Expect(metric.Validate(), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("isn't read from other messages", func() {
+			_, err := MetricFromMessage(&Message{Type: "logfile"})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("The decoder and encoder", func() {
+		decoder := new(StatMetricDecoder)
+		encoder := new(StatMetricEncoder)
+		pack := &PipelinePack{MsgBytes: []byte(line), Message: new(Message)}
+		err := decoder.Decode(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(pack.Decoded, gs.Equals, true)
+		c.Expect(pack.Message.Fields["name"], gs.Equals, "web.requests")
+		output, err := encoder.Encode(pack)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(output), gs.Equals,
+			"web.requests 42.5 counter 1350000000 env=prod host=web1\n")
+	})
+}
@@ -0,0 +1,165 @@
+//go:build !nostatsfilter
+// +build !nostatsfilter
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	. "heka/message"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("StatsFilter", func() interface{} {
+		return new(StatsFilter)
+	})
+}
+
+// StatsFilter counts the messages matching its `Matcher` (every message,
+// if not set) and, every `FlushInterval` (60s by default), injects
+// a summary message of type `Type` ("heka.stats" by default) w/ the
+// "count" as a field. If `Field` names a numeric message variable, e.g.
+// "Fields[latency]", its "min", "max", "avg" and "sum" are included too,
+// over the messages that had a numeric value for it.
+//
+// A summary is sent for every interval, even an empty one, so a missing
+// event stream can be alerted on. The filter never counts its own
+// summaries.
+type StatsFilter struct {
+	helper        PluginHelper
+	matcher       *MessageMatcher
+	field         string
+	msgType       string
+	flushInterval time.Duration
+	count         int64
+	values        int64
+	min, max, sum float64
+	lock          sync.Mutex
+}
+
+type StatsFilterConfig struct {
+	Matcher       string
+	Field         string
+	Type          string        `default:"heka.stats"`
+	FlushInterval time.Duration `default:"60s" min:"1s"`
+}
+
+func (self *StatsFilter) Init(config *PluginConfig) (err error) {
+	conf := new(StatsFilterConfig)
+	if err = LoadConfigStruct(config, conf); err != nil {
+		return fmt.Errorf("StatsFilter config: %s", err.Error())
+	}
+	if conf.Matcher != "" {
+		if self.matcher, err = NewMessageMatcher(conf.Matcher); err != nil {
+			return fmt.Errorf("StatsFilter config: %s", err.Error())
+		}
+	}
+	if conf.Field != "" && !isMessageVariable(conf.Field) {
+		return fmt.Errorf("StatsFilter config: Invalid Field: %s", conf.Field)
+	}
+	self.field = conf.Field
+	self.msgType = conf.Type
+	self.flushInterval = conf.FlushInterval
+	return nil
+}
+
+func (self *StatsFilter) SetPluginHelper(helper PluginHelper) {
+	self.helper = helper
+}
+
+// Starts the flush timer
+func (self *StatsFilter) Prepare() error {
+	if self.helper == nil {
+		return errors.New("StatsFilter needs a PluginHelper")
+	}
+	go func() {
+		for _ = range time.Tick(self.flushInterval) {
+			self.Flush()
+		}
+	}()
+	return nil
+}
+
+func (self *StatsFilter) FilterMsg(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	if msg.Type == self.msgType {
+		return
+	}
+	if self.matcher != nil && !self.matcher.Match(msg) {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.count++
+	if self.field == "" {
+		return
+	}
+	value, ok := MessageVariable(msg, self.field)
+	if !ok {
+		return
+	}
+	num, err := toFloat64(value)
+	if err != nil {
+		return
+	}
+	if self.values == 0 || num < self.min {
+		self.min = num
+	}
+	if self.values == 0 || num > self.max {
+		self.max = num
+	}
+	self.values++
+	self.sum += num
+}
+
+// Injects the summary for the current interval and starts a new one
+func (self *StatsFilter) Flush() {
+	self.lock.Lock()
+	fields := map[string]interface{}{
+		"count":    self.count,
+		"interval": int64(self.flushInterval / time.Second),
+	}
+	if self.field != "" {
+		fields["field"] = self.field
+		if self.values > 0 {
+			fields["min"] = self.min
+			fields["max"] = self.max
+			fields["sum"] = self.sum
+			fields["avg"] = self.sum / float64(self.values)
+		}
+	}
+	self.count, self.values, self.sum = 0, 0, 0
+	self.lock.Unlock()
+
+	hostname, _ := os.Hostname()
+	payload := fmt.Sprintf("%d messages", fields["count"])
+	if self.matcher != nil {
+		payload += " matching " + self.matcher.String()
+	}
+	self.helper.InjectMessage(&Message{
+		Type:      self.msgType,
+		Timestamp: self.helper.Now(),
+		Logger:    "hekad",
+		Severity:  SEVERITY_INFO,
+		Payload:   payload,
+		Pid:       os.Getpid(),
+		Hostname:  hostname,
+		Fields:    fields,
+	})
+}
@@ -0,0 +1,161 @@
+//go:build !nostdio
+// +build !nostdio
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("StdinInput", func() interface{} {
+		return new(StdinInput)
+	})
+	RegisterPlugin("StdoutOutput", func() interface{} {
+		return new(StdoutOutput)
+	})
+}
+
+// StdinInput reads graterd's stdin, split into records w/ the configured
+// splitter (newline by default) and handed to the decoder, so graterd can
+// sit in a shell pipeline and decoder and filter configs can be tried out
+// interactively:
+//
+//	tail -f app.log | graterd -config test.json
+//
+// At the end of the input, graterd shuts down (once the records read have
+// been handed to the pipeline) unless `ExitOnEof` is set to false.
+type StdinInput struct {
+	decoder    string
+	splitter   Splitter
+	exitOnEof  bool
+	recordChan chan []byte
+	// Set once stdin has been read to the end
+	done chan bool
+}
+
+func (self *StdinInput) Init(config *PluginConfig) (err error) {
+	if value, ok := (*config)["Decoder"]; ok {
+		self.decoder = value.(string)
+	}
+	splitterKind := "newline"
+	if value, ok := (*config)["Splitter"]; ok {
+		splitterKind = value.(string)
+	}
+	if self.splitter, err = NewSplitter(splitterKind); err != nil {
+		return
+	}
+	if err = self.splitter.Init(config); err != nil {
+		return
+	}
+	self.exitOnEof = true
+	if value, ok := (*config)["ExitOnEof"]; ok {
+		self.exitOnEof = value.(bool)
+	}
+	self.recordChan = make(chan []byte, 100)
+	self.done = make(chan bool)
+	return nil
+}
+
+// Starts reading stdin
+func (self *StdinInput) Prepare() error {
+	go self.readLoop(os.Stdin)
+	return nil
+}
+
+func (self *StdinInput) readLoop(stdin io.Reader) {
+	scanner := bufio.NewScanner(stdin)
+	scanner.Split(self.splitter.Split)
+	for scanner.Scan() {
+		// The scanner reuses its buffer, so each record needs a copy
+		record := make([]byte, len(scanner.Bytes()))
+		copy(record, scanner.Bytes())
+		self.recordChan <- record
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("StdinInput error reading stdin: %s\n", err.Error())
+	}
+	close(self.done)
+}
+
+func (self *StdinInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case record := <-self.recordChan:
+		msgBytes := pipelinePack.MsgBytes[:cap(pipelinePack.MsgBytes)]
+		if len(record) > len(msgBytes) {
+			return NewRecordError("StdinInput dropping %d byte record, max "+
+				"size is %d", len(record), len(msgBytes))
+		}
+		pipelinePack.MsgBytes = msgBytes[:copy(msgBytes, record)]
+		if self.decoder != "" {
+			pipelinePack.Decoder = self.decoder
+		}
+		return nil
+	case <-self.done:
+		// Stdin is done but there may be records left to hand over
+		if len(self.recordChan) == 0 && self.exitOnEof {
+			self.exitOnEof = false
+			log.Println("StdinInput reached the end of stdin, shutting down")
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+		}
+		time.Sleep(*timeout)
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No records to read")
+	return &err
+}
+
+// StdoutOutput writes messages to graterd's stdout, encoded w/ the
+// configured encoder (a PayloadEncoder by default, see EncodingOutput),
+// for use in shell pipelines or to see what a config does to messages.
+type StdoutOutput struct {
+	EncodingOutput
+	dryRunnable
+	lock sync.Mutex
+}
+
+func (self *StdoutOutput) Init(config *PluginConfig) error {
+	if err := self.InitEncoder(config, &PayloadEncoder{}); err != nil {
+		return fmt.Errorf("StdoutOutput config: %s", err.Error())
+	}
+	return nil
+}
+
+func (self *StdoutOutput) Deliver(pipelinePack *PipelinePack) {
+	msgBytes, err := self.Encode(pipelinePack)
+	if err != nil {
+		log.Println(NewDeliveryError(pipelinePack, "StdoutOutput", err))
+		return
+	}
+	if self.dryRun.Skip(msgBytes) {
+		return
+	}
+	// Deliver is called from many goroutines at once, and the records
+	// mustn't be interleaved
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, err = os.Stdout.Write(msgBytes); err != nil {
+		log.Println(NewDeliveryError(pipelinePack, "StdoutOutput", err))
+	}
+}
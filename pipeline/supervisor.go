@@ -0,0 +1,113 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	. "heka/message"
+	"log"
+	"os"
+	"time"
+)
+
+// Controls how a failed plugin goroutine is restarted. The delay doubles
+// after each consecutive failure, up to MaxDelay. A negative MaxRetries
+// means retry forever.
+type RestartPolicy struct {
+	MaxRetries int
+	Delay      time.Duration
+	MaxDelay   time.Duration
+}
+
+var DefaultRestartPolicy = RestartPolicy{
+	MaxRetries: 10,
+	Delay:      time.Duration(250 * time.Millisecond),
+	MaxDelay:   time.Duration(30 * time.Second),
+}
+
+// A goroutine that runs at least this long before failing is considered
+// to have recovered, resetting the retry count and delay
+const healthyRunTime = time.Duration(time.Minute)
+
+// Calls fn, converting a panic into an error
+func runRecovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// Runs fn until it returns nil, restarting it according to the policy if
+// it panics or returns an error. onRestart, if not nil, is called before
+// each restart. Returns the last error if the retries run out.
+func Supervise(name string, policy RestartPolicy, fn func() error,
+	onRestart func(attempt int, err error)) error {
+	attempt := 0
+	delay := policy.Delay
+	for {
+		start := time.Now()
+		err := runRecovered(fn)
+		if err == nil {
+			return nil
+		}
+		if time.Since(start) > healthyRunTime {
+			attempt = 0
+			delay = policy.Delay
+		}
+		attempt++
+		if policy.MaxRetries >= 0 && attempt > policy.MaxRetries {
+			log.Printf("%s failed, giving up after %d restarts: %s\n", name,
+				policy.MaxRetries, err.Error())
+			return err
+		}
+		log.Printf("%s failed, restarting in %s (attempt %d): %s\n", name,
+			delay, attempt, err.Error())
+		if onRestart != nil {
+			onRestart(attempt, err)
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
+
+// Returns a callback for Supervise that injects a heka.plugin-restart
+// message into the pipeline for each restart, so restarts can be routed
+// and alerted on like any other message
+func restartNotifier(helpers *pipelineHelpers, kind,
+	name string) func(int, error) {
+	helper := &pluginHelper{helpers: helpers,
+		plugin: namedPlugin{kind: kind, name: name}}
+	return func(attempt int, err error) {
+		hostname, _ := os.Hostname()
+		msg := &Message{
+			Type:      "heka.plugin-restart",
+			Timestamp: time.Now(),
+			Logger:    "hekad",
+			Severity:  SEVERITY_WARNING,
+			Payload:   err.Error(),
+			Pid:       os.Getpid(),
+			Hostname:  hostname,
+			Fields: map[string]interface{}{
+				"plugin_kind": kind,
+				"plugin_name": name,
+				"attempt":     attempt,
+			},
+		}
+		helper.InjectMessage(msg)
+	}
+}
@@ -0,0 +1,302 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	. "heka/message"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of messages kept for each stage if GraterConfig.TapSize isn't
+// set
+const defaultTapSize = 100
+
+// Messages queued for a tap subscriber. A subscriber that falls further
+// behind than this misses messages rather than holding up the pipeline.
+const tapSubscriberBuffer = 1000
+
+// PipelineTap lets you see what's actually flowing through a running
+// pipeline, w/o adding an output and restarting. When
+// GraterConfig.TapAddress is set every message is recorded at each stage
+// it passes:
+//
+//	input.<name>          once decoded, as it came from the input
+//	filter.<chain>[<i>]   after each filter of a chain that keeps it
+//	output.<name>         as delivered to each output, after any transform
+//
+// The last TapSize (100) messages of each stage are kept, and are served
+// over HTTP on TapAddress along w/ a live stream of new ones (see
+// heka-tail):
+//
+//	GET /stages   JSON list of the stages and how many messages each saw
+//	GET /tail?stage=filter.*&match=Severity<=3&format=text&recent=true
+//	GET /traces   JSON list of recent trace IDs (see MessageTracer)
+//	GET /traces?id=<id>
+//
+// /tail streams a line for each message at a stage matching the `stage`
+// glob (all of them, if not given) that matches the `match` expression
+// (see MessageMatcher), starting w/ the kept ones if `recent` is set. The
+// `format` is "json" (the default), "text" (see Message.String) or
+// "pretty" (see Message.PrettyString). Recording copies every message at
+// every stage, so the tap is meant for debugging rather than leaving on.
+type PipelineTap struct {
+	size        int
+	stages      map[string]*tapRing
+	subscribers map[*tapSubscriber]bool
+	lock        sync.RWMutex
+	// Serves /traces, if set
+	tracer *MessageTracer
+}
+
+type tapEntry struct {
+	stage string
+	time  time.Time
+	msg   *Message
+}
+
+// The last messages seen at a stage
+type tapRing struct {
+	entries []*tapEntry
+	next    int
+	seen    int64
+}
+
+type tapSubscriber struct {
+	stage   string
+	matcher *MessageMatcher
+	entries chan *tapEntry
+}
+
+func NewPipelineTap(size int) *PipelineTap {
+	if size <= 0 {
+		size = defaultTapSize
+	}
+	return &PipelineTap{size: size, stages: make(map[string]*tapRing),
+		subscribers: make(map[*tapSubscriber]bool)}
+}
+
+func (self *tapSubscriber) wants(entry *tapEntry) bool {
+	if self.stage != "" {
+		if ok, _ := path.Match(self.stage, entry.stage); !ok {
+			return false
+		}
+	}
+	return self.matcher == nil || self.matcher.Match(entry.msg)
+}
+
+// Records a copy of a message seen at a stage
+func (self *PipelineTap) Record(stage string, msg *Message) {
+	entry := &tapEntry{stage: stage, time: time.Now(), msg: new(Message)}
+	msg.Copy(entry.msg)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ring, ok := self.stages[stage]
+	if !ok {
+		ring = &tapRing{entries: make([]*tapEntry, 0, self.size)}
+		self.stages[stage] = ring
+	}
+	if len(ring.entries) < self.size {
+		ring.entries = append(ring.entries, entry)
+	} else {
+		ring.entries[ring.next] = entry
+		ring.next = (ring.next + 1) % self.size
+	}
+	ring.seen++
+	for subscriber := range self.subscribers {
+		if !subscriber.wants(entry) {
+			continue
+		}
+		select {
+		case subscriber.entries <- entry:
+		default:
+		}
+	}
+}
+
+// Returns the kept messages a subscriber wants, oldest first
+func (self *PipelineTap) recent(subscriber *tapSubscriber) []*tapEntry {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	entries := make([]*tapEntry, 0)
+	for _, ring := range self.stages {
+		for _, entry := range ring.entries {
+			if subscriber.wants(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Sort(tapEntriesByTime(entries))
+	return entries
+}
+
+type tapEntriesByTime []*tapEntry
+
+func (self tapEntriesByTime) Len() int      { return len(self) }
+func (self tapEntriesByTime) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self tapEntriesByTime) Less(i, j int) bool {
+	return self[i].time.Before(self[j].time)
+}
+
+// Starts serving the tap on an address
+func (self *PipelineTap) Serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stages", self.serveStages)
+	mux.HandleFunc("/tail", self.serveTail)
+	if self.tracer != nil {
+		mux.HandleFunc("/traces", self.tracer.serveTraces)
+	}
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Printf("Pipeline tap %s stopped: %s\n", address, err.Error())
+	}()
+	log.Printf("Pipeline tap listening on %s\n", address)
+	return nil
+}
+
+type tapStage struct {
+	Stage string `json:"stage"`
+	Seen  int64  `json:"seen"`
+}
+
+func (self *PipelineTap) serveStages(w http.ResponseWriter,
+	req *http.Request) {
+	self.lock.RLock()
+	stages := make([]string, 0, len(self.stages))
+	for stage := range self.stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	result := make([]*tapStage, len(stages))
+	for i, stage := range stages {
+		result[i] = &tapStage{stage, self.stages[stage].seen}
+	}
+	self.lock.RUnlock()
+	stagesJson, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(stagesJson)
+}
+
+// A line of a json format tail
+type tapLine struct {
+	Stage   string          `json:"stage"`
+	Time    string          `json:"time"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Writes an entry in the given format
+func writeTapEntry(w io.Writer, entry *tapEntry, format string) error {
+	var err error
+	switch format {
+	case "text":
+		_, err = fmt.Fprintf(w, "%s %s\n", entry.stage, entry.msg.String())
+	case "pretty":
+		_, err = fmt.Fprintf(w, "== %s at %s\n%s\n", entry.stage,
+			entry.time.Format(time.RFC3339Nano), entry.msg.PrettyString())
+	default:
+		var msgJson, line []byte
+		if msgJson, err = entry.msg.MarshalJSON(); err != nil {
+			return err
+		}
+		line, err = json.Marshal(&tapLine{entry.stage,
+			entry.time.Format(time.RFC3339Nano), msgJson})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(line, '\n'))
+	}
+	return err
+}
+
+func (self *PipelineTap) serveTail(w http.ResponseWriter,
+	req *http.Request) {
+	query := req.URL.Query()
+	subscriber := &tapSubscriber{stage: query.Get("stage"),
+		entries: make(chan *tapEntry, tapSubscriberBuffer)}
+	if _, err := path.Match(subscriber.stage, ""); err != nil {
+		http.Error(w, "Bad stage pattern: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+	if expr := query.Get("match"); expr != "" {
+		var err error
+		if subscriber.matcher, err = NewMessageMatcher(expr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	format := query.Get("format")
+	switch format {
+	case "", "json", "text", "pretty":
+	default:
+		http.Error(w, "Unknown format: "+format, http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming isn't supported",
+			http.StatusInternalServerError)
+		return
+	}
+	if format == "" || format == "json" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if recent, _ := strconv.ParseBool(query.Get("recent")); recent {
+		for _, entry := range self.recent(subscriber) {
+			if writeTapEntry(w, entry, format) != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+	self.lock.Lock()
+	self.subscribers[subscriber] = true
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		delete(self.subscribers, subscriber)
+		self.lock.Unlock()
+	}()
+	closed := w.(http.CloseNotifier).CloseNotify()
+	for {
+		select {
+		case entry := <-subscriber.entries:
+			if writeTapEntry(w, entry, format) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
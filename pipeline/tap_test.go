@@ -0,0 +1,72 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+	"strings"
+)
+
+func TapSpec(c gospec.Context) {
+	tap := NewPipelineTap(2)
+	for i := 0; i < 3; i++ {
+		tap.Record("input.udp", &Message{Type: "udp", Severity: i})
+	}
+	tap.Record("filter.default[0]", &Message{Type: "filtered"})
+
+	c.Specify("The tap keeps the last messages of each stage", func() {
+		entries := tap.recent(&tapSubscriber{stage: "input.*"})
+		c.Expect(len(entries), gs.Equals, 2)
+		c.Expect(entries[0].msg.Severity, gs.Equals, 1)
+		c.Expect(entries[1].msg.Severity, gs.Equals, 2)
+		c.Expect(len(tap.recent(&tapSubscriber{})), gs.Equals, 3)
+	})
+
+	c.Specify("Recorded messages are copies", func() {
+		msg := &Message{Type: "before"}
+		tap.Record("output.log", msg)
+		msg.Type = "after"
+		entries := tap.recent(&tapSubscriber{stage: "output.log"})
+		c.Expect(entries[0].msg.Type, gs.Equals, "before")
+	})
+
+	c.Specify("Subscribers only get the messages they match", func() {
+		matcher, err := NewMessageMatcher("Severity >= 5")
+		c.Assume(err, gs.IsNil)
+		subscriber := &tapSubscriber{stage: "input.*", matcher: matcher,
+			entries: make(chan *tapEntry, 10)}
+		tap.subscribers[subscriber] = true
+		tap.Record("input.udp", &Message{Severity: 3})
+		tap.Record("filter.default[0]", &Message{Severity: 6})
+		tap.Record("input.tcp", &Message{Severity: 7})
+		c.Expect(len(subscriber.entries), gs.Equals, 1)
+		entry := <-subscriber.entries
+		c.Expect(entry.stage, gs.Equals, "input.tcp")
+	})
+
+	c.Specify("Entries are written in the requested format", func() {
+		entry := tap.recent(&tapSubscriber{stage: "filter.*"})[0]
+		buf := new(bytes.Buffer)
+		c.Expect(writeTapEntry(buf, entry, "text"), gs.IsNil)
+		c.Expect(strings.HasPrefix(buf.String(),
+			`filter.default[0] Type="filtered"`), gs.IsTrue)
+		buf.Reset()
+		c.Expect(writeTapEntry(buf, entry, "json"), gs.IsNil)
+		c.Expect(strings.HasPrefix(buf.String(),
+			`{"stage":"filter.default[0]","time":`), gs.IsTrue)
+	})
+}
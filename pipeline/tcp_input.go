@@ -0,0 +1,237 @@
+//go:build !notcpinput
+// +build !notcpinput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("TcpInput", func() interface{} { return new(TcpInput) })
+}
+
+// TcpInput accepts stream connections and breaks each stream into
+// records using the configured splitter (heka framing by default, which
+// skips over corrupt data, see FramingSplitter). The records are handed
+// to the decoder named by the `Decoder` config setting, or the default
+// decoder if it isn't set.
+//
+// W/ `UseTls` set connections must use TLS, w/ the server certificate
+// from `TlsCertFile` and `TlsKeyFile`. If `TlsClientCaFile` is set clients
+// must present a certificate signed by one of its CAs. Messages are
+// stamped w/ the details of their connection (see ConnFieldNames).
+type TcpInput struct {
+	acceptTracker
+	address    string
+	decoder    string
+	splitter   Splitter
+	tlsConfig  *tls.Config
+	connFields *ConnFieldNames
+	listener   net.Listener
+	recordChan chan *connRecord
+}
+
+func (self *TcpInput) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Address"]
+	if !ok {
+		return errors.New("TcpInput config: Missing Address")
+	}
+	self.address = value.(string)
+	if value, ok = (*config)["Decoder"]; ok {
+		self.decoder = value.(string)
+	}
+	splitterKind := "framing"
+	if value, ok = (*config)["Splitter"]; ok {
+		splitterKind = value.(string)
+	}
+	if self.splitter, err = NewSplitter(splitterKind); err != nil {
+		return
+	}
+	if err = self.splitter.Init(config); err != nil {
+		return
+	}
+	if value, ok = (*config)["UseTls"]; ok && value.(bool) {
+		if self.tlsConfig, err = tcpInputTlsConfig(config); err != nil {
+			return fmt.Errorf("TcpInput config: %s", err.Error())
+		}
+	}
+	self.connFields = NewConnFieldNames(config)
+	self.recordChan = make(chan *connRecord, 100)
+	return nil
+}
+
+func tcpInputTlsConfig(config *PluginConfig) (*tls.Config, error) {
+	certFile, _ := (*config)["TlsCertFile"].(string)
+	keyFile, _ := (*config)["TlsKeyFile"].(string)
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("UseTls needs TlsCertFile and TlsKeyFile")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile, ok := (*config)["TlsClientCaFile"].(string); ok {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("No certificates in %s", caFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Starts listening, reusing an inherited socket if there is one. This
+// happens here rather than in Init so configs can be validated w/o opening
+// sockets.
+func (self *TcpInput) Prepare() (err error) {
+	if file := InheritedFile(self.address); file != nil {
+		self.listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		self.listener, err = net.Listen("tcp", self.address)
+	}
+	if err != nil {
+		return
+	}
+	go self.acceptLoop()
+	return nil
+}
+
+func (self *TcpInput) SocketFiles() (map[string]*os.File, error) {
+	tcpListener, ok := self.listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("Not a TCP listener: %s", self.address)
+	}
+	file, err := tcpListener.File()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*os.File{self.address: file}, nil
+}
+
+// Closes the listener; open connections are read until the clients close
+// them
+func (self *TcpInput) StopAccepting() {
+	self.stopListener(self.listener)
+}
+
+func (self *TcpInput) acceptLoop() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil && !self.accepting() {
+			return
+		}
+		if err != nil {
+			log.Printf("TcpInput accept error: %s\n", err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go self.handleConnection(conn)
+	}
+}
+
+// TLS is applied per connection rather than by wrapping the listener, so
+// SocketFiles still has the TCP listener to hand on
+func (self *TcpInput) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	var tlsState *tls.ConnectionState
+	if self.tlsConfig != nil {
+		tlsConn := tls.Server(conn, self.tlsConfig)
+		conn = tlsConn
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TcpInput TLS handshake w/ %s failed: %s\n",
+				conn.RemoteAddr(), err.Error())
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+	// Edges are known by their certificate's CN if they have one
+	peer := peerHost(conn)
+	if tlsState != nil && len(tlsState.PeerCertificates) > 0 {
+		peer = tlsState.PeerCertificates[0].Subject.CommonName
+	}
+	self.opened(peer)
+	defer self.closed(peer)
+	fields := self.connFields.Fields(conn.RemoteAddr().String(),
+		conn.LocalAddr().String(), tlsState, NewConnectionId())
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), frameHeaderSize+maxFrameSize)
+	scanner.Split(self.splitter.Split)
+	for scanner.Scan() {
+		// The scanner reuses its buffer, so each record needs a copy
+		record := make([]byte, len(scanner.Bytes()))
+		copy(record, scanner.Bytes())
+		self.recordChan <- &connRecord{record, fields}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("TcpInput error reading from %s: %s\n", conn.RemoteAddr(),
+			err.Error())
+	}
+}
+
+// Reports the open connections, in total and per peer (the client
+// certificate's CN, or else the remote host), so an aggregator shows
+// which edges are connected to it, and the bytes skipped over as corrupt
+// when using heka framing
+func (self *TcpInput) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"connections": int64(self.OpenConnections()),
+		"peers":       self.Peers(),
+	}
+	if framing, ok := self.splitter.(*FramingSplitter); ok {
+		report["skipped_bytes"] = framing.Skipped()
+	}
+	return report
+}
+
+func (self *TcpInput) Read(pipelinePack *PipelinePack,
+	timeout *time.Duration) error {
+	select {
+	case record := <-self.recordChan:
+		msgBytes := pipelinePack.MsgBytes[:cap(pipelinePack.MsgBytes)]
+		if len(record.data) > len(msgBytes) {
+			return NewRecordError("TcpInput dropping %d byte record, max "+
+				"size is %d", len(record.data), len(msgBytes))
+		}
+		pipelinePack.MsgBytes = msgBytes[:copy(msgBytes, record.data)]
+		pipelinePack.Fields = record.fields
+		if self.decoder != "" {
+			pipelinePack.Decoder = self.decoder
+		}
+		return nil
+	case <-time.After(*timeout):
+	}
+	err := TimeoutError("No records to read")
+	return &err
+}
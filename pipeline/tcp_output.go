@@ -0,0 +1,351 @@
+//go:build !notcpoutput
+// +build !notcpoutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("TcpOutput", func() interface{} { return new(TcpOutput) })
+}
+
+const (
+	defaultTcpQueueSize  = 10000
+	minReconnectInterval = time.Duration(100 * time.Millisecond)
+	maxReconnectInterval = time.Duration(30 * time.Second)
+)
+
+// TcpOutput streams encoded messages (framed gobs by default) to another
+// hekad or any other socket consumer. Destinations come from `Address`
+// (one or a list, tried in order) or from DNS SRV, Consul or etcd (see
+// NewResolverFromConfig), re-resolved every `ResolveInterval` seconds.
+// Messages are queued in memory, up to `QueueSize` (10000 by default),
+// and written by a separate goroutine, so a slow or unreachable peer only
+// fills the queue. What happens once it's full is up to `Backpressure`
+// (see Backpressure): by default new messages are dropped rather than
+// blocking the pipeline.
+//
+// W/ `Compression` set to "gzip", framed records of at least
+// `CompressionMinSize` bytes (1024 by default) are compressed before
+// they're queued (see CompressFrame), cutting WAN bandwidth for large
+// payloads. A TcpInput using heka framing decompresses them w/o any
+// config of its own. Records from encoders that don't frame are sent as
+// is.
+type TcpOutput struct {
+	EncodingOutput
+	dryRunnable
+	endpoints    *Endpoints
+	address      string
+	useTls       bool
+	tlsConfig    *tls.Config
+	keepAlive    time.Duration
+	queue        *Queue
+	snapshotChan chan chan [][]byte
+	restoreChan  chan [][]byte
+	backpressure *Backpressure
+	conn         net.Conn
+	// W/ sharding, when the output last checked whether it can move back
+	// to its preferred endpoint
+	sharded     bool
+	lastPrefers time.Time
+	compression string
+	minSize     int
+	// Bytes compression has saved, for the report
+	savedBytes int64
+	// The endpoints aren't resolved until Prepare, so checking the config
+	// doesn't need the network
+	resolver        Resolver
+	resolveInterval time.Duration
+	helper          PluginHelper
+	// Records taken off the data channel but not yet sent, kept across
+	// restarts of the sender
+	pending [][]byte
+}
+
+func (self *TcpOutput) Init(config *PluginConfig) error {
+	var ok bool
+	var value interface{}
+	var err error
+	if self.resolver, err = NewResolverFromConfig(config); err != nil {
+		return fmt.Errorf("TcpOutput config: %s", err.Error())
+	}
+	self.resolveInterval, err = ConfigDuration(config, "ResolveInterval",
+		time.Second, 0)
+	if err != nil {
+		return fmt.Errorf("TcpOutput config: %s", err.Error())
+	}
+	_, self.sharded = self.resolver.(*ShardedResolver)
+	if err := self.InitEncoder(config, &GobEncoder{}); err != nil {
+		return fmt.Errorf("TcpOutput config: %s", err.Error())
+	}
+	if value, ok = (*config)["UseTls"]; ok {
+		self.useTls = value.(bool)
+	}
+	if self.useTls {
+		self.tlsConfig = &tls.Config{}
+		if value, ok = (*config)["TlsInsecureSkipVerify"]; ok {
+			self.tlsConfig.InsecureSkipVerify = value.(bool)
+		}
+		if value, ok = (*config)["TlsCertFile"]; ok {
+			keyFile, _ := (*config)["TlsKeyFile"].(string)
+			cert, err := tls.LoadX509KeyPair(value.(string), keyFile)
+			if err != nil {
+				return err
+			}
+			self.tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	self.keepAlive, err = ConfigDuration(config, "KeepAlive", time.Second,
+		30*time.Second)
+	if err != nil {
+		return fmt.Errorf("TcpOutput config: %s", err.Error())
+	}
+	queueSize, err := ConfigInt(config, "QueueSize", defaultTcpQueueSize)
+	if err != nil {
+		return fmt.Errorf("TcpOutput config: %s", err.Error())
+	}
+	if queueSize < 0 {
+		return errors.New("TcpOutput config: QueueSize can't be negative")
+	}
+	self.backpressure, err = ConfigBackpressure(config, BackpressureDrop)
+	if err != nil {
+		return fmt.Errorf("TcpOutput config: %s", err.Error())
+	}
+	self.compression, self.minSize, err = configFrameCompression(config)
+	if err != nil {
+		return fmt.Errorf("TcpOutput config: %s", err.Error())
+	}
+	self.queue = NewQueue(int(queueSize), self.backpressure)
+	self.snapshotChan = make(chan chan [][]byte)
+	self.restoreChan = make(chan [][]byte)
+	return nil
+}
+
+// Resolves the endpoints and starts sending
+func (self *TcpOutput) Prepare() (err error) {
+	self.endpoints, err = NewEndpoints(self.resolver, self.resolveInterval)
+	if err != nil {
+		return fmt.Errorf("TcpOutput error resolving endpoints: %s",
+			err.Error())
+	}
+	superviseTask(self.helper, "sender", self.sender)
+	return nil
+}
+
+func (self *TcpOutput) SetPluginHelper(helper PluginHelper) {
+	self.helper = helper
+}
+
+func (self *TcpOutput) Deliver(pipelinePack *PipelinePack) {
+	msgBytes, err := self.Encode(pipelinePack)
+	if err != nil {
+		log.Println(NewDeliveryError(pipelinePack, "TcpOutput", err))
+		return
+	}
+	if self.compression != "" {
+		size := len(msgBytes)
+		msgBytes = CompressFrame(msgBytes, self.compression, self.minSize)
+		atomic.AddInt64(&self.savedBytes, int64(size-len(msgBytes)))
+	}
+	if !self.queue.Send(msgBytes, nil) {
+		if dropped := self.backpressure.Lost(); dropped%1000 == 1 {
+			log.Printf("%s, %d messages dropped so far\n",
+				NewDeliveryError(pipelinePack, "TcpOutput",
+					errors.New("queue full")), dropped)
+		}
+	}
+}
+
+func (self *TcpOutput) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"dropped": self.backpressure.Lost(),
+	}
+	self.queue.report(report)
+	if self.compression != "" {
+		report["compression_saved_bytes"] = atomic.LoadInt64(&self.savedBytes)
+	}
+	return report
+}
+
+func (self *TcpOutput) dial(address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: self.keepAlive}
+	if self.useTls {
+		return tls.DialWithDialer(dialer, "tcp", address, self.tlsConfig)
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// Connects to the first reachable endpoint
+func (self *TcpOutput) connect() (err error) {
+	var conn net.Conn
+	for _, address := range self.endpoints.Current() {
+		if conn, err = self.dial(address); err == nil {
+			self.conn = conn
+			self.address = address
+			return
+		}
+		log.Printf("TcpOutput error connecting to %s: %s\n", address,
+			err.Error())
+	}
+	if err == nil {
+		err = errors.New("no endpoints available")
+	}
+	return
+}
+
+// Checks that one of the endpoints accepts connections, for a staged
+// start (see HealthChecker)
+func (self *TcpOutput) Healthy() error {
+	var err error
+	for _, address := range self.endpoints.Current() {
+		var conn net.Conn
+		if conn, err = self.dial(address); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no endpoints available")
+	}
+	return err
+}
+
+// Writes a record to the peer, connecting first if necessary
+func (self *TcpOutput) send(msgBytes []byte) (err error) {
+	if self.dryRun.Skip(msgBytes) {
+		return nil
+	}
+	// Move to a new endpoint once ours has been removed from the list
+	if self.conn != nil && !self.endpoints.Contains(self.address) {
+		log.Printf("TcpOutput endpoint %s removed, reconnecting\n",
+			self.address)
+		self.conn.Close()
+		self.conn = nil
+	}
+	if self.conn != nil && self.sharded {
+		self.preferEndpoint()
+	}
+	if self.conn == nil {
+		if err = self.connect(); err != nil {
+			return
+		}
+		log.Printf("TcpOutput connected to %s\n", self.address)
+	}
+	if _, err = self.conn.Write(msgBytes); err != nil {
+		log.Printf("TcpOutput error writing to %s: %s\n", self.address,
+			err.Error())
+		self.conn.Close()
+		self.conn = nil
+	}
+	return
+}
+
+// Moves back to the preferred endpoint after a failover, e.g. once an
+// aggregator is back from a restart, so sharded edges stay balanced
+func (self *TcpOutput) preferEndpoint() {
+	current := self.endpoints.Current()
+	if len(current) == 0 || self.address == current[0] ||
+		time.Since(self.lastPrefers) < maxReconnectInterval {
+		return
+	}
+	self.lastPrefers = time.Now()
+	conn, err := self.dial(current[0])
+	if err != nil {
+		return
+	}
+	log.Printf("TcpOutput moving from %s back to %s\n", self.address,
+		current[0])
+	self.conn.Close()
+	self.conn = conn
+	self.address = current[0]
+}
+
+// Sends queued records in order, retrying the oldest w/ exponential backoff
+// until the peer accepts it. Records that have been taken off the data
+// channel but not yet sent are held in pending, which snapshots and
+// restores also operate on.
+func (self *TcpOutput) sender() error {
+	interval := minReconnectInterval
+	var retry <-chan time.Time
+	for {
+		if len(self.pending) > 0 && retry == nil {
+			if err := self.send(self.pending[0]); err == nil {
+				self.pending = self.pending[1:]
+				interval = minReconnectInterval
+				continue
+			}
+			retry = time.After(interval)
+			if interval *= 2; interval > maxReconnectInterval {
+				interval = maxReconnectInterval
+			}
+		}
+		// Only take new data when there's nothing pending, so the total
+		// queue length stays bounded by the queue size
+		var queued <-chan interface{}
+		if len(self.pending) == 0 {
+			queued = self.queue.Chan()
+		}
+		select {
+		case item := <-queued:
+			self.pending = append(self.pending, item.([]byte))
+		case <-retry:
+			retry = nil
+		case reply := <-self.snapshotChan:
+			for {
+				item, ok := self.queue.TryPop()
+				if !ok {
+					break
+				}
+				self.pending = append(self.pending, item.([]byte))
+			}
+			records := make([][]byte, len(self.pending))
+			copy(records, self.pending)
+			reply <- records
+		case records := <-self.restoreChan:
+			self.pending = append(records, self.pending...)
+		}
+	}
+}
+
+// Returns the records that haven't been written to the peer yet
+func (self *TcpOutput) Snapshot() ([][]byte, error) {
+	reply := make(chan [][]byte)
+	self.snapshotChan <- reply
+	return <-reply, nil
+}
+
+func (self *TcpOutput) Restore(records [][]byte) error {
+	self.restoreChan <- records
+	return nil
+}
+
+// Waits for the send queue to empty out
+func (self *TcpOutput) Drain() error {
+	for {
+		if records, _ := self.Snapshot(); len(records) == 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,202 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Month and day names by locale, for parsing localized timestamps. Each
+// entry lists the full name followed by its abbreviations, separated by
+// "|". Months start w/ January and days w/ Monday.
+var timestampLocales = map[string]struct {
+	months [12]string
+	days   [7]string
+}{
+	"de": {
+		[12]string{"januar|jan|jän", "februar|feb", "märz|mär|mrz|maerz",
+			"april|apr", "mai", "juni|jun", "juli|jul", "august|aug",
+			"september|sep|sept", "oktober|okt", "november|nov",
+			"dezember|dez"},
+		[7]string{"montag|mo|mon", "dienstag|di|die", "mittwoch|mi|mit",
+			"donnerstag|do|don", "freitag|fr|fre", "samstag|sa|sam|sonnabend",
+			"sonntag|so|son"},
+	},
+	"es": {
+		[12]string{"enero|ene", "febrero|feb", "marzo|mar", "abril|abr",
+			"mayo|may", "junio|jun", "julio|jul", "agosto|ago",
+			"septiembre|sep|sept|setiembre|set", "octubre|oct",
+			"noviembre|nov", "diciembre|dic"},
+		[7]string{"lunes|lun", "martes|mar", "miércoles|mié|miercoles|mie",
+			"jueves|jue", "viernes|vie", "sábado|sáb|sabado|sab",
+			"domingo|dom"},
+	},
+	"fr": {
+		[12]string{"janvier|janv|jan", "février|févr|fév|fevrier|fevr|fev",
+			"mars", "avril|avr", "mai", "juin", "juillet|juil",
+			"août|aout", "septembre|sept|sep", "octobre|oct",
+			"novembre|nov", "décembre|déc|decembre|dec"},
+		[7]string{"lundi|lun", "mardi|mar", "mercredi|mer", "jeudi|jeu",
+			"vendredi|ven", "samedi|sam", "dimanche|dim"},
+	},
+	"it": {
+		[12]string{"gennaio|gen", "febbraio|feb", "marzo|mar", "aprile|apr",
+			"maggio|mag", "giugno|giu", "luglio|lug", "agosto|ago",
+			"settembre|set", "ottobre|ott", "novembre|nov", "dicembre|dic"},
+		[7]string{"lunedì|lun|lunedi", "martedì|mar|martedi",
+			"mercoledì|mer|mercoledi", "giovedì|gio|giovedi",
+			"venerdì|ven|venerdi", "sabato|sab", "domenica|dom"},
+	},
+	"nl": {
+		[12]string{"januari|jan", "februari|feb", "maart|mrt|mar",
+			"april|apr", "mei", "juni|jun", "juli|jul", "augustus|aug",
+			"september|sep|sept", "oktober|okt", "november|nov",
+			"december|dec"},
+		[7]string{"maandag|ma", "dinsdag|di", "woensdag|wo", "donderdag|do",
+			"vrijdag|vr", "zaterdag|za", "zondag|zo"},
+	},
+	"pt": {
+		[12]string{"janeiro|jan", "fevereiro|fev", "março|mar|marco",
+			"abril|abr", "maio|mai", "junho|jun", "julho|jul", "agosto|ago",
+			"setembro|set", "outubro|out", "novembro|nov", "dezembro|dez"},
+		[7]string{"segunda-feira|segunda|seg", "terça-feira|terça|ter|terca",
+			"quarta-feira|quarta|qua", "quinta-feira|quinta|qui",
+			"sexta-feira|sexta|sex", "sábado|sáb|sabado|sab",
+			"domingo|dom"},
+	},
+}
+
+// Returns the map of lower case localized month and day names to the
+// English ones Go's time layouts use, full names to full names and
+// abbreviations to "Jan" style ones. Where an abbreviation could be a
+// month or a day (e.g. Spanish "mar") it's taken as the month.
+func localeNames(locale string) (map[string]string, error) {
+	names, ok := timestampLocales[strings.ToLower(locale)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown locale: %s", locale)
+	}
+	english := make(map[string]string)
+	add := func(localized, full string) {
+		for i, name := range strings.Split(localized, "|") {
+			if _, ok := english[name]; ok {
+				continue
+			}
+			if i == 0 {
+				english[name] = full
+			} else {
+				english[name] = full[:3]
+			}
+		}
+	}
+	for i, localized := range names.months {
+		add(localized, time.Month(i+1).String())
+	}
+	for i, localized := range names.days {
+		add(localized, time.Weekday((i+1)%7).String())
+	}
+	return english, nil
+}
+
+// Replaces the localized month and day names in a timestamp w/ English
+// ones. Words are runs of letters, including hyphenated ones, matched
+// regardless of case.
+func translateNames(value string, english map[string]string) string {
+	runes := []rune(value)
+	isWordRune := func(i int) bool {
+		if unicode.IsLetter(runes[i]) {
+			return true
+		}
+		return runes[i] == '-' && i > 0 && i+1 < len(runes) &&
+			unicode.IsLetter(runes[i-1]) && unicode.IsLetter(runes[i+1])
+	}
+	translated := make([]rune, 0, len(runes))
+	for i := 0; i < len(runes); {
+		if !isWordRune(i) {
+			translated = append(translated, runes[i])
+			i++
+			continue
+		}
+		start := i
+		for i < len(runes) && isWordRune(i) {
+			i++
+		}
+		word := string(runes[start:i])
+		if name, ok := english[strings.ToLower(word)]; ok {
+			word = name
+		}
+		translated = append(translated, []rune(word)...)
+	}
+	return string(translated)
+}
+
+// Returns whether a layout has a numeric day before a numeric month (e.g.
+// "02/01/2006"), and whether it has both at all. Layouts w/ named months
+// aren't ambiguous, so aren't considered numeric.
+func layoutDayFirst(layout string) (dayFirst, numeric bool) {
+	month, day := -1, -1
+	for i := 0; i < len(layout); {
+		rest := layout[i:]
+		switch {
+		case strings.HasPrefix(rest, "Jan"):
+			return false, false
+		case strings.HasPrefix(rest, "2006"):
+			i += 4
+		case strings.HasPrefix(rest, "15"), strings.HasPrefix(rest, "06"):
+			i += 2
+		case strings.HasPrefix(rest, "01"):
+			month = i
+			i += 2
+		case strings.HasPrefix(rest, "02"), strings.HasPrefix(rest, "_2"):
+			day = i
+			i += 2
+		case rest[0] == '1':
+			month = i
+			i++
+		case rest[0] == '2':
+			day = i
+			i++
+		default:
+			i++
+		}
+	}
+	if month < 0 || day < 0 {
+		return false, false
+	}
+	return day < month, true
+}
+
+// Orders the layouts so the ones w/ numeric dates in the given order
+// ("dmy" or "mdy") are tried before the ones w/ the other order. A value
+// like "05/06/2013" then parses the preferred way, while one only valid
+// in the other order (e.g. "13/06/2013") still falls through to it.
+func orderLayouts(layouts []string, order string) ([]string, error) {
+	if order != "dmy" && order != "mdy" {
+		return nil, fmt.Errorf("Unknown date order: %s", order)
+	}
+	preferred := make([]string, 0, len(layouts))
+	others := make([]string, 0)
+	for _, layout := range layouts {
+		dayFirst, numeric := layoutDayFirst(layout)
+		if numeric && dayFirst != (order == "dmy") {
+			others = append(others, layout)
+		} else {
+			preferred = append(preferred, layout)
+		}
+	}
+	ordered := append(preferred, others...)
+	return ordered, nil
+}
@@ -0,0 +1,251 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampParser parses timestamps in any of a list of formats. Each
+// format is a Go time layout (e.g. "02/Jan/2006:15:04:05 -0700"), or one of
+// "unix", "unix_ms" or "unix_ns" for numeric epoch times. Times w/o a zone
+// are taken to be in the parser's location, and times w/o a year (e.g.
+// syslog's "Jan _2 15:04:05") in the most recent year that doesn't put
+// them more than a day in the future. SetLocale and SetDateOrder adapt it
+// to timestamps from non-English or non-US applications.
+type TimestampParser struct {
+	layouts  []string
+	location *time.Location
+	// Localized month and day names to English ones, if a locale is set
+	names map[string]string
+	// For tests
+	now func() time.Time
+}
+
+// Returns a parser for the layouts, for times w/o a zone in the named
+// location (UTC if empty, or "Local")
+func NewTimestampParser(layouts []string,
+	timezone string) (*TimestampParser, error) {
+	if len(layouts) == 0 {
+		return nil, errors.New("No timestamp layouts")
+	}
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, err
+		}
+	}
+	return &TimestampParser{layouts: layouts, location: location,
+		now: time.Now}, nil
+}
+
+// Sets the locale of the month and day names in the timestamps, e.g.
+// "de" or "fr", matched regardless of case and w/ or w/o accents (see
+// timestampLocales). The layouts still use the English names, so
+// "02. January 2006" parses "14. März 2013".
+func (self *TimestampParser) SetLocale(locale string) (err error) {
+	self.names, err = localeNames(locale)
+	return
+}
+
+// Sets how dates w/ a numeric day and month are read when more than one
+// layout matches, "dmy" (e.g. 05/06/2013 is the 5th of June) or "mdy"
+// (the 6th of May). Otherwise the first matching layout wins.
+func (self *TimestampParser) SetDateOrder(order string) (err error) {
+	self.layouts, err = orderLayouts(self.layouts, order)
+	return
+}
+
+func parseEpoch(value string, unit time.Duration) (time.Time, error) {
+	epoch, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos := epoch * float64(unit)
+	return time.Unix(0, int64(nanos)), nil
+}
+
+// Fills in the year of a time parsed w/o one
+func (self *TimestampParser) withYear(t time.Time) time.Time {
+	now := self.now().In(t.Location())
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.Sub(now) > 24*time.Hour {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+func (self *TimestampParser) Parse(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if self.names != nil {
+		value = translateNames(value, self.names)
+	}
+	for _, layout := range self.layouts {
+		var t time.Time
+		var err error
+		switch layout {
+		case "unix":
+			t, err = parseEpoch(value, time.Second)
+		case "unix_ms":
+			t, err = parseEpoch(value, time.Millisecond)
+		case "unix_ns":
+			t, err = parseEpoch(value, time.Nanosecond)
+		default:
+			t, err = time.ParseInLocation(layout, value, self.location)
+			if err == nil && t.Year() == 0 {
+				t = self.withYear(t)
+			}
+		}
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Timestamp %q doesn't match any layout",
+		value)
+}
+
+// TimestampDecoder runs the decoder named by `Decoder` and then sets the
+// message timestamp from the message variable in `Source` (see
+// MessageVariable, e.g. "Fields[time]"), parsed w/ a TimestampParser for
+// `Layouts` and `Timezone` (and `Locale` and `DateOrder`, see
+// TimestampParser.SetLocale and SetDateOrder). If `Pattern` is set, only
+// the part of the source matched by it is parsed, i.e. its "timestamp"
+// named group if it has one, else its first group, else the whole match;
+// the source then defaults to the payload.
+//
+// If the timestamp can't be parsed the message keeps the one the decoder
+// gave it, unless `Required` is set, in which case the decode fails.
+type TimestampDecoder struct {
+	decoder  string
+	source   string
+	pattern  *regexp.Regexp
+	group    int
+	parser   *TimestampParser
+	required bool
+}
+
+func (self *TimestampDecoder) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Decoder"]
+	if !ok {
+		return errors.New("TimestampDecoder config: Missing Decoder")
+	}
+	self.decoder = value.(string)
+	if value, ok = (*config)["Pattern"]; ok {
+		if self.pattern, err = regexp.Compile(value.(string)); err != nil {
+			return fmt.Errorf("TimestampDecoder config: %s", err.Error())
+		}
+		self.source = "Payload"
+		if self.pattern.NumSubexp() > 0 {
+			self.group = 1
+		}
+		for i, name := range self.pattern.SubexpNames() {
+			if name == "timestamp" {
+				self.group = i
+			}
+		}
+	}
+	if value, ok = (*config)["Source"]; ok {
+		self.source = value.(string)
+	}
+	if self.source == "" {
+		return errors.New("TimestampDecoder config: Missing Source")
+	}
+	if !isMessageVariable(self.source) {
+		return fmt.Errorf("TimestampDecoder config: Invalid message "+
+			"variable: %s", self.source)
+	}
+	var layouts []string
+	switch value := (*config)["Layouts"].(type) {
+	case string:
+		layouts = []string{value}
+	case []string:
+		layouts = value
+	}
+	timezone, _ := (*config)["Timezone"].(string)
+	if self.parser, err = NewTimestampParser(layouts, timezone); err != nil {
+		return fmt.Errorf("TimestampDecoder config: %s", err.Error())
+	}
+	if value, ok = (*config)["Locale"]; ok {
+		if err = self.parser.SetLocale(value.(string)); err != nil {
+			return fmt.Errorf("TimestampDecoder config: %s", err.Error())
+		}
+	}
+	if value, ok = (*config)["DateOrder"]; ok {
+		if err = self.parser.SetDateOrder(value.(string)); err != nil {
+			return fmt.Errorf("TimestampDecoder config: %s", err.Error())
+		}
+	}
+	if value, ok = (*config)["Required"]; ok {
+		self.required = value.(bool)
+	}
+	return nil
+}
+
+// Returns the name of the wrapped decoder, so ValidateConfig can check it
+// exists
+func (self *TimestampDecoder) decoderRefs() []string {
+	return []string{self.decoder}
+}
+
+// Returns the timestamp text from the message's source
+func (self *TimestampDecoder) timestamp(pipelinePack *PipelinePack) (string,
+	error) {
+	value, ok := MessageVariable(pipelinePack.Message, self.source)
+	if !ok || value == nil {
+		return "", fmt.Errorf("Missing %s", self.source)
+	}
+	text := fmt.Sprint(value)
+	if self.pattern == nil {
+		return text, nil
+	}
+	match := self.pattern.FindStringSubmatch(text)
+	if match == nil {
+		return "", fmt.Errorf("%s doesn't match Pattern", self.source)
+	}
+	return match[self.group], nil
+}
+
+func (self *TimestampDecoder) Decode(pipelinePack *PipelinePack) error {
+	decoder, ok := pipelinePack.Config.Decoders[self.decoder]
+	if !ok {
+		return fmt.Errorf("Decoder doesn't exist: %s", self.decoder)
+	}
+	if decoder == Decoder(self) {
+		return errors.New("TimestampDecoder can't wrap itself")
+	}
+	if err := decoder.Decode(pipelinePack); err != nil {
+		return err
+	}
+	if pipelinePack.Message == nil {
+		return nil
+	}
+	text, err := self.timestamp(pipelinePack)
+	if err == nil {
+		var t time.Time
+		if t, err = self.parser.Parse(text); err == nil {
+			pipelinePack.Message.Timestamp = t
+		}
+	}
+	if err != nil && self.required {
+		return err
+	}
+	pipelinePack.Decoded = true
+	return nil
+}
@@ -0,0 +1,222 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	. "heka/message"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The field that asks for a message to be traced. Its value is the trace
+// ID; if it's empty an ID is generated and set, so the ID travels w/ the
+// message to any downstream hekad.
+const TraceField = "X-Heka-Trace"
+
+// The field a flagged message's path through the pipeline is attached
+// as, just before it's handed to its outputs
+const TraceStagesField = "X-Heka-Trace-Stages"
+
+// Number of finished traces kept if GraterConfig.TraceSize isn't set
+const defaultTraceSize = 1000
+
+// MessageTracer answers "why didn't this message reach output Y?". A
+// traced pack carries a PackTrace recording each stage it passed w/ what
+// happened there and when: the input and decoder, each filter of its
+// chain (not matched, passed or dropped), where it was routed, and for
+// each output whether it was queued, delivered, failed or skipped.
+//
+// Messages w/ a TraceField are always traced, and get their path so far
+// attached as TraceStagesField before delivery. W/ `trace_messages` set,
+// a debug mode, every message is traced. The last `trace_size` (1000)
+// finished traces are kept and, if the pipeline tap is on, served as JSON
+// from its /traces (the recent trace IDs) and /traces?id=<id>.
+type MessageTracer struct {
+	all      bool
+	size     int
+	lock     sync.RWMutex
+	finished []*PackTrace
+	next     int
+	traced   int64
+}
+
+// A traced pack's record of its path through the pipeline
+type PackTrace struct {
+	ID      string       `json:"id"`
+	Input   string       `json:"input"`
+	Type    string       `json:"type"`
+	Events  []TraceEvent `json:"events"`
+	flagged bool
+	lock    sync.Mutex
+}
+
+type TraceEvent struct {
+	Time    time.Time `json:"time"`
+	Stage   string    `json:"stage"`
+	Outcome string    `json:"outcome"`
+}
+
+func NewMessageTracer(config *GraterConfig) *MessageTracer {
+	size := config.TraceSize
+	if size <= 0 {
+		size = defaultTraceSize
+	}
+	return &MessageTracer{all: config.TraceMessages, size: size,
+		finished: make([]*PackTrace, 0, size)}
+}
+
+// Returns a random trace ID
+func newTraceID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Starts tracing a decoded pack if it's flagged or everything's traced,
+// recording the input and, if the pipeline decoded it, the decoder
+func (self *MessageTracer) Start(pipelinePack *PipelinePack,
+	decoder, outcome string) {
+	if self == nil {
+		return
+	}
+	msg := pipelinePack.Message
+	flag, flagged := msg.Fields[TraceField]
+	if !flagged && !self.all {
+		return
+	}
+	trace := &PackTrace{Input: pipelinePack.InputName, Type: msg.Type,
+		flagged: flagged}
+	if id, ok := flag.(string); ok && id != "" {
+		trace.ID = id
+	} else {
+		trace.ID = newTraceID()
+		if flagged {
+			msg.ReplaceField(TraceField, trace.ID)
+		}
+	}
+	readTime := pipelinePack.ReadTime
+	if readTime.IsZero() {
+		readTime = time.Now()
+	}
+	trace.Events = append(trace.Events, TraceEvent{readTime,
+		"input." + pipelinePack.InputName, "read"})
+	if decoder != "" {
+		trace.Record("decoder."+decoder, outcome)
+	}
+	atomic.AddInt64(&self.traced, 1)
+	pipelinePack.Trace = trace
+}
+
+// Records what happened to the pack at a stage. Does nothing for packs
+// that aren't traced, i.e. w/ a nil PackTrace.
+func (self *PackTrace) Record(stage, outcome string) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	self.Events = append(self.Events, TraceEvent{time.Now(), stage, outcome})
+	self.lock.Unlock()
+}
+
+// Attaches the path so far to a flagged message, as "stage: outcome"
+// entries separated by "; "
+func (self *PackTrace) attach(msg *Message) {
+	if self == nil || !self.flagged {
+		return
+	}
+	self.lock.Lock()
+	stages := make([]string, len(self.Events))
+	for i, event := range self.Events {
+		stages[i] = event.Stage + ": " + event.Outcome
+	}
+	self.lock.Unlock()
+	msg.ReplaceField(TraceStagesField, strings.Join(stages, "; "))
+}
+
+// Keeps a trace once the pack's been recycled, i.e. every output is done
+// w/ it
+func (self *MessageTracer) Finish(trace *PackTrace) {
+	if self == nil || trace == nil {
+		return
+	}
+	self.lock.Lock()
+	if len(self.finished) < self.size {
+		self.finished = append(self.finished, trace)
+	} else {
+		self.finished[self.next] = trace
+		self.next = (self.next + 1) % self.size
+	}
+	self.lock.Unlock()
+}
+
+// Returns the kept traces w/ an ID, oldest first. A flagged message
+// that's been through more than once, e.g. reinjected by a filter, has a
+// trace per pass.
+func (self *MessageTracer) Lookup(id string) []*PackTrace {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	traces := make([]*PackTrace, 0)
+	for i := range self.finished {
+		trace := self.finished[(self.next+i)%len(self.finished)]
+		if trace.ID == id {
+			traces = append(traces, trace)
+		}
+	}
+	return traces
+}
+
+func (self *MessageTracer) serveTraces(w http.ResponseWriter,
+	req *http.Request) {
+	var result interface{}
+	if id := req.URL.Query().Get("id"); id != "" {
+		traces := self.Lookup(id)
+		if len(traces) == 0 {
+			http.Error(w, "No such trace: "+id, http.StatusNotFound)
+			return
+		}
+		result = traces
+	} else {
+		self.lock.RLock()
+		ids := make([]string, len(self.finished))
+		for i := range self.finished {
+			ids[i] = self.finished[(self.next+i)%len(self.finished)].ID
+		}
+		self.lock.RUnlock()
+		result = ids
+	}
+	tracesJson, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(tracesJson)
+}
+
+// Number of packs traced, reported as the "pipeline tracer" plugin
+func (self *MessageTracer) Report() map[string]interface{} {
+	self.lock.RLock()
+	kept := len(self.finished)
+	self.lock.RUnlock()
+	return map[string]interface{}{
+		"traced": atomic.LoadInt64(&self.traced),
+		"kept":   int64(kept),
+	}
+}
@@ -0,0 +1,70 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"github.com/orfjackal/gospec/src/gospec"
+	gs "github.com/orfjackal/gospec/src/gospec"
+	. "heka/message"
+)
+
+func MessageTracerSpec(c gospec.Context) {
+	newPack := func(fields map[string]interface{}) *PipelinePack {
+		return &PipelinePack{InputName: "in",
+			Message: &Message{Type: "test", Fields: fields}}
+	}
+
+	c.Specify("Only flagged messages are traced by default", func() {
+		tracer := NewMessageTracer(&GraterConfig{})
+		pipelinePack := newPack(nil)
+		tracer.Start(pipelinePack, "json", "decoded")
+		c.Expect(pipelinePack.Trace == nil, gs.IsTrue)
+		// Recording on an untraced pack is a no-op
+		pipelinePack.Trace.Record("filter.main[0]", "passed")
+
+		pipelinePack = newPack(map[string]interface{}{TraceField: ""})
+		tracer.Start(pipelinePack, "json", "decoded")
+		trace := pipelinePack.Trace
+		c.Expect(trace == nil, gs.IsFalse)
+		c.Expect(len(trace.ID), gs.Equals, 32)
+		c.Expect(pipelinePack.Message.Fields[TraceField], gs.Equals, trace.ID)
+	})
+
+	c.Specify("Flagged messages get their path attached", func() {
+		tracer := NewMessageTracer(&GraterConfig{})
+		pipelinePack := newPack(map[string]interface{}{TraceField: "abc"})
+		tracer.Start(pipelinePack, "", "")
+		trace := pipelinePack.Trace
+		c.Expect(trace.ID, gs.Equals, "abc")
+		trace.Record("filter.main[0]", "not matched")
+		trace.attach(pipelinePack.Message)
+		c.Expect(pipelinePack.Message.Fields[TraceStagesField], gs.Equals,
+			"input.in: read; filter.main[0]: not matched")
+	})
+
+	c.Specify("Finished traces are kept up to the trace size", func() {
+		tracer := NewMessageTracer(&GraterConfig{TraceMessages: true,
+			TraceSize: 2})
+		for _, id := range []string{"a", "b", "c"} {
+			pipelinePack := newPack(map[string]interface{}{TraceField: id})
+			tracer.Start(pipelinePack, "json", "decoded")
+			tracer.Finish(pipelinePack.Trace)
+		}
+		c.Expect(len(tracer.Lookup("a")), gs.Equals, 0)
+		traces := tracer.Lookup("c")
+		c.Expect(len(traces), gs.Equals, 1)
+		c.Expect(traces[0].Events[1].Stage, gs.Equals, "decoder.json")
+		c.Expect(tracer.Report()["traced"], gs.Equals, int64(3))
+	})
+}
@@ -0,0 +1,274 @@
+//go:build !nowebhookoutput
+// +build !nowebhookoutput
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+func init() {
+	RegisterPlugin("WebhookOutput", func() interface{} {
+		return new(WebhookOutput)
+	})
+}
+
+// Posts a Slack message w/ one line per message
+const defaultWebhookTemplate = `{"text": {{json .Text}}}`
+
+// What a webhook template sees of a message
+type WebhookMessage struct {
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	Logger    string                 `json:"logger"`
+	Severity  int                    `json:"severity"`
+	Hostname  string                 `json:"hostname"`
+	Payload   string                 `json:"payload"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// The data a webhook template is rendered w/
+type WebhookData struct {
+	Messages []*WebhookMessage
+	// A line per message, "[Type] Hostname: Payload"
+	Text string
+}
+
+// WebhookOutput POSTs messages to `Url`, as the JSON body rendered from the
+// text/template in `Template` w/ a WebhookData. The template has a "json"
+// function for quoting values, and the default posts a Slack compatible
+// {"text": ...} body. Only the fields listed in `Fields` are passed on, so
+// nothing sensitive leaks to a third party by accident.
+//
+// Messages are sent in batches of up to `BatchSize` (1 by default, i.e. a
+// POST per message), w/ partial batches sent every `FlushInterval`
+// milliseconds (1000 by default). Requests time out after `Timeout`
+// seconds (10 by default), and failed requests are retried up to
+// `Retries` times (3 by default) w/ a doubling delay, unless the server
+// rejected them w/ a 4xx status. W/ `BreakerThreshold` set a circuit
+// breaker drops batches while the server is down rather than retrying
+// each one (see CircuitBreaker).
+type WebhookOutput struct {
+	dryRunnable
+	url           string
+	template      *template.Template
+	fields        []string
+	batchSize     int
+	flushInterval time.Duration
+	retries       int
+	client        *http.Client
+	batch         []*WebhookMessage
+	msgChan       chan *WebhookMessage
+	drainChan     chan chan error
+	breaker       *CircuitBreaker
+	// Messages in batches that couldn't be sent
+	dropped int64
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+func (self *WebhookOutput) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Url"]
+	if !ok {
+		return errors.New("WebhookOutput config: Missing Url")
+	}
+	self.url = value.(string)
+	templateText := defaultWebhookTemplate
+	if value, ok = (*config)["Template"]; ok {
+		templateText = value.(string)
+	}
+	self.template, err = template.New("webhook").Funcs(webhookFuncs).
+		Parse(templateText)
+	if err != nil {
+		return fmt.Errorf("WebhookOutput config: %s", err.Error())
+	}
+	if value, ok = (*config)["Fields"]; ok {
+		self.fields = value.([]string)
+	}
+	self.batchSize = 1
+	if value, ok = (*config)["BatchSize"]; ok {
+		if self.batchSize = int(value.(int64)); self.batchSize < 1 {
+			return errors.New("WebhookOutput config: BatchSize must be " +
+				"positive")
+		}
+	}
+	self.flushInterval, err = ConfigDuration(config, "FlushInterval",
+		time.Millisecond, time.Second)
+	if err != nil {
+		return fmt.Errorf("WebhookOutput config: %s", err.Error())
+	}
+	self.retries = 3
+	if value, ok = (*config)["Retries"]; ok {
+		self.retries = int(value.(int64))
+	}
+	timeout, err := ConfigDuration(config, "Timeout", time.Second,
+		10*time.Second)
+	if err != nil {
+		return fmt.Errorf("WebhookOutput config: %s", err.Error())
+	}
+	self.breaker, err = ConfigCircuitBreaker(config, "WebhookOutput")
+	if err != nil {
+		return fmt.Errorf("WebhookOutput config: %s", err.Error())
+	}
+	self.client = &http.Client{Timeout: timeout}
+	self.msgChan = make(chan *WebhookMessage, 1000)
+	self.drainChan = make(chan chan error)
+	go self.sender()
+	return nil
+}
+
+func (self *WebhookOutput) Deliver(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	webhookMsg := &WebhookMessage{
+		Type:      msg.Type,
+		Timestamp: msg.Timestamp,
+		Logger:    msg.Logger,
+		Severity:  msg.Severity,
+		Hostname:  msg.Hostname,
+		Payload:   msg.Payload,
+	}
+	for _, name := range self.fields {
+		if value, ok := msg.Fields[name]; ok {
+			if webhookMsg.Fields == nil {
+				webhookMsg.Fields = make(map[string]interface{})
+			}
+			webhookMsg.Fields[name] = value
+		}
+	}
+	self.msgChan <- webhookMsg
+}
+
+// POSTs a body, returning whether it's worth retrying on failure
+func (self *WebhookOutput) post(body []byte) (retry bool, err error) {
+	if self.dryRun.Skip(body) {
+		return false, nil
+	}
+	resp, err := self.client.Post(self.url, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("POST %s: %s", self.url, resp.Status)
+	retry = resp.StatusCode >= 500 ||
+		resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// Renders and sends the current batch, retrying as configured
+func (self *WebhookOutput) flush() error {
+	if len(self.batch) == 0 {
+		return nil
+	}
+	lines := make([]string, len(self.batch))
+	for i, msg := range self.batch {
+		lines[i] = fmt.Sprintf("[%s] %s: %s", msg.Type, msg.Hostname,
+			msg.Payload)
+	}
+	data := &WebhookData{self.batch, strings.Join(lines, "\n")}
+	self.batch = nil
+	body := new(bytes.Buffer)
+	if err := self.template.Execute(body, data); err != nil {
+		return err
+	}
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if !self.breaker.Allow() {
+			atomic.AddInt64(&self.dropped, int64(len(data.Messages)))
+			return nil
+		}
+		retry, err := self.post(body.Bytes())
+		// A rejected request still means the server is up
+		if err == nil || !retry {
+			self.breaker.Success()
+		} else {
+			self.breaker.Failure()
+		}
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= self.retries {
+			atomic.AddInt64(&self.dropped, int64(len(data.Messages)))
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Sends a batch when it fills up or the flush interval passes
+func (self *WebhookOutput) sender() {
+	ticker := time.NewTicker(self.flushInterval)
+	for {
+		var err error
+		select {
+		case msg := <-self.msgChan:
+			self.batch = append(self.batch, msg)
+			if len(self.batch) >= self.batchSize {
+				err = self.flush()
+			}
+		case <-ticker.C:
+			err = self.flush()
+		case done := <-self.drainChan:
+			for queued := len(self.msgChan); queued > 0; queued-- {
+				self.batch = append(self.batch, <-self.msgChan)
+				if len(self.batch) >= self.batchSize {
+					if err = self.flush(); err != nil {
+						log.Printf("WebhookOutput error: %s\n", err.Error())
+					}
+				}
+			}
+			done <- self.flush()
+			continue
+		}
+		if err != nil {
+			log.Printf("WebhookOutput error: %s\n", err.Error())
+		}
+	}
+}
+
+// Sends any queued messages
+func (self *WebhookOutput) Drain() error {
+	done := make(chan error)
+	self.drainChan <- done
+	return <-done
+}
+
+func (self *WebhookOutput) Report() map[string]interface{} {
+	report := map[string]interface{}{
+		"queued":  len(self.msgChan),
+		"dropped": atomic.LoadInt64(&self.dropped),
+	}
+	self.breaker.report(report)
+	return report
+}
@@ -0,0 +1,355 @@
+//go:build !nowebsocket
+// +build !nowebsocket
+
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+package pipeline
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterPlugin("WebSocketOutput", func() interface{} {
+		return new(WebSocketOutput)
+	})
+}
+
+// Appended to a client's Sec-WebSocket-Key to make the accept key, see
+// RFC 6455 section 1.3
+const webSocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// WebSocketOutput streams messages as JSON, one per text frame, to
+// WebSocket clients connected to `Path` (/stream by default) on
+// `Address`, so a dashboard or a browser console can tail a running
+// graterd live. Only messages matching the output's `Matcher` (all of
+// them, if not set) are streamed, and each client can narrow that down
+// w/ a matcher expression of its own (see MessageMatcher):
+//
+//	ws://localhost:4352/stream?match=Type=='nginx.access'%20%26%26%20Severity<=3
+//
+// Messages are queued for each client, up to `BufferSize` (100 by
+// default) of them; when a client falls further behind than that, its
+// messages are dropped rather than holding up the pipeline.
+type WebSocketOutput struct {
+	address    string
+	path       string
+	matcher    *MessageMatcher
+	bufferSize int
+	maxClients int
+	listener   net.Listener
+	clients    map[*webSocketClient]bool
+	lock       sync.RWMutex
+	dropped    int64
+}
+
+type webSocketClient struct {
+	conn    net.Conn
+	matcher *MessageMatcher
+	send    chan []byte
+	// Closed by whichever of the reading and writing goroutines finishes
+	// first
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (self *webSocketClient) close() {
+	self.closeOnce.Do(func() {
+		close(self.done)
+		self.conn.Close()
+	})
+}
+
+func (self *WebSocketOutput) Init(config *PluginConfig) (err error) {
+	value, ok := (*config)["Address"]
+	if !ok {
+		return errors.New("WebSocketOutput config: Missing Address")
+	}
+	self.address = value.(string)
+	self.path = "/stream"
+	if value, ok = (*config)["Path"]; ok {
+		self.path = value.(string)
+	}
+	if value, ok = (*config)["Matcher"]; ok {
+		if self.matcher, err = NewMessageMatcher(value.(string)); err != nil {
+			return fmt.Errorf("WebSocketOutput config: %s", err.Error())
+		}
+	}
+	self.bufferSize = 100
+	if value, ok = (*config)["BufferSize"]; ok {
+		self.bufferSize = int(value.(int64))
+	}
+	if self.bufferSize <= 0 {
+		return errors.New("WebSocketOutput config: BufferSize must be " +
+			"positive")
+	}
+	if value, ok = (*config)["MaxClients"]; ok {
+		self.maxClients = int(value.(int64))
+	}
+	self.clients = make(map[*webSocketClient]bool)
+	return nil
+}
+
+// Starts accepting clients, reusing an inherited socket if there is one
+func (self *WebSocketOutput) Prepare() (err error) {
+	if file := InheritedFile(self.address); file != nil {
+		self.listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		self.listener, err = net.Listen("tcp", self.address)
+	}
+	if err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(self.path, self.serveStream)
+	go func() {
+		err := http.Serve(self.listener, mux)
+		log.Printf("WebSocketOutput %s stopped: %s\n", self.address,
+			err.Error())
+	}()
+	return nil
+}
+
+func (self *WebSocketOutput) Deliver(pipelinePack *PipelinePack) {
+	msg := pipelinePack.Message
+	if self.matcher != nil && !self.matcher.Match(msg) {
+		return
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var msgJson []byte
+	for client := range self.clients {
+		if client.matcher != nil && !client.matcher.Match(msg) {
+			continue
+		}
+		if msgJson == nil {
+			var err error
+			if msgJson, err = msg.MarshalJSON(); err != nil {
+				log.Println(NewDeliveryError(pipelinePack, "WebSocketOutput",
+					err))
+				return
+			}
+		}
+		select {
+		case client.send <- msgJson:
+		default:
+			atomic.AddInt64(&self.dropped, 1)
+		}
+	}
+}
+
+func (self *WebSocketOutput) Report() map[string]interface{} {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return map[string]interface{}{
+		"clients": len(self.clients),
+		"dropped": atomic.LoadInt64(&self.dropped),
+	}
+}
+
+func (self *WebSocketOutput) serveStream(w http.ResponseWriter,
+	req *http.Request) {
+	if req.Method != "GET" ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	client := &webSocketClient{
+		send: make(chan []byte, self.bufferSize),
+		done: make(chan struct{}),
+	}
+	if expr := req.URL.Query().Get("match"); expr != "" {
+		var err error
+		if client.matcher, err = NewMessageMatcher(expr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	self.lock.Lock()
+	if self.maxClients > 0 && len(self.clients) >= self.maxClients {
+		self.lock.Unlock()
+		http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+		return
+	}
+	self.lock.Unlock()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't upgrade the connection",
+			http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("WebSocketOutput error upgrading connection: %s\n",
+			err.Error())
+		return
+	}
+	client.conn = conn
+	accept := sha1.Sum([]byte(key + webSocketGuid))
+	fmt.Fprintf(buffered, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]))
+	if err = buffered.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	self.lock.Lock()
+	self.clients[client] = true
+	self.lock.Unlock()
+	go self.readClient(client, buffered.Reader)
+	self.writeClient(client)
+	self.lock.Lock()
+	delete(self.clients, client)
+	self.lock.Unlock()
+}
+
+// Sends the client its messages until it goes away
+func (self *WebSocketOutput) writeClient(client *webSocketClient) {
+	defer client.close()
+	for {
+		select {
+		case msgJson := <-client.send:
+			if err := writeWebSocketFrame(client.conn, wsText,
+				msgJson); err != nil {
+				return
+			}
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// Reads (and ignores) whatever the client sends, answering pings, until
+// it closes the connection
+func (self *WebSocketOutput) readClient(client *webSocketClient,
+	reader *bufio.Reader) {
+	defer client.close()
+	for {
+		opcode, payload, err := readWebSocketFrame(reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsClose:
+			writeWebSocketFrame(client.conn, wsClose, nil)
+			return
+		case wsPing:
+			if writeWebSocketFrame(client.conn, wsPong, payload) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Writes a single, unmasked (as server frames are) WebSocket frame
+func writeWebSocketFrame(writer io.Writer, opcode byte,
+	payload []byte) error {
+	header := []byte{0x80 | opcode, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	size := len(payload)
+	switch {
+	case size < 126:
+		header[1] = byte(size)
+		header = header[:2]
+	case size <= 0xFFFF:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(size))
+		header = header[:4]
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(size))
+	}
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	_, err := writer.Write(payload)
+	return err
+}
+
+// Largest client frame payload that's kept; the rest are skipped
+const wsMaxReadPayload = 4096
+
+// Reads a WebSocket frame sent by a client, returning its opcode and
+// (unmasked) payload
+func readWebSocketFrame(reader io.Reader) (opcode byte, payload []byte,
+	err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err = io.ReadFull(reader, extended); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err = io.ReadFull(reader, extended); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(extended)
+	}
+	mask := make([]byte, 4)
+	if masked {
+		if _, err = io.ReadFull(reader, mask); err != nil {
+			return
+		}
+	}
+	if size > wsMaxReadPayload {
+		_, err = io.CopyN(ioutil.Discard, reader, int64(size))
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}